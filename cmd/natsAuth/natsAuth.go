@@ -0,0 +1,212 @@
+// natsAuth.go — Bootstrap a decentralized (JWT based) NATS security setup.
+//
+// PURPOSE:
+//
+//	The demos of this repository use a simple user/password by default.
+//	Production NATS deployments usually rely on DECENTRALIZED AUTH instead:
+//	a chain of trust made of NKeys (ed25519 key pairs) and JWTs.
+//
+// CHAIN OF TRUST:
+//
+//	Operator  ── signs ──►  Account  ── signs ──►  User
+//	(trusted by the server)  (isolated namespace)   (what clients connect with)
+//
+//	The server only needs to know the operator JWT and the account JWTs.
+//	Clients present a "creds" file containing their user JWT and seed; the
+//	server verifies the signatures up to the trusted operator. No user
+//	password is ever stored on the server.
+//
+// USAGE:
+//
+//	go run ./cmd/natsAuth bootstrap -operator DEMO -account APP -user app_user -out ./nats_auth
+//
+//	Then start the server with the printed config snippet and run the demos with:
+//	  bin/natsPubSub -creds ./nats_auth/app_user.creds -mode sub -subject "greetings"
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	APP        = "natsAuth"
+	VERSION    = "0.1.0"
+	REPOSITORY = "https://github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats"
+	// cmdBootstrap is the only sub-command for now.
+	cmdBootstrap = "bootstrap"
+	// sysAccountName is the name of the system account, needed by the server
+	// to publish its own events and to answer monitoring requests.
+	sysAccountName = "SYS"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != cmdBootstrap {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n", APP, cmdBootstrap)
+		os.Exit(1)
+	}
+
+	// ─── CLI Flag Definitions ──────────────────────────────────────────
+	// Each sub-command has its own FlagSet, parsed from the arguments
+	// following the sub-command name.
+	fs := flag.NewFlagSet(cmdBootstrap, flag.ExitOnError)
+	operatorName := fs.String("operator", "DEMO", "Name of the operator to create")
+	accountName := fs.String("account", "APP", "Name of the application account to create")
+	userName := fs.String("user", "app_user", "Name of the user to create inside the account")
+	outDir := fs.String("out", "./nats_auth", "Directory where keys, JWTs and creds files are written")
+	_ = fs.Parse(os.Args[2:])
+
+	l := log.New(os.Stderr, fmt.Sprintf("%s [%s] ", APP, cmdBootstrap), log.LstdFlags)
+	l.Printf("🚀  Starting %s v%s, from %s\n", APP, VERSION, REPOSITORY)
+
+	if err := os.MkdirAll(*outDir, 0o700); err != nil {
+		l.Fatalf("💥 Failed to create output directory %s: %v", *outDir, err)
+	}
+
+	b := &bootstrapper{l: l, outDir: *outDir}
+	b.run(*operatorName, *accountName, *userName)
+}
+
+// bootstrapper writes every generated artifact to outDir.
+type bootstrapper struct {
+	l      *log.Logger
+	outDir string
+}
+
+// run generates the operator, the system account, the application account
+// and one user, then prints the server configuration snippet on stdout.
+//
+// KEY CONCEPT — Seeds are secrets, JWTs are public:
+//
+//	An NKey seed (starting with "SO", "SA" or "SU") is the private key and
+//	must be protected like a password: it is written with 0600 permissions.
+//	JWTs only contain public keys and signed claims, they can be shared.
+func (b *bootstrapper) run(operatorName, accountName, userName string) {
+	// ─── Operator ──────────────────────────────────────────────────────
+	operatorKP := b.createKeyPair(nkeys.CreateOperator, operatorName)
+	operatorPub := b.publicKey(operatorKP)
+
+	// ─── Accounts ──────────────────────────────────────────────────────
+	sysKP := b.createKeyPair(nkeys.CreateAccount, sysAccountName)
+	sysPub := b.publicKey(sysKP)
+	sysClaims := jwt.NewAccountClaims(sysPub)
+	sysClaims.Name = sysAccountName
+	sysJWT := b.encode(sysAccountName, sysClaims.Encode, operatorKP)
+
+	accountKP := b.createKeyPair(nkeys.CreateAccount, accountName)
+	accountPub := b.publicKey(accountKP)
+	accountClaims := jwt.NewAccountClaims(accountPub)
+	accountClaims.Name = accountName
+	// Without JetStream limits an account cannot create streams: enable it
+	// without restriction so that all the demos work out of the box.
+	accountClaims.Limits.JetStreamLimits = jwt.JetStreamLimits{
+		MemoryStorage: jwt.NoLimit,
+		DiskStorage:   jwt.NoLimit,
+		Streams:       jwt.NoLimit,
+		Consumer:      jwt.NoLimit,
+	}
+	accountJWT := b.encode(accountName, accountClaims.Encode, operatorKP)
+
+	// ─── Operator JWT (self-signed, references the system account) ─────
+	operatorClaims := jwt.NewOperatorClaims(operatorPub)
+	operatorClaims.Name = operatorName
+	operatorClaims.SystemAccount = sysPub
+	b.encode(operatorName, operatorClaims.Encode, operatorKP)
+	operatorFile := filepath.Join(b.outDir, operatorName+".jwt")
+
+	// ─── Users (creds files) ───────────────────────────────────────────
+	b.createUser(userName, accountKP)
+	b.createUser("sys_user", sysKP)
+
+	// ─── Server configuration snippet ──────────────────────────────────
+	// The MEMORY resolver preloads the account JWTs from the config file,
+	// the simplest resolver to get started (no account server needed).
+	absOperator, _ := filepath.Abs(operatorFile)
+	snippet := fmt.Sprintf(`# generated by %s v%s
+operator: %q
+system_account: %s
+resolver: MEMORY
+resolver_preload: {
+  # %s
+  %s: %s
+  # %s
+  %s: %s
+}
+`, APP, VERSION, absOperator, sysPub, sysAccountName, sysPub, sysJWT, accountName, accountPub, accountJWT)
+	confFile := b.write("resolver.conf", []byte(snippet), 0o644)
+
+	b.l.Printf("✅ Bootstrap done, server config snippet written to %s :", confFile)
+	fmt.Print(snippet)
+	b.l.Printf("ℹ️  include it in your server config (include %q) or run: nats-server -js -c %s", confFile, confFile)
+	b.l.Printf("ℹ️  then connect with: bin/natsPubSub -creds %s -mode sub -subject greetings",
+		filepath.Join(b.outDir, userName+".creds"))
+}
+
+// createUser generates a user signed by the given account and writes its creds file.
+func (b *bootstrapper) createUser(name string, accountKP nkeys.KeyPair) {
+	userKP := b.createKeyPair(nkeys.CreateUser, name)
+	userClaims := jwt.NewUserClaims(b.publicKey(userKP))
+	userClaims.Name = name
+	userJWT := b.encode(name, userClaims.Encode, accountKP)
+
+	seed, err := userKP.Seed()
+	if err != nil {
+		b.l.Fatalf("💥 Failed to read seed of user %s: %v", name, err)
+	}
+	// A creds file bundles the user JWT and its seed, this is the single
+	// file a client needs (see nats.UserCredentials).
+	creds, err := jwt.FormatUserConfig(userJWT, seed)
+	if err != nil {
+		b.l.Fatalf("💥 Failed to format creds of user %s: %v", name, err)
+	}
+	b.write(name+".creds", creds, 0o600)
+}
+
+// createKeyPair generates a new NKey pair and stores its seed in <name>.nk.
+func (b *bootstrapper) createKeyPair(create func() (nkeys.KeyPair, error), name string) nkeys.KeyPair {
+	kp, err := create()
+	if err != nil {
+		b.l.Fatalf("💥 Failed to create nkey for %s: %v", name, err)
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		b.l.Fatalf("💥 Failed to read seed of %s: %v", name, err)
+	}
+	b.write(name+".nk", seed, 0o600)
+	return kp
+}
+
+// publicKey returns the public key of kp, the "subject" of its JWT.
+func (b *bootstrapper) publicKey(kp nkeys.KeyPair) string {
+	pub, err := kp.PublicKey()
+	if err != nil {
+		b.l.Fatalf("💥 Failed to read public key: %v", err)
+	}
+	return pub
+}
+
+// encode signs claims of the entity called name with the issuer key pair.
+func (b *bootstrapper) encode(name string, encode func(nkeys.KeyPair) (string, error), issuer nkeys.KeyPair) string {
+	token, err := encode(issuer)
+	if err != nil {
+		b.l.Fatalf("💥 Failed to encode JWT of %s: %v", name, err)
+	}
+	b.write(name+".jwt", []byte(token), 0o644)
+	return token
+}
+
+// write stores content in outDir/name with the given permissions and returns its path.
+func (b *bootstrapper) write(name string, content []byte, perm os.FileMode) string {
+	path := filepath.Join(b.outDir, name)
+	if err := os.WriteFile(path, content, perm); err != nil {
+		b.l.Fatalf("💥 Failed to write %s: %v", path, err)
+	}
+	b.l.Printf("📝 wrote %s", path)
+	return path
+}
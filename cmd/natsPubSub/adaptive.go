@@ -0,0 +1,114 @@
+// adaptive.go — Adaptive limit of the messages handled at the same time.
+//
+// WHY ADAPTIVE:
+//
+//	The right number of messages in flight depends on the downstream the
+//	handler talks to (a database, an API): too few and the consumer lags,
+//	too many and the downstream slows down, times out, and the messages
+//	come back as redeliveries, making things worse. The right number also
+//	changes during the day.
+//
+// AIMD ON LATENCY AND ERRORS:
+//
+//	Like TCP congestion control, the limit grows while the downstream is
+//	healthy and is cut in half as soon as it shows signs of overload.
+//	After every "window" of handled messages (as many as the limit, at
+//	least adaptiveMinWindow):
+//
+//	  error rate > adaptiveMaxErrorRate                      → limit / 2
+//	  mean latency > adaptiveLatencyTolerance × baseline     → limit / 2
+//	  otherwise                                              → limit + 25%
+//
+//	The baseline is the lowest mean latency observed, the latency of an
+//	idle downstream; it slowly follows the observed latency so that a
+//	lasting change of the downstream is accepted after a while.
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveMinWindow is the minimum number of messages per evaluation.
+	adaptiveMinWindow = 10
+	// adaptiveMaxErrorRate is the error rate from which the limit is cut.
+	adaptiveMaxErrorRate = 0.05
+	// adaptiveLatencyTolerance is how much slower than the baseline the
+	// handler may become before the limit is cut.
+	adaptiveLatencyTolerance = 2.0
+	// adaptiveBaselineDrift is the fraction of the gap between the mean
+	// latency and the baseline closed at each evaluation.
+	adaptiveBaselineDrift = 0.01
+)
+
+// inFlightLimit is the number of messages that may be handled at the same
+// time, fixed or adapted to the observed latency and errors.
+type inFlightLimit struct {
+	mu       sync.Mutex
+	l        *log.Logger
+	adaptive bool
+	limit    int
+	max      int
+	// statistics of the current window
+	handled, errors int
+	latency         time.Duration
+	baseline        time.Duration
+}
+
+// newInFlightLimit returns a limit starting at initial, adapted between 1
+// and max when adaptive is true.
+func newInFlightLimit(l *log.Logger, initial, max int, adaptive bool) *inFlightLimit {
+	return &inFlightLimit{l: l, adaptive: adaptive, limit: min(initial, max), max: max}
+}
+
+// Limit returns the current limit.
+func (a *inFlightLimit) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// Observe records that a message was handled in d, failing with err.
+func (a *inFlightLimit) Observe(d time.Duration, err error) {
+	if !a.adaptive {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handled++
+	a.latency += d
+	if err != nil {
+		a.errors++
+	}
+	if a.handled < max(a.limit, adaptiveMinWindow) {
+		return
+	}
+
+	mean := a.latency / time.Duration(a.handled)
+	errorRate := float64(a.errors) / float64(a.handled)
+	switch {
+	case a.baseline == 0 || mean < a.baseline:
+		a.baseline = mean
+	default:
+		a.baseline += time.Duration(float64(mean-a.baseline) * adaptiveBaselineDrift)
+	}
+	previous, reason := a.limit, ""
+	switch {
+	case errorRate > adaptiveMaxErrorRate:
+		reason = fmt.Sprintf("%.0f%% of the messages failed", 100*errorRate)
+	case float64(mean) > adaptiveLatencyTolerance*float64(a.baseline):
+		reason = fmt.Sprintf("handler latency %v, baseline %v", mean.Round(time.Microsecond), a.baseline.Round(time.Microsecond))
+	default:
+		a.limit = min(a.max, a.limit+max(1, a.limit/4))
+	}
+	if reason != "" {
+		a.limit = max(1, a.limit/2)
+		if a.limit != previous {
+			a.l.Printf("⬇️  In-flight limit %d → %d: %s", previous, a.limit, reason)
+		}
+	}
+	a.handled, a.errors, a.latency = 0, 0, 0
+}
@@ -0,0 +1,229 @@
+// advise.go — Retention, duplicate-window and replica tuning advisor.
+//
+// WHY TUNE A STREAM:
+//
+//	The defaults of a JetStream stream keep everything forever, with a 2
+//	minutes duplicate window and a single replica. That is perfect for a
+//	demo and wrong for most production streams: disks fill up, slow
+//	consumers lose messages when a limit finally kicks in, and a single
+//	replica loses data with its server.
+//
+// HOW THE ADVISOR WORKS:
+//
+//	The "advise" mode takes two snapshots of the stream, -observe apart, to
+//	measure the real traffic (messages/s, average payload size), reads the
+//	lag of every consumer, and derives recommendations, each printed with
+//	the reasoning behind it. Nothing is changed on the server: copy the
+//	values you agree with into your stream spec (see reconcile.go).
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// defaultObserveWindow is the traffic measurement duration of the advisor.
+	defaultObserveWindow = 30 * time.Second
+	// minRetention is the smallest max_age we recommend, to survive a weekend incident.
+	minRetention = 24 * time.Hour
+	// maxDuplicateIDs bounds the number of message IDs tracked by the duplicate window.
+	maxDuplicateIDs = 1_000_000
+	// defaultDuplicateWindow is the server default duplicate window.
+	defaultDuplicateWindow = 2 * time.Minute
+)
+
+// advice is one recommendation of the advisor.
+type advice struct {
+	Setting   string
+	Current   string
+	Suggested string
+	Reason    string
+}
+
+// trafficStats is what was measured during the observation window.
+type trafficStats struct {
+	MsgRate     float64 // messages per second
+	AvgSize     float64 // bytes per message
+	MaxLagMsgs  uint64  // pending + ack pending of the slowest consumer
+	MaxLagName  string
+	ClusterSize int
+}
+
+// advise observes streamName during window, then prints recommendations.
+func advise(nc *nats.Conn, l *log.Logger, streamName string, window time.Duration) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fail(l, exitFailure, "failed to create JetStream context: %v", err)
+	}
+	ctx, stop := stopContext()
+	defer stop()
+
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		fail(l, exitFailure, "failed to get stream %q: %v", streamName, err)
+	}
+	before, err := stream.Info(ctx)
+	if err != nil {
+		fail(l, exitFailure, "failed to get stream info: %v", err)
+	}
+	l.Printf("🔬 Observing traffic of stream %q for %v …", streamName, window)
+	sleepCtx(ctx, window)
+	after, err := stream.Info(context.Background())
+	if err != nil {
+		fail(l, exitFailure, "failed to get stream info: %v", err)
+	}
+	elapsed := after.TimeStamp.Sub(before.TimeStamp)
+	if elapsed <= 0 {
+		elapsed = window
+	}
+
+	stats := trafficStats{
+		MsgRate: float64(after.State.LastSeq-before.State.LastSeq) / elapsed.Seconds(),
+	}
+	if after.State.Msgs > 0 {
+		stats.AvgSize = float64(after.State.Bytes) / float64(after.State.Msgs)
+	}
+	if nc.ConnectedClusterName() != "" {
+		stats.ClusterSize = len(nc.Servers())
+	} else {
+		stats.ClusterSize = 1
+	}
+
+	consumers := stream.ListConsumers(context.Background())
+	for ci := range consumers.Info() {
+		lag := ci.NumPending + uint64(ci.NumAckPending)
+		l.Printf("👥 Consumer %q: %d pending, %d awaiting ack", ci.Name, ci.NumPending, ci.NumAckPending)
+		if lag >= stats.MaxLagMsgs {
+			stats.MaxLagMsgs, stats.MaxLagName = lag, ci.Name
+		}
+	}
+	if err := consumers.Err(); err != nil {
+		l.Printf("⚠️  Could not list consumers: %v", err)
+	}
+
+	l.Printf("📈 Traffic: %.2f msg/s, average payload %s, %s/day, %d message(s) / %s stored",
+		stats.MsgRate, humanBytes(stats.AvgSize), humanBytes(stats.MsgRate*stats.AvgSize*86400),
+		after.State.Msgs, humanBytes(float64(after.State.Bytes)))
+
+	advices := adviseStream(after.Config, stats)
+	if len(advices) == 0 {
+		l.Println("✅ The stream configuration looks right for the observed traffic")
+		return
+	}
+	for _, a := range advices {
+		l.Printf("💡 %s: %s → %s", a.Setting, a.Current, a.Suggested)
+		l.Printf("   because %s", a.Reason)
+	}
+}
+
+// adviseStream derives the recommendations from the configuration and the
+// observed traffic.
+func adviseStream(cfg jetstream.StreamConfig, s trafficStats) []advice {
+	var advices []advice
+
+	// ─── Retention (max_age) ───────────────────────────────────────────
+	// Keep messages long enough for the slowest consumer to catch up,
+	// three times its current lag, and at least minRetention.
+	var lagTime time.Duration
+	if s.MsgRate > 0 {
+		lagTime = time.Duration(float64(s.MaxLagMsgs) / s.MsgRate * float64(time.Second))
+	}
+	suggestedAge := max(minRetention, 3*lagTime).Round(time.Hour)
+	unbounded := cfg.MaxAge == 0 && cfg.MaxBytes <= 0 && cfg.MaxMsgs <= 0
+	switch {
+	case cfg.Retention == jetstream.LimitsPolicy && unbounded:
+		advices = append(advices, advice{"max_age", "unlimited", suggestedAge.String(),
+			"with limits retention and no limit at all, the stream grows until the disk is full"})
+	case cfg.MaxAge > 0 && lagTime > 0 && cfg.MaxAge < 2*lagTime:
+		advices = append(advices, advice{"max_age", cfg.MaxAge.String(), suggestedAge.String(),
+			fmt.Sprintf("consumer %q lags %v behind, messages may expire before it reads them", s.MaxLagName, lagTime.Round(time.Second))})
+	}
+
+	// ─── Size limit (max_bytes) ────────────────────────────────────────
+	// A byte limit is the safety net of max_age when traffic spikes:
+	// observed throughput over the retention, plus 25% headroom.
+	age := cfg.MaxAge
+	if age == 0 {
+		age = suggestedAge
+	}
+	if s.MsgRate > 0 && s.AvgSize > 0 {
+		needed := int64(math.Ceil(s.MsgRate * s.AvgSize * age.Seconds() * 1.25))
+		switch {
+		case cfg.MaxBytes <= 0:
+			advices = append(advices, advice{"max_bytes", "unlimited", fmt.Sprintf("%d (%s)", needed, humanBytes(float64(needed))),
+				fmt.Sprintf("%.2f msg/s of %s during %v, +25%% headroom for spikes", s.MsgRate, humanBytes(s.AvgSize), age)})
+		case cfg.MaxBytes < needed*8/10:
+			advices = append(advices, advice{"max_bytes", humanBytes(float64(cfg.MaxBytes)), fmt.Sprintf("%d (%s)", needed, humanBytes(float64(needed))),
+				fmt.Sprintf("at the observed rate the byte limit is reached before max_age (%v), silently shortening retention", age)})
+		}
+	} else {
+		advices = append(advices, advice{"max_bytes", byteLimit(cfg.MaxBytes), "(not computed)",
+			"no traffic observed, run the advisor again with a longer -observe"})
+	}
+
+	// ─── Duplicate window ──────────────────────────────────────────────
+	// The server remembers every Nats-Msg-Id seen during the window, in
+	// memory: large windows on busy streams cost a lot of RAM.
+	window := cfg.Duplicates
+	if window == 0 {
+		window = defaultDuplicateWindow
+	}
+	tracked := s.MsgRate * window.Seconds()
+	switch {
+	case cfg.MaxAge > 0 && window > cfg.MaxAge:
+		advices = append(advices, advice{"duplicate_window", window.String(), cfg.MaxAge.String(),
+			"the duplicate window cannot be longer than the retention of the messages"})
+	case tracked > maxDuplicateIDs:
+		suggested := max(30*time.Second, time.Duration(maxDuplicateIDs/s.MsgRate*float64(time.Second)).Round(time.Second))
+		advices = append(advices, advice{"duplicate_window", window.String(), suggested.String(),
+			fmt.Sprintf("%.0f message IDs are tracked in memory at %.0f msg/s, cover only the publishers retry horizon", tracked, s.MsgRate)})
+	case window < time.Minute:
+		advices = append(advices, advice{"duplicate_window", window.String(), defaultDuplicateWindow.String(),
+			"publishers retrying after a timeout or a reconnect may send duplicates outside such a short window"})
+	}
+
+	// ─── Replicas ──────────────────────────────────────────────────────
+	replicas := max(cfg.Replicas, 1)
+	switch {
+	case replicas > s.ClusterSize:
+		advices = append(advices, advice{"num_replicas", fmt.Sprint(replicas), fmt.Sprint(s.ClusterSize),
+			fmt.Sprintf("only %d server(s) known in the cluster", s.ClusterSize)})
+	case replicas == 1 && s.ClusterSize >= 3:
+		advices = append(advices, advice{"num_replicas", "1", "3",
+			"the stream lives on a single server of a cluster: losing its disk loses the data, R3 survives one server failure"})
+	case replicas == 2:
+		advices = append(advices, advice{"num_replicas", "2", "3",
+			"R2 needs both servers for a quorum, so it tolerates no failure: use R3 (or R1 if durability is not required)"})
+	}
+
+	return advices
+}
+
+// byteLimit formats a max_bytes value, where -1 means unlimited.
+func byteLimit(b int64) string {
+	if b <= 0 {
+		return "unlimited"
+	}
+	return humanBytes(float64(b))
+}
+
+// humanBytes formats a byte count with a binary unit.
+func humanBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/div, "KMGTPE"[exp])
+}
@@ -0,0 +1,194 @@
+// analyze.go — Payload size histogram and cardinality report.
+//
+// LOOK BEFORE YOU PERSIST:
+//
+//	Core NATS forgets a message as soon as it is delivered, so nobody
+//	really knows how big the traffic of a subject is. Enabling JetStream on
+//	it changes that: every byte now costs disk, memory and replication.
+//	The "analyze" mode samples a subject during -observe and reports:
+//
+//	  - the payload size distribution (power-of-two histogram, percentiles);
+//	  - the distinct event types (CloudEvents "ce-type" header in binary
+//	    mode, or the "type" attribute of a structured JSON event);
+//	  - the number of distinct values of each subject token, which shows
+//	    which token is an ID (high cardinality) and which is a category;
+//	  - the estimated storage cost per day if the subject were persisted.
+//
+//	It is a plain subscriber: the traffic is not slowed down nor changed.
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxTrackedValues caps the distinct values remembered per dimension,
+	// so sampling a subject full of unique IDs cannot exhaust the memory.
+	maxTrackedValues = 10_000
+	// storeOverhead approximates the per-message bytes JetStream stores in
+	// addition to subject, headers and payload (sequence, timestamp, hash).
+	storeOverhead = 22
+	// histogramBuckets is the number of power-of-two size buckets (up to 1 MiB and more).
+	histogramBuckets = 22
+)
+
+// subjectSample accumulates the statistics of the sampled messages.
+type subjectSample struct {
+	mu         sync.Mutex
+	count      int
+	bytes      int
+	storeBytes int
+	sizes      []int
+	buckets    [histogramBuckets]int
+	types      map[string]int
+	tokens     []map[string]struct{}
+	overflow   []bool
+}
+
+// analyze samples subject during window, then prints the report.
+func analyze(nc *nats.Conn, l *log.Logger, subject string, window time.Duration) {
+	s := &subjectSample{types: make(map[string]int)}
+	sub, err := nc.Subscribe(subject, s.add)
+	if err != nil {
+		fail(l, exitConnection, "failed to subscribe to %q: %v", subject, err)
+	}
+
+	ctx, stop := stopContext()
+	defer stop()
+	l.Printf("🔬 Sampling %q for %v (Ctrl+C to stop earlier) …", subject, window)
+	start := time.Now()
+	sleepCtx(ctx, window)
+	if err := sub.Unsubscribe(); err != nil {
+		l.Printf("⚠️  Error unsubscribing: %v", err)
+	}
+	s.report(l, time.Since(start))
+}
+
+// add records one message, it is the subscription handler.
+func (s *subjectSample) add(m *nats.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := len(m.Data)
+	s.count++
+	s.bytes += size
+	s.storeBytes += size + len(m.Subject) + headerSize(m.Header) + storeOverhead
+	s.sizes = append(s.sizes, size)
+	s.buckets[min(bits.Len(uint(size)), histogramBuckets-1)]++
+
+	if eventType := eventTypeOf(m); len(s.types) < maxTrackedValues || s.types[eventType] > 0 {
+		s.types[eventType]++
+	}
+
+	for i, token := range strings.Split(m.Subject, ".") {
+		if i == len(s.tokens) {
+			s.tokens = append(s.tokens, make(map[string]struct{}))
+			s.overflow = append(s.overflow, false)
+		}
+		if len(s.tokens[i]) < maxTrackedValues {
+			s.tokens[i][token] = struct{}{}
+		} else if _, seen := s.tokens[i][token]; !seen {
+			s.overflow[i] = true
+		}
+	}
+}
+
+// report prints the statistics collected during elapsed.
+func (s *subjectSample) report(l *log.Logger, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 {
+		l.Printf("🤷 No message received in %v, nothing to report", elapsed.Round(time.Second))
+		return
+	}
+	rate := float64(s.count) / elapsed.Seconds()
+	l.Printf("📊 %d message(s) in %v — %.2f msg/s, %s of payload", s.count, elapsed.Round(time.Second), rate, humanBytes(float64(s.bytes)))
+
+	// ─── Payload sizes ─────────────────────────────────────────────────
+	slices.Sort(s.sizes)
+	l.Printf("📏 Payload size — min %s, p50 %s, p90 %s, p99 %s, max %s, average %s",
+		humanBytes(float64(s.sizes[0])), humanBytes(float64(percentile(s.sizes, 50))),
+		humanBytes(float64(percentile(s.sizes, 90))), humanBytes(float64(percentile(s.sizes, 99))),
+		humanBytes(float64(s.sizes[len(s.sizes)-1])), humanBytes(float64(s.bytes)/float64(s.count)))
+	peak := slices.Max(s.buckets[:])
+	for i, n := range s.buckets {
+		if n == 0 {
+			continue
+		}
+		low, high := 0, 0
+		if i > 0 {
+			low, high = 1<<(i-1), 1<<i-1
+		}
+		label := fmt.Sprintf("%s – %s", humanBytes(float64(low)), humanBytes(float64(high)))
+		if i == histogramBuckets-1 {
+			label = fmt.Sprintf("≥ %s", humanBytes(float64(low)))
+		}
+		l.Printf("   %-22s %-40s %d", label, strings.Repeat("█", max(1, n*40/peak)), n)
+	}
+
+	// ─── Event types ───────────────────────────────────────────────────
+	types := make([]string, 0, len(s.types))
+	for t := range s.types {
+		types = append(types, t)
+	}
+	slices.SortFunc(types, func(a, b string) int { return s.types[b] - s.types[a] })
+	l.Printf("🏷️  %d distinct event type(s)", len(types))
+	for _, t := range types[:min(len(types), 20)] {
+		l.Printf("   %-40s %d", t, s.types[t])
+	}
+
+	// ─── Subject tokens ────────────────────────────────────────────────
+	for i, values := range s.tokens {
+		distinct := fmt.Sprint(len(values))
+		if s.overflow[i] {
+			distinct = fmt.Sprintf("> %d", maxTrackedValues)
+		}
+		example := ""
+		for v := range values {
+			example = v
+			break
+		}
+		l.Printf("🔢 Subject token #%d: %s distinct value(s), e.g. %q", i+1, distinct, example)
+	}
+
+	// ─── Storage estimate ──────────────────────────────────────────────
+	perDay := float64(s.storeBytes) / elapsed.Seconds() * 86400
+	l.Printf("💾 Estimated storage if persisted: %s/day (%s/month), %.0f message(s)/day — per replica, before compression",
+		humanBytes(perDay), humanBytes(perDay*30), rate*86400)
+}
+
+// eventTypeOf returns the CloudEvents type of m, or "(none)".
+func eventTypeOf(m *nats.Msg) string {
+	if ev, ok := decodeCloudEvent(m); ok {
+		return ev.Attributes["type"]
+	}
+	return "(none)"
+}
+
+// headerSize returns the size of the headers on the wire.
+func headerSize(h nats.Header) int {
+	if len(h) == 0 {
+		return 0
+	}
+	size := len("NATS/1.0\r\n\r\n")
+	for k, values := range h {
+		for _, v := range values {
+			size += len(k) + len(": ") + len(v) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// percentile returns the p-th percentile of the sorted values.
+func percentile[T any](sorted []T, p int) T {
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,208 @@
+// audit.go — Data-quality report of the events kept in a stream.
+//
+// WHAT CAN GO WRONG UPSTREAM:
+//
+//	At-least-once delivery, retrying producers and replays from spools
+//	(see spool.go) all trade duplicates for safety; a crashed producer or a
+//	mis-configured filter loses events; clocks and concurrent producers
+//	mix up the order. Consumers are supposed to cope, but nobody knows how
+//	often it really happens. The "audit" mode reads every message of
+//	-subject kept in the stream (-stream, or the stream capturing the
+//	subject), from the first to the last one stored when it starts, and
+//	reports:
+//
+//	  - duplicate event IDs: the CloudEvents "id" attribute, or the
+//	    Nats-Msg-Id header for plain messages;
+//	  - gaps in sequence-numbered payloads: the -sequence-field of the data
+//	    (e.g. {"sequence": 42}) must grow by one for each producer;
+//	  - out-of-order timestamps: the CloudEvents "time" attribute going
+//	    back in time for a producer.
+//
+//	A producer is the CloudEvents "source", or the subject of plain
+//	messages. The audit reads through an ordered consumer: nothing is
+//	acknowledged nor changed on the server.
+//
+//	  go run . -mode audit -subject "orders.>" -sequence-field seq
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// defaultSequenceField is the field of the data holding the producer sequence.
+	defaultSequenceField = "sequence"
+	// maxAuditFindings caps the findings listed per kind in the report.
+	maxAuditFindings = 20
+	// maxAuditIDs caps the event IDs remembered, about 100 bytes each.
+	maxAuditIDs = 5_000_000
+)
+
+// auditFinding is one problem found, located by its stream sequence.
+type auditFinding struct {
+	seq    uint64
+	detail string
+}
+
+// streamAudit accumulates the checks of the messages read.
+type streamAudit struct {
+	sequenceField string
+	count         int
+	flagged       int // messages with at least one finding
+	firstSeq      uint64
+	lastSeq       uint64
+	withoutID     int
+	idsOverflow   bool
+	ids           map[string]uint64 // event ID → stream sequence of its first occurrence
+	producerSeq   map[string]uint64 // producer → last sequence number of its data
+	producerTime  map[string]time.Time
+	duplicates    []auditFinding
+	gaps          []auditFinding
+	missing       uint64
+	reordered     []auditFinding
+	lateEvents    []auditFinding
+}
+
+// audit reads the messages of subject stored in the stream and prints the
+// data-quality report.
+func audit(nc *nats.Conn, l *log.Logger, subject, streamName, sequenceField string) {
+	a := &streamAudit{
+		sequenceField: sequenceField,
+		ids:           make(map[string]uint64),
+		producerSeq:   make(map[string]uint64),
+		producerTime:  make(map[string]time.Time),
+	}
+	ctx, stop := stopContext()
+	defer stop()
+	start := time.Now()
+	read := readStored(ctx, nc, l, subject, streamName, func(m *nats.Msg, meta *jetstream.MsgMetadata) {
+		a.add(m, meta.Sequence.Stream)
+	})
+	if read > 0 {
+		a.report(l, time.Since(start))
+	}
+}
+
+// add checks the message m stored at the stream sequence seq.
+func (a *streamAudit) add(m *nats.Msg, seq uint64) {
+	a.count++
+	if a.firstSeq == 0 {
+		a.firstSeq = seq
+	}
+	a.lastSeq = seq
+	findings := a.findings()
+	defer func() {
+		if a.findings() > findings {
+			a.flagged++
+		}
+	}()
+
+	ev, isEvent := decodeCloudEvent(m)
+	producer, id, data := m.Subject, m.Header.Get(nats.MsgIdHdr), json.RawMessage(m.Data)
+	if isEvent {
+		if source := ev.Attributes["source"]; source != "" {
+			producer = source
+		}
+		if ev.Attributes["id"] != "" {
+			id = ev.Attributes["id"]
+		}
+		data = ev.Data
+	}
+
+	// ─── Duplicate IDs ─────────────────────────────────────────────────
+	switch first, seen := a.ids[id]; {
+	case id == "":
+		a.withoutID++
+	case seen:
+		a.duplicates = append(a.duplicates, auditFinding{seq, fmt.Sprintf("id %q first stored at sequence %d", id, first)})
+	case len(a.ids) < maxAuditIDs:
+		a.ids[id] = seq
+	default:
+		a.idsOverflow = true
+	}
+
+	// ─── Producer sequence ─────────────────────────────────────────────
+	if n, ok := sequenceOf(data, a.sequenceField); ok {
+		last, known := a.producerSeq[producer]
+		switch {
+		case !known:
+		case n == last+1:
+		case n > last+1:
+			a.missing += n - last - 1
+			a.gaps = append(a.gaps, auditFinding{seq, fmt.Sprintf("%s: %d…%d missing", producer, last+1, n-1)})
+		default:
+			a.reordered = append(a.reordered, auditFinding{seq, fmt.Sprintf("%s: %d after %d", producer, n, last)})
+		}
+		if !known || n > last {
+			a.producerSeq[producer] = n
+		}
+	}
+
+	// ─── Event time ────────────────────────────────────────────────────
+	if t, err := time.Parse(time.RFC3339Nano, ev.Attributes["time"]); err == nil {
+		latest, known := a.producerTime[producer]
+		if known && t.Before(latest) {
+			a.lateEvents = append(a.lateEvents, auditFinding{seq, fmt.Sprintf("%s: %s, %v before an earlier event", producer, t.Format(time.RFC3339Nano), latest.Sub(t))})
+		}
+		if !known || t.After(latest) {
+			a.producerTime[producer] = t
+		}
+	}
+}
+
+// sequenceOf returns the unsigned integer field of the JSON object data.
+func sequenceOf(data json.RawMessage, field string) (uint64, bool) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(data, &object) != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(object[field]), 10, 64)
+	return n, err == nil
+}
+
+// report prints the findings of the audit.
+func (a *streamAudit) report(l *log.Logger, elapsed time.Duration) {
+	l.Printf("📊 %d message(s) audited in %v — stream sequences %d to %d, %d producer(s) with a %q",
+		a.count, elapsed.Round(time.Millisecond), a.firstSeq, a.lastSeq, len(a.producerSeq), a.sequenceField)
+
+	findings := func(icon, title string, list []auditFinding) {
+		if len(list) == 0 {
+			l.Printf("✅ No %s", title)
+			return
+		}
+		l.Printf("%s %d %s", icon, len(list), title)
+		for _, f := range list[:min(len(list), maxAuditFindings)] {
+			l.Printf("   #%-10d %s", f.seq, f.detail)
+		}
+		if len(list) > maxAuditFindings {
+			l.Printf("   … and %d more", len(list)-maxAuditFindings)
+		}
+	}
+	findings("🔁", "duplicate event ID(s)", a.duplicates)
+	if a.withoutID > 0 {
+		l.Printf("⚠️  %d message(s) without CloudEvents id nor %s header, not checked for duplicates", a.withoutID, nats.MsgIdHdr)
+	}
+	if a.idsOverflow {
+		l.Printf("⚠️  More than %d distinct IDs: the later ones were not checked for duplicates", maxAuditIDs)
+	}
+	findings("🕳️ ", "gap(s) in the producer sequences", a.gaps)
+	if a.missing > 0 {
+		l.Printf("   %d sequence number(s) skipped in total, some may arrive later out of order", a.missing)
+	}
+	findings("🔀", "producer sequence(s) out of order", a.reordered)
+	findings("⏪", "event time(s) going back", a.lateEvents)
+
+	l.Printf("🏁 Data quality: %.2f%% of the messages without finding", 100*float64(a.count-a.flagged)/float64(a.count))
+}
+
+// findings returns the number of problems found so far.
+func (a *streamAudit) findings() int {
+	return len(a.duplicates) + len(a.gaps) + len(a.reordered) + len(a.lateEvents)
+}
@@ -0,0 +1,295 @@
+// auth.go — API keys and OIDC tokens of the HTTP and GraphQL gateways.
+//
+// WHO MAY USE WHICH SUBJECT:
+//
+//	-subject bounds what a gateway exposes to everybody. With
+//	-auth-config, every request of the "http" bridge and of the "graphql"
+//	gateway (HTTP, SSE and WebSocket) must also tell who it comes from,
+//	and each identity is allowed its own subject patterns within -subject:
+//
+//	  {
+//	    "api_keys": [
+//	      {"name": "ci-bot", "key_sha256": "9f86d0…", "subjects": ["orders.test.>"]}
+//	    ],
+//	    "oidc": {
+//	      "issuer": "https://login.example.com/realms/acme",
+//	      "audience": "events-gateway",
+//	      "claim": "email",
+//	      "subjects": {
+//	        "alice@example.com": ["orders.>"],
+//	        "*":                 ["orders.public.*"]
+//	      }
+//	    }
+//	  }
+//
+//	  api_keys  static keys, stored as their SHA-256 in hex
+//	            (printf %s "$KEY" | sha256sum), each with its patterns
+//	  oidc      bearer tokens of an OpenID Connect provider (see oidc.go):
+//	            issuer and audience checked, the identity read from
+//	            "claim" ("sub" by default), its patterns those of
+//	            "subjects" plus the ones of "*" for every valid token;
+//	            "jwks_url" skips the discovery of the keys
+//
+//	The document is reloaded as -handler-config is: a file checked every
+//	-reload-interval and on SIGHUP, or a kv://<bucket>/<key> watched for
+//	updates.
+//
+// CREDENTIALS ON THE WIRE:
+//
+//	  Authorization: Bearer <OIDC token or API key>
+//	  X-API-Key: <API key>
+//
+//	A browser cannot set headers on a WebSocket: the graphql-transport-ws
+//	clients send them in the payload of connection_init instead,
+//	{"Authorization": "Bearer …"} (connectionParams of graphql-ws), and a
+//	refused one closes the socket with 4403 Forbidden. Over HTTP, missing
+//	or invalid credentials are answered 401, a subject outside of the
+//	identity's patterns 403 (a GraphQL error on the gateway), a provider
+//	whose keys cannot be fetched 503.
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Errors of the authentication, told apart by the gateways.
+var (
+	errNoCredentials      = errors.New("credentials required")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errForbiddenSubject   = errors.New("forbidden subject")
+)
+
+// authConfig is the JSON document of -auth-config.
+type authConfig struct {
+	APIKeys []apiKeyConfig `json:"api_keys,omitempty"`
+	OIDC    *oidcConfig    `json:"oidc,omitempty"`
+}
+
+// apiKeyConfig is a static API key and the subjects it is allowed.
+type apiKeyConfig struct {
+	Name      string   `json:"name"`
+	KeySHA256 string   `json:"key_sha256"`
+	Subjects  []string `json:"subjects"`
+}
+
+// oidcConfig is the OIDC provider trusted, and the subjects of its users.
+type oidcConfig struct {
+	Issuer   string              `json:"issuer"`
+	Audience string              `json:"audience"`
+	JWKSURL  string              `json:"jwks_url,omitempty"`
+	Claim    string              `json:"claim,omitempty"`
+	Subjects map[string][]string `json:"subjects"`
+}
+
+// identity is who a request comes from, and the subjects it may use.
+type identity struct {
+	name     string
+	subjects []string
+}
+
+// allows reports whether the identity may use subject.
+func (id *identity) allows(subject string) bool {
+	for _, pattern := range id.subjects {
+		if subjectWithin(subject, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the credentials of the gateway requests against the
+// -auth-config in force. Its methods accept a nil authenticator, which
+// lets everything through.
+type authenticator struct {
+	mu       sync.RWMutex
+	keys     map[string]*identity // SHA-256 of the API key → identity
+	oidc     *oidcVerifier
+	subjects map[string][]string // OIDC identity → subject patterns
+}
+
+// identityKey is the context key of the identity of a request.
+type identityKey struct{}
+
+// load applies a version of the -auth-config document; every subject
+// pattern must be within exposed, the -subject of the gateway.
+func (a *authenticator) load(data []byte, exposed string) error {
+	var cfg authConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return err
+	}
+	if len(cfg.APIKeys) == 0 && cfg.OIDC == nil {
+		return errors.New("no api_keys and no oidc")
+	}
+	checkSubjects := func(who string, patterns []string) error {
+		for _, p := range patterns {
+			if !subjectWithin(p, exposed) {
+				return fmt.Errorf("%s: subject %q is not within %q", who, p, exposed)
+			}
+		}
+		return nil
+	}
+
+	keys := make(map[string]*identity, len(cfg.APIKeys))
+	for _, k := range cfg.APIKeys {
+		hash := strings.ToLower(k.KeySHA256)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size || k.Name == "" {
+			return fmt.Errorf("api key %q: a name and the SHA-256 of the key in hex are required", k.Name)
+		}
+		if _, dup := keys[hash]; dup {
+			return fmt.Errorf("api key %q: the same key is given twice", k.Name)
+		}
+		if err := checkSubjects("api key "+k.Name, k.Subjects); err != nil {
+			return err
+		}
+		keys[hash] = &identity{name: k.Name, subjects: k.Subjects}
+	}
+
+	var verifier *oidcVerifier
+	if o := cfg.OIDC; o != nil {
+		if o.Issuer == "" || o.Audience == "" {
+			return errors.New("oidc: issuer and audience are required")
+		}
+		for who, patterns := range o.Subjects {
+			if err := checkSubjects("oidc "+who, patterns); err != nil {
+				return err
+			}
+		}
+		a.mu.RLock()
+		previous := a.oidc
+		a.mu.RUnlock()
+		verifier = &oidcVerifier{issuer: o.Issuer, audience: o.Audience, claim: cmp.Or(o.Claim, "sub"),
+			jwksConf: o.JWKSURL, jwksURL: o.JWKSURL, client: &http.Client{Timeout: oidcTimeout}}
+		if previous != nil && previous.issuer == verifier.issuer && previous.audience == verifier.audience &&
+			previous.claim == verifier.claim && previous.jwksConf == verifier.jwksConf {
+			verifier = previous // keeps the keys fetched
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys, a.oidc, a.subjects = keys, verifier, nil
+	if cfg.OIDC != nil {
+		a.subjects = cfg.OIDC.Subjects
+	}
+	return nil
+}
+
+// authenticate returns the identity of the credentials: the value of an
+// Authorization header, or of an X-API-Key header.
+func (a *authenticator) authenticate(ctx context.Context, authorization, apiKey string) (*identity, error) {
+	a.mu.RLock()
+	keys, verifier, subjects := a.keys, a.oidc, a.subjects
+	a.mu.RUnlock()
+
+	if scheme, token, ok := strings.Cut(authorization, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if strings.Count(token, ".") == 2 && verifier != nil { // a JWT
+			name, err := verifier.verify(ctx, token)
+			if errors.Is(err, errOIDCUnavailable) {
+				return nil, err
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+			}
+			return &identity{name: name, subjects: slices.Concat(subjects[name], subjects["*"])}, nil
+		}
+		apiKey = token
+	} else if authorization != "" {
+		return nil, fmt.Errorf("%w: unsupported Authorization scheme %q", errInvalidCredentials, scheme)
+	}
+	if apiKey == "" {
+		return nil, errNoCredentials
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	if id, ok := keys[hex.EncodeToString(sum[:])]; ok {
+		return id, nil
+	}
+	return nil, fmt.Errorf("%w: unknown API key", errInvalidCredentials)
+}
+
+// middleware authenticates the requests before next handles them, with
+// their identity in their context. A WebSocket upgrade without
+// credentials goes through: they come with its first message.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.authenticate(r.Context(), r.Header.Get("Authorization"), r.Header.Get(defaultAPIKeyHeader))
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		case errors.Is(err, errNoCredentials) && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			next.ServeHTTP(w, r)
+		case errors.Is(err, errOIDCUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			challenge := `Bearer realm="` + APP + `"`
+			if !errors.Is(err, errNoCredentials) {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		}
+	})
+}
+
+// authenticateInit authenticates the payload of a graphql-transport-ws
+// connection_init, {"Authorization": "Bearer …"} or {"X-API-Key": "…"}
+// (any case), and returns ctx with the identity.
+func (a *authenticator) authenticateInit(ctx context.Context, payload json.RawMessage) (context.Context, error) {
+	if a == nil || identityOf(ctx) != nil {
+		return ctx, nil
+	}
+	var params map[string]any
+	_ = json.Unmarshal(payload, &params)
+	var authorization, apiKey string
+	for name, value := range params {
+		s, _ := value.(string)
+		switch {
+		case strings.EqualFold(name, "Authorization"):
+			authorization = s
+		case strings.EqualFold(name, defaultAPIKeyHeader):
+			apiKey = s
+		}
+	}
+	id, err := a.authenticate(ctx, authorization, apiKey)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, identityKey{}, id), nil
+}
+
+// authorize returns an error wrapping errForbiddenSubject, or
+// errNoCredentials, unless the identity of ctx may use subject.
+func (a *authenticator) authorize(ctx context.Context, subject string) error {
+	if a == nil {
+		return nil
+	}
+	id := identityOf(ctx)
+	if id == nil {
+		return errNoCredentials
+	}
+	if !id.allows(subject) {
+		return fmt.Errorf("%w: %s may not use %q", errForbiddenSubject, id.name, subject)
+	}
+	return nil
+}
+
+// identityOf returns the identity of a request context, nil when none.
+func identityOf(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sha256Hex returns the SHA-256 of key in hex, as -auth-config stores it.
+func sha256Hex(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuthLoad(t *testing.T) {
+	hash := sha256Hex("secret")
+	tests := []struct {
+		name string
+		doc  string
+		ok   bool
+	}{
+		{"api key", fmt.Sprintf(`{"api_keys":[{"name":"ci","key_sha256":%q,"subjects":["orders.test.>"]}]}`, hash), true},
+		{"oidc", `{"oidc":{"issuer":"https://idp","audience":"gw","subjects":{"*":["orders.public.*"]}}}`, true},
+		{"empty", `{}`, false},
+		{"unknown field", `{"api_keys":[],"oidc":null,"users":[]}`, false},
+		{"key not hex", `{"api_keys":[{"name":"ci","key_sha256":"secret","subjects":["orders.>"]}]}`, false},
+		{"key without name", fmt.Sprintf(`{"api_keys":[{"key_sha256":%q,"subjects":["orders.>"]}]}`, hash), false},
+		{"key twice", fmt.Sprintf(`{"api_keys":[{"name":"a","key_sha256":%q},{"name":"b","key_sha256":%q}]}`, hash, hash), false},
+		{"key subject outside", fmt.Sprintf(`{"api_keys":[{"name":"ci","key_sha256":%q,"subjects":["billing.>"]}]}`, hash), false},
+		{"key subject wider", fmt.Sprintf(`{"api_keys":[{"name":"ci","key_sha256":%q,"subjects":[">"]}]}`, hash), false},
+		{"oidc without audience", `{"oidc":{"issuer":"https://idp"}}`, false},
+		{"oidc subject outside", `{"oidc":{"issuer":"https://idp","audience":"gw","subjects":{"bob":["billing.*"]}}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a authenticator
+			if err := a.load([]byte(tt.doc), "orders.>"); (err == nil) != tt.ok {
+				t.Errorf("load() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p := newTestProvider(t, "rsa")
+	var a authenticator
+	doc := fmt.Sprintf(`{
+		"api_keys": [{"name": "ci-bot", "key_sha256": %q, "subjects": ["orders.test.>"]}],
+		"oidc": {"issuer": %q, "audience": %q, "jwks_url": %q,
+			"subjects": {"alice": ["orders.>"], "*": ["orders.public.*"]}}
+	}`, sha256Hex("secret"), p.srv.URL, testAudience, p.srv.URL+"/jwks")
+	if err := a.load([]byte(doc), "orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	alice := "Bearer " + signToken(t, "RS256", "rsa", p.claims("alice"))
+	bob := "Bearer " + signToken(t, "RS256", "rsa", p.claims("bob"))
+
+	tests := []struct {
+		name          string
+		authorization string
+		apiKey        string
+		subject       string
+		want          error // nil when allowed
+	}{
+		{"alice, her own", alice, "", "orders.created", nil},
+		{"alice, deep", alice, "", "orders.eu.created", nil},
+		{"alice, outside", alice, "", "billing.invoice", errForbiddenSubject},
+		{"bob, the patterns of everybody", bob, "", "orders.public.created", nil},
+		{"bob, not his", bob, "", "orders.created", errForbiddenSubject},
+		{"bob, deeper than *", bob, "", "orders.public.eu.created", errForbiddenSubject},
+		{"api key in X-API-Key", "", "secret", "orders.test.created", nil},
+		{"api key as a bearer", "Bearer secret", "", "orders.test.eu.created", nil},
+		{"api key, outside", "", "secret", "orders.created", errForbiddenSubject},
+		{"unknown api key", "", "guess", "orders.test.created", errInvalidCredentials},
+		{"basic scheme", "Basic c2VjcmV0", "", "orders.test.created", errInvalidCredentials},
+		{"forged token", "Bearer " + signToken(t, "none", "rsa", p.claims("alice")), "", "orders.created", errInvalidCredentials},
+		{"nothing", "", "", "orders.created", errNoCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.authenticate(context.Background(), tt.authorization, tt.apiKey)
+			if err == nil {
+				ctx := context.WithValue(context.Background(), identityKey{}, id)
+				err = a.authorize(ctx, tt.subject)
+			}
+			if (tt.want == nil) != (err == nil) || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("authenticate and authorize %q = %v, want %v", tt.subject, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	var a authenticator
+	doc := fmt.Sprintf(`{"api_keys": [{"name": "ci-bot", "key_sha256": %q, "subjects": ["orders.>"]}]}`, sha256Hex("secret"))
+	if err := a.load([]byte(doc), "orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	h := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.authorize(r.Context(), "orders.created"); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	}))
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"valid key", map[string]string{defaultAPIKeyHeader: "secret"}, http.StatusOK},
+		{"invalid key", map[string]string{defaultAPIKeyHeader: "guess"}, http.StatusUnauthorized},
+		{"nothing", nil, http.StatusUnauthorized},
+		{"websocket without credentials", map[string]string{"Upgrade": "websocket"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
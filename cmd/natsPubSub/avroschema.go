@@ -0,0 +1,284 @@
+// avroschema.go — Avro schemas (.avsc) as event contracts.
+//
+// THE JSON FORM OF AVRO DATA:
+//
+//	The events of this program carry JSON: an Avro contract describes the
+//	JSON form of their data, a record as an object, a union as its plain
+//	value (not wrapped in {"type": value}). The schema is translated to
+//	the JSON Schema subset of schema.go, so "schema diff" and -schema apply
+//	the same rules to it:
+//
+//	  Avro                          JSON Schema
+//	  ────────────────────────────  ──────────────────────────────────────────────
+//	  record                        object, the fields without default required
+//	  enum                          string of the symbols (any with a default:
+//	                                the readers map an unknown symbol to it)
+//	  array, map                    array of the items, object
+//	  int                           integer within the 32-bit bounds
+//	  long                          integer
+//	  float, double                 number
+//	  string, bytes, fixed          string
+//	  ["null", T]                   T or null
+//
+//	An old reader ignores the fields it does not know and needs a default
+//	for the ones missing, as JSON Schema treats additional and required
+//	properties: the diff of the translations gives the Avro rules. The
+//	names defined (records, enums, fixed) are resolved in their namespace;
+//	the root is the top-level schema, or for a union the record named after
+//	"#" (order.avsc#OrderCreated), by default the first one.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// avroTranslator translates an Avro schema, its named types registered as
+// they are defined.
+type avroTranslator struct {
+	named    map[string]any  // full name → definition
+	visiting map[string]bool // records being translated, to stop recursion
+}
+
+// avroToJSONSchema translates the Avro schema content, rooted at the record
+// root ("" for the default one).
+func avroToJSONSchema(content []byte, root string) (map[string]any, error) {
+	var node any
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	t := &avroTranslator{named: make(map[string]any), visiting: make(map[string]bool)}
+	if err := t.define(node, ""); err != nil {
+		return nil, err
+	}
+	if branches, ok := node.([]any); ok { // a union of the event types
+		node = nil
+		for _, b := range branches {
+			if def, _ := b.(map[string]any); def["type"] == "record" && (root == "" || avroNamed(def, root)) {
+				node = def
+				break
+			}
+		}
+		if node == nil {
+			return nil, fmt.Errorf("no record %q in the union", root)
+		}
+	} else if def, _ := node.(map[string]any); root != "" && (def["type"] != "record" || !avroNamed(def, root)) {
+		return nil, fmt.Errorf("the schema is not the record %q", root)
+	}
+	return t.translate(node, "")
+}
+
+// avroNamed reports whether the named type def, its name made full by
+// define, is name, full or not.
+func avroNamed(def map[string]any, name string) bool {
+	full, _ := def["name"].(string)
+	return full == name || strings.HasSuffix(full, "."+name)
+}
+
+// define registers the named types of node, defined in the namespace ns,
+// and replaces their name by their full name.
+func (t *avroTranslator) define(node any, ns string) error {
+	switch n := node.(type) {
+	case []any:
+		for _, b := range n {
+			if err := t.define(b, ns); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		kind, _ := n["type"].(string)
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			name := avroFullName(n, ns)
+			if name == "" {
+				return fmt.Errorf("%s without a name", kind)
+			}
+			if _, dup := t.named[name]; dup {
+				return fmt.Errorf("%q defined twice", name)
+			}
+			t.named[name] = n
+			n["name"] = name
+			ns = name[:max(0, strings.LastIndex(name, "."))]
+		}
+		if err := t.define(n["type"], ns); err != nil {
+			return err
+		}
+		for _, key := range []string{"items", "values"} {
+			if err := t.define(n[key], ns); err != nil {
+				return err
+			}
+		}
+		fields, _ := n["fields"].([]any)
+		for _, f := range fields {
+			field, _ := f.(map[string]any)
+			if err := t.define(field["type"], ns); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// avroFullName returns the full name of the named type def, defined in the
+// namespace ns.
+func avroFullName(def map[string]any, ns string) string {
+	name, _ := def["name"].(string)
+	if name == "" || strings.Contains(name, ".") {
+		return name
+	}
+	if n, ok := def["namespace"].(string); ok {
+		ns = n
+	}
+	if ns == "" {
+		return name
+	}
+	return ns + "." + name
+}
+
+// translate returns the JSON Schema of node, in the namespace ns.
+func (t *avroTranslator) translate(node any, ns string) (map[string]any, error) {
+	switch n := node.(type) {
+	case string:
+		return t.primitive(n, ns)
+	case []any:
+		return t.union(n, ns)
+	case map[string]any:
+		kind, _ := n["type"].(string)
+		switch kind {
+		case "record", "error":
+			return t.record(n, ns)
+		case "enum":
+			symbols, _ := n["symbols"].([]any)
+			if len(symbols) == 0 {
+				return nil, fmt.Errorf("enum %q without symbols", avroFullName(n, ns))
+			}
+			if _, lenient := n["default"]; lenient {
+				return map[string]any{"type": "string"}, nil
+			}
+			return map[string]any{"type": "string", "enum": symbols}, nil
+		case "array":
+			items, err := t.translate(n["items"], ns)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{"type": "array", "items": items}, nil
+		case "map":
+			if _, err := t.translate(n["values"], ns); err != nil {
+				return nil, err
+			}
+			return map[string]any{"type": "object"}, nil
+		case "fixed":
+			return map[string]any{"type": "string"}, nil
+		}
+		// A primitive in the object form, with a logicalType or not.
+		return t.translate(n["type"], ns)
+	}
+	return nil, fmt.Errorf("invalid Avro schema %s", jsonString(node))
+}
+
+// primitive returns the JSON Schema of a primitive type, or of the named
+// type name.
+func (t *avroTranslator) primitive(name, ns string) (map[string]any, error) {
+	switch name {
+	case "null":
+		return map[string]any{"type": "null"}, nil
+	case "boolean":
+		return map[string]any{"type": "boolean"}, nil
+	case "int":
+		return map[string]any{"type": "integer", "minimum": float64(math.MinInt32), "maximum": float64(math.MaxInt32)}, nil
+	case "long":
+		return map[string]any{"type": "integer"}, nil
+	case "float", "double":
+		return map[string]any{"type": "number"}, nil
+	case "string", "bytes":
+		return map[string]any{"type": "string"}, nil
+	}
+	full := name
+	if ns != "" && !strings.Contains(name, ".") {
+		if _, ok := t.named[ns+"."+name]; ok {
+			full = ns + "." + name
+		}
+	}
+	def, ok := t.named[full]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", name)
+	}
+	if t.visiting[full] {
+		return map[string]any{"type": "object"}, nil // recursive: not expanded again
+	}
+	return t.translate(def, ns)
+}
+
+// record returns the JSON Schema of a record.
+func (t *avroTranslator) record(def map[string]any, ns string) (map[string]any, error) {
+	name := avroFullName(def, ns)
+	ns = name[:max(0, strings.LastIndex(name, "."))]
+	t.visiting[name] = true
+	defer delete(t.visiting, name)
+
+	fields, _ := def["fields"].([]any)
+	properties := make(map[string]any, len(fields))
+	var required []any
+	for _, f := range fields {
+		field, _ := f.(map[string]any)
+		fieldName, _ := field["name"].(string)
+		if fieldName == "" {
+			return nil, fmt.Errorf("record %q: field without a name", name)
+		}
+		schema, err := t.translate(field["type"], ns)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", name, fieldName, err)
+		}
+		properties[fieldName] = schema
+		if _, hasDefault := field["default"]; !hasDefault {
+			required = append(required, fieldName)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema, nil
+}
+
+// union returns the JSON Schema of a union: the one of its only branch
+// that is not null, null allowed, or the types of its branches.
+func (t *avroTranslator) union(branches []any, ns string) (map[string]any, error) {
+	if len(branches) == 0 {
+		return nil, errors.New("empty union")
+	}
+	var types []string
+	var nonNull []map[string]any
+	for _, b := range branches {
+		schema, err := t.translate(b, ns)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, schemaTypes(schema)...)
+		if schema["type"] != "null" {
+			nonNull = append(nonNull, schema)
+		}
+	}
+	if len(nonNull) == 1 {
+		schema := nonNull[0]
+		if len(nonNull) < len(branches) {
+			schema["type"] = anySlice(append(schemaTypes(schema), "null"))
+		}
+		return schema, nil
+	}
+	slices.Sort(types)
+	return map[string]any{"type": anySlice(slices.Compact(types))}, nil
+}
+
+// anySlice returns the strings of s as a []any, the form of decoded JSON.
+func anySlice(s []string) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+// cloudevent.go — Reading the CloudEvents attributes of a NATS message.
+//
+// CONTENT MODES:
+//
+//	The CloudEvents NATS protocol binding allows two ways of carrying an
+//	event in a message:
+//
+//	  binary mode      the attributes are headers prefixed with "ce-"
+//	                   (ce-type, ce-source, ce-id, …), the payload is the data;
+//	  structured mode  the payload is a JSON envelope holding the attributes
+//	                   and the data: {"specversion":"1.0","type":…,"data":{…}}.
+//
+//	decodeCloudEvent accepts both, so the modes reading events do not care
+//	how the producer encoded them.
+//
+// CAUSAL CHAINS:
+//
+//	The events published by this program carry the correlationid and
+//	causationid extension attributes (see pkg/correlation): an event
+//	published on its own starts a chain, a reply inherits from the event
+//	it answers — the reply of a "-reply" http bridge, of the sink of an
+//	"http" bridge. The AMQP correlation-id property maps to correlationid.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/correlation"
+)
+
+// cePrefix is the header prefix of the attributes in binary content mode.
+const cePrefix = "ce-"
+
+// cloudEvent is the part of a CloudEvent this program looks at.
+type cloudEvent struct {
+	// Attributes holds the context attributes and extensions by lower case
+	// name ("type", "source", "id", "time", "dataversion", …).
+	Attributes map[string]string
+	Data       json.RawMessage
+}
+
+// decodeCloudEvent extracts the CloudEvent carried by m, in binary or
+// structured content mode. It returns false when m has no "type" attribute.
+func decodeCloudEvent(m *nats.Msg) (cloudEvent, bool) {
+	ev := cloudEvent{Attributes: make(map[string]string)}
+	for k, values := range m.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, cePrefix) && len(values) > 0 {
+			ev.Attributes[strings.TrimPrefix(name, cePrefix)] = values[0]
+		}
+	}
+	if ev.Attributes["type"] != "" {
+		ev.Data = m.Data
+		return ev, true
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(m.Data, &envelope); err != nil {
+		return ev, false
+	}
+	for name, raw := range envelope {
+		if name == "data" || name == "data_base64" {
+			continue
+		}
+		// Extension attributes may be strings, numbers or booleans
+		// depending on the producer: keep their text form.
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		ev.Attributes[strings.ToLower(name)] = s
+	}
+	ev.Data = envelope["data"]
+	return ev, ev.Attributes["type"] != ""
+}
+
+// eventContext returns ctx carrying the causal chain of the event m, when m
+// is a CloudEvent, for the events published while handling it.
+func eventContext(ctx context.Context, m *nats.Msg) context.Context {
+	if ev, ok := decodeCloudEvent(m); ok {
+		return correlation.NewContext(ctx, correlation.FromAttributes(ev.Attributes))
+	}
+	return ctx
+}
+
+// inheritCausation fills in the id, correlationid and causationid missing
+// in attrs, the attributes (by lower case name) of an event published while
+// handling the event of ctx, if any. It returns the attributes added.
+func inheritCausation(ctx context.Context, attrs map[string]string) map[string]string {
+	added := make(map[string]string)
+	if attrs["id"] == "" {
+		attrs["id"] = nuid.Next()
+		added["id"] = attrs["id"]
+	}
+	for name, value := range correlation.Next(ctx, attrs["id"]).Attributes() {
+		if attrs[name] == "" {
+			attrs[name], added[name] = value, value
+		}
+	}
+	return added
+}
+
+// stampCausation fills in the id, correlationid and causationid headers
+// missing in m, published while handling the event of ctx, if any. Only
+// CloudEvents in binary content mode are changed: the envelope of a
+// structured event belongs to its producer.
+func stampCausation(ctx context.Context, m *nats.Msg) {
+	binary := false
+	for k := range m.Header {
+		binary = binary || strings.EqualFold(k, cePrefix+"type")
+	}
+	ev, ok := decodeCloudEvent(m)
+	if !ok || !binary {
+		return
+	}
+	for name, value := range inheritCausation(ctx, ev.Attributes) {
+		m.Header.Set(cePrefix+name, value)
+	}
+}
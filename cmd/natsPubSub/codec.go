@@ -0,0 +1,64 @@
+// codec.go — Event data codecs of "pub" and "sub", selected by name.
+//
+// CODECS:
+//
+//	The data of the events is JSON by default. -codec selects another
+//	encoding among the ones registered in pkg/codec: "pub" encodes the JSON
+//	-msg with it and sets its Content-Type, "sub" decodes the data with it
+//	before handling, the handlers (upcasters, printing) seeing JSON:
+//
+//	  go run . -mode pub -subject sensors.gw-7 -codec flatbuffers -msg '{"t":21.5}'
+//	  go run . -mode sub -subject "sensors.>" -codec flatbuffers
+//
+//	With -handler-config, the codec is its "codec" setting. The routes
+//	forward the messages as received, still encoded.
+//
+// YOUR OWN CODEC:
+//
+//	A codec of the company is added by a file of this directory importing
+//	the package that registers it (see pkg/codec), then selected by name:
+//
+//	  // codec_internal.go
+//	  package main
+//
+//	  import _ "example.com/events/fbcodec"
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/codec"
+)
+
+// encodeMsg returns the payload msg encoded with c: msg is decoded as JSON
+// first, or taken as a string when it is not JSON.
+func encodeMsg(c codec.Codec, msg string) ([]byte, error) {
+	var v any = msg
+	if json.Valid([]byte(msg)) {
+		_ = json.Unmarshal([]byte(msg), &v) // valid JSON
+	}
+	return c.Encode(v)
+}
+
+// codecHandler returns a handler decoding the data of the messages with
+// the codec name, and calling next with the data in JSON.
+func codecHandler(name string, next func(m *nats.Msg) error) (func(m *nats.Msg) error, error) {
+	c, err := codec.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *nats.Msg) error {
+		var v any
+		if err := c.Decode(m.Data, &v); err != nil {
+			return fmt.Errorf("failed to decode the message on [%s] with the codec %q: %w", m.Subject, name, err)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("message on [%s] decoded by the codec %q is not representable in JSON: %w", m.Subject, name, err)
+		}
+		return next(&nats.Msg{Subject: m.Subject, Reply: m.Reply, Header: m.Header, Data: data})
+	}, nil
+}
@@ -0,0 +1,355 @@
+// conformance.go — CloudEvents wire format test vectors for other languages.
+//
+// WHY:
+//
+//	The consumers of the events are not all written in Go: a Python
+//	analytics job, a Java billing service, a TypeScript dashboard each
+//	decode the CloudEvents of NATS their own way, binary mode (attributes
+//	in ce-* headers) and structured mode (one JSON envelope) alike. The
+//	"conformance" mode publishes a documented set of test vectors, as this
+//	repository writes them, and checks what the implementation under test
+//	decoded from each of them:
+//
+//	  go run . -mode conformance -subject conformance -reply   # reference consumer, in Go
+//	  go run . -mode conformance -subject conformance          # the vectors, checked
+//	  go run . -mode conformance -subject conformance -dry-run # the vectors, as JSON
+//
+// THE PROTOCOL:
+//
+//	Every vector is sent as a request on <subject>.<vector name>. The
+//	consumer under test subscribes to <subject>.>, decodes the event and
+//	replies with what it understood, as JSON:
+//
+//	  {"attributes": {"specversion":"1.0","type":"…","source":"…","id":"…",…},
+//	   "data": <the data, when it is JSON>,
+//	   "data_base64": "<the data bytes, when it is not>"}
+//
+//	  attributes   every context attribute, extensions included, by lower
+//	               case name, as strings (an integer extension 2 is "2");
+//	               in binary mode, datacontenttype is the Content-Type
+//	               header, as the NATS protocol binding maps it
+//	  data         the data as a JSON value, when datacontenttype is a JSON
+//	               media type or absent and the data is valid JSON
+//	  data_base64  otherwise, the bytes of the data (a structured "data"
+//	               string decoded, data_base64 decoded), none without data
+//
+//	The attributes must be equal, the JSON data equal as values (spacing
+//	and key order do not matter), the bytes equal. Any reply that is not
+//	such a document fails the vector.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"mime"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// binaryMode and structuredMode are the CloudEvents content modes.
+	binaryMode     = "binary"
+	structuredMode = "structured"
+)
+
+// conformanceVector is a test vector: a message as published, and what its
+// consumers must decode from it.
+type conformanceVector struct {
+	Name        string          `json:"name"` // last token of the subject
+	Mode        string          `json:"mode"`
+	Description string          `json:"description"`
+	Header      nats.Header     `json:"headers,omitempty"`
+	Payload     []byte          `json:"-"`
+	Expected    conformanceView `json:"expected"`
+}
+
+// conformanceView is what a consumer decoded from a vector, its reply.
+type conformanceView struct {
+	Attributes map[string]string `json:"attributes"`
+	Data       json.RawMessage   `json:"data,omitempty"`
+	DataBase64 string            `json:"data_base64,omitempty"`
+}
+
+// vectorText is the text data of the vectors: accents and CJK in UTF-8.
+const vectorText = "Grüezi, 世界"
+
+// vectorBytes is the binary data of the vectors: NUL, 0xff, CR LF.
+var vectorBytes = []byte{0x00, 0x01, 0xfe, 0xff, '\r', '\n'}
+
+// conformanceVectors returns the test vectors, in the order they are sent.
+func conformanceVectors() []conformanceVector {
+	// attrs returns the attributes common to the vectors, with extra.
+	attrs := func(extra ...string) map[string]string {
+		a := map[string]string{
+			"specversion": "1.0",
+			"type":        "com.example.order.created",
+			"source":      "https://shop.example.com/orders",
+			"id":          "A234-1234-1234",
+			"time":        "2026-10-16T08:30:00Z",
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			a[extra[i]] = extra[i+1]
+		}
+		return a
+	}
+	// binary returns the headers of a binary mode event of attributes a.
+	binary := func(a map[string]string, contentType string) nats.Header {
+		h := nats.Header{}
+		for name, value := range a {
+			if name != "datacontenttype" {
+				h.Set(cePrefix+name, value)
+			}
+		}
+		if contentType != "" {
+			h.Set("Content-Type", contentType)
+		}
+		return h
+	}
+	structured := nats.Header{"Content-Type": []string{ceJSONContentType}}
+	textBase64 := base64.StdEncoding.EncodeToString([]byte(vectorText))
+	bytesBase64 := base64.StdEncoding.EncodeToString(vectorBytes)
+	order := `{"orderId":42,"amount":19.99,"items":["book","pen"]}`
+	extensions := attrs("subject", "order/42", "dataschema", "https://schemas.example.com/order/v2.json",
+		"correlationid", "c-7f3a", "causationid", "A234-1234-1233", "dataversion", "2")
+
+	return []conformanceVector{
+		{
+			Name: "binary-json", Mode: binaryMode,
+			Description: "JSON data, the attributes in ce- headers, datacontenttype in Content-Type",
+			Header:      binary(attrs(), "application/json"),
+			Payload:     []byte(order),
+			Expected:    conformanceView{Attributes: attrs("datacontenttype", "application/json"), Data: json.RawMessage(order)},
+		},
+		{
+			Name: "binary-text", Mode: binaryMode,
+			Description: "UTF-8 text data, with a charset parameter",
+			Header:      binary(attrs(), "text/plain; charset=utf-8"),
+			Payload:     []byte(vectorText),
+			Expected:    conformanceView{Attributes: attrs("datacontenttype", "text/plain; charset=utf-8"), DataBase64: textBase64},
+		},
+		{
+			Name: "binary-bytes", Mode: binaryMode,
+			Description: "opaque binary data, NUL and 0xff bytes included",
+			Header:      binary(attrs(), "application/octet-stream"),
+			Payload:     vectorBytes,
+			Expected:    conformanceView{Attributes: attrs("datacontenttype", "application/octet-stream"), DataBase64: bytesBase64},
+		},
+		{
+			Name: "binary-extensions", Mode: binaryMode,
+			Description: "optional and extension attributes, JSON data without Content-Type",
+			Header:      binary(extensions, ""),
+			Payload:     []byte(`{"orderId":42}`),
+			Expected:    conformanceView{Attributes: extensions, Data: json.RawMessage(`{"orderId":42}`)},
+		},
+		{
+			Name: "binary-no-data", Mode: binaryMode,
+			Description: "an event without data: empty payload",
+			Header:      binary(attrs(), ""),
+			Expected:    conformanceView{Attributes: attrs()},
+		},
+		{
+			Name: "structured-json", Mode: structuredMode,
+			Description: "JSON envelope, JSON data as a JSON value",
+			Header:      structured,
+			Payload: []byte(`{"specversion":"1.0","type":"com.example.order.created","source":"https://shop.example.com/orders",` +
+				`"id":"A234-1234-1234","time":"2026-10-16T08:30:00Z","datacontenttype":"application/json","data":` + order + `}`),
+			Expected: conformanceView{Attributes: attrs("datacontenttype", "application/json"), Data: json.RawMessage(order)},
+		},
+		{
+			Name: "structured-text", Mode: structuredMode,
+			Description: "JSON envelope, text data as a JSON string",
+			Header:      structured,
+			Payload: []byte(`{"specversion":"1.0","type":"com.example.order.created","source":"https://shop.example.com/orders",` +
+				`"id":"A234-1234-1234","time":"2026-10-16T08:30:00Z","datacontenttype":"text/plain","data":"` + vectorText + `"}`),
+			Expected: conformanceView{Attributes: attrs("datacontenttype", "text/plain"), DataBase64: textBase64},
+		},
+		{
+			Name: "structured-base64", Mode: structuredMode,
+			Description: "JSON envelope, binary data in data_base64",
+			Header:      structured,
+			Payload: []byte(`{"specversion":"1.0","type":"com.example.order.created","source":"https://shop.example.com/orders",` +
+				`"id":"A234-1234-1234","time":"2026-10-16T08:30:00Z","datacontenttype":"application/octet-stream","data_base64":"` + bytesBase64 + `"}`),
+			Expected: conformanceView{Attributes: attrs("datacontenttype", "application/octet-stream"), DataBase64: bytesBase64},
+		},
+		{
+			Name: "structured-extensions", Mode: structuredMode,
+			Description: "JSON envelope, integer and boolean extensions read as strings, no datacontenttype",
+			Header:      structured,
+			Payload: []byte(`{"specversion":"1.0","type":"com.example.order.created","source":"https://shop.example.com/orders",` +
+				`"id":"A234-1234-1234","time":"2026-10-16T08:30:00Z","dataversion":2,"sampled":true,"subject":"order/42","data":{"orderId":42}}`),
+			Expected: conformanceView{Attributes: attrs("dataversion", "2", "sampled", "true", "subject", "order/42"), Data: json.RawMessage(`{"orderId":42}`)},
+		},
+	}
+}
+
+// conformance sends the test vectors on subject.<name>, checks the replies
+// of the consumer under test, and fails when one of them is wrong. With
+// serve, it is the reference consumer instead, answering the vectors.
+func conformance(nc *nats.Conn, l *log.Logger, subject string, timeout time.Duration, serve bool) {
+	if serve {
+		serveConformance(nc, l, subject)
+		return
+	}
+	vectors := conformanceVectors()
+	var failed int
+	for _, v := range vectors {
+		m := &nats.Msg{Subject: subject + "." + v.Name, Header: v.Header, Data: v.Payload}
+		reply, err := nc.RequestMsg(m, timeout)
+		if err != nil {
+			failed++
+			l.Printf("❌ %-22s no reply on [%s]: %v", v.Name, m.Subject, err)
+			continue
+		}
+		countPublished(len(m.Data))
+		countReceived(len(reply.Data))
+		var got conformanceView
+		if err := json.Unmarshal(reply.Data, &got); err != nil {
+			failed++
+			l.Printf("❌ %-22s invalid reply %q: %v", v.Name, reply.Data, err)
+			continue
+		}
+		if diffs := v.Expected.diff(got); len(diffs) > 0 {
+			failed++
+			l.Printf("❌ %-22s %s", v.Name, v.Description)
+			for _, d := range diffs {
+				l.Printf("   %s", d)
+			}
+			continue
+		}
+		l.Printf("✅ %-22s %s", v.Name, v.Description)
+	}
+	if failed > 0 {
+		fail(l, exitFailure, "%d of %d conformance vectors failed", failed, len(vectors))
+	}
+	l.Printf("🎉 All %d conformance vectors passed", len(vectors))
+}
+
+// diff returns the differences between the expected view and got.
+func (want conformanceView) diff(got conformanceView) []string {
+	var diffs []string
+	for _, name := range slices.Sorted(maps.Keys(want.Attributes)) {
+		if value, ok := got.Attributes[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("attribute %q missing, want %q", name, want.Attributes[name]))
+		} else if value != want.Attributes[name] {
+			diffs = append(diffs, fmt.Sprintf("attribute %q = %q, want %q", name, value, want.Attributes[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(got.Attributes)) {
+		if _, ok := want.Attributes[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected attribute %q = %q", name, got.Attributes[name]))
+		}
+	}
+	if !jsonEqual(want.Data, got.Data) {
+		diffs = append(diffs, fmt.Sprintf("data = %s, want %s", orNone(got.Data), orNone(want.Data)))
+	}
+	if want.DataBase64 != got.DataBase64 {
+		diffs = append(diffs, fmt.Sprintf("data_base64 = %q, want %q", got.DataBase64, want.DataBase64))
+	}
+	return diffs
+}
+
+// jsonEqual reports whether a and b are the same JSON value, or both empty.
+func jsonEqual(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	return json.Unmarshal(a, &va) == nil && json.Unmarshal(b, &vb) == nil && reflect.DeepEqual(va, vb)
+}
+
+// orNone returns data as text, "none" when empty.
+func orNone(data json.RawMessage) string {
+	if len(data) == 0 {
+		return "none"
+	}
+	return string(data)
+}
+
+// ─── Reference Consumer ────────────────────────────────────────────────
+
+// serveConformance answers the vectors sent on subject.> with what this
+// repository decodes from them, until interrupted.
+func serveConformance(nc *nats.Conn, l *log.Logger, subject string) {
+	sub, err := nc.Subscribe(subject+".>", func(m *nats.Msg) {
+		countReceived(len(m.Data))
+		view, err := decodeConformance(m)
+		if err != nil {
+			l.Printf("⚠️  [%s]: %v", m.Subject, err)
+			_ = m.Respond([]byte(fmt.Sprintf(`{"error":%q}`, err.Error())))
+			return
+		}
+		data, _ := json.Marshal(view) // strings and valid JSON only
+		if err := m.Respond(data); err == nil {
+			countPublished(len(data))
+		}
+		l.Printf("📩 [%s] decoded: %s", m.Subject, data)
+	})
+	if err != nil {
+		fail(l, exitFailure, "failed to subscribe: %v", err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	l.Printf("🧪 Reference consumer answering the conformance vectors on %q (Ctrl+C to quit) …", subject+".>")
+	<-stopSignals()
+}
+
+// decodeConformance returns the view of the CloudEvent m, as the consumers
+// under test must reply it.
+func decodeConformance(m *nats.Msg) (conformanceView, error) {
+	ev, ok := decodeCloudEvent(m)
+	if !ok {
+		return conformanceView{}, fmt.Errorf("not a CloudEvent")
+	}
+	view := conformanceView{Attributes: ev.Attributes}
+	data := m.Data
+	if m.Header.Get(cePrefix+"type") == "" { // structured mode
+		var err error
+		if data, err = eventData(m.Data, ev); err != nil {
+			return conformanceView{}, err
+		}
+	} else if ct := m.Header.Get("Content-Type"); ct != "" && ev.Attributes["datacontenttype"] == "" {
+		view.Attributes["datacontenttype"] = ct
+	}
+	if len(data) == 0 {
+		return view, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(view.Attributes["datacontenttype"])
+	if (mediaType == "" || isJSONMediaType(mediaType)) && json.Valid(data) {
+		view.Data = data
+		return view, nil
+	}
+	view.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	return view, nil
+}
+
+// printConformanceVectors prints the vectors as JSON on stdout, the
+// payloads as text when they are UTF-8, and in base64 always.
+func printConformanceVectors() {
+	type printed struct {
+		conformanceVector
+		Payload       string `json:"payload,omitempty"`
+		PayloadBase64 string `json:"payload_base64,omitempty"`
+	}
+	var list []printed
+	for _, v := range conformanceVectors() {
+		p := printed{conformanceVector: v, PayloadBase64: base64.StdEncoding.EncodeToString(v.Payload)}
+		if utf8.Valid(v.Payload) && !strings.ContainsRune(string(v.Payload), 0) {
+			p.Payload = string(v.Payload)
+		}
+		list = append(list, p)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(list); err != nil {
+		exit(exitFailure, fmt.Errorf("printing the test vectors: %w", err))
+	}
+}
@@ -0,0 +1,251 @@
+// connector.go — Cloud connectors relaying between NATS and cloud brokers.
+//
+// HYBRID EVENT ROUTING:
+//
+//	Some consumers live in a cloud provider and only speak its managed
+//	broker. The "connector" mode relays events between NATS and:
+//
+//	  Google Cloud Pub/Sub  gcppubsub://projects/<project>/topics/<topic>                  (sink)
+//	                        gcppubsub://projects/<project>/subscriptions/<subscription>    (source)
+//	  AWS SNS               awssns:///arn:aws:sns:<region>:<account>:<topic>               (sink)
+//	  AWS SQS               awssqs://sqs.<region>.amazonaws.com/<account>/<queue>          (sink or source)
+//
+//	(the URL schemes of the Go CDK, gocloud.dev/pubsub). A -sink receives
+//	the NATS messages of -subject, a -source is read and published on NATS,
+//	both can be given at once.
+//
+// CLOUDEVENTS CONVERSION:
+//
+//	Binary content mode everywhere: the "ce-*" NATS headers become "ce-*"
+//	Pub/Sub attributes (the CloudEvents Google Pub/Sub binding) or SNS/SQS
+//	message attributes, and back. SNS and SQS accept at most 10 attributes
+//	and text bodies only: an event not fitting is sent in structured mode
+//	(JSON envelope, "data_base64" for binary data).
+//
+//	Sinks receive the NATS subject in a "nats-subject" attribute. A source
+//	message is published on its "nats-subject" attribute when it lies
+//	within -subject, or on -subject itself when it has no wildcard. As in
+//	the "amqp" mode, an x-bridged-by header prevents relaying loops.
+//
+// CREDENTIALS:
+//
+//	Nothing is configured here, the standard chains of each provider apply:
+//	  GCP  Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS,
+//	       gcloud auth application-default login, or the metadata server of
+//	       GCE/GKE (workload identity); PUBSUB_EMULATOR_HOST for the emulator.
+//	  AWS  environment variables, shared config/credentials files (AWS_PROFILE),
+//	       IRSA web identity on EKS, or the EC2/ECS instance role.
+//
+// DELIVERY:
+//
+//	A source message is acknowledged in the cloud only after NATS has
+//	processed it (flush). Towards a sink, the NATS messages are relayed as
+//	they arrive (core NATS does not redeliver): relay a JetStream stream
+//	subject for at-least-once end to end.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// connectorTimeout bounds one call to a cloud API.
+	connectorTimeout = 30 * time.Second
+	// natsSubjectAttribute is the source message attribute selecting the NATS subject.
+	natsSubjectAttribute = "nats-subject"
+)
+
+// cloudSink publishes NATS messages to a cloud broker.
+type cloudSink interface {
+	Send(ctx context.Context, m *nats.Msg) error
+}
+
+// cloudSource receives messages from a cloud broker.
+type cloudSource interface {
+	// Receive waits for the next messages, possibly none.
+	Receive(ctx context.Context) ([]sourceMessage, error)
+}
+
+// sourceMessage is a message received from a cloud source, converted to NATS.
+type sourceMessage struct {
+	Msg *nats.Msg // Subject is set from the "nats-subject" attribute, if any
+	Ack func(ctx context.Context) error
+}
+
+// connector runs the cloud connector until interrupted (Ctrl+C).
+func connector(nc *nats.Conn, l *log.Logger, subject, sinkURL, sourceURL string) {
+	ctx, stop := stopContext()
+	defer stop()
+
+	if sinkURL != "" {
+		sink, err := openSink(ctx, sinkURL)
+		if err != nil {
+			fail(l, exitFailure, "failed to open sink %s: %v", sinkURL, err)
+		}
+		sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
+			if m.Header.Get(bridgedHeader) != "" {
+				return // came from a source, do not send it back
+			}
+			sendCtx, cancel := context.WithTimeout(ctx, connectorTimeout)
+			defer cancel()
+			if err := sink.Send(sendCtx, m); err != nil {
+				l.Printf("⚠️  Could not relay %q to %s: %v", m.Subject, sinkURL, err)
+			}
+		})
+		if err != nil {
+			fail(l, exitConnection, "failed to subscribe: %v", err)
+		}
+		defer func() { _ = sub.Drain() }()
+		l.Printf("☁️  Relaying NATS %q → %s", subject, sinkURL)
+	}
+
+	if sourceURL == "" {
+		sdNotify("READY=1")
+		<-ctx.Done()
+	} else {
+		source, err := openSource(ctx, sourceURL)
+		if err != nil {
+			fail(l, exitFailure, "failed to open source %s: %v", sourceURL, err)
+		}
+		l.Printf("☁️  Relaying %s → NATS %q", sourceURL, subject)
+		sdNotify("READY=1")
+		relaySource(ctx, nc, l, subject, source)
+	}
+
+	sdNotify("STOPPING=1")
+	l.Println("👋 Bye!")
+}
+
+// relaySource publishes the messages of source on NATS until ctx is
+// cancelled, acknowledging them once NATS has them.
+func relaySource(ctx context.Context, nc *nats.Conn, l *log.Logger, subject string, source cloudSource) {
+	for ctx.Err() == nil {
+		recvCtx, cancel := context.WithTimeout(ctx, connectorTimeout)
+		msgs, err := source.Receive(recvCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				l.Printf("⚠️  Receive failed: %v — retrying in %v", err, edgeRetryDelay)
+				sleepCtx(ctx, edgeRetryDelay)
+			}
+			continue
+		}
+
+		var published []sourceMessage
+		for _, sm := range msgs {
+			target := sm.Msg.Subject
+			switch {
+			case target != "" && subjectWithin(target, subject):
+			case target == "" && !strings.ContainsAny(subject, "*>"):
+				target = subject
+			default:
+				// Left unacknowledged: the cloud broker redelivers it, then
+				// moves it to its dead-letter queue if one is configured.
+				l.Printf("⚠️  Skipping message for subject %q, not within %q", target, subject)
+				continue
+			}
+			sm.Msg.Subject = target
+			sm.Msg.Header.Set(bridgedHeader, APP)
+			if err := nc.PublishMsg(sm.Msg); err != nil {
+				l.Printf("⚠️  Could not publish on %q: %v", target, err)
+				continue
+			}
+			published = append(published, sm)
+		}
+		if len(published) == 0 {
+			continue
+		}
+		if err := nc.FlushTimeout(edgeHubTimeout); err != nil {
+			l.Printf("⚠️  NATS did not confirm the batch, it will be redelivered: %v", err)
+			continue
+		}
+		ackCtx, cancel := context.WithTimeout(context.Background(), connectorTimeout)
+		for _, sm := range published {
+			if err := sm.Ack(ackCtx); err != nil {
+				l.Printf("⚠️  Ack failed, the message will be redelivered: %v", err)
+			}
+		}
+		cancel()
+	}
+}
+
+// openSink returns the sink of a connector URL.
+func openSink(ctx context.Context, rawURL string) (cloudSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "gcppubsub":
+		return newGCPPubSub(ctx, u, "topics")
+	case "awssns":
+		return newSNSSink(ctx, u)
+	case "awssqs":
+		return newSQSQueue(ctx, u)
+	}
+	return nil, fmt.Errorf("unsupported sink scheme %q (gcppubsub, awssns or awssqs)", u.Scheme)
+}
+
+// openSource returns the source of a connector URL.
+func openSource(ctx context.Context, rawURL string) (cloudSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "gcppubsub":
+		return newGCPPubSub(ctx, u, "subscriptions")
+	case "awssqs":
+		return newSQSQueue(ctx, u)
+	case "awssns":
+		return nil, errors.New("SNS cannot be read directly, subscribe an SQS queue to the topic and use awssqs://")
+	}
+	return nil, fmt.Errorf("unsupported source scheme %q (gcppubsub or awssqs)", u.Scheme)
+}
+
+// messageAttributes returns the attributes of m for a cloud broker: the
+// CloudEvents attributes in binary mode ("ce-*") and the other headers.
+func messageAttributes(m *nats.Msg) map[string]string {
+	attrs := map[string]string{natsSubjectAttribute: m.Subject}
+	for k, values := range m.Header {
+		if len(values) > 0 {
+			attrs[k] = values[0]
+		}
+	}
+	if ev, ok := decodeCloudEvent(m); ok && m.Header.Get(cePrefix+"type") == "" {
+		// Structured on NATS, binary in the cloud.
+		for name, value := range ev.Attributes {
+			attrs[cePrefix+name] = value
+		}
+	}
+	return attrs
+}
+
+// messageData returns the payload to send along messageAttributes(m).
+func messageData(m *nats.Msg) []byte {
+	if ev, ok := decodeCloudEvent(m); ok && m.Header.Get(cePrefix+"type") == "" {
+		return ev.Data
+	}
+	return m.Data
+}
+
+// natsMessage converts received data and attributes into a NATS message,
+// the "nats-subject" attribute becoming its subject.
+func natsMessage(data []byte, attrs map[string]string) *nats.Msg {
+	m := nats.NewMsg(attrs[natsSubjectAttribute])
+	m.Data = data
+	for k, v := range attrs {
+		if k != natsSubjectAttribute {
+			m.Header.Set(k, v)
+		}
+	}
+	return m
+}
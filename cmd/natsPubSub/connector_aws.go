@@ -0,0 +1,196 @@
+// connector_aws.go — AWS SNS sink and SQS sink/source of the "connector" mode.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// awsMaxAttributes is the number of message attributes SNS and SQS accept.
+	awsMaxAttributes = 10
+	// sqsReceiveBatch is the maximum number of messages SQS returns at once.
+	sqsReceiveBatch = 10
+	// sqsWaitSeconds is the long polling duration of a receive.
+	sqsWaitSeconds = 20
+)
+
+// snsSink publishes on an SNS topic.
+type snsSink struct {
+	client   *sns.Client
+	topicARN string
+}
+
+// sqsQueue sends to and receives from an SQS queue.
+type sqsQueue struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+// newSNSSink opens awssns:///arn:aws:sns:<region>:<account>:<topic>.
+func newSNSSink(ctx context.Context, u *url.URL) (*snsSink, error) {
+	arn := strings.TrimPrefix(u.Path, "/")
+	parts := strings.Split(arn, ":")
+	if len(parts) != 6 || parts[2] != "sns" {
+		return nil, errors.New("expected awssns:///arn:aws:sns:<region>:<account>:<topic>")
+	}
+	cfg, err := awsConfig(ctx, u, parts[3])
+	if err != nil {
+		return nil, err
+	}
+	return &snsSink{client: sns.NewFromConfig(cfg), topicARN: arn}, nil
+}
+
+// newSQSQueue opens awssqs://sqs.<region>.amazonaws.com/<account>/<queue>.
+func newSQSQueue(ctx context.Context, u *url.URL) (*sqsQueue, error) {
+	if u.Host == "" || strings.Count(strings.Trim(u.Path, "/"), "/") != 1 {
+		return nil, errors.New("expected awssqs://sqs.<region>.amazonaws.com/<account>/<queue>")
+	}
+	region := ""
+	if hostParts := strings.Split(u.Host, "."); len(hostParts) > 2 && hostParts[0] == "sqs" {
+		region = hostParts[1]
+	}
+	cfg, err := awsConfig(ctx, u, region)
+	if err != nil {
+		return nil, err
+	}
+	return &sqsQueue{client: sqs.NewFromConfig(cfg), queueURL: "https://" + u.Host + u.Path}, nil
+}
+
+// awsConfig loads the default credential chain, in the region of the
+// "region" URL parameter, or of the resource, or of the environment.
+func awsConfig(ctx context.Context, u *url.URL, resourceRegion string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region := u.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	} else if resourceRegion != "" {
+		opts = append(opts, config.WithRegion(resourceRegion))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("AWS configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// Send publishes m on the topic.
+func (s *snsSink) Send(ctx context.Context, m *nats.Msg) error {
+	body, attrs, err := awsMessage(m)
+	if err != nil {
+		return err
+	}
+	in := &sns.PublishInput{TopicArn: &s.topicARN, Message: &body, MessageAttributes: make(map[string]snstypes.MessageAttributeValue)}
+	for k, v := range attrs {
+		in.MessageAttributes[k] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	_, err = s.client.Publish(ctx, in)
+	return err
+}
+
+// Send sends m to the queue.
+func (q *sqsQueue) Send(ctx context.Context, m *nats.Msg) error {
+	body, attrs, err := awsMessage(m)
+	if err != nil {
+		return err
+	}
+	in := &sqs.SendMessageInput{QueueUrl: &q.queueURL, MessageBody: &body, MessageAttributes: make(map[string]sqstypes.MessageAttributeValue)}
+	for k, v := range attrs {
+		in.MessageAttributes[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	_, err = q.client.SendMessage(ctx, in)
+	return err
+}
+
+// Receive long-polls the queue for the next messages.
+func (q *sqsQueue) Receive(ctx context.Context) ([]sourceMessage, error) {
+	out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              &q.queueURL,
+		MaxNumberOfMessages:   sqsReceiveBatch,
+		WaitTimeSeconds:       sqsWaitSeconds,
+		MessageAttributeNames: []string{"All"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]sourceMessage, 0, len(out.Messages))
+	for _, sm := range out.Messages {
+		body := aws.ToString(sm.Body)
+		attrs := make(map[string]string)
+		for k, v := range sm.MessageAttributes {
+			attrs[k] = aws.ToString(v.StringValue)
+		}
+		body = unwrapSNSNotification(body, attrs)
+		receipt := sm.ReceiptHandle
+		msgs = append(msgs, sourceMessage{
+			Msg: natsMessage([]byte(body), attrs),
+			Ack: func(ctx context.Context) error {
+				_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: &q.queueURL, ReceiptHandle: receipt})
+				return err
+			},
+		})
+	}
+	return msgs, nil
+}
+
+// awsMessage returns the body and attributes of m for SNS/SQS: binary
+// content mode when it fits, structured mode (JSON envelope) otherwise.
+func awsMessage(m *nats.Msg) (string, map[string]string, error) {
+	attrs, data := messageAttributes(m), messageData(m)
+	if len(attrs) <= awsMaxAttributes && len(data) > 0 && utf8.Valid(data) {
+		return string(data), attrs, nil
+	}
+	if _, ok := decodeCloudEvent(m); !ok {
+		return "", nil, fmt.Errorf("%d header(s) and a %d bytes non UTF-8 or empty payload do not fit in an SNS/SQS message", len(attrs)-1, len(data))
+	}
+
+	envelope := make(map[string]any)
+	kept := map[string]string{natsSubjectAttribute: m.Subject}
+	for k, v := range attrs {
+		if name, ok := strings.CutPrefix(k, cePrefix); ok {
+			envelope[name] = v
+		}
+	}
+	switch {
+	case json.Valid(data):
+		envelope["data"] = json.RawMessage(data)
+	case utf8.Valid(data):
+		envelope["data"] = string(data)
+	default:
+		envelope["data_base64"] = data // []byte is base64 encoded
+	}
+	body, err := json.Marshal(envelope)
+	return string(body), kept, err
+}
+
+// unwrapSNSNotification returns the original message of an SNS
+// notification delivered to SQS without raw message delivery, adding its
+// attributes to attrs. Any other body is returned as is.
+func unwrapSNSNotification(body string, attrs map[string]string) string {
+	var n struct {
+		Type              string
+		TopicArn          string
+		Message           string
+		MessageAttributes map[string]struct{ Type, Value string }
+	}
+	if json.Unmarshal([]byte(body), &n) != nil || n.Type != "Notification" || n.TopicArn == "" {
+		return body
+	}
+	for k, v := range n.MessageAttributes {
+		attrs[k] = v.Value
+	}
+	return n.Message
+}
@@ -0,0 +1,130 @@
+// connector_gcp.go — Google Cloud Pub/Sub sink and source of the "connector" mode.
+//
+// The Pub/Sub REST API is used directly (publish, pull, acknowledge): it
+// only needs an HTTP client carrying the Application Default Credentials,
+// instead of the whole gRPC client library.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// gcpPubSubScope is the OAuth2 scope of the Pub/Sub API.
+	gcpPubSubScope = "https://www.googleapis.com/auth/pubsub"
+	// gcpPullBatch is the maximum number of messages of one pull.
+	gcpPullBatch = 100
+)
+
+// gcpPubSub is a Pub/Sub topic (sink) or subscription (source).
+type gcpPubSub struct {
+	client   *http.Client
+	base     string // https://pubsub.googleapis.com/v1/projects/<p>/<kind>/<name>
+	resource string
+}
+
+// gcpMessage is a PubsubMessage of the REST API.
+type gcpMessage struct {
+	Data        []byte            `json:"data,omitempty"` // base64 in JSON
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	MessageID   string            `json:"messageId,omitempty"`
+	PublishTime string            `json:"publishTime,omitempty"`
+}
+
+// newGCPPubSub opens gcppubsub://projects/<project>/<kind>/<name>.
+func newGCPPubSub(ctx context.Context, u *url.URL, kind string) (*gcpPubSub, error) {
+	resource := u.Host + u.Path
+	parts := strings.Split(resource, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != kind {
+		return nil, fmt.Errorf("expected gcppubsub://projects/<project>/%s/<name>", kind)
+	}
+
+	g := &gcpPubSub{resource: resource}
+	if emulator := os.Getenv("PUBSUB_EMULATOR_HOST"); emulator != "" {
+		g.client, g.base = http.DefaultClient, "http://"+emulator+"/v1/"+resource
+		return g, nil
+	}
+	client, err := google.DefaultClient(ctx, gcpPubSubScope)
+	if err != nil {
+		return nil, fmt.Errorf("application default credentials: %w", err)
+	}
+	g.client, g.base = client, "https://pubsub.googleapis.com/v1/"+resource
+	return g, nil
+}
+
+// Send publishes m on the topic.
+func (g *gcpPubSub) Send(ctx context.Context, m *nats.Msg) error {
+	req := struct {
+		Messages []gcpMessage `json:"messages"`
+	}{[]gcpMessage{{Data: messageData(m), Attributes: messageAttributes(m)}}}
+	return g.call(ctx, "publish", req, nil)
+}
+
+// Receive pulls the next messages of the subscription.
+func (g *gcpPubSub) Receive(ctx context.Context) ([]sourceMessage, error) {
+	var resp struct {
+		ReceivedMessages []struct {
+			AckID   string     `json:"ackId"`
+			Message gcpMessage `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := g.call(ctx, "pull", map[string]int{"maxMessages": gcpPullBatch}, &resp); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]sourceMessage, 0, len(resp.ReceivedMessages))
+	for _, rm := range resp.ReceivedMessages {
+		attrs := rm.Message.Attributes
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		if attrs[cePrefix+"type"] != "" && attrs[cePrefix+"id"] == "" {
+			attrs[cePrefix+"id"] = rm.Message.MessageID
+		}
+		ackID := rm.AckID
+		msgs = append(msgs, sourceMessage{
+			Msg: natsMessage(rm.Message.Data, attrs),
+			Ack: func(ctx context.Context) error {
+				return g.call(ctx, "acknowledge", map[string][]string{"ackIds": {ackID}}, nil)
+			},
+		})
+	}
+	return msgs, nil
+}
+
+// call invokes the REST method (":publish", ":pull", …) of the resource.
+func (g *gcpPubSub) call(ctx context.Context, method string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.base+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, g.resource, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,220 @@
+// control.go — Runtime control of the "sub" mode: pause, resume, rate limit.
+//
+// CONTROL SUBJECT:
+//
+//	A subscriber flooding a downstream under repair, or one that must
+//	wait for a migration, is usually stopped, losing its place in the
+//	queue group, its caches and its warm connections. Instead, every "sub"
+//	instance listens for commands on its own control subject:
+//
+//	  _ctl.natsPubSub.<name>        (<name> as in the heartbeats, see -name)
+//
+//	and answers each request with the outcome:
+//
+//	  natsctl req _ctl.natsPubSub.orders-audit pause
+//	  natsctl req _ctl.natsPubSub.orders-audit resume
+//	  natsctl req _ctl.natsPubSub.orders-audit "set-rate 50"    # messages/s, 0 = unlimited
+//	  natsctl req _ctl.natsPubSub.orders-audit dump-stats       # JSON, with the metrics by event type (see slo.go)
+//
+//	_ctl.natsPubSub.all reaches every instance at once, collect all the
+//	answers with the "request" mode:
+//
+//	  go run . -mode request -subject _ctl.natsPubSub.all -msg pause -max-replies 0
+//
+// WHAT PAUSE MEANS:
+//
+//	While paused, no message is handled. A durable pull consumer stops
+//	pulling and its messages wait in the stream. A push consumer receives
+//	up to -max-ack-pending messages, which are delivered again after their
+//	ack wait. A plain subscription keeps receiving: the messages pile up in
+//	the client buffer, and beyond its limits they are dropped (slow
+//	consumer), so keep the pauses of core NATS subscribers short.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/heartbeat"
+)
+
+const (
+	// controlSubjectPrefix is the prefix of the control subjects.
+	controlSubjectPrefix = "_ctl"
+	// controlAllInstances is the name addressing every instance.
+	controlAllInstances = "all"
+)
+
+// flowControl gates the handling of the messages: paused or rate limited.
+// The zero value lets every message through; it is safe for concurrent use.
+type flowControl struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed on resume
+	rate    float64       // messages per second, 0 for no limit
+	next    time.Time     // earliest start of the next message under the rate
+}
+
+// wait blocks while the flow is paused, then until the rate allows one
+// more message. It returns false when ctx is done first.
+func (f *flowControl) wait(ctx context.Context) bool {
+	for {
+		if !f.waitResumed(ctx) {
+			return false
+		}
+		f.mu.Lock()
+		if f.paused {
+			f.mu.Unlock()
+			continue // paused again in between
+		}
+		var delay time.Duration
+		if f.rate > 0 {
+			now := time.Now()
+			start := now
+			if f.next.After(now) {
+				start = f.next
+			}
+			f.next = start.Add(time.Duration(float64(time.Second) / f.rate))
+			delay = start.Sub(now)
+		}
+		f.mu.Unlock()
+		if delay > 0 {
+			sleepCtx(ctx, delay)
+		}
+		return ctx.Err() == nil
+	}
+}
+
+// waitResumed blocks while the flow is paused. It returns false when ctx
+// is done first.
+func (f *flowControl) waitResumed(ctx context.Context) bool {
+	for {
+		f.mu.Lock()
+		paused, resumed := f.paused, f.resumed
+		f.mu.Unlock()
+		if !paused {
+			return ctx.Err() == nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// pause stops the handling of the messages until resume.
+func (f *flowControl) pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.paused {
+		f.paused, f.resumed = true, make(chan struct{})
+	}
+}
+
+// resume lets the messages through again.
+func (f *flowControl) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused {
+		f.paused = false
+		close(f.resumed)
+	}
+}
+
+// setRate limits the handling to rate messages per second, 0 for no limit.
+func (f *flowControl) setRate(rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rate, f.next = rate, time.Time{}
+}
+
+// state returns whether the flow is paused and its rate.
+func (f *flowControl) state() (paused bool, rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused, f.rate
+}
+
+// controlSubject returns the control subject of the instance name.
+func controlSubject(name string) string {
+	return fmt.Sprintf("%s.%s.%s", controlSubjectPrefix, APP, heartbeat.Token(name))
+}
+
+// startControl answers the commands sent on the control subject of the
+// instance name, until the returned function is called.
+func startControl(nc *nats.Conn, l *log.Logger, name string, flow *flowControl) (stop func()) {
+	handler := func(m *nats.Msg) {
+		reply := runControlCommand(l, flow, strings.TrimSpace(string(m.Data)))
+		if m.Reply != "" {
+			_ = m.Respond([]byte(reply))
+		}
+	}
+	var subs []*nats.Subscription
+	for _, subject := range []string{controlSubject(name), controlSubject(controlAllInstances)} {
+		sub, err := nc.Subscribe(subject, handler)
+		if err != nil {
+			l.Printf("⚠️  Failed to subscribe to the control subject %q: %v", subject, err)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	l.Printf("🎛️  Listening for pause, resume, set-rate and dump-stats on %q", controlSubject(name))
+	return func() {
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
+	}
+}
+
+// runControlCommand applies a control command and returns the answer.
+func runControlCommand(l *log.Logger, flow *flowControl, command string) string {
+	verb, arg, _ := strings.Cut(command, " ")
+	switch strings.ToLower(verb) {
+	case "pause":
+		flow.pause()
+		l.Printf("⏸️  Paused by the control subject")
+		return "paused"
+	case "resume":
+		flow.resume()
+		l.Printf("▶️  Resumed by the control subject")
+		return "resumed"
+	case "set-rate":
+		rate, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil || rate < 0 {
+			return fmt.Sprintf("error: set-rate expects messages per second (0 for no limit), got %q", arg)
+		}
+		flow.setRate(rate)
+		l.Printf("🚦 Rate set to %g msg/s by the control subject (0 = unlimited)", rate)
+		return fmt.Sprintf("rate %g msg/s", rate)
+	case "dump-stats":
+		paused, rate := flow.state()
+		resultMu.Lock()
+		stats := map[string]any{
+			"paused":      paused,
+			"rate":        rate,
+			"received":    result.Received,
+			"published":   result.Published,
+			"quarantined": result.Quarantined,
+			"started_at":  result.StartedAt,
+			"uptime":      time.Since(result.StartedAt).Round(time.Second).String(),
+		}
+		resultMu.Unlock()
+		stats["events"] = events.stats()
+		if slos := events.sloStats(); len(slos) > 0 {
+			stats["slo"] = slos
+		}
+		data, _ := json.Marshal(stats)
+		return string(data)
+	default:
+		return fmt.Sprintf("error: unknown command %q, expected pause, resume, set-rate <msg/s> or dump-stats", command)
+	}
+}
@@ -0,0 +1,236 @@
+// credentials.go — Credentials and TLS material that survive rotation.
+//
+// CREDENTIAL ROTATION:
+//
+//	In production, creds files and TLS certificates are short-lived: they
+//	are renewed by tools like cert-manager, Vault or a Kubernetes secret
+//	update while the subscriber keeps running. A long-running client must
+//	pick up the new material without being restarted.
+//
+//	The nats.go client already re-reads the creds file (nats.UserCredentials)
+//	and, with nats.ClientTLSConfig, calls our loaders on EVERY (re)connect.
+//	So rotating is only a matter of forcing a reconnect once the files have
+//	changed: the subscriptions are restored automatically by the client and
+//	messages published meanwhile are kept in the reconnect buffer.
+//
+// AVOIDING RECONNECT STORMS:
+//
+//	When a secret is rotated, hundreds of replicas see the change at the
+//	same moment. If they all reconnect at once the server is hit by a burst
+//	of TLS handshakes and JWT verifications. Each client therefore waits a
+//	random delay (-reload-jitter) before reconnecting, and validates the new
+//	files first, so a half-written file never kicks a healthy connection.
+//
+// EVERY CONNECTION:
+//
+//	The main connection is not the only one using the files: the DR one
+//	after a failover (see failover.go) and the ones the modes open, like
+//	the connection of "edge" to its local server, are in a connSet, and
+//	all of them are re-authenticated together.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// defaultReloadInterval is how often the credential files are checked for changes.
+	defaultReloadInterval = 10 * time.Second
+	// defaultReloadJitter is the maximum random delay before re-authenticating.
+	defaultReloadJitter = 5 * time.Second
+)
+
+// tlsOptions returns the connection options enabling TLS with certificate
+// files that are loaded again on each (re)connect. It returns nil when no
+// TLS file is configured.
+func tlsOptions(certFile, keyFile, caFile string) []nats.Option {
+	if certFile == "" && caFile == "" {
+		return nil
+	}
+	var certCB nats.TLSCertHandler
+	if certFile != "" {
+		certCB = func() (tls.Certificate, error) {
+			return tls.LoadX509KeyPair(certFile, keyFile)
+		}
+	}
+	var rootCAsCB nats.RootCAsHandler
+	if caFile != "" {
+		rootCAsCB = func() (*x509.CertPool, error) {
+			return loadCertPool(caFile)
+		}
+	}
+	return []nats.Option{nats.ClientTLSConfig(certCB, rootCAsCB)}
+}
+
+// loadCertPool reads the PEM encoded CA certificates in caFile.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// validateCredentials checks that the rotated files are complete and usable
+// before we drop a working connection for them.
+func validateCredentials(credsFile, certFile, keyFile, caFile string) error {
+	if credsFile != "" {
+		content, err := os.ReadFile(credsFile)
+		if err != nil {
+			return err
+		}
+		if _, err := nkeys.ParseDecoratedJWT(content); err != nil {
+			return fmt.Errorf("invalid user JWT in %s: %w", credsFile, err)
+		}
+		if _, err := nkeys.ParseDecoratedNKey(content); err != nil {
+			return fmt.Errorf("invalid seed in %s: %w", credsFile, err)
+		}
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	if caFile != "" {
+		if _, err := loadCertPool(caFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connSet is the set of the connections using the credential files.
+type connSet struct {
+	mu      sync.Mutex
+	sources []func() []*nats.Conn
+}
+
+// add registers the connections returned by conns, called at every
+// re-authentication: a failover gives its current connections.
+func (s *connSet) add(conns func() []*nats.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append(s.sources, conns)
+}
+
+// open returns the connections of the set not closed.
+func (s *connSet) open() []*nats.Conn {
+	s.mu.Lock()
+	sources := slices.Clone(s.sources)
+	s.mu.Unlock()
+	var conns []*nats.Conn
+	for _, source := range sources {
+		for _, nc := range source() {
+			if nc != nil && !nc.IsClosed() && !slices.Contains(conns, nc) {
+				conns = append(conns, nc)
+			}
+		}
+	}
+	return conns
+}
+
+// watchCredentials re-authenticates the connections of conns when one of
+// the files changes on disk (checked every interval, 0 disables polling)
+// or when SIGHUP is received. The validate function is called before
+// reconnecting. Call the returned function to stop watching.
+//
+// KEY CONCEPT — ForceReconnect:
+//
+//	nc.ForceReconnect closes the TCP connection and lets the client go
+//	through its normal reconnect logic, which calls the credential and TLS
+//	callbacks again. Unlike Close + Connect, the *nats.Conn, its
+//	subscriptions and its handlers all stay valid.
+func watchCredentials(conns *connSet, l *log.Logger, interval, maxJitter time.Duration, validate func() error, files ...string) (stop func()) {
+	var watched []string
+	for _, f := range files {
+		if f != "" {
+			watched = append(watched, f)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 && len(watched) > 0 {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			tick = t.C
+		}
+		last := fingerprint(watched)
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				l.Println("🔑 SIGHUP received — re-authenticating with fresh credentials")
+			case <-tick:
+				current := fingerprint(watched)
+				if current == last {
+					continue
+				}
+				last = current
+				l.Println("🔑 Credential files changed on disk — re-authenticating")
+			}
+
+			if maxJitter > 0 {
+				delay := rand.N(maxJitter)
+				l.Printf("⏳ Waiting %v before reconnecting (jitter avoids reconnect storms)", delay.Round(time.Millisecond))
+				select {
+				case <-done:
+					return
+				case <-time.After(delay):
+				}
+			}
+			if err := validate(); err != nil {
+				l.Printf("⚠️  New credentials are not usable, keeping current connection: %v", err)
+				continue
+			}
+			for _, nc := range conns.open() {
+				if err := nc.ForceReconnect(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+					l.Printf("⚠️  Error forcing reconnect (%s): %v", nc.ConnectedUrlRedacted(), err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
+// fingerprint summarizes the size and modification time of the files, any
+// change (including a Kubernetes secret symlink swap) changes the result.
+func fingerprint(files []string) string {
+	var sb strings.Builder
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&sb, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&sb, "%s:missing;", f)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,255 @@
+// deploy.go — Render Kubernetes manifests for the long-running modes.
+//
+// FROM LOCAL DEMO TO CLUSTER:
+//
+//	The flags you use locally are exactly what the container needs, so the
+//	"deploy manifest" sub-command turns them into Kubernetes YAML, without
+//	Helm or any templating tool:
+//
+//	  natsPubSub deploy manifest -name orders-sub -image ghcr.io/me/natspubsub:0.1.0 \
+//	    -- -mode sub -subject "orders.>" -url nats://nats.nats.svc:4222 | kubectl apply -f -
+//
+//	It renders:
+//	  - a Deployment running this binary with the given flags, reading
+//	    NATS_USER/NATS_PASSWORD from a Secret (kubectl create secret generic
+//	    <name>-nats --from-env-file=.env);
+//	  - a ConfigMap with the files of -config-dir (e.g. the stream specs of the
+//	    "reconcile" mode), mounted read-only in /etc/<name>;
+//	  - a Service, only when the component listens on a -port.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// cmdDeploy is the first argument selecting the deploy sub-command.
+	cmdDeploy = "deploy"
+)
+
+// drainGraceMargin is the time the pod is given after its -drain-timeout
+// before being killed.
+const drainGraceMargin = 15 * time.Second
+
+// manifestData holds everything the manifest template needs.
+type manifestData struct {
+	Name      string
+	Namespace string
+	Image     string
+	Replicas  int
+	Secret    string
+	Port      int
+	Args      []string
+	MountPath string
+	Files     map[string]string
+	Version   string
+	// GracePeriod outlasts the -drain-timeout of the component, in seconds.
+	GracePeriod int
+}
+
+// manifestTemplate renders the Kubernetes resources, strings go through the
+// q function (JSON quoting, a valid YAML scalar).
+var manifestTemplate = template.Must(template.New("manifest").Funcs(template.FuncMap{
+	"q": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	},
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+	},
+}).Parse(`# generated by natsPubSub {{.Version}} — natsPubSub deploy manifest
+{{- if .Files}}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{q (print .Name "-config")}}
+  namespace: {{q .Namespace}}
+  labels:
+    app.kubernetes.io/name: {{q .Name}}
+data:
+{{- range $file, $content := .Files}}
+  {{q $file}}: |
+{{indent 4 $content}}
+{{- end}}
+{{- end}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{q .Name}}
+  namespace: {{q .Namespace}}
+  labels:
+    app.kubernetes.io/name: {{q .Name}}
+    app.kubernetes.io/part-of: "natsPubSub"
+spec:
+  replicas: {{.Replicas}}
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: {{q .Name}}
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: {{q .Name}}
+    spec:
+      # SIGTERM drains the connection (see drain.go), leave it time to finish in-flight messages
+      terminationGracePeriodSeconds: {{.GracePeriod}}
+      containers:
+        - name: {{q .Name}}
+          image: {{q .Image}}
+          args:
+{{- range .Args}}
+            - {{q .}}
+{{- end}}
+          envFrom:
+            - secretRef:
+                name: {{q .Secret}}
+{{- if .Port}}
+          ports:
+            - name: "http"
+              containerPort: {{.Port}}
+{{- end}}
+          resources:
+            requests:
+              cpu: "50m"
+              memory: "32Mi"
+            limits:
+              memory: "128Mi"
+{{- if .Files}}
+          volumeMounts:
+            - name: "config"
+              mountPath: {{q .MountPath}}
+              readOnly: true
+      volumes:
+        - name: "config"
+          configMap:
+            name: {{q (print .Name "-config")}}
+{{- end}}
+{{- if .Port}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{q .Name}}
+  namespace: {{q .Namespace}}
+  labels:
+    app.kubernetes.io/name: {{q .Name}}
+spec:
+  selector:
+    app.kubernetes.io/name: {{q .Name}}
+  ports:
+    - name: "http"
+      port: {{.Port}}
+      targetPort: "http"
+{{- end}}
+`))
+
+// deployCommand handles "natsPubSub deploy manifest [flags] [-- run flags]".
+func deployCommand(args []string) {
+	result.Mode = cmdDeploy
+	fs := flag.NewFlagSet(cmdDeploy+" manifest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s manifest [flags] -- <run flags>\n", APP, cmdDeploy)
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", strings.ToLower(APP), "Name of the Kubernetes resources (must be a DNS label)")
+	namespace := fs.String("namespace", "default", "Kubernetes namespace")
+	image := fs.String("image", "", "Container image running this binary — required")
+	replicas := fs.Int("replicas", 1, "Number of pods (subscribers can scale with a queue group)")
+	secret := fs.String("secret", "", "Secret holding NATS_USER/NATS_PASSWORD (default <name>-nats)")
+	port := fs.Int("port", 0, "Port the component listens on, renders a Service when > 0")
+	configDir := fs.String("config-dir", "", "Directory whose files are shipped in a ConfigMap mounted in /etc/<name>")
+	resultFlag(fs)
+	if len(args) < 1 || args[0] != "manifest" {
+		commandUsageError(fs, `the only deploy sub-command is "manifest"`)
+	}
+	_ = fs.Parse(args[1:])
+
+	runArgs := fs.Args()
+	switch {
+	case *image == "" || len(runArgs) == 0:
+		commandUsageError(fs, "-image and the flags of the component after -- are required")
+	case resultFile == "-":
+		commandUsageError(fs, "-result-json - is not supported: stdout carries the manifest")
+	}
+	l := log.New(os.Stderr, "", 0)
+	if *secret == "" {
+		*secret = *name + "-nats"
+	}
+
+	data := manifestData{
+		Name:        *name,
+		Namespace:   *namespace,
+		Image:       *image,
+		Replicas:    *replicas,
+		Secret:      *secret,
+		Port:        *port,
+		Args:        runArgs,
+		MountPath:   "/etc/" + *name,
+		Version:     VERSION,
+		GracePeriod: int((drainTimeoutOf(runArgs) + drainGraceMargin).Seconds()),
+	}
+	if *configDir != "" {
+		files, err := readConfigDir(*configDir)
+		if err != nil {
+			fail(l, exitUsage, "failed to read %s: %v", *configDir, err)
+		}
+		data.Files = files
+		fmt.Fprintf(os.Stderr, "ℹ️  files of %s are mounted in %s, e.g. use -specs %s in the component flags\n",
+			*configDir, data.MountPath, data.MountPath)
+	}
+
+	if err := manifestTemplate.Execute(os.Stdout, data); err != nil {
+		fail(l, exitFailure, "failed to render manifest: %v", err)
+	}
+	writeResult(exitOK, nil)
+}
+
+// readConfigDir returns the regular files of dir, keyed by file name.
+func readConfigDir(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name()] = string(content)
+	}
+	return files, nil
+}
+
+// drainTimeoutOf returns the -drain-timeout given in the flags of the
+// component, nats.DefaultDrainTimeout when absent or invalid.
+func drainTimeoutOf(runArgs []string) time.Duration {
+	for i, arg := range runArgs {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "drain-timeout" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !hasValue && i+1 < len(runArgs) {
+			value = runArgs[i+1]
+		}
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+	}
+	return nats.DefaultDrainTimeout
+}
@@ -0,0 +1,63 @@
+// drain.go — Two-phase shutdown: drain on the first signal, force on the second.
+//
+// ROLLING RESTARTS:
+//
+//	Kubernetes stops a pod with a SIGTERM, waits its grace period (30s by
+//	default) and then kills it. Closing the connection at once would lose
+//	the messages being handled and those still buffered by the client
+//	library (a Publish only queues the message, see publish). Draining
+//	does it in order instead:
+//
+//	  1. the subscriptions stop receiving, the messages already delivered
+//	     are handled to the end (and acknowledged);
+//	  2. the pending publishes, the replies and acks included, are flushed
+//	     to the server;
+//	  3. the connection is closed.
+//
+//	The drain is bounded by -drain-timeout (nats.DrainTimeout), keep it
+//	below the grace period. A second SIGINT/SIGTERM during the drain
+//	closes the connection at once: a Ctrl+C that seems stuck is forced
+//	with another one.
+//
+//	  spec:
+//	    terminationGracePeriodSeconds: 45   # > -drain-timeout 30s
+package main
+
+import (
+	"log"
+	"os/signal"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// drainPoll is how often the end of a drain is checked.
+const drainPoll = 50 * time.Millisecond
+
+// drainConn drains nc and waits until it is closed: at the end of the
+// drain, after the -drain-timeout, or at once on a second stop signal.
+func drainConn(l *log.Logger, nc *nats.Conn) {
+	if nc == nil || nc.IsClosed() {
+		return
+	}
+	sigCh := stopSignals()
+	defer signal.Stop(sigCh)
+	if !nc.IsDraining() {
+		l.Printf("🚰 Draining the connection (up to %v, signal again to force) …", nc.Opts.DrainTimeout)
+		if err := nc.Drain(); err != nil {
+			l.Printf("⚠️  Error during drain, closing: %v", err)
+			nc.Close()
+			return
+		}
+	}
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for !nc.IsClosed() {
+		select {
+		case sig := <-sigCh:
+			l.Printf("⚡ Received signal %v again — closing without waiting for the drain", sig)
+			nc.Close()
+		case <-tick.C:
+		}
+	}
+}
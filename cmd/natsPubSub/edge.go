@@ -0,0 +1,201 @@
+// edge.go — Store-and-forward edge agent (leafnode + local JetStream).
+//
+// EDGE TOPOLOGY:
+//
+//	In IoT and retail deployments the devices talk to a small NATS server
+//	running next to them (often configured as a leafnode of the central
+//	"hub" cluster). The uplink between the edge and the hub is unreliable:
+//	it can disappear for minutes or hours. Events produced during an
+//	outage must not be lost.
+//
+//	                 ┌──────────── edge site ────────────┐
+//	  devices ──pub──► local nats-server (JetStream)     │        hub
+//	                 │   stream EDGE_BUFFER  ◄── edge ───┼──pub──► nats://hub:4222
+//	                 └───────────────────────────────────┘
+//
+// STORE-AND-FORWARD:
+//
+//	The agent makes sure a local JetStream stream captures the edge subject,
+//	so every event is persisted on the edge disk first, whatever the state
+//	of the uplink. A durable pull consumer then forwards the buffered events
+//	to the hub and acknowledges them locally ONLY after the hub accepted
+//	them. While the uplink is down the agent simply stops fetching and the
+//	events pile up in the stream; when connectivity returns the backlog is
+//	drained in order.
+//
+//	The stream uses the WorkQueue retention policy, so acknowledged events
+//	are removed from the edge disk once forwarded.
+//
+// DUPLICATES:
+//
+//	If the agent crashes between "hub accepted" and "local ack", the event
+//	is forwarded again. Each forwarded message carries a Nats-Msg-Id header
+//	derived from the edge stream sequence, so a JetStream stream on the hub
+//	side deduplicates those retries within its duplicate window.
+//
+//	Note: if the edge server is a leafnode of the hub and the edge subject is
+//	also shared over the leafnode connection, the hub will see the events
+//	twice. Keep the edge subject local (e.g. through leafnode permissions)
+//	and let this agent be the only path to the hub.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// defaultEdgeURL is where the local leafnode usually listens, next to a hub on 4222.
+	defaultEdgeURL = "nats://127.0.0.1:4223"
+	// defaultEdgeStream is the local JetStream stream used as the on-disk buffer.
+	defaultEdgeStream = "EDGE_BUFFER"
+	// edgeConsumer is the durable consumer name tracking what was already forwarded.
+	edgeConsumer = "edge-forwarder"
+	// edgeBatchSize is the maximum number of events forwarded per fetch.
+	edgeBatchSize = 100
+	// edgeRetryDelay is how long we wait before retrying when the uplink is down.
+	edgeRetryDelay = 2 * time.Second
+	// edgeHubTimeout bounds the time the hub has to confirm a forwarded batch.
+	edgeHubTimeout = 5 * time.Second
+)
+
+// edge runs the store-and-forward agent until interrupted (Ctrl+C).
+//
+// KEY CONCEPT — Acknowledge only what the hub has accepted:
+//
+//	Each fetched event is published to the hub and the hub connection is
+//	flushed (a PING/PONG round trip) before the local message is acked.
+//	If anything fails, the event is Nak'ed with a delay and stays in the
+//	local stream, so nothing is lost while the uplink is down.
+func edge(hub *nats.Conn, l *log.Logger, subject, edgeURL, streamName string, creds *connSet, authOpts ...nats.Option) {
+	// Log every uplink state transition: this is what operators look at
+	// first when an edge site stops reporting.
+	hub.SetDisconnectErrHandler(func(_ *nats.Conn, err error) {
+		l.Printf("📴 Uplink to hub lost (%v) — buffering events locally in %q", err, streamName)
+	})
+	hub.SetReconnectHandler(func(c *nats.Conn) {
+		l.Printf("📶 Uplink to hub restored (%s) — forwarding buffered events", c.ConnectedUrl())
+	})
+
+	l.Printf("Connecting to local edge NATS server at %s …", edgeURL)
+	local, err := nats.Connect(edgeURL, append([]nats.Option{nats.Name(APP + "-edge")}, authOpts...)...)
+	if err != nil {
+		fail(l, exitConnection, "failed to connect to local edge NATS at %s: %v", edgeURL, err)
+	}
+	defer local.Close()
+	// Same credentials as the hub: rotated together (see credentials.go).
+	creds.add(func() []*nats.Conn { return []*nats.Conn{local} })
+
+	js, err := jetstream.New(local)
+	if err != nil {
+		fail(l, exitFailure, "failed to create JetStream context on edge server: %v", err)
+	}
+
+	// The context is cancelled on SIGINT/SIGTERM, which stops the forward loop.
+	ctx, stop := stopContext()
+	defer stop()
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        streamName,
+		Description: fmt.Sprintf("%s store-and-forward buffer for %q", APP, subject),
+		Subjects:    []string{subject},
+		Retention:   jetstream.WorkQueuePolicy,
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		fail(l, exitFailure, "failed to create edge buffer stream %q: %v", streamName, err)
+	}
+
+	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   edgeConsumer,
+		AckPolicy: jetstream.AckExplicitPolicy,
+		AckWait:   30 * time.Second,
+	})
+	if err != nil {
+		fail(l, exitFailure, "failed to create edge consumer %q: %v", edgeConsumer, err)
+	}
+
+	l.Printf("🛰️  Edge agent buffering %q in stream %q and forwarding to hub (Ctrl+C to quit) …", subject, streamName)
+	sdNotify("READY=1")
+
+	var forwarded uint64
+	for ctx.Err() == nil {
+		if !hub.IsConnected() {
+			sleepCtx(ctx, edgeRetryDelay)
+			continue
+		}
+
+		batch, err := cons.Fetch(edgeBatchSize, jetstream.FetchMaxWait(edgeRetryDelay))
+		if err != nil {
+			l.Printf("⚠️  Error fetching from edge buffer: %v", err)
+			sleepCtx(ctx, edgeRetryDelay)
+			continue
+		}
+
+		uplinkOK := true
+		for m := range batch.Messages() {
+			if !uplinkOK {
+				// The hub failed on a previous message of this batch, keep the
+				// rest in the buffer and preserve the original ordering.
+				_ = m.NakWithDelay(edgeRetryDelay)
+				continue
+			}
+			if err := forwardToHub(hub, streamName, m); err != nil {
+				l.Printf("⚠️  Could not forward event on %q to hub: %v", m.Subject(), err)
+				_ = m.NakWithDelay(edgeRetryDelay)
+				uplinkOK = false
+				continue
+			}
+			if err := m.Ack(); err != nil {
+				l.Printf("⚠️  Forwarded event on %q but local ack failed: %v", m.Subject(), err)
+				continue
+			}
+			forwarded++
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			l.Printf("⚠️  Edge buffer fetch ended with error: %v", err)
+		}
+	}
+
+	sdNotify("STOPPING=1")
+	l.Printf("🛑 Shutting down edge agent — %d event(s) forwarded to hub", forwarded)
+	if info, err := stream.Info(context.Background()); err == nil {
+		l.Printf("ℹ️  %d event(s) still buffered in %q", info.State.Msgs, streamName)
+	}
+	l.Println("👋 Bye!")
+}
+
+// forwardToHub republishes a buffered JetStream message on the hub connection
+// and waits until the hub has processed it.
+func forwardToHub(hub *nats.Conn, streamName string, m jetstream.Msg) error {
+	out := nats.NewMsg(m.Subject())
+	out.Data = m.Data()
+	for k, v := range m.Headers() {
+		out.Header[k] = v
+	}
+	if out.Header.Get(nats.MsgIdHdr) == "" {
+		if meta, err := m.Metadata(); err == nil {
+			out.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", streamName, meta.Sequence.Stream))
+		}
+	}
+	if err := hub.PublishMsg(out); err != nil {
+		return err
+	}
+	return hub.FlushTimeout(edgeHubTimeout)
+}
+
+// sleepCtx waits for d, or less if ctx is cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
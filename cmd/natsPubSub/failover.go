@@ -0,0 +1,253 @@
+// failover.go — Client-side failover between a primary and a DR cluster.
+//
+// MULTI-CLUSTER DEPLOYMENTS:
+//
+//	Inside ONE cluster, nats.go already handles failures: the -url flag can
+//	list several servers ("nats://a:4222,nats://b:4222") and the client
+//	reconnects to any surviving member. A whole-site outage is different:
+//	the client must move to another cluster, the disaster recovery (DR)
+//	one, which lives behind another set of URLs.
+//
+// STATE MACHINE:
+//
+//	  PRIMARY ──disconnect──► PRIMARY_DOWN ──still down after -failover-after──► DR
+//	     ▲                        │                                             │
+//	     └────reconnected─────────┘◄──────────── primary reconnected ───────────┘
+//	                                               (failback)
+//
+//	A short blip (a server restart, a rolling upgrade) is absorbed by the
+//	normal reconnect logic and never triggers a failover: only a PROLONGED
+//	disconnection does. The primary connection keeps retrying in the
+//	background while we run on DR, and we fail back as soon as it succeeds.
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// defaultFailoverAfter is how long the primary may stay unreachable before failing over.
+	defaultFailoverAfter = 30 * time.Second
+
+	statePrimary     = "PRIMARY"
+	statePrimaryDown = "PRIMARY_DOWN"
+	stateDR          = "DR"
+)
+
+// clusterFailover keeps one active connection, to the primary cluster or to
+// the DR cluster, and notifies the registered callbacks when it switches.
+type clusterFailover struct {
+	l         *log.Logger
+	drURL     string
+	after     time.Duration
+	opts      []nats.Option
+	primary   *nats.Conn
+	mu        sync.Mutex
+	dr        *nats.Conn
+	active    *nats.Conn
+	state     string
+	since     time.Time
+	timer     *time.Timer
+	onSwitch  []func(from, to *nats.Conn)
+	failovers int
+	failbacks int
+	timeOnDR  time.Duration
+	drStart   time.Time
+}
+
+// connectWithFailover connects to the primary cluster, or to the DR cluster
+// when the primary cannot be reached within after.
+func connectWithFailover(l *log.Logger, primaryURL, drURL string, after time.Duration, opts []nats.Option) (*clusterFailover, error) {
+	f := &clusterFailover{l: l, drURL: drURL, after: after, opts: opts, since: time.Now()}
+
+	// The primary connection never gives up: it keeps reconnecting in the
+	// background, even while we are running on the DR cluster.
+	primaryOpts := append(append([]nats.Option{}, opts...),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(f.primaryDisconnected),
+		nats.ReconnectHandler(f.primaryReconnected),
+		// When the very first connection attempt failed, the client calls
+		// the connect handler (not the reconnect one) once it finally succeeds.
+		nats.ConnectHandler(f.primaryReconnected),
+	)
+	primary, err := nats.Connect(primaryURL, primaryOpts...)
+	if err != nil {
+		return nil, err
+	}
+	f.primary = primary
+
+	deadline := time.Now().Add(after)
+	for !primary.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if primary.IsConnected() {
+		f.active = primary
+		f.setState(statePrimary)
+		return f, nil
+	}
+
+	l.Printf("📴 Primary cluster %s unreachable for %v", primaryURL, after)
+	if err := f.connectDR(); err != nil {
+		primary.Close()
+		return nil, fmt.Errorf("primary unreachable and DR cluster failed: %w", err)
+	}
+	f.active = f.dr
+	f.failovers++
+	f.drStart = time.Now()
+	f.setState(stateDR)
+	return f, nil
+}
+
+// Conn returns the currently active connection.
+func (f *clusterFailover) Conn() *nats.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// Conns returns the open connections: the primary one, and the DR one
+// while it is connected.
+func (f *clusterFailover) Conns() []*nats.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dr == nil {
+		return []*nats.Conn{f.primary}
+	}
+	return []*nats.Conn{f.primary, f.dr}
+}
+
+// OnSwitch registers fn, called after each failover or failback with the
+// previous and the new active connection (e.g. to move a subscription).
+func (f *clusterFailover) OnSwitch(fn func(from, to *nats.Conn)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onSwitch = append(f.onSwitch, fn)
+}
+
+// Close closes both connections and logs the failover metrics.
+func (f *clusterFailover) Close() {
+	f.mu.Lock()
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	timeOnDR := f.timeOnDR
+	if f.state == stateDR {
+		timeOnDR += time.Since(f.drStart)
+	}
+	l, failovers, failbacks, dr := f.l, f.failovers, f.failbacks, f.dr
+	f.mu.Unlock()
+
+	l.Printf("📊 Failover metrics — failovers: %d, failbacks: %d, time on DR: %v", failovers, failbacks, timeOnDR.Round(time.Second))
+	if dr != nil {
+		dr.Close()
+	}
+	f.primary.Close()
+}
+
+// primaryDisconnected arms the failover timer when the active primary drops.
+func (f *clusterFailover) primaryDisconnected(_ *nats.Conn, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state != statePrimary {
+		return
+	}
+	f.l.Printf("📴 Primary cluster disconnected (%v), failing over to DR in %v unless it comes back", err, f.after)
+	f.setState(statePrimaryDown)
+	f.timer = time.AfterFunc(f.after, f.failover)
+}
+
+// failover switches to the DR cluster if the primary is still down.
+func (f *clusterFailover) failover() {
+	f.mu.Lock()
+	if f.state != statePrimaryDown || f.primary.IsConnected() {
+		f.mu.Unlock()
+		return
+	}
+	if err := f.connectDR(); err != nil {
+		f.l.Printf("💥 Failover to DR cluster %s failed: %v — retrying in %v", f.drURL, err, f.after)
+		f.timer = time.AfterFunc(f.after, f.failover)
+		f.mu.Unlock()
+		return
+	}
+	from := f.active
+	f.active = f.dr
+	f.failovers++
+	f.drStart = time.Now()
+	f.setState(stateDR)
+	callbacks := append([]func(from, to *nats.Conn){}, f.onSwitch...)
+	to := f.active
+	f.mu.Unlock()
+
+	f.l.Printf("🔀 FAILOVER primary → DR (%s)", to.ConnectedUrl())
+	for _, fn := range callbacks {
+		fn(from, to)
+	}
+}
+
+// primaryReconnected cancels a pending failover, or fails back from DR.
+func (f *clusterFailover) primaryReconnected(c *nats.Conn) {
+	f.mu.Lock()
+	switch f.state {
+	case statePrimaryDown:
+		f.timer.Stop()
+		f.setState(statePrimary)
+		f.mu.Unlock()
+		return
+	case stateDR:
+	default:
+		f.mu.Unlock()
+		return
+	}
+	from := f.active
+	f.active = f.primary
+	f.failbacks++
+	f.timeOnDR += time.Since(f.drStart)
+	f.dr = nil
+	f.setState(statePrimary)
+	callbacks := append([]func(from, to *nats.Conn){}, f.onSwitch...)
+	f.mu.Unlock()
+
+	f.l.Printf("🔀 FAILBACK DR → primary (%s)", c.ConnectedUrl())
+	for _, fn := range callbacks {
+		fn(from, c)
+	}
+	// Drain lets the DR subscriptions finish their in-flight messages.
+	go func() {
+		if err := from.Drain(); err != nil {
+			f.l.Printf("⚠️  Error draining DR connection: %v", err)
+		}
+	}()
+}
+
+// connectDR opens the DR connection if needed. Called with f.mu held.
+func (f *clusterFailover) connectDR() error {
+	if f.dr != nil && !f.dr.IsClosed() {
+		return nil
+	}
+	dr, err := nats.Connect(f.drURL, append(append([]nats.Option{}, f.opts...), nats.MaxReconnects(-1))...)
+	if err != nil {
+		return err
+	}
+	f.dr = dr
+	return nil
+}
+
+// setState logs the transition and the time spent in the previous state.
+// Called with f.mu held.
+func (f *clusterFailover) setState(state string) {
+	if f.state != "" {
+		f.l.Printf("🚦 Cluster state %s → %s (after %v)", f.state, state, time.Since(f.since).Round(time.Millisecond))
+	} else {
+		f.l.Printf("🚦 Cluster state %s", state)
+	}
+	f.state = state
+	f.since = time.Now()
+}
@@ -0,0 +1,272 @@
+// fallback.go — Degraded publishing when the server denies the subject.
+//
+// SILENT REFUSALS:
+//
+//	A publish on a subject the user may not publish on does not fail on
+//	the client side: the server drops the message and answers with an
+//	asynchronous "-ERR 'Permissions Violation for Publish to <subject>'".
+//	A multi-tenant publisher whose permissions were narrowed (tenant moved
+//	to another account, subjects renamed) would thus report success while
+//	losing every event. The "pub" mode waits for the answer of the server
+//	(Flush) and checks it, then degrades instead of losing the message:
+//
+//	  1. with -fallback-subject, the message is published there instead,
+//	     its original subject in a Denied-Subject header (e.g. a quarantine
+//	     subject the operators watch, or a tenant-neutral intake);
+//	  2. otherwise, or when the fallback subject is denied as well, the
+//	     message goes to the -spool, published again by the next run once
+//	     the permissions are fixed;
+//	  3. otherwise the program fails with the exit code 6.
+//
+//	  go run . -mode pub -subject tenants.acme.orders -msg '{}' -fallback-subject quarantine.orders -spool /var/spool/app
+//
+//	The violation is the one the ErrorHandler of the connection recorded
+//	for this publish, not LastError: that one stays set after a denial,
+//	and would make every later publish on the subject look denied.
+//
+// AUDIT EVENT:
+//
+//	Every denial is reported with a CloudEvent of type
+//	io.nats.app.publish.denied on _sys.app.audit.publish.denied, caused by
+//	the denied event (causationid), telling the subject, the error and
+//	what became of the message:
+//
+//	  {"type":"io.nats.app.publish.denied","source":"natsPubSub/host-1",…,
+//	   "data":{"subject":"tenants.acme.orders","error":"…","fallback_subject":"quarantine.orders"}}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// deniedSubjectHeader carries the subject a fallback message was denied on.
+	deniedSubjectHeader = "Denied-Subject"
+	// deniedAuditSubject receives the audit events of the denied publishes.
+	deniedAuditSubject = "_sys.app.audit.publish.denied"
+	// deniedEventType is the CloudEvents type of these audit events.
+	deniedEventType = "io.nats.app.publish.denied"
+	// deniedAuditTimeout bounds the publication of an audit event.
+	deniedAuditTimeout = 2 * time.Second
+)
+
+// publishDenial is the data of a denied publish audit event.
+type publishDenial struct {
+	Subject         string `json:"subject"`
+	Error           string `json:"error"`
+	FallbackSubject string `json:"fallback_subject,omitempty"` // where the message was published instead
+	Spooled         bool   `json:"spooled,omitempty"`
+	Lost            bool   `json:"lost,omitempty"` // neither fallback subject nor spool took it
+}
+
+// ─── Violations reported by the server ────────────────────────────────
+
+const (
+	// deniedKept bounds the violations remembered for the publishes.
+	deniedKept = 256
+	// deniedHandlerWait bounds the wait for the ErrorHandler to record a
+	// violation the connection already reports.
+	deniedHandlerWait = time.Second
+)
+
+// publishDenials records the permissions violations that the server
+// reports asynchronously, through the ErrorHandler of the connections.
+type publishDenials struct {
+	mu    sync.Mutex
+	errs  []error       // the last deniedKept violations, oldest first
+	total int           // violations recorded since the start
+	added chan struct{} // closed when the next violation is recorded
+}
+
+// denials records the violations of every connection of the program.
+var denials = &publishDenials{added: make(chan struct{})}
+
+// errorHandler returns the nats.ErrorHandler of the connections: it logs
+// the asynchronous errors, as the default one does, and records the
+// permissions violations.
+func (d *publishDenials) errorHandler(l *log.Logger) nats.ErrHandler {
+	return func(_ *nats.Conn, sub *nats.Subscription, err error) {
+		if sub != nil {
+			l.Printf("⚠️  Asynchronous error on the subscription to %q: %v", sub.Subject, err)
+		} else {
+			l.Printf("⚠️  Asynchronous error: %v", err)
+		}
+		if errors.Is(err, nats.ErrPermissionViolation) {
+			d.record(err)
+		}
+	}
+}
+
+// record adds the violation err.
+func (d *publishDenials) record(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errs = append(d.errs, err)
+	if len(d.errs) > deniedKept {
+		d.errs = d.errs[len(d.errs)-deniedKept:]
+	}
+	d.total++
+	close(d.added)
+	d.added = make(chan struct{})
+}
+
+// waitFor waits until the violation err, already set as the LastError of
+// a connection, is recorded too: the ErrorHandler runs on another
+// goroutine, in the order of the errors. It reports whether it was.
+func (d *publishDenials) waitFor(err error) bool {
+	if !errors.Is(err, nats.ErrPermissionViolation) {
+		return true
+	}
+	timeout := time.After(deniedHandlerWait)
+	for {
+		d.mu.Lock()
+		found := false
+		for _, e := range d.errs {
+			if e == err {
+				found = true
+				break
+			}
+		}
+		added := d.added
+		d.mu.Unlock()
+		if found {
+			return true
+		}
+		select {
+		case <-added:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// publishCheck tells the publishes the server denied since it was taken.
+type publishCheck struct {
+	nc    *nats.Conn
+	total int // violations recorded when taken
+}
+
+// checkPublishes returns the check of the publishes to come on nc, taken
+// before them.
+func checkPublishes(nc *nats.Conn) publishCheck {
+	// A violation already reported is not one of these publishes.
+	denials.waitFor(nc.LastError())
+	denials.mu.Lock()
+	defer denials.mu.Unlock()
+	return publishCheck{nc: nc, total: denials.total}
+}
+
+// denied returns the permissions violation of the server for a publish to
+// subject since the check was taken, once the connection was flushed; nil
+// when there was none.
+func (c publishCheck) denied(subject string) error {
+	last := c.nc.LastError()
+	recorded := denials.waitFor(last)
+	denials.mu.Lock()
+	since := denials.errs[max(len(denials.errs)-(denials.total-c.total), 0):]
+	for _, err := range since {
+		if deniedSubject(err, subject) {
+			denials.mu.Unlock()
+			return err
+		}
+	}
+	denials.mu.Unlock()
+	if !recorded && deniedSubject(last, subject) {
+		return last // no ErrorHandler on this connection
+	}
+	return nil
+}
+
+// deniedSubject reports whether err is the violation of a publish to subject.
+func deniedSubject(err error, subject string) bool {
+	return errors.Is(err, nats.ErrPermissionViolation) &&
+		strings.Contains(strings.ToLower(err.Error()), strings.ToLower(fmt.Sprintf("publish to %q", subject)))
+}
+
+// publishFallback handles the message m denied by the server: published on
+// fallbackSubject, else kept in the spool sp, else the program fails. The
+// denial is reported by an audit event in every case.
+func publishFallback(nc *nats.Conn, l *log.Logger, m *nats.Msg, denied error, fallbackSubject string, sp *spool) {
+	l.Printf("🚫 Publish to %q denied by the server: %v", m.Subject, denied)
+	countDenied()
+	d := publishDenial{Subject: m.Subject, Error: denied.Error()}
+
+	if fallbackSubject != "" {
+		fb := &nats.Msg{Subject: fallbackSubject, Header: nats.Header{}, Data: m.Data}
+		for k, values := range m.Header {
+			fb.Header[k] = values
+		}
+		fb.Header.Set(deniedSubjectHeader, m.Subject)
+		check := checkPublishes(nc)
+		err := nc.PublishMsg(fb)
+		if err == nil {
+			err = nc.Flush()
+		}
+		if err == nil {
+			err = check.denied(fallbackSubject)
+		}
+		if err == nil {
+			countPublished(len(fb.Data))
+			d.FallbackSubject = fallbackSubject
+			auditDenial(nc, l, m, d)
+			l.Printf("↪️  Message published on the fallback subject %q instead", fallbackSubject)
+			return
+		}
+		l.Printf("⚠️  Fallback subject %q failed as well: %v", fallbackSubject, err)
+	}
+
+	if sp != nil {
+		d.Spooled = true
+		auditDenial(nc, l, m, d)
+		spoolMessage(l, sp, m, denied)
+		return
+	}
+	d.Lost = true
+	auditDenial(nc, l, m, d)
+	fail(l, exitPublish, "publish to %q denied: %v", m.Subject, denied)
+}
+
+// auditDenial publishes the audit event of the denial d of m. Failing to
+// is only logged: the user may not be allowed to publish it either.
+func auditDenial(nc *nats.Conn, l *log.Logger, m *nats.Msg, d publishDenial) {
+	host, _ := os.Hostname()
+	attrs := map[string]string{
+		"specversion":     "1.0",
+		"type":            deniedEventType,
+		"source":          APP + "/" + host,
+		"time":            time.Now().UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+	}
+	inheritCausation(eventContext(context.Background(), m), attrs)
+	envelope := make(map[string]any, len(attrs)+1)
+	for name, value := range attrs {
+		envelope[name] = value
+	}
+	envelope["data"] = d
+	check := checkPublishes(nc)
+	data, err := json.Marshal(envelope)
+	if err == nil {
+		err = nc.Publish(deniedAuditSubject, data)
+	}
+	if err == nil {
+		err = nc.FlushTimeout(deniedAuditTimeout)
+	}
+	if err == nil {
+		err = check.denied(deniedAuditSubject)
+	}
+	if err != nil {
+		l.Printf("⚠️  Failed to publish the audit event on %q: %v", deniedAuditSubject, err)
+		return
+	}
+	l.Printf("📝 Denial reported on %q", deniedAuditSubject)
+}
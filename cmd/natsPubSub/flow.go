@@ -0,0 +1,199 @@
+// flow.go — Diagram of the event flows between services and subjects.
+//
+// WHO TALKS TO WHOM:
+//
+//	Publish/subscribe decouples the services so well that nobody knows the
+//	whole picture anymore: which service emits which event types, on which
+//	subjects, and who reacts to them. The "flow" mode observes -subject
+//	during -observe (or reads the events kept in -stream) and prints a
+//	Mermaid (default) or Graphviz diagram of the flows on stdout:
+//
+//	  go run . -mode flow -subject ">" -observe 10m > flows.mmd
+//	  go run . -mode flow -subject "orders.>" -stream ORDERS -diagram dot | dot -Tsvg > flows.svg
+//
+//	  /shop ──order.created ×120──► orders.created ┈┈order.created ×118┈┈► /billing
+//
+// HOW THE EDGES ARE FOUND:
+//
+//	  service ──type──► subject   a CloudEvent of that type and "source"
+//	                              was published on the subject
+//	  subject ┈┈type┈┈► service   the service published an event caused by
+//	                              one received on the subject ("causationid",
+//	                              see pkg/correlation), so it consumes it
+//
+//	Subject tokens holding digits (IDs: orders.c-4812.created) are shown as
+//	"*", so one node stands for all the instances of a subject.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/correlation"
+)
+
+const (
+	// diagramMermaid and diagramDot are the values of -diagram.
+	diagramMermaid = "mermaid"
+	diagramDot     = "dot"
+	// unknownProducer stands for the producer of the messages without source.
+	unknownProducer = "(unknown)"
+	// maxFlowOrigins caps the event IDs remembered to find the causations.
+	maxFlowOrigins = 1_000_000
+)
+
+// flowEdge is an arrow of the diagram.
+type flowEdge struct {
+	from, to  string // node names, prefixed by "service:" or "subject:"
+	eventType string
+	consumes  bool // subject → service
+}
+
+// eventOrigin is where an event observed was published.
+type eventOrigin struct {
+	subject, eventType string
+}
+
+// flowGraph accumulates the flows observed.
+type flowGraph struct {
+	mu      sync.Mutex
+	edges   map[flowEdge]int
+	origins map[string]eventOrigin // event id → where it was published
+}
+
+// flowDiagram observes subject during window, or reads the events stored in
+// streamName when it is not empty, then prints the diagram in format.
+func flowDiagram(nc *nats.Conn, l *log.Logger, subject, streamName string, window time.Duration, format string) {
+	g := &flowGraph{edges: make(map[flowEdge]int), origins: make(map[string]eventOrigin)}
+	ctx, stop := stopContext()
+	defer stop()
+	if streamName != "" {
+		readStored(ctx, nc, l, subject, streamName, func(m *nats.Msg, _ *jetstream.MsgMetadata) { g.add(m) })
+	} else {
+		sub, err := nc.Subscribe(subject, g.add)
+		if err != nil {
+			fail(l, exitFailure, "failed to subscribe to %q: %v", subject, err)
+		}
+		l.Printf("🗺️  Observing the flows on %q for %v (Ctrl+C to stop earlier) …", subject, window)
+		sleepCtx(ctx, window)
+		if err := sub.Unsubscribe(); err != nil {
+			l.Printf("⚠️  Error unsubscribing: %v", err)
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.edges) == 0 {
+		l.Printf("🤷 No flow observed, no diagram")
+		return
+	}
+	l.Printf("🗺️  %d flow(s) found, diagram on stdout", len(g.edges))
+	g.write(os.Stdout, format)
+}
+
+// add records the flows revealed by m, it is the subscription handler.
+func (g *flowGraph) add(m *nats.Msg) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	subject, eventType, producer := flowSubject(m.Subject), "(not a CloudEvent)", unknownProducer
+	ev, ok := decodeCloudEvent(m)
+	if ok {
+		eventType = ev.Attributes["type"]
+		if source := ev.Attributes["source"]; source != "" {
+			producer = source
+		}
+	}
+	g.edges[flowEdge{from: "service:" + producer, to: "subject:" + subject, eventType: eventType}]++
+	if !ok {
+		return
+	}
+
+	chain := correlation.FromAttributes(ev.Attributes)
+	if cause, known := g.origins[chain.CausationID]; known && chain.CausationID != "" {
+		g.edges[flowEdge{from: "subject:" + cause.subject, to: "service:" + producer, eventType: cause.eventType, consumes: true}]++
+	}
+	if chain.ID != "" && len(g.origins) < maxFlowOrigins {
+		g.origins[chain.ID] = eventOrigin{subject: subject, eventType: eventType}
+	}
+}
+
+// flowSubject returns subject with the tokens holding digits replaced by "*".
+func flowSubject(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if strings.ContainsAny(token, "0123456789") {
+			tokens[i] = "*"
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// write prints the diagram of the flows in format, sorted so that two
+// observations of the same traffic give the same text.
+func (g *flowGraph) write(w io.Writer, format string) {
+	edges := make([]flowEdge, 0, len(g.edges))
+	var nodes []string
+	for e := range g.edges {
+		edges = append(edges, e)
+		nodes = append(nodes, e.from, e.to)
+	}
+	slices.SortFunc(edges, func(a, b flowEdge) int {
+		return strings.Compare(a.from+"\x00"+a.to+"\x00"+a.eventType, b.from+"\x00"+b.to+"\x00"+b.eventType)
+	})
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+	ids := make(map[string]string, len(nodes))
+	for i, n := range nodes {
+		ids[n] = fmt.Sprintf("n%d", i)
+	}
+
+	label := func(e flowEdge) string { return fmt.Sprintf("%s ×%d", e.eventType, g.edges[e]) }
+	if format == diagramDot {
+		fmt.Fprintln(w, "digraph events {\n  rankdir=LR;")
+		for _, n := range nodes {
+			kind, name, _ := strings.Cut(n, ":")
+			shape := "box, style=rounded"
+			if kind == "subject" {
+				shape = "cds"
+			}
+			fmt.Fprintf(w, "  %s [label=%q, shape=%s];\n", ids[n], name, shape)
+		}
+		for _, e := range edges {
+			style := ""
+			if e.consumes {
+				style = ", style=dashed"
+			}
+			fmt.Fprintf(w, "  %s -> %s [label=%q%s];\n", ids[e.from], ids[e.to], label(e), style)
+		}
+		fmt.Fprintln(w, "}")
+		return
+	}
+
+	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"` }
+	fmt.Fprintln(w, "flowchart LR")
+	for _, n := range nodes {
+		kind, name, _ := strings.Cut(n, ":")
+		if kind == "subject" {
+			fmt.Fprintf(w, "  %s[[%s]]\n", ids[n], quote(name))
+		} else {
+			fmt.Fprintf(w, "  %s(%s)\n", ids[n], quote(name))
+		}
+	}
+	for _, e := range edges {
+		arrow := "-- %s -->"
+		if e.consumes {
+			arrow = "-. %s .->"
+		}
+		fmt.Fprintf(w, "  %s "+arrow+" %s\n", ids[e.from], quote(label(e)), ids[e.to])
+	}
+}
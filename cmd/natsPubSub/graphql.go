@@ -0,0 +1,433 @@
+// graphql.go — GraphQL subscription gateway backed by NATS subjects.
+//
+// WHY A GATEWAY:
+//
+//	Front-end teams already live in GraphQL (Apollo, urql, Relay, GraphiQL)
+//	and should not need a NATS client, credentials or network access to the
+//	cluster to follow events. The "graphql" mode listens on -listen and
+//	exposes the subjects under -subject as a GraphQL subscription:
+//
+//	  subscription {
+//	    events(subject: "orders.created", type: "order.created") {
+//	      subject id type source time data
+//	    }
+//	  }
+//
+//	Each subscription opens one NATS subscription, filtered by the optional
+//	CloudEvents "type" and "source" arguments, and closed with the client.
+//	-subject bounds what the gateway exposes: a client asking for a subject
+//	outside of it gets a GraphQL error, not a NATS subscription.
+//
+// TRANSPORTS (all on /graphql):
+//
+//	WebSocket  the "graphql-transport-ws" protocol of the graphql-ws
+//	           library, the default of Apollo Client and urql;
+//	SSE        a POST with "Accept: text/event-stream" streams the results
+//	           as "next" events, handy with curl;
+//	HTTP POST  plain queries, e.g. { allowedSubject } or introspection.
+//
+//	With -auth-config, every transport requires an API key or an OIDC
+//	token, and a subscription is refused outside of the subjects of its
+//	identity (see auth.go).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// defaultListenAddr is where the HTTP modes listen by default.
+	defaultListenAddr = ":8080"
+	// graphqlWSProtocol is the WebSocket sub-protocol of the graphql-ws library.
+	graphqlWSProtocol = "graphql-transport-ws"
+	// graphqlInitTimeout is how long a WebSocket client has to send connection_init.
+	graphqlInitTimeout = 10 * time.Second
+	// graphqlEventBuffer is the number of events buffered per subscription.
+	graphqlEventBuffer = 64
+)
+
+// graphqlSchema is the GraphQL schema served by the gateway.
+const graphqlSchema = `
+	schema {
+		query: Query
+		subscription: Subscription
+	}
+
+	type Query {
+		# Subject (possibly with wildcards) under which events can be subscribed to.
+		allowedSubject: String!
+	}
+
+	type Subscription {
+		# Events published on subject, optionally filtered by CloudEvents type and source.
+		events(subject: String!, type: String, source: String): Event!
+	}
+
+	type Event {
+		subject: String!
+		id: String
+		type: String
+		source: String
+		time: String
+		# The event data, or the whole payload when it is not a CloudEvent.
+		data: String!
+	}
+`
+
+// graphqlGateway resolves the GraphQL operations with NATS subscriptions.
+type graphqlGateway struct {
+	nc      *nats.Conn
+	l       *log.Logger
+	allowed string
+	auth    *authenticator // nil without -auth-config
+}
+
+// graphqlEvent resolves the Event type.
+type graphqlEvent struct {
+	subject string
+	attrs   map[string]string
+	data    string
+}
+
+// graphqlRequest is a GraphQL operation, as sent over every transport.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphqlWSMessage is a message of the graphql-transport-ws protocol.
+type graphqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// serveGraphQL runs the GraphQL gateway until interrupted (Ctrl+C).
+func serveGraphQL(nc *nats.Conn, l *log.Logger, allowed, listenAddr string, allowedOrigins []string, auth *authenticator) {
+	gw := &graphqlGateway{nc: nc, l: l, allowed: allowed, auth: auth}
+	schema := graphql.MustParseSchema(graphqlSchema, gw)
+
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			gw.serveWebSocket(w, r, schema, allowedOrigins)
+		case strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+			gw.serveSSE(w, r, schema)
+		default:
+			(&relay.Handler{Schema: schema}).ServeHTTP(w, r)
+		}
+	})))
+	// Every request context derives from baseCtx: cancelling it ends the
+	// streaming requests and their NATS subscriptions on shutdown, which
+	// srv.Shutdown alone does not do for WebSocket connections.
+	baseCtx, cancelAll := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fail(l, exitFailure, "GraphQL gateway failed: %v", err)
+		}
+	}()
+	l.Printf("🕸️  GraphQL gateway on http://%s/graphql exposing %q (Ctrl+C to quit) …", listenAddr, allowed)
+	sdNotify("READY=1")
+
+	sig := <-stopSignals()
+	l.Printf("🛑 Received signal %v — shutting down gracefully …", sig)
+	sdNotify("STOPPING=1")
+	cancelAll()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		l.Printf("⚠️  Error during HTTP shutdown: %v", err)
+	}
+	l.Println("👋 Bye!")
+}
+
+// AllowedSubject resolves Query.allowedSubject.
+func (g *graphqlGateway) AllowedSubject() string {
+	return g.allowed
+}
+
+// Events resolves Subscription.events with a NATS subscription living as
+// long as the GraphQL subscription.
+func (g *graphqlGateway) Events(ctx context.Context, args struct {
+	Subject string
+	Type    *string
+	Source  *string
+}) (<-chan *graphqlEvent, error) {
+	if !subjectWithin(args.Subject, g.allowed) {
+		return nil, fmt.Errorf("subject %q is not within %q", args.Subject, g.allowed)
+	}
+	if err := g.auth.authorize(ctx, args.Subject); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		closed bool
+		events = make(chan *graphqlEvent, graphqlEventBuffer)
+	)
+	sub, err := g.nc.Subscribe(args.Subject, func(m *nats.Msg) {
+		ev := &graphqlEvent{subject: m.Subject, data: string(m.Data)}
+		if ce, ok := decodeCloudEvent(m); ok {
+			ev.attrs, ev.data = ce.Attributes, string(ce.Data)
+		}
+		if (args.Type != nil && ev.attrs["type"] != *args.Type) || (args.Source != nil && ev.attrs["source"] != *args.Source) {
+			return
+		}
+		// The lock keeps the channel open while we send; a slow client
+		// only delays its own subscription.
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.l.Printf("➕ GraphQL subscription to %q", args.Subject)
+
+	go func() {
+		<-ctx.Done()
+		_ = sub.Unsubscribe()
+		mu.Lock()
+		closed = true
+		close(events)
+		mu.Unlock()
+		g.l.Printf("➖ GraphQL subscription to %q closed", args.Subject)
+	}()
+	return events, nil
+}
+
+// Subject, ID, Type, Source, Time and Data resolve the Event fields.
+func (e *graphqlEvent) Subject() string { return e.subject }
+func (e *graphqlEvent) ID() *string     { return e.attr("id") }
+func (e *graphqlEvent) Type() *string   { return e.attr("type") }
+func (e *graphqlEvent) Source() *string { return e.attr("source") }
+func (e *graphqlEvent) Time() *string   { return e.attr("time") }
+func (e *graphqlEvent) Data() string    { return e.data }
+
+// attr returns the CloudEvents attribute name, nil when absent.
+func (e *graphqlEvent) attr(name string) *string {
+	if v, ok := e.attrs[name]; ok {
+		return &v
+	}
+	return nil
+}
+
+// serveSSE streams the results of one operation as Server-Sent Events.
+func (g *graphqlGateway) serveSSE(w http.ResponseWriter, r *http.Request, schema *graphql.Schema) {
+	var req graphqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid GraphQL request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	results, err := schema.Subscribe(r.Context(), req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for result := range results {
+		b, err := json.Marshal(result)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "event: next\ndata: %s\n\n", b)
+		flusher.Flush()
+	}
+	fmt.Fprint(w, "event: complete\ndata:\n\n")
+	flusher.Flush()
+}
+
+// serveWebSocket speaks the graphql-transport-ws protocol: connection_init
+// / connection_ack, then any number of subscribe / next / complete
+// exchanges multiplexed by id, plus ping / pong.
+func (g *graphqlGateway) serveWebSocket(w http.ResponseWriter, r *http.Request, schema *graphql.Schema, allowedOrigins []string) {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:   []string{graphqlWSProtocol},
+		OriginPatterns: allowedOrigins,
+	})
+	if err != nil {
+		g.l.Printf("⚠️  WebSocket upgrade failed: %v", err)
+		return
+	}
+	if c.Subprotocol() != graphqlWSProtocol {
+		_ = c.Close(4406, "Subprotocol not acceptable")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	opsCtx := ctx // with the identity of connection_init
+	send := func(msg graphqlWSMessage) {
+		b, _ := json.Marshal(msg)
+		_ = c.Write(ctx, websocket.MessageText, b)
+	}
+
+	var (
+		mu    sync.Mutex
+		acked bool
+		ops   = make(map[string]context.CancelFunc)
+	)
+	initTimer := time.AfterFunc(graphqlInitTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !acked {
+			_ = c.Close(4408, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+
+	for {
+		_, b, err := c.Read(ctx)
+		if err != nil {
+			return // closed by the client, the server or the protocol
+		}
+		var msg graphqlWSMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			_ = c.Close(4400, "Invalid message")
+			return
+		}
+
+		mu.Lock()
+		switch msg.Type {
+		case "connection_init":
+			if acked {
+				mu.Unlock()
+				_ = c.Close(4429, "Too many initialisation requests")
+				return
+			}
+			if opsCtx, err = g.auth.authenticateInit(ctx, msg.Payload); err != nil {
+				mu.Unlock()
+				g.l.Printf("⚠️  WebSocket client refused: %v", err)
+				_ = c.Close(4403, "Forbidden")
+				return
+			}
+			acked = true
+			send(graphqlWSMessage{Type: "connection_ack"})
+		case "ping":
+			send(graphqlWSMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !acked {
+				mu.Unlock()
+				_ = c.Close(4401, "Unauthorized")
+				return
+			}
+			if _, exists := ops[msg.ID]; exists {
+				mu.Unlock()
+				_ = c.Close(4409, fmt.Sprintf("Subscriber for %s already exists", msg.ID))
+				return
+			}
+			var req graphqlRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				mu.Unlock()
+				_ = c.Close(4400, "Invalid subscribe payload")
+				return
+			}
+			opCtx, opCancel := context.WithCancel(opsCtx)
+			ops[msg.ID] = opCancel
+			go g.runOperation(opCtx, schema, msg.ID, req, send, func() {
+				mu.Lock()
+				delete(ops, msg.ID)
+				mu.Unlock()
+				opCancel()
+			})
+		case "complete":
+			if opCancel, ok := ops[msg.ID]; ok {
+				opCancel()
+			}
+		default:
+			mu.Unlock()
+			_ = c.Close(4400, fmt.Sprintf("Unexpected message type %q", msg.Type))
+			return
+		}
+		mu.Unlock()
+	}
+}
+
+// runOperation executes one WebSocket operation and sends its results.
+func (g *graphqlGateway) runOperation(ctx context.Context, schema *graphql.Schema, id string, req graphqlRequest, send func(graphqlWSMessage), done func()) {
+	defer done()
+	results, err := schema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+		send(graphqlWSMessage{ID: id, Type: "error", Payload: payload})
+		return
+	}
+	first := true
+	for result := range results {
+		resp, _ := result.(*graphql.Response)
+		if first && resp != nil && resp.Data == nil && len(resp.Errors) > 0 {
+			// The operation was rejected (syntax, validation, resolver error).
+			payload, _ := json.Marshal(resp.Errors)
+			send(graphqlWSMessage{ID: id, Type: "error", Payload: payload})
+			return
+		}
+		first = false
+		payload, err := json.Marshal(result)
+		if err != nil {
+			continue
+		}
+		send(graphqlWSMessage{ID: id, Type: "next", Payload: payload})
+	}
+	if ctx.Err() == nil {
+		send(graphqlWSMessage{ID: id, Type: "complete"})
+	}
+}
+
+// subjectWithin reports whether every subject matched by subject is also
+// matched by the pattern (both may hold * and > wildcards).
+func subjectWithin(subject, pattern string) bool {
+	s, p := strings.Split(subject, "."), strings.Split(pattern, ".")
+	for i, pt := range p {
+		switch {
+		case pt == ">":
+			return i < len(s)
+		case i >= len(s):
+			return false
+		case s[i] == ">":
+			return false
+		case pt == "*":
+		case pt != s[i]:
+			return false
+		}
+	}
+	return len(s) == len(p)
+}
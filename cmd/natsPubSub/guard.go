@@ -0,0 +1,213 @@
+// guard.go — Defensive decoding of the messages received by "sub".
+//
+// UNTRUSTED PAYLOADS:
+//
+//	Any user allowed to publish on the subject can send anything: a 60 MB
+//	gzip bomb, a JSON document nested 100 000 levels deep (each level
+//	costing a stack frame and an allocation to the decoder), an event
+//	whose "time" is "yesterday". The subscriber must not trust the
+//	producer with its memory. Before decoding anything, "sub" checks:
+//
+//	  -max-event-size  the size of the payload, compressed or inflated
+//	                   (1 MB by default), and of each event of a batch
+//	  -max-json-depth  the nesting of a JSON payload (64 by default),
+//	                   measured by a scan of the bytes, without decoding
+//	  -strict          the CloudEvents attributes: specversion 1.0, the
+//	                   required ones set, lower case alphanumeric names,
+//	                   source a URI reference, time RFC 3339, dataschema
+//	                   an absolute URI, datacontenttype a media type, and
+//	                   the data valid JSON when declared as JSON
+//
+// QUARANTINE:
+//
+//	A rejected message is not handled. With -quarantine-subject, it is
+//	published there as received, with the reason and its subject in the
+//	Quarantine-Reason and Quarantine-Subject headers, for someone to look
+//	at it later (store the quarantine subject in a stream):
+//
+//	  go run . -mode sub -subject "orders.>" -strict -quarantine-subject quarantine.orders
+//	  natsctl sub quarantine.orders
+//
+//	A quarantined message counts as handled: a -durable consumer
+//	acknowledges it instead of delivering it again forever. Without
+//	-quarantine-subject, it is logged and dropped (delivered again by a
+//	-durable consumer, until its max_deliver).
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// defaultMaxEventSize is the default -max-event-size.
+	defaultMaxEventSize = 1 << 20
+	// defaultMaxJSONDepth is the default -max-json-depth.
+	defaultMaxJSONDepth = 64
+	// quarantineReasonHeader and quarantineSubjectHeader tell why and from
+	// where a message was quarantined.
+	quarantineReasonHeader  = "Quarantine-Reason"
+	quarantineSubjectHeader = "Quarantine-Subject"
+)
+
+// attributeName matches the names of the CloudEvents attributes.
+var attributeName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// payloadGuard checks the messages before they are decoded, and
+// quarantines the rejected ones.
+type payloadGuard struct {
+	l          *log.Logger
+	maxSize    int
+	maxDepth   int
+	strict     bool
+	quarantine string // subject of the rejected messages, "" drops them
+}
+
+// snapshot returns m as received, for the quarantine: its payload and
+// headers are changed in place by the decoding.
+func (g *payloadGuard) snapshot(m *nats.Msg) *nats.Msg {
+	if g.quarantine == "" {
+		return m
+	}
+	return &nats.Msg{Subject: m.Subject, Header: maps.Clone(m.Header), Data: m.Data}
+}
+
+// checkLimits returns why the payload of m exceeds the size or nesting
+// limits, nil when it does not.
+func (g *payloadGuard) checkLimits(m *nats.Msg) error {
+	if len(m.Data) > g.maxSize {
+		return fmt.Errorf("payload of %d bytes over -max-event-size %d", len(m.Data), g.maxSize)
+	}
+	if depth := jsonDepth(m.Data, g.maxDepth); depth > g.maxDepth {
+		return fmt.Errorf("JSON nested over -max-json-depth %d", g.maxDepth)
+	}
+	return nil
+}
+
+// check returns why the single event m is rejected, nil when it is
+// accepted.
+func (g *payloadGuard) check(m *nats.Msg) error {
+	if err := g.checkLimits(m); err != nil {
+		return err
+	}
+	if g.strict {
+		return validateEvent(m)
+	}
+	return nil
+}
+
+// reject quarantines m for reason, or returns the error telling why it was
+// not handled.
+func (g *payloadGuard) reject(m *nats.Msg, reason error, forward func(m *nats.Msg) error) error {
+	err := fmt.Errorf("rejected message on [%s]: %w", m.Subject, reason)
+	if g.quarantine == "" {
+		return err
+	}
+	q := &nats.Msg{Subject: g.quarantine, Header: maps.Clone(m.Header), Data: m.Data}
+	if q.Header == nil {
+		q.Header = nats.Header{}
+	}
+	q.Header.Set(quarantineReasonHeader, reason.Error())
+	q.Header.Set(quarantineSubjectHeader, m.Subject)
+	if qErr := forward(q); qErr != nil {
+		return fmt.Errorf("%w, and not quarantined: %w", err, qErr)
+	}
+	countQuarantined()
+	countPublished(len(q.Data))
+	g.l.Printf("🚫 %v — quarantined on [%s]", err, g.quarantine)
+	return nil
+}
+
+// jsonDepth returns the nesting depth of the JSON document data, scanning
+// it without decoding, and stops as soon as it exceeds limit. A payload
+// that does not start like a JSON object or array has a depth of 0.
+func jsonDepth(data []byte, limit int) int {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' && trimmed[0] != '[' {
+		return 0
+	}
+	var depth, deepest int
+	var inString, escaped bool
+	for _, b := range trimmed {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = b == '\\'
+			inString = b != '"'
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > deepest {
+				if deepest = depth; deepest > limit {
+					return deepest
+				}
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// validateEvent checks that m is a CloudEvent valid for the specification.
+func validateEvent(m *nats.Msg) error {
+	ev, ok := decodeCloudEvent(m)
+	if !ok {
+		return errors.New("not a CloudEvent")
+	}
+	for _, name := range requiredAttributes {
+		if ev.Attributes[name] == "" {
+			return fmt.Errorf("missing required CloudEvents attribute %q", name)
+		}
+	}
+	for name := range ev.Attributes {
+		if !attributeName.MatchString(name) {
+			return fmt.Errorf("invalid CloudEvents attribute name %q: lower case letters and digits only", name)
+		}
+	}
+	if v := ev.Attributes["specversion"]; v != "1.0" {
+		return fmt.Errorf("unsupported specversion %q, expected 1.0", v)
+	}
+	if _, err := url.Parse(ev.Attributes["source"]); err != nil {
+		return fmt.Errorf("source is not a URI reference: %w", err)
+	}
+	if t, set := ev.Attributes["time"]; set {
+		if _, err := time.Parse(time.RFC3339Nano, t); err != nil {
+			return fmt.Errorf("time %q is not an RFC 3339 timestamp", t)
+		}
+	}
+	if s, set := ev.Attributes["dataschema"]; set {
+		if u, err := url.Parse(s); err != nil || !u.IsAbs() {
+			return fmt.Errorf("dataschema %q is not an absolute URI", s)
+		}
+	}
+	if ct, set := ev.Attributes["datacontenttype"]; set {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return fmt.Errorf("datacontenttype %q: %w", ct, err)
+		}
+		if isJSONMediaType(mediaType) && len(ev.Data) > 0 && !json.Valid(ev.Data) {
+			return fmt.Errorf("data declared as %s is not valid JSON", mediaType)
+		}
+	}
+	return nil
+}
+
+// isJSONMediaType reports whether mediaType is JSON: application/json or
+// any +json type.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
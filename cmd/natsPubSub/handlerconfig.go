@@ -0,0 +1,316 @@
+// handlerconfig.go — Filters, routes and handler settings reloaded live.
+//
+// WHY HOT RELOAD:
+//
+//	Changing what a subscriber filters or where it forwards events should
+//	not require a restart: a restart drops the subscription (core NATS
+//	messages published meanwhile are lost), resets the caches and, with
+//	many instances, turns a one-line change into a rolling deployment.
+//	With -handler-config, the "sub" mode reads these settings from a JSON
+//	document and applies every new version between two messages, the
+//	subscription staying in place:
+//
+//	  {
+//	    "match_header": {"ce-type": ["order.*"]},
+//	    "expect_version": 2,
+//	    "rate": 100,
+//	    "sample": "10%",
+//	    "codec": "json",
+//	    "routes": [
+//	      {"match_header": {"ce-type": ["order.cancelled"]}, "to": "orders.refunds"},
+//	      {"subject": "orders.eu.>", "to": "archive.eu"}
+//	    ]
+//	  }
+//
+//	  match_header    only the matching messages are handled (as -match-header)
+//	  expect_version  CloudEvents are upcast to this version (as -expect-version)
+//	  rate            messages per second, 0 for no limit (as "set-rate", see control.go)
+//	  sample          share of the messages handled, "10%" or "1/10" (as -sample, see sample.go)
+//	  codec           codec decoding the data before handling (as -codec, see codec.go)
+//	  routes          the first route whose subject pattern and headers match
+//	                  republishes the message on "to" instead of printing it
+//
+// FILE OR KV BUCKET:
+//
+//	-handler-config names a file, checked every -reload-interval and on
+//	SIGHUP (a ConfigMap update is seen within a minute or so), or a key of
+//	a JetStream Key-Value bucket, watched for updates:
+//
+//	  go run . -mode sub -subject 'orders.>' -handler-config ./orders-handler.json
+//	  go run . -mode sub -subject 'orders.>' -handler-config kv://handlers/orders
+//	  natsctl kv put handlers orders "$(cat orders-handler.json)"
+//
+//	A version that cannot be parsed or is invalid is logged and ignored:
+//	the previous one stays in force.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// kvConfigScheme prefixes the -handler-config read from a Key-Value bucket.
+const kvConfigScheme = "kv://"
+
+// handlerConfig is the JSON document of -handler-config.
+type handlerConfig struct {
+	MatchHeader   nats.Header `json:"match_header,omitempty"`
+	ExpectVersion int         `json:"expect_version,omitempty"`
+	Rate          *float64    `json:"rate,omitempty"` // nil keeps the current rate
+	Sample        string      `json:"sample,omitempty"`
+	Codec         string      `json:"codec,omitempty"`
+	Routes        []route     `json:"routes,omitempty"`
+}
+
+// route republishes on To the messages received on a subject matching the
+// Subject pattern (any subject when empty) and carrying MatchHeader.
+type route struct {
+	Subject     string      `json:"subject,omitempty"`
+	MatchHeader nats.Header `json:"match_header,omitempty"`
+	To          string      `json:"to"`
+}
+
+// liveConfig is the handler configuration in force, with the handler of the
+// messages built for it, swapped atomically on every reload.
+type liveConfig struct {
+	current atomic.Pointer[compiledConfig]
+}
+
+// compiledConfig is a validated configuration, its sampler and its
+// message handler.
+type compiledConfig struct {
+	handlerConfig
+	sampler *sampler
+	handle  func(m *nats.Msg) error
+}
+
+// Load returns the configuration in force.
+func (c *liveConfig) Load() *compiledConfig {
+	return c.current.Load()
+}
+
+// apply validates cfg for the subscription subject and puts it in force.
+func (c *liveConfig) apply(l *log.Logger, subject string, cfg handlerConfig, flow *flowControl) error {
+	if err := cfg.validate(subject); err != nil {
+		return err
+	}
+	s, err := parseSample(cfg.Sample)
+	if err != nil {
+		return err
+	}
+	handle := func(m *nats.Msg) error {
+		l.Printf("📩 Received on [%s]: %s", m.Subject, string(m.Data))
+		for k, values := range m.Header {
+			l.Printf("   %s: %s", k, strings.Join(values, ", "))
+		}
+		return nil
+	}
+	if cfg.ExpectVersion > 0 {
+		handle = upcastHandler(l, upcasters(), cfg.ExpectVersion)
+	}
+	if cfg.Codec != "" {
+		if handle, err = codecHandler(cfg.Codec, handle); err != nil {
+			return err
+		}
+	}
+	c.current.Store(&compiledConfig{handlerConfig: cfg, sampler: s, handle: handle})
+	if cfg.Rate != nil {
+		flow.setRate(*cfg.Rate)
+	}
+	return nil
+}
+
+// validate checks the settings, and that no route sends the messages back
+// to the subscription subject, which would loop forever.
+func (cfg handlerConfig) validate(subject string) error {
+	if cfg.ExpectVersion < 0 {
+		return fmt.Errorf("expect_version must be 0 (raw messages) or more, got %d", cfg.ExpectVersion)
+	}
+	if cfg.Rate != nil && *cfg.Rate < 0 {
+		return fmt.Errorf("rate must be 0 (no limit) or more, got %g", *cfg.Rate)
+	}
+	for i, r := range cfg.Routes {
+		switch {
+		case r.To == "" || strings.ContainsAny(r.To, "*> \t"):
+			return fmt.Errorf("routes[%d]: \"to\" must be a subject without wildcards, got %q", i, r.To)
+		case subjectWithin(r.To, subject):
+			return fmt.Errorf("routes[%d]: %q is within the subscription %q, the messages would loop", i, r.To, subject)
+		}
+	}
+	return nil
+}
+
+// routeOf returns the subject the first matching route sends m to.
+func (cfg handlerConfig) routeOf(m *nats.Msg) (string, bool) {
+	for _, r := range cfg.Routes {
+		if (r.Subject == "" || subjectWithin(m.Subject, r.Subject)) && matchHeaders(m, r.MatchHeader) {
+			return r.To, true
+		}
+	}
+	return "", false
+}
+
+// parseHandlerConfig decodes a -handler-config document, refusing unknown
+// fields so that a typo does not silently disable a filter.
+func parseHandlerConfig(data []byte) (handlerConfig, error) {
+	var cfg handlerConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return handlerConfig{}, err
+	}
+	return cfg, nil
+}
+
+// watchHandlerConfig loads the -handler-config source, a file or a
+// kv://<bucket>/<key>, calls apply with it, then with every new version
+// until the returned function is called. The versions apply rejects are
+// logged and skipped.
+func watchHandlerConfig(nc *nats.Conn, l *log.Logger, source string, interval time.Duration, apply func(handlerConfig) error) (stop func(), err error) {
+	return watchConfig(nc, l, "handler config", source, interval, func(data []byte) error {
+		cfg, err := parseHandlerConfig(data)
+		if err != nil {
+			return err
+		}
+		return apply(cfg)
+	})
+}
+
+// watchConfig loads the document of source, a file or a
+// kv://<bucket>/<key>, calls apply with it, then with every new version
+// until the returned function is called; what names it in the logs.
+func watchConfig(nc *nats.Conn, l *log.Logger, what, source string, interval time.Duration, apply func(data []byte) error) (stop func(), err error) {
+	if rest, isKV := strings.CutPrefix(source, kvConfigScheme); isKV {
+		bucket, key, ok := strings.Cut(rest, "/")
+		if !ok || bucket == "" || key == "" {
+			return nil, fmt.Errorf("expected %s<bucket>/<key>, got %q", kvConfigScheme, source)
+		}
+		return watchKVConfig(nc, l, what, bucket, key, apply)
+	}
+	return watchFileConfig(l, what, source, interval, apply)
+}
+
+// watchFileConfig reloads the file when its size or modification time
+// changes (checked every interval, 0 disables polling) or on SIGHUP.
+func watchFileConfig(l *log.Logger, what, file string, interval time.Duration, apply func(data []byte) error) (stop func(), err error) {
+	load := func() error {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := apply(data); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		return nil
+	}
+	last := fingerprint([]string{file})
+	if err := load(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+			case <-tick:
+				current := fingerprint([]string{file})
+				if current == last {
+					continue
+				}
+				last = current
+			}
+			if err := load(); err != nil {
+				l.Printf("⚠️  New %s is not usable, keeping the current one: %v", what, err)
+				continue
+			}
+			l.Printf("🔄 Reloaded the %s from %s", what, file)
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}, nil
+}
+
+// watchKVConfig reads the key of the Key-Value bucket, then follows its
+// updates through a KV watcher (a JetStream ordered consumer).
+func watchKVConfig(nc *nats.Conn, l *log.Logger, what, bucket, key string, apply func(data []byte) error) (stop func(), err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	js, err := jetstream.New(nc)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Key-Value bucket %q: %w", bucket, err)
+	}
+	entry, err := kv.Get(ctx, key)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("key %q of the bucket %q: %w", key, bucket, err)
+	}
+	load := func(entry jetstream.KeyValueEntry) error {
+		if err := apply(entry.Value()); err != nil {
+			return fmt.Errorf("%s/%s revision %d: %w", bucket, key, entry.Revision(), err)
+		}
+		return nil
+	}
+	if err := load(entry); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	watcher, err := kv.Watch(ctx, key, jetstream.UpdatesOnly())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			switch {
+			case entry == nil:
+				continue
+			case entry.Operation() != jetstream.KeyValuePut:
+				l.Printf("⚠️  The %s %s/%s was deleted, keeping the current one", what, bucket, key)
+			default:
+				if err := load(entry); err != nil {
+					l.Printf("⚠️  New %s is not usable, keeping the current one: %v", what, err)
+					continue
+				}
+				l.Printf("🔄 Reloaded the %s from %s/%s revision %d", what, bucket, key, entry.Revision())
+			}
+		}
+	}()
+	return func() {
+		if err := watcher.Stop(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			l.Printf("⚠️  Error stopping the %s watcher: %v", what, err)
+		}
+		cancel()
+	}, nil
+}
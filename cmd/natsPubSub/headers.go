@@ -0,0 +1,92 @@
+// headers.go — Header flags of the "pub" mode and header filters of the "sub" mode.
+//
+// HEADERS:
+//
+//	NATS headers carry the metadata of a message next to its opaque
+//	payload: the CloudEvents attributes in binary mode (ce-type, ce-id, …),
+//	the W3C trace context (traceparent), Nats-Msg-Id for JetStream
+//	de-duplication, …
+//
+//	  -header ce-type=order.created -header ce-source=/shop   (repeatable)
+//	  -header-file ./headers.txt                              ("Key: value" or "key=value" lines, # comments)
+//	  -match-header ce-type=order.*                           (sub: all must match, values are path.Match patterns)
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// headerFlag collects repeated "key=value" flags.
+type headerFlag nats.Header
+
+func (h headerFlag) String() string {
+	var pairs []string
+	for k, values := range h {
+		for _, v := range values {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlag) Set(kv string) error {
+	k, v, ok := strings.Cut(kv, "=")
+	if !ok || strings.TrimSpace(k) == "" {
+		return fmt.Errorf("expected key=value, got %q", kv)
+	}
+	nats.Header(h).Add(strings.TrimSpace(k), v)
+	return nil
+}
+
+// readHeaderFile adds to h the headers of a file, one per line as
+// "Key: value" (the NATS/HTTP wire form) or "key=value".
+func readHeaderFile(h nats.Header, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, ":=")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expected \"Key: value\" or \"key=value\"", file, n)
+		}
+		h.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return scanner.Err()
+}
+
+// matchHeaders reports whether m carries every header of want, the
+// wanted values being path.Match patterns ("order.*").
+func matchHeaders(m *nats.Msg, want nats.Header) bool {
+	for k, patterns := range want {
+		values := m.Header.Values(k)
+		for _, pattern := range patterns {
+			if !anyMatch(pattern, values) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// anyMatch reports whether one of values matches pattern.
+func anyMatch(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// heartbeat.go — Liveness events of the long-running modes.
+//
+// HEARTBEATS:
+//
+//	The modes running until stopped (sub, edge, reconcile, graphql, amqp,
+//	connector, http) publish every -heartbeat a CloudEvent describing
+//	themselves on _sys.app.heartbeat.<name> (see pkg/heartbeat), and
+//	answer the pings of "natsctl fleet" on _sys.app.ping:
+//
+//	  go run . -mode sub -subject "orders.>" -name orders-audit
+//	  natsctl fleet
+//
+//	A last heartbeat with the status "stopping" is sent on a graceful
+//	shutdown, so the component leaves the fleet at once. The NATS user
+//	needs the permission to publish on _sys.app.heartbeat.> and to
+//	subscribe to _sys.app.ping; -heartbeat 0 disables it all.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/heartbeat"
+)
+
+// defaultHeartbeatInterval is the default delay between two heartbeats.
+const defaultHeartbeatInterval = 15 * time.Second
+
+// longRunningModes lists the modes sending heartbeats.
+var longRunningModes = []string{modeSub, modeEdge, modeReconcile, modeGraphQL, modeAMQP, modeConnector, modeHTTP}
+
+// defaultComponentName returns "<mode>-<host>-<pid>", unique per instance.
+func defaultComponentName(mode string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s-%d", mode, host, os.Getpid())
+}
+
+// startHeartbeat publishes the heartbeats of the component name every
+// interval and answers the pings, until the returned function is called
+// or a stop signal is received.
+func startHeartbeat(nc *nats.Conn, l *log.Logger, name, mode, subject string, interval time.Duration) (stop func()) {
+	host, _ := os.Hostname()
+	status := heartbeat.Status{
+		Name:       name,
+		App:        APP,
+		Version:    VERSION,
+		Mode:       mode,
+		Subject:    subject,
+		Status:     heartbeat.StatusRunning,
+		Host:       host,
+		PID:        os.Getpid(),
+		StartedAt:  result.StartedAt,
+		IntervalMS: interval.Milliseconds(),
+	}
+	var stopping atomic.Bool
+	// current returns the heartbeat event with the counters of now.
+	current := func() []byte {
+		s := status
+		if stopping.Load() {
+			s.Status = heartbeat.StatusStopping
+		}
+		resultMu.Lock()
+		s.Received, s.Published = result.Received, result.Published
+		resultMu.Unlock()
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s.Goroutines, s.HeapBytes = runtime.NumGoroutine(), mem.HeapAlloc
+		data, _ := heartbeat.Encode(s, nuid.Next())
+		return data
+	}
+	hbSubject := heartbeat.Subject(name)
+	send := func() {
+		if err := nc.Publish(hbSubject, current()); err != nil {
+			l.Printf("⚠️  Failed to publish heartbeat on %q: %v", hbSubject, err)
+		}
+	}
+
+	ping, err := nc.Subscribe(heartbeat.PingSubject, func(m *nats.Msg) {
+		if m.Reply != "" {
+			_ = m.Respond(current())
+		}
+	})
+	if err != nil {
+		l.Printf("⚠️  Failed to subscribe to %q, natsctl fleet will wait for the heartbeats: %v", heartbeat.PingSubject, err)
+	}
+	l.Printf("💓 Heartbeat every %v on %q", interval, hbSubject)
+
+	ctx, cancel := stopContext()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		send()
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-ctx.Done():
+				stopping.Store(true)
+				send()
+				_ = nc.Flush()
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if ping != nil {
+			_ = ping.Unsubscribe()
+		}
+	}
+}
@@ -0,0 +1,484 @@
+// httpbridge.go — CloudEvents over HTTP bridge, Knative Eventing compatible.
+//
+// KNATIVE EVENTING CONTRACT:
+//
+//	Knative moves CloudEvents between "sources" and "sinks" with plain HTTP
+//	POSTs. The "http" mode plays both roles for NATS:
+//
+//	  sink    Knative (Trigger, Subscription, SinkBinding, …) POSTs events to
+//	          -listen, they are published on NATS. POST /orders.created
+//	          publishes on "orders.created", POST / on -subject.
+//	  source  the events published on -subject are POSTed to the sink URL,
+//	          -sink or the K_SINK variable injected by a Knative SinkBinding
+//	          (K_CE_OVERRIDES extensions are applied).
+//
+// RESPONSE CODES (sink side):
+//
+//	  202 Accepted             published on NATS, no reply event
+//	  200 OK + CloudEvent      with -reply, the NATS reply becomes the Knative reply event
+//	  400 Bad Request          not a valid CloudEvent (missing id, source, type, …), or a body cut short
+//	  404 Not Found            subject outside of -subject
+//	  405 Method Not Allowed   only POST delivers events
+//	  401 Unauthorized         missing or unknown API key or token, with -quota-config or -auth-config
+//	  403 Forbidden            subject outside of the identity's ones, with -auth-config (see auth.go)
+//	  413 Payload Too Large    larger than the max_payload of the NATS server, or the quota
+//	  429 Too Many Requests    over the rate of the tenant, with -quota-config (see quota.go)
+//	  503 Service Unavailable  NATS unreachable: Knative retries with its backoff
+//
+//	Events are accepted in binary mode (Ce-* HTTP headers) and structured
+//	mode (application/cloudevents+json), and published on NATS in binary
+//	mode (ce-* headers). A batch (application/cloudevents-batch+json) is
+//	published as is, in one message, without waiting for a reply; the
+//	batches published on -subject are POSTed to the sink event by event
+//	(see cebatch.go). GET /healthz answers the Kubernetes probes.
+//
+// SENDING TO THE SINK (source side):
+//
+//	The events are POSTed by httpSinkWorkers workers, each retrying its
+//	event with a backoff on 408, 429 and 5xx: a slow or failing sink holds
+//	a worker, not the NATS subscription, and the events are sent in
+//	parallel, in no guaranteed order. When all the workers are busy and
+//	httpSinkQueue events wait, the subscription waits too, NATS buffering
+//	the messages up to its pending limits (a slow consumer error beyond).
+//
+//	At the shutdown, the subscription is drained and the events waiting
+//	are still sent, within the httpShutdownTimeout of the bridge. Past it,
+//	the sends are interrupted and every event left is logged, by its id,
+//	and counted.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// ceJSONContentType is the content type of a structured mode event.
+	ceJSONContentType = "application/cloudevents+json"
+	// httpReplyTimeout bounds the wait for a NATS reply with -reply.
+	httpReplyTimeout = 10 * time.Second
+	// httpSendAttempts is how many times an event is POSTed to the sink.
+	httpSendAttempts = 5
+	// httpSinkWorkers is how many events are POSTed to the sink at once.
+	httpSinkWorkers = 8
+	// httpSinkQueue is how many events wait for a worker.
+	httpSinkQueue = 256
+	// httpShutdownTimeout bounds the shutdown of the server, and the
+	// sends of the events still waiting for the sink.
+	httpShutdownTimeout = 5 * time.Second
+)
+
+// requiredAttributes must be present in every CloudEvent.
+var requiredAttributes = []string{"specversion", "id", "source", "type"}
+
+// httpBridge runs the HTTP bridge until interrupted (Ctrl+C).
+func httpBridge(nc *nats.Conn, l *log.Logger, subject, listenAddr, sinkURL string, reply bool, quotas *quotaEnforcer, auth *authenticator) {
+	if port := os.Getenv("PORT"); port != "" && listenAddr == defaultListenAddr {
+		listenAddr = ":" + port // set by Knative Serving
+	}
+	if sinkURL == "" {
+		sinkURL = os.Getenv("K_SINK")
+	}
+
+	ctx, stop := stopContext()
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if !nc.IsConnected() {
+			http.Error(w, "NATS disconnected", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if quotas != nil {
+		mux.HandleFunc("GET /metrics", quotas.serveMetrics)
+	}
+	mux.Handle("/", auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiveHTTPEvent(nc, l, subject, reply, quotas, auth, w, r)
+	})))
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fail(l, exitFailure, "HTTP bridge failed: %v", err)
+		}
+	}()
+	l.Printf("🌐 HTTP bridge listening on %s, events published within %q", listenAddr, subject)
+
+	stopSink := func(context.Context) {}
+	if sinkURL != "" {
+		overrides := ceOverrides(l)
+		client := &http.Client{Timeout: connectorTimeout}
+		pool := startSinkPool(l, func(ctx context.Context, m *nats.Msg) bool {
+			return sendHTTPEvent(ctx, nc, l, client, sinkURL, overrides, m)
+		})
+		sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
+			if m.Header.Get(bridgedHeader) != "" {
+				return // received over HTTP, do not send it back
+			}
+			if !isEventBatch(m) {
+				pool.enqueue(m)
+				return
+			}
+			events, err := unbundleEvents(m)
+			if err != nil {
+				l.Printf("⚠️  %v", err)
+				return
+			}
+			for _, ev := range events {
+				pool.enqueue(ev)
+			}
+		})
+		if err != nil {
+			fail(l, exitConnection, "failed to subscribe: %v", err)
+		}
+		closed := sub.StatusChanged(nats.SubscriptionClosed)
+		stopSink = func(deadline context.Context) { pool.stop(deadline, sub, closed) }
+		l.Printf("🌐 Sending the events of %q to %s", subject, sinkURL)
+	}
+
+	sdNotify("READY=1")
+	<-ctx.Done()
+	sdNotify("STOPPING=1")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		l.Printf("⚠️  Error during HTTP shutdown: %v", err)
+	}
+	stopSink(shutdownCtx)
+	l.Println("👋 Bye!")
+}
+
+// sinkPool POSTs the events of the source side to the sink with
+// httpSinkWorkers workers, httpSinkQueue events waiting for them.
+type sinkPool struct {
+	l       *log.Logger
+	send    func(ctx context.Context, m *nats.Msg) bool
+	queue   chan *nats.Msg
+	mu      sync.RWMutex // read by the enqueues running, written to close the queue
+	closed  bool
+	ctx     context.Context // of the sends, cancelled past the shutdown deadline
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	dropped atomic.Int64
+}
+
+// startSinkPool starts the workers calling send, which returns false when
+// it gave up on its event.
+func startSinkPool(l *log.Logger, send func(ctx context.Context, m *nats.Msg) bool) *sinkPool {
+	p := &sinkPool{l: l, send: send, queue: make(chan *nats.Msg, httpSinkQueue)}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for range httpSinkWorkers {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for m := range p.queue {
+				if p.ctx.Err() != nil {
+					p.drop(m, "shutdown deadline passed")
+				} else if !p.send(p.ctx, m) && p.ctx.Err() != nil {
+					p.dropped.Add(1) // logged by send
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// enqueue hands m to the workers, waiting while they are all busy.
+func (p *sinkPool) enqueue(m *nats.Msg) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.drop(m, "shutting down")
+		return
+	}
+	p.queue <- m
+}
+
+// drop logs and counts an event not sent.
+func (p *sinkPool) drop(m *nats.Msg, why string) {
+	p.dropped.Add(1)
+	attrs, _ := natsToHTTPAttributes(m)
+	p.l.Printf("⚠️  Event %s not sent to the sink: %s", attrs["id"], why)
+}
+
+// stop drains sub, whose closed status is notified on closed, then sends
+// the events waiting until deadline, and drops the ones left.
+func (p *sinkPool) stop(deadline context.Context, sub *nats.Subscription, closed <-chan nats.SubStatus) {
+	defer context.AfterFunc(deadline, p.cancel)()
+	_ = sub.Drain()
+	select {
+	case <-closed:
+	case <-deadline.Done():
+		if n, _, err := sub.Pending(); err == nil && n > 0 {
+			p.dropped.Add(int64(n))
+			p.l.Printf("⚠️  %d messages of %q not sent to the sink: shutdown deadline passed", n, sub.Subject)
+		}
+		_ = sub.Unsubscribe()
+	}
+	// A callback may still be running once the subscription is closed:
+	// the lock waits for its enqueue.
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	p.workers.Wait()
+	p.cancel()
+	if n := p.dropped.Load(); n > 0 {
+		p.l.Printf("⚠️  %d events not sent to the sink: interrupted", n)
+	}
+}
+
+// receiveHTTPEvent publishes the CloudEvent POSTed in r on NATS.
+func receiveHTTPEvent(nc *nats.Conn, l *log.Logger, subject string, reply bool, quotas *quotaEnforcer, auth *authenticator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "CloudEvents are delivered with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	target := strings.TrimPrefix(r.URL.Path, "/")
+	if target == "" {
+		target = subject
+	}
+	if strings.ContainsAny(target, "*> ") || !subjectWithin(target, subject) {
+		http.Error(w, fmt.Sprintf("subject %q is not within %q", target, subject), http.StatusNotFound)
+		return
+	}
+	if err := auth.authorize(r.Context(), target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tenant, maxSize, ok := quotas.admit(w, r)
+	if !ok {
+		return
+	}
+	limit := nc.MaxPayload()
+	if maxSize > 0 {
+		limit = min(limit, maxSize)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if tooLarge := new(*http.MaxBytesError); errors.As(err, tooLarge) {
+		quotas.tooLarge(tenant)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		quotas.release(tenant)
+		http.Error(w, "reading the event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !quotas.admitBytes(w, tenant, len(body)) {
+		return
+	}
+	m, err := httpToNATS(target, r.Header, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.Header.Set(bridgedHeader, APP)
+	stampCausation(r.Context(), m)
+
+	if !nc.IsConnected() {
+		http.Error(w, "NATS unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !reply || isEventBatch(m) {
+		if err := nc.PublishMsg(m); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// KEY CONCEPT — Knative reply events:
+	// the NATS request-reply answer becomes the HTTP response, and Knative
+	// routes it as a new event (e.g. to a Broker).
+	ctx, cancel := context.WithTimeout(r.Context(), httpReplyTimeout)
+	defer cancel()
+	resp, err := nc.RequestMsgWithContext(ctx, m)
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		w.WriteHeader(http.StatusAccepted) // nobody answers, nothing to reply
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		ev, ok := decodeCloudEvent(resp)
+		if !ok {
+			l.Printf("⚠️  Reply on %q is not a CloudEvent, dropped", target)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		inheritCausation(eventContext(ctx, m), ev.Attributes)
+		for name, value := range ev.Attributes {
+			if name == "datacontenttype" {
+				w.Header().Set("Content-Type", value)
+			} else {
+				w.Header().Set("Ce-"+name, value)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(ev.Data)
+	}
+}
+
+// httpToNATS converts an HTTP CloudEvent, binary or structured, into a NATS
+// message in binary mode, and a batch of CloudEvents into a NATS batch.
+func httpToNATS(subject string, h http.Header, body []byte) (*nats.Msg, error) {
+	m := nats.NewMsg(subject)
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch mediaType {
+	case ceBatchContentType:
+		data, err := bundleEvents(context.Background(), body)
+		if err != nil {
+			return nil, err
+		}
+		m.Header.Set("Content-Type", ceBatchContentType)
+		m.Data = data
+		return m, nil
+	case ceJSONContentType:
+		structured := nats.NewMsg(subject)
+		structured.Data = body
+		ev, ok := decodeCloudEvent(structured)
+		if !ok {
+			return nil, errors.New("invalid structured CloudEvent")
+		}
+		for name, value := range ev.Attributes {
+			m.Header.Set(cePrefix+name, value)
+		}
+		m.Data = ev.Data
+	default:
+		for k, values := range h {
+			if name, ok := strings.CutPrefix(strings.ToLower(k), cePrefix); ok && len(values) > 0 {
+				m.Header.Set(cePrefix+name, values[0])
+			}
+		}
+		if ct := h.Get("Content-Type"); ct != "" {
+			m.Header.Set(cePrefix+"datacontenttype", ct)
+		}
+		m.Data = body
+	}
+	for _, name := range requiredAttributes {
+		if m.Header.Get(cePrefix+name) == "" {
+			return nil, fmt.Errorf("missing required CloudEvents attribute %q", name)
+		}
+	}
+	return m, nil
+}
+
+// sendHTTPEvent POSTs m to the sink in binary mode, retrying the transient
+// failures, and publishes the reply event, if any, on m's reply subject.
+// It returns false when it gave up on the event, the sink not answering.
+func sendHTTPEvent(ctx context.Context, nc *nats.Conn, l *log.Logger, client *http.Client, sinkURL string, overrides map[string]string, m *nats.Msg) bool {
+	attrs, data := natsToHTTPAttributes(m)
+	for name, value := range overrides {
+		attrs[name] = value
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; attempt <= httpSendAttempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sinkURL, bytes.NewReader(data))
+		if err != nil {
+			l.Printf("💥 Invalid sink %s: %v", sinkURL, err)
+			return false
+		}
+		for name, value := range attrs {
+			if name == "datacontenttype" {
+				req.Header.Set("Content-Type", value)
+			} else {
+				req.Header.Set("Ce-"+name, value)
+			}
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			replyBody, _ := io.ReadAll(io.LimitReader(resp.Body, nc.MaxPayload()))
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < 300:
+				forwardHTTPReply(nc, l, m, resp.Header, replyBody)
+				return true
+			case resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout:
+				l.Printf("⚠️  Sink refused event %s: %s", attrs["id"], resp.Status)
+				return true
+			}
+			err = errors.New(resp.Status)
+		}
+		if attempt == httpSendAttempts || ctx.Err() != nil {
+			l.Printf("⚠️  Could not deliver event %s to the sink: %v", attrs["id"], err)
+			return false
+		}
+		sleepCtx(ctx, backoff)
+		backoff *= 2
+	}
+	return false
+}
+
+// natsToHTTPAttributes returns the CloudEvents attributes and data of m,
+// wrapping a plain NATS message into a minimal CloudEvent.
+func natsToHTTPAttributes(m *nats.Msg) (map[string]string, []byte) {
+	if ev, ok := decodeCloudEvent(m); ok {
+		return ev.Attributes, ev.Data
+	}
+	return map[string]string{
+		"specversion": "1.0",
+		"id":          nuid.Next(),
+		"source":      "nats://" + m.Subject,
+		"type":        "io.nats.message",
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+	}, m.Data
+}
+
+// forwardHTTPReply publishes the reply event of the sink on the reply
+// subject of m, when both exist.
+func forwardHTTPReply(nc *nats.Conn, l *log.Logger, m *nats.Msg, h http.Header, body []byte) {
+	if m.Reply == "" || h.Get("Ce-Type") == "" && !strings.HasPrefix(h.Get("Content-Type"), ceJSONContentType) {
+		return
+	}
+	reply, err := httpToNATS(m.Reply, h, body)
+	if err != nil {
+		l.Printf("⚠️  Invalid reply event from the sink: %v", err)
+		return
+	}
+	stampCausation(eventContext(context.Background(), m), reply)
+	if err := nc.PublishMsg(reply); err != nil {
+		l.Printf("⚠️  Could not publish the reply event: %v", err)
+	}
+}
+
+// ceOverrides returns the extensions of the K_CE_OVERRIDES variable.
+func ceOverrides(l *log.Logger) map[string]string {
+	raw := os.Getenv("K_CE_OVERRIDES")
+	if raw == "" {
+		return nil
+	}
+	var overrides struct {
+		Extensions map[string]string `json:"extensions"`
+	}
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		l.Printf("⚠️  Ignoring invalid K_CE_OVERRIDES: %v", err)
+		return nil
+	}
+	return overrides.Extensions
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// brokenBody fails after its first bytes, as a client gone mid-request.
+type brokenBody struct{ read bool }
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	if b.read {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b.read = true
+	return copy(p, `{"id":`), nil
+}
+
+func TestReceiveHTTPEventBody(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	nc := connectFake(t, &fakeNATS{}, l)
+	quotas := newQuotaEnforcer()
+	if err := quotas.load([]byte(`{"anonymous": {"rate": 100, "max_event_size": 64}}`)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		body         io.Reader
+		wantCode     int
+		wantTooLarge int64 // of the requests so far
+	}{
+		{"valid", strings.NewReader(`{"id":42}`), http.StatusAccepted, 0},
+		{"larger than max_event_size, chunked", strings.NewReader(strings.Repeat("x", 100)), http.StatusRequestEntityTooLarge, 1},
+		{"cut short", &brokenBody{}, http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/orders.created", tt.body)
+			r.ContentLength = -1 // unknown: the size is told while reading
+			for name, value := range map[string]string{"Ce-Id": "1", "Ce-Source": "/shop", "Ce-Type": "order.created", "Ce-Specversion": "1.0"} {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			receiveHTTPEvent(nc, l, "orders.>", false, quotas, nil, w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.wantCode)
+			}
+			if got := quotas.tenants[anonymousTenant].decisions[quotaTooLarge]; got != tt.wantTooLarge {
+				t.Errorf("too_large = %d, want %d", got, tt.wantTooLarge)
+			}
+		})
+	}
+}
+
+// enqueueEvents subscribes to events.> on nc, hands n events to pool, and
+// returns the subscription and its closed status.
+func enqueueEvents(t *testing.T, nc *nats.Conn, pool *sinkPool, n int) (*nats.Subscription, <-chan nats.SubStatus) {
+	t.Helper()
+	sub, err := nc.Subscribe("events.>", func(*nats.Msg) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		m := nats.NewMsg("events.created")
+		m.Header.Set("ce-id", strconv.Itoa(i))
+		pool.enqueue(m)
+	}
+	return sub, sub.StatusChanged(nats.SubscriptionClosed)
+}
+
+func TestSinkPoolDrainsAtShutdown(t *testing.T) {
+	var logs bytes.Buffer
+	l := log.New(&logs, "", 0)
+	nc := connectFake(t, &fakeNATS{}, l)
+	var sent atomic.Int64
+	pool := startSinkPool(l, func(ctx context.Context, m *nats.Msg) bool {
+		time.Sleep(10 * time.Millisecond)
+		sent.Add(1)
+		return true
+	})
+	sub, closed := enqueueEvents(t, nc, pool, 40)
+
+	deadline, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pool.stop(deadline, sub, closed)
+	if sent.Load() != 40 || pool.dropped.Load() != 0 {
+		t.Errorf("sent %d, dropped %d, want the 40 events waiting sent (logs: %s)", sent.Load(), pool.dropped.Load(), logs.String())
+	}
+}
+
+func TestSinkPoolDropsPastTheDeadline(t *testing.T) {
+	var logs bytes.Buffer
+	l := log.New(&logs, "", 0)
+	nc := connectFake(t, &fakeNATS{}, l)
+	pool := startSinkPool(l, func(ctx context.Context, m *nats.Msg) bool {
+		<-ctx.Done() // a sink that never answers
+		return false
+	})
+	sub, closed := enqueueEvents(t, nc, pool, 20)
+
+	deadline, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	pool.stop(deadline, sub, closed)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop took %v, want about the deadline", elapsed)
+	}
+	if got := pool.dropped.Load(); got != 20 {
+		t.Errorf("dropped %d, want the 20 events", got)
+	}
+	// The events still waiting are logged one by one, the ones being sent
+	// by the send that gave up; then the total.
+	if got, want := strings.Count(logs.String(), "not sent to the sink: shutdown deadline passed"), 20-httpSinkWorkers; got != want {
+		t.Errorf("%d events logged as dropped, want %d:\n%s", got, want, logs.String())
+	}
+	if !strings.Contains(logs.String(), "20 events not sent to the sink") {
+		t.Errorf("logs without the total:\n%s", logs.String())
+	}
+
+	// An event arriving after the stop is dropped too, not sent on a
+	// closed queue.
+	pool.enqueue(nats.NewMsg("events.late"))
+	if got := pool.dropped.Load(); got != 21 {
+		t.Errorf("dropped %d after a late event, want 21", got)
+	}
+	if pool.ctx.Err() == nil {
+		t.Error("the sends were not cancelled past the deadline")
+	}
+}
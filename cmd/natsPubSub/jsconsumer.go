@@ -0,0 +1,465 @@
+// jsconsumer.go — "sub" through a durable or an ordered JetStream consumer.
+//
+// CORE NATS VS JETSTREAM:
+//
+//	A plain subscription receives the messages published while it is
+//	connected, at most once. With -durable <name>, the "sub" mode reads
+//	the stream capturing -subject (or -stream) through a durable pull
+//	consumer instead: the server remembers what was acknowledged, so a
+//	restarted subscriber resumes where it stopped, and a message whose
+//	handling failed is delivered again.
+//
+//	  go run . -mode sub -subject "orders.>" -durable billing -max-in-flight 8 -adaptive
+//
+// IN-FLIGHT TUNING:
+//
+//	-batch          messages requested per pull (one round trip each)
+//	-max-in-flight  messages handled at the same time (1 keeps the order)
+//	-max-ack-pending  server side limit of the messages delivered and not
+//	                acknowledged yet, for all the instances of the consumer
+//	-adaptive       adapts the in-flight limit, between 1 and
+//	                -max-ack-pending, to the latency and the error rate of
+//	                the handler (see adaptive.go)
+//
+//	A message must be acknowledged within the AckWait of the consumer
+//	(30s) or it is delivered again: keep -batch small when the handler is
+//	slow.
+//
+// DELIVER GROUPS:
+//
+//	With -deliver-group <group>, the durable consumer is a push consumer
+//	instead: the server pushes the messages on a deliver subject, and the
+//	instances subscribing to it in the same queue group share them, each
+//	message going to one instance only. Start as many instances as needed
+//	with the same -durable and -deliver-group:
+//
+//	  go run . -mode sub -subject "orders.>" -durable billing -deliver-group billing
+//
+//	The deliver subject defaults to _push.<stream>.<durable>
+//	(-deliver-subject). Every -lag-interval, each instance logs its own
+//	throughput and lag (the age of the messages it handled, since they
+//	were stored), and the backlog of the consumer shared by all.
+//
+// ORDERED CONSUMER:
+//
+//	With -ordered, the stream is read through an ordered consumer: an
+//	ephemeral, read-only consumer delivering the messages strictly in
+//	stream order, one at a time, without acks. The client checks every
+//	sequence number; on a gap (a lost message, a missed heartbeat, a
+//	server restart) it recreates the consumer from the last message
+//	handled, so nothing is skipped nor handled twice.
+//
+//	  go run . -mode sub -subject "orders.>" -ordered -deliver all
+//
+//	Prefer it to a durable consumer to rebuild a projection or a cache,
+//	replay a stream, or follow a change log (KV watchers use it): one
+//	reader, strict order, nothing to acknowledge nor to clean up. Prefer a
+//	durable consumer when the work must be shared among instances, or may
+//	fail and be retried: an ordered consumer does not deliver a message
+//	again when its handling fails. To survive a restart without a replay,
+//	-positions keeps the last sequence handled in a store (see store.go).
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+const (
+	// defaultMaxAckPending is the JetStream default of MaxAckPending.
+	defaultMaxAckPending = 1000
+	// defaultPullBatch is the default number of messages per pull.
+	defaultPullBatch = 100
+	// consumerAckWait is how long the server waits for an ack before redelivering.
+	consumerAckWait = 30 * time.Second
+	// consumerNakDelay is the delay before a failed message is delivered again.
+	consumerNakDelay = time.Second
+	// consumerFetchWait bounds one pull when the stream is idle.
+	consumerFetchWait = 5 * time.Second
+	// defaultLagInterval is the default delay between two lag reports of a deliver group instance.
+	defaultLagInterval = 30 * time.Second
+)
+
+// deliverPolicies maps the values of -deliver to the JetStream policies.
+var deliverPolicies = map[string]jetstream.DeliverPolicy{
+	"all":              jetstream.DeliverAllPolicy,
+	"new":              jetstream.DeliverNewPolicy,
+	"last":             jetstream.DeliverLastPolicy,
+	"last-per-subject": jetstream.DeliverLastPerSubjectPolicy,
+}
+
+// consumerOptions holds the JetStream flags of the "sub" mode.
+type consumerOptions struct {
+	stream        string // stream name, looked up from the subject when empty
+	durable       string
+	ordered       bool
+	deliver       string // key of deliverPolicies
+	batch         int
+	maxInFlight   int
+	maxAckPending int
+	adaptive      bool
+	deliverGroup  string // push consumer shared by the instances of this queue group
+	deliverSubj   string
+	lagInterval   time.Duration
+	positions     *store.Positions // where the ordered consumer resumes, nil for -deliver
+}
+
+// consumeJetStream handles the messages of subject through the durable
+// consumer co.durable, acknowledging them when handle succeeds, until
+// interrupted. Nothing is pulled while flow is paused.
+func consumeJetStream(nc *nats.Conn, l *log.Logger, subject string, co consumerOptions, handle func(m *nats.Msg) error, flow *flowControl) {
+	ctx, stop := stopContext()
+	defer stop()
+	js, streamName := streamOf(ctx, nc, l, subject, co.stream)
+	cons, err := js.CreateOrUpdateConsumer(ctx, streamName, jetstream.ConsumerConfig{
+		Durable:       co.durable,
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       consumerAckWait,
+		MaxAckPending: co.maxAckPending,
+		DeliverPolicy: deliverPolicies[co.deliver],
+	})
+	if err != nil {
+		fail(l, exitFailure, "failed to create consumer %q on stream %q: %v", co.durable, streamName, err)
+	}
+
+	limit := newInFlightLimit(l, co.maxInFlight, co.maxAckPending, co.adaptive)
+	l.Printf("Consuming %q from stream %q with durable consumer %q — batch %d, in-flight %d, max ack pending %d (Ctrl+C to quit) …",
+		subject, streamName, co.durable, co.batch, limit.Limit(), co.maxAckPending)
+	sdNotify("READY=1")
+
+	var (
+		wg       sync.WaitGroup
+		inFlight atomic.Int64
+		done     = make(chan struct{}, 1) // a message was handled, a slot is free
+		acked    atomic.Int64
+		nakked   atomic.Int64
+	)
+	for ctx.Err() == nil {
+		// While paused, nothing is pulled: the messages wait in the stream.
+		if !flow.waitResumed(ctx) {
+			break
+		}
+		free := limit.Limit() - int(inFlight.Load())
+		if free <= 0 {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		batch, err := cons.Fetch(min(free, co.batch), jetstream.FetchMaxWait(consumerFetchWait))
+		if err != nil {
+			l.Printf("⚠️  Error pulling from %q: %v", streamName, err)
+			sleepCtx(ctx, consumerNakDelay)
+			continue
+		}
+		for jm := range batch.Messages() {
+			inFlight.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				err := handle(&nats.Msg{Subject: jm.Subject(), Header: jm.Headers(), Data: jm.Data()})
+				limit.Observe(time.Since(start), err)
+				if err != nil {
+					l.Printf("⚠️  %v — delivered again in %v", err, consumerNakDelay)
+					_ = jm.NakWithDelay(consumerNakDelay)
+					nakked.Add(1)
+				} else if err := jm.Ack(); err != nil {
+					l.Printf("⚠️  Failed to ack message on [%s]: %v", jm.Subject(), err)
+				} else {
+					acked.Add(1)
+				}
+				inFlight.Add(-1)
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			}()
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.Canceled) {
+			l.Printf("⚠️  Pull from %q ended with error: %v", streamName, err)
+		}
+	}
+
+	sdNotify("STOPPING=1")
+	l.Printf("🛑 Shutting down — waiting for %d message(s) being handled …", inFlight.Load())
+	wg.Wait()
+	l.Printf("👋 Bye! %d message(s) acknowledged, %d to be delivered again, in-flight limit %d", acked.Load(), nakked.Load(), limit.Limit())
+}
+
+// consumePushGroup handles the messages of subject delivered by the push
+// consumer co.durable to the instances of the deliver group co.deliverGroup,
+// until interrupted.
+func consumePushGroup(nc *nats.Conn, l *log.Logger, subject string, co consumerOptions, handle func(m *nats.Msg) error) {
+	ctx, stop := stopContext()
+	defer stop()
+	js, streamName := streamOf(ctx, nc, l, subject, co.stream)
+	deliverSubject := co.deliverSubj
+	if deliverSubject == "" {
+		deliverSubject = fmt.Sprintf("_push.%s.%s", streamName, co.durable)
+	}
+	cons, err := js.CreateOrUpdatePushConsumer(ctx, streamName, jetstream.ConsumerConfig{
+		Durable:        co.durable,
+		DeliverSubject: deliverSubject,
+		DeliverGroup:   co.deliverGroup,
+		FilterSubject:  subject,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        consumerAckWait,
+		MaxAckPending:  co.maxAckPending,
+		DeliverPolicy:  deliverPolicies[co.deliver],
+	})
+	if err != nil {
+		fail(l, exitFailure, "failed to create push consumer %q on stream %q: %v", co.durable, streamName, err)
+	}
+
+	var lag lagStats
+	cc, err := cons.Consume(func(jm jetstream.Msg) {
+		if meta, err := jm.Metadata(); err == nil {
+			lag.observe(time.Since(meta.Timestamp))
+		}
+		if err := handle(&nats.Msg{Subject: jm.Subject(), Header: jm.Headers(), Data: jm.Data()}); err != nil {
+			l.Printf("⚠️  %v — delivered again in %v", err, consumerNakDelay)
+			_ = jm.NakWithDelay(consumerNakDelay)
+			return
+		}
+		if err := jm.Ack(); err != nil {
+			l.Printf("⚠️  Failed to ack message on [%s]: %v", jm.Subject(), err)
+		}
+	}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		l.Printf("⚠️  Push consumer %q: %v", co.durable, err)
+	}))
+	if err != nil {
+		fail(l, exitFailure, "failed to consume %q: %v", co.durable, err)
+	}
+	l.Printf("Consuming %q from stream %q with push consumer %q, deliver group %q on %q (Ctrl+C to quit) …",
+		subject, streamName, co.durable, co.deliverGroup, deliverSubject)
+	sdNotify("READY=1")
+
+	ticker := time.NewTicker(co.lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, avg, worst := lag.reset()
+			pending, ackPending := "?", "?"
+			if info, err := cons.Info(ctx); err == nil {
+				pending, ackPending = fmt.Sprint(info.NumPending), fmt.Sprint(info.NumAckPending)
+			}
+			l.Printf("📊 This instance: %d msg(s) (%.1f/s), lag avg %v max %v — consumer %q: %s pending, %s awaiting ack",
+				n, float64(n)/co.lagInterval.Seconds(), avg.Round(time.Millisecond), worst.Round(time.Millisecond), co.durable, pending, ackPending)
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			// Drain lets the messages being handled be acknowledged; the
+			// ones not delivered yet go to the other instances.
+			cc.Drain()
+			<-cc.Closed()
+			l.Println("👋 Bye!")
+			return
+		}
+	}
+}
+
+// lagStats accumulates the lag of the messages handled by an instance:
+// the time between their storage in the stream and their delivery.
+type lagStats struct {
+	mu         sync.Mutex
+	n          int
+	sum, worst time.Duration
+}
+
+func (s *lagStats) observe(lag time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	s.sum += lag
+	s.worst = max(s.worst, lag)
+}
+
+// reset returns the count, the mean and the maximum lag since the previous
+// reset, and starts over.
+func (s *lagStats) reset() (n int, avg, worst time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, worst = s.n, s.worst
+	if n > 0 {
+		avg = s.sum / time.Duration(n)
+	}
+	s.n, s.sum, s.worst = 0, 0, 0
+	return n, avg, worst
+}
+
+// consumeOrdered handles the messages of subject in stream order through an
+// ordered consumer, until interrupted.
+func consumeOrdered(nc *nats.Conn, l *log.Logger, subject string, co consumerOptions, handle func(m *nats.Msg) error) {
+	ctx, stop := stopContext()
+	defer stop()
+	js, streamName := streamOf(ctx, nc, l, subject, co.stream)
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+		DeliverPolicy:  deliverPolicies[co.deliver],
+	}
+	// With -positions, the consumer starts after the last message handled
+	// by the previous run (see store.go).
+	var handledSeq atomic.Uint64
+	stopSaving := func() {}
+	if co.positions != nil {
+		key := positionKey(streamName, subject)
+		last, err := co.positions.Load(ctx, key)
+		if err != nil {
+			fail(l, exitFailure, "failed to load the position of %q: %v", subject, err)
+		}
+		if last > 0 {
+			cfg.DeliverPolicy, cfg.OptStartSeq = jetstream.DeliverByStartSequencePolicy, last+1
+			l.Printf("⏩ Resuming after stream sequence %d, the last one handled (-positions)", last)
+		}
+		handledSeq.Store(last)
+		stopSaving = savePositions(l, co.positions, key, &handledSeq)
+	}
+	cons, err := js.OrderedConsumer(ctx, streamName, cfg)
+	if err != nil {
+		fail(l, exitFailure, "failed to create an ordered consumer on stream %q: %v", streamName, err)
+	}
+
+	var handled, failed, lastSeq atomic.Uint64
+	cc, err := cons.Consume(func(jm jetstream.Msg) {
+		meta, metaErr := jm.Metadata()
+		if metaErr == nil {
+			lastSeq.Store(meta.Sequence.Stream)
+		}
+		// Nothing is acknowledged: a failed message is reported, not retried.
+		err := handle(&nats.Msg{Subject: jm.Subject(), Header: jm.Headers(), Data: jm.Data()})
+		if metaErr == nil {
+			handledSeq.Store(meta.Sequence.Stream)
+		}
+		if err != nil {
+			l.Printf("⚠️  %v", err)
+			failed.Add(1)
+			return
+		}
+		handled.Add(1)
+	}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		l.Printf("⚠️  Ordered consumer: %v — recreating it after stream sequence %d", err, lastSeq.Load())
+	}))
+	if err != nil {
+		fail(l, exitFailure, "failed to consume stream %q: %v", streamName, err)
+	}
+	l.Printf("Reading %q in order from stream %q, delivering %s (Ctrl+C to quit) …", subject, streamName, co.deliver)
+	sdNotify("READY=1")
+
+	<-ctx.Done()
+	sdNotify("STOPPING=1")
+	cc.Stop()
+	stopSaving()
+	l.Printf("👋 Bye! %d message(s) handled, %d failed, last stream sequence %d", handled.Load(), failed.Load(), lastSeq.Load())
+}
+
+// streamOf returns the JetStream context of nc and the stream to read:
+// streamName, or the stream capturing subject when it is empty.
+func streamOf(ctx context.Context, nc *nats.Conn, l *log.Logger, subject, streamName string) (jetstream.JetStream, string) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fail(l, exitFailure, "failed to create JetStream context: %v", err)
+	}
+	if streamName == "" {
+		if streamName, err = js.StreamNameBySubject(ctx, subject); err != nil {
+			fail(l, exitFailure, "no stream captures %q, create one or use -stream: %v", subject, err)
+		}
+	}
+	return js, streamName
+}
+
+// readStored calls fn with every message of subject stored in the stream
+// (streamName, or the stream capturing subject) and its metadata (stream
+// sequence, timestamp), up to the last one stored when it starts, through
+// an ordered consumer that changes nothing on the server. It returns the
+// number of messages read, fewer when ctx is done first (Ctrl+C).
+func readStored(ctx context.Context, nc *nats.Conn, l *log.Logger, subject, streamName string, fn func(m *nats.Msg, meta *jetstream.MsgMetadata)) int {
+	js, streamName := streamOf(ctx, nc, l, subject, streamName)
+	read, err := readStream(ctx, js, l, subject, streamName, time.Time{}, fn)
+	if err != nil {
+		fail(l, exitFailure, "%v", err)
+	}
+	return read
+}
+
+// readStream is readStored on a given stream, from the first message stored
+// at or after since (the first one of the stream when zero), returning the
+// errors instead of exiting.
+func readStream(ctx context.Context, js jetstream.JetStream, l *log.Logger, subject, streamName string, since time.Time, fn func(m *nats.Msg, meta *jetstream.MsgMetadata)) (int, error) {
+	// A live stream keeps growing: the reading ends at the last message
+	// stored when it starts.
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stream %q: %w", streamName, err)
+	}
+	lastSeq := stream.CachedInfo().State.LastSeq
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	}
+	if !since.IsZero() {
+		cfg.DeliverPolicy, cfg.OptStartTime = jetstream.DeliverByStartTimePolicy, &since
+	}
+	cons, err := js.OrderedConsumer(ctx, streamName, cfg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create an ordered consumer on stream %q: %w", streamName, err)
+	}
+	it, err := cons.Messages()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stream %q: %w", streamName, err)
+	}
+	defer it.Stop()
+	// The messages to read are those already delivered plus the pending ones.
+	info, err := cons.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the consumer of stream %q: %w", streamName, err)
+	}
+	total := info.Delivered.Consumer + info.NumPending
+	if total == 0 || lastSeq == 0 {
+		l.Printf("🤷 No message of %q in stream %q", subject, streamName)
+		return 0, nil
+	}
+
+	l.Printf("🔎 Reading %d message(s) of %q in stream %q (Ctrl+C to stop earlier) …", total, subject, streamName)
+	read := 0
+	for {
+		jm, err := it.Next(jetstream.NextContext(ctx))
+		if err != nil {
+			if ctx.Err() == nil {
+				l.Printf("⚠️  Reading interrupted: %v", err)
+			}
+			return read, nil
+		}
+		meta, err := jm.Metadata()
+		if err != nil {
+			continue
+		}
+		if meta.Sequence.Stream > lastSeq {
+			return read, nil // stored after the reading started
+		}
+		fn(&nats.Msg{Subject: jm.Subject(), Header: jm.Headers(), Data: jm.Data()}, meta)
+		read++
+		// The last message stored when the reading started, or the last one
+		// of subject so far when that one does not match.
+		if meta.Sequence.Stream >= lastSeq || meta.NumPending == 0 {
+			return read, nil
+		}
+	}
+}
+
+// deliverNames returns the valid values of -deliver, for the error messages.
+func deliverNames() string {
+	return fmt.Sprintf("%q, %q, %q or %q", "all", "new", "last", "last-per-subject")
+}
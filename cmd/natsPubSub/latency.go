@@ -0,0 +1,237 @@
+// latency.go — End-to-end latency report corrected for the clock skew.
+//
+// WHY THE CLOCKS MATTER:
+//
+//	The end-to-end latency of an event is the time of its reception minus
+//	its CloudEvents "time" attribute, stamped by the producer on another
+//	machine. Two clocks synchronized by NTP still differ by a few
+//	milliseconds, often more in containers and VMs: a latency of 3ms
+//	measured across machines may be 12ms or "-6ms". The "latency" mode
+//	estimates the offset of the clock of every producer host before
+//	measuring, and corrects the latencies with it:
+//
+//	  go run . -mode latency -subject "orders.>" -observe 1m
+//
+// SKEW ESTIMATION:
+//
+//	The long-running components of the fleet answer the pings on
+//	_sys.app.ping with a heartbeat stamped with their clock (see
+//	heartbeat.go). Sending a ping at t0 and receiving a heartbeat stamped
+//	t1 at t2, the clock of its host is ahead of the local one by:
+//
+//	  offset = t1 - (t0 + t2) / 2      within ± (t2 - t0) / 2
+//
+//	the NTP formula, assuming both legs take the same time. Several probes
+//	are sent, at the start and at the end of the observation, and the one
+//	with the shortest round trip is kept per host. Every host producing
+//	events needs a component answering the pings (any "sub", "edge",
+//	"http" … instance, with -heartbeat > 0).
+//
+// EVENTS AND HOSTS:
+//
+//	An event is matched to the host of its producer by its "source": the
+//	host of a URL source (https://shop-eu-1/orders), or the last segment
+//	of a path-like source (natsPubSub/shop-eu-1) or the source itself. The
+//	latencies of the sources whose host did not answer are reported
+//	uncorrected.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/heartbeat"
+)
+
+const (
+	// clockProbes is the number of pings sent at each probing, clockProbeWait
+	// how long the answers of one ping are awaited.
+	clockProbes    = 5
+	clockProbeWait = 500 * time.Millisecond
+)
+
+// clockOffset is the estimated offset of the clock of a host, ahead of the
+// local clock when positive.
+type clockOffset struct {
+	offset, rtt time.Duration
+}
+
+// latencySample accumulates the latencies of the events by source.
+type latencySample struct {
+	mu        sync.Mutex
+	bySource  map[string][]time.Duration
+	untimed   int
+	truncated bool
+}
+
+// latency measures the end-to-end latency of the events of subject during
+// window, corrected for the clock skew of their producers, then reports it.
+func latency(nc *nats.Conn, l *log.Logger, subject string, window time.Duration) {
+	offsets := make(map[string]clockOffset)
+	probeClocks(nc, l, offsets)
+
+	s := &latencySample{bySource: make(map[string][]time.Duration)}
+	sub, err := nc.Subscribe(subject, s.add)
+	if err != nil {
+		fail(l, exitConnection, "failed to subscribe to %q: %v", subject, err)
+	}
+
+	ctx, stop := stopContext()
+	defer stop()
+	l.Printf("⏱️  Measuring the latency of %q for %v (Ctrl+C to stop earlier) …", subject, window)
+	start := time.Now()
+	sleepCtx(ctx, window)
+	if err := sub.Unsubscribe(); err != nil {
+		l.Printf("⚠️  Error unsubscribing: %v", err)
+	}
+	elapsed := time.Since(start)
+	probeClocks(nc, l, offsets)
+	s.report(l, offsets, elapsed)
+}
+
+// probeClocks pings the fleet clockProbes times and keeps in offsets, per
+// host, the estimate of the shortest round trip. Every ping has its own
+// reply subject, so a late answer is not taken for the answer of the next.
+func probeClocks(nc *nats.Conn, l *log.Logger, offsets map[string]clockOffset) {
+	var mu sync.Mutex
+	sentAt := make(map[string]time.Time) // reply subject → t0
+	inbox := nc.NewInbox()
+	sub, err := nc.Subscribe(inbox+".*", func(m *nats.Msg) {
+		t2 := time.Now()
+		ev, ok := decodeCloudEvent(m)
+		status, err := heartbeat.Decode(m.Data)
+		t1, timeErr := time.Parse(time.RFC3339Nano, ev.Attributes["time"])
+		if !ok || err != nil || timeErr != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		t0 := sentAt[m.Subject]
+		rtt := t2.Sub(t0)
+		estimate := clockOffset{offset: t1.Sub(t0.Add(rtt / 2)), rtt: rtt}
+		if previous, seen := offsets[status.Host]; !seen || rtt < previous.rtt {
+			offsets[status.Host] = estimate
+		}
+	})
+	if err != nil {
+		l.Printf("⚠️  Failed to probe the clocks, latencies left uncorrected: %v", err)
+		return
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	for i := range clockProbes {
+		reply := fmt.Sprintf("%s.%d", inbox, i)
+		mu.Lock()
+		sentAt[reply] = time.Now()
+		mu.Unlock()
+		err := nc.PublishRequest(heartbeat.PingSubject, reply, nil)
+		if err == nil {
+			err = nc.Flush()
+		}
+		if err != nil {
+			l.Printf("⚠️  Failed to ping the fleet: %v", err)
+			return
+		}
+		time.Sleep(clockProbeWait)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(offsets) == 0 {
+		l.Printf("⚠️  No component answered on %q, latencies left uncorrected", heartbeat.PingSubject)
+	}
+	for host, o := range offsets {
+		l.Printf("🕰️  Clock of %s: %s ± %v", host, signed(o.offset), (o.rtt / 2).Round(10*time.Microsecond))
+	}
+}
+
+// add records the raw latency of one event, it is the subscription handler.
+func (s *latencySample) add(m *nats.Msg) {
+	received := time.Now()
+	ev, ok := decodeCloudEvent(m)
+	sent, err := time.Parse(time.RFC3339Nano, ev.Attributes["time"])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok || err != nil {
+		s.untimed++
+		return
+	}
+	source := ev.Attributes["source"]
+	if _, seen := s.bySource[source]; !seen && len(s.bySource) >= maxTrackedValues {
+		s.truncated = true
+		return
+	}
+	s.bySource[source] = append(s.bySource[source], received.Sub(sent))
+}
+
+// report prints the latencies of every source, raw and corrected.
+func (s *latencySample) report(l *log.Logger, offsets map[string]clockOffset, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.bySource) == 0 {
+		l.Printf("🤷 No timed event received in %v (%d without time attribute), nothing to report", elapsed.Round(time.Second), s.untimed)
+		return
+	}
+	sources := slices.SortedFunc(maps.Keys(s.bySource), func(a, b string) int { return cmp.Compare(len(s.bySource[b]), len(s.bySource[a])) })
+
+	for _, source := range sources {
+		raw := s.bySource[source]
+		slices.Sort(raw)
+		host := sourceHost(source)
+		o, known := offsets[host]
+		l.Printf("📨 %s — %d event(s), raw latency %s", source, len(raw), latencySummary(raw, 0))
+		if !known {
+			l.Printf("   ⚠️  no clock estimate for the host %q, latency left uncorrected", host)
+			continue
+		}
+		l.Printf("   ✅ corrected for the clock of %s (%s ± %v): %s",
+			host, signed(o.offset), (o.rtt / 2).Round(10*time.Microsecond), latencySummary(raw, o.offset))
+		if raw[0]+o.offset < -o.rtt/2 {
+			l.Printf("   ⚠️  negative corrected latencies: the clock of %s drifted during the measure", host)
+		}
+	}
+	if s.untimed > 0 {
+		l.Printf("ℹ️  %d message(s) without CloudEvents time attribute ignored", s.untimed)
+	}
+	if s.truncated {
+		l.Printf("ℹ️  More than %d sources, the others were ignored", maxTrackedValues)
+	}
+}
+
+// latencySummary returns the percentiles of the sorted latencies, shifted
+// by offset.
+func latencySummary(sorted []time.Duration, offset time.Duration) string {
+	at := func(p int) time.Duration {
+		return (percentile(sorted, p) + offset).Round(10 * time.Microsecond)
+	}
+	return fmt.Sprintf("min %v, p50 %v, p90 %v, p99 %v, max %v",
+		(sorted[0] + offset).Round(10*time.Microsecond), at(50), at(90), at(99), (sorted[len(sorted)-1] + offset).Round(10*time.Microsecond))
+}
+
+// signed returns the clock offset d with its sign.
+func signed(d time.Duration) string {
+	d = d.Round(10 * time.Microsecond)
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
+
+// sourceHost returns the host of the producer of the events of source: the
+// host of a URL, the last segment of a path, or source itself.
+func sourceHost(source string) string {
+	if u, err := url.Parse(source); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return source[strings.LastIndex(source, "/")+1:]
+}
@@ -32,75 +32,568 @@
 //
 //	You should see the subscriber terminal print the received message.
 //
+//	Edge mode (store-and-forward agent, see edge.go):
+//	  go run . -mode edge -subject "sensors.>" -edge-url nats://127.0.0.1:4223 -url nats://hub:4222
+//
+//	Advise mode (stream tuning suggestions, see advise.go):
+//	  go run . -mode advise -stream ORDERS -observe 1m
+//
+//	Analyze mode (payload sizes and cardinality of a subject, see analyze.go):
+//	  go run . -mode analyze -subject "orders.>" -observe 5m
+//
+//	GraphQL mode (subscription gateway for web clients, see graphql.go):
+//	  go run . -mode graphql -subject "orders.>" -listen :8080
+//
+//	AMQP mode (RabbitMQ bridge in both directions, see amqp.go):
+//	  go run . -mode amqp -subject "orders.>" -amqp-exchange orders -amqp-queue from-rabbit
+//
+//	Connector mode (Google Pub/Sub, AWS SNS/SQS relay, see connector.go):
+//	  go run . -mode connector -subject "orders.>" -sink gcppubsub://projects/acme/topics/orders
+//
+//	Request mode (request-reply, scatter-gather with -max-replies, see request.go):
+//	  go run . -mode request -subject "inventory.stock.42" -msg "" -max-replies 0 -timeout 1s
+//
+//	Flow mode (Mermaid or Graphviz diagram of the event flows, see flow.go):
+//	  go run . -mode flow -subject ">" -observe 10m > flows.mmd
+//
+//	Replay mode (stored events published again at a chosen pace, see replay.go):
+//	  go run . -mode replay -subject "orders.>" -speed 10x -as-of first
+//
+//	Audit mode (duplicates, gaps and late events kept in a stream, see audit.go):
+//	  go run . -mode audit -subject "orders.>" -sequence-field seq
+//
+//	HTTP mode (CloudEvents over HTTP, Knative sink/source, see httpbridge.go):
+//	  go run . -mode http -subject "orders.>" -listen :8080 -sink http://broker-ingress/default/default
+//
+//	Latency mode (end-to-end latency corrected for the clock skew, see latency.go):
+//	  go run . -mode latency -subject "orders.>" -observe 1m
+//
+//	Conformance mode (CloudEvents test vectors for other languages, see conformance.go):
+//	  go run . -mode conformance -subject conformance
+//
+//	Trace mode (timeline and narrative of an event chain, see trace.go):
+//	  go run . -mode trace -subject ">" -trace-id 8fQf2oKkD5sFqyx3Xa1xWc
+//
 // NATS DEFAULT URL:
 //
 //	By default the client connects to nats://127.0.0.1:4222 (nats.DefaultURL).
 //	You can override this with the -url flag if your server runs elsewhere.
+//	Where only port 443 goes out, use the WebSocket port of the server
+//	(-url wss://nats.example.com:443, -ws-path when behind a reverse proxy),
+//	and -proxy when the egress goes through an HTTP or SOCKS5 proxy; -ip
+//	restricts the connections to IPv4 or IPv6 (see pkg/transport).
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/codec"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/transport"
 )
 
 const (
 	APP        = "natsPubSub"
 	VERSION    = "0.1.0"
 	REPOSITORY = "https://github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats"
-	// modePub and modeSub are the two operating modes of this program.
-	modePub = "pub"
-	modeSub = "sub"
+	// modePub, modeSub, modeEdge, modeReconcile, modeAdvise, modeAnalyze, modeAudit,
+	// modeFlow, modeReplay, modeGraphQL, modeAMQP, modeConnector, modeHTTP,
+	// modeRequest, modeLatency, modeConformance and modeTrace are the operating
+	// modes of this program.
+	modePub         = "pub"
+	modeSub         = "sub"
+	modeEdge        = "edge"
+	modeReconcile   = "reconcile"
+	modeAdvise      = "advise"
+	modeAnalyze     = "analyze"
+	modeAudit       = "audit"
+	modeFlow        = "flow"
+	modeReplay      = "replay"
+	modeGraphQL     = "graphql"
+	modeAMQP        = "amqp"
+	modeConnector   = "connector"
+	modeHTTP        = "http"
+	modeRequest     = "request"
+	modeLatency     = "latency"
+	modeConformance = "conformance"
+	modeTrace       = "trace"
 )
 
+// modes lists the valid values of the -mode flag.
+var modes = []string{modePub, modeSub, modeEdge, modeReconcile, modeAdvise, modeAnalyze, modeAudit, modeFlow, modeReplay, modeGraphQL, modeAMQP, modeConnector, modeHTTP, modeRequest, modeLatency, modeConformance, modeTrace}
+
+// modesWithoutSubject lists the modes that do not work on a single -subject.
+var modesWithoutSubject = []string{modeReconcile, modeAdvise}
+
 func main() {
+	// "natsPubSub service …" manages the systemd unit / Windows service,
+	// "natsPubSub deploy …" renders Kubernetes manifests, "natsPubSub schema …"
+	// checks event contracts, everything else runs the program (possibly
+	// under the service manager).
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case cmdService:
+			serviceCommand(os.Args[2:])
+			return
+		case cmdDeploy:
+			deployCommand(os.Args[2:])
+			return
+		case cmdSchema:
+			schemaCommand(os.Args[2:])
+			return
+		}
+	}
+	runService(run)
+}
+
+// run parses the flags, connects to NATS and dispatches to the selected mode.
+func run() {
 	// ─── CLI Flag Definitions ──────────────────────────────────────────
 	// flag.String returns a *string; we dereference them below after Parse().
-	mode := flag.String("mode", "", `Operating mode: "pub" (publish) or "sub" (subscribe) — required`)
-	subject := flag.String("subject", "", "NATS subject (topic) to publish/subscribe to — required")
-	msg := flag.String("msg", "", `Message payload to publish — required only in "pub" mode`)
+	mode := flag.String("mode", "", `Operating mode: "pub" (publish), "sub" (subscribe), "edge" (store-and-forward), "reconcile" (stream specs), "advise" (stream tuning), "analyze" (traffic report), "audit" (stream data quality), "flow" (event flow diagram), "replay" (stored events at a chosen pace), "graphql" (subscription gateway), "amqp" (RabbitMQ bridge), "connector" (GCP/AWS relay), "http" (CloudEvents over HTTP, Knative), "request" (request-reply, scatter-gather), "latency" (end-to-end latency, clock skew corrected), "conformance" (CloudEvents test vectors) or "trace" (timeline of an event chain) — required`)
+	subject := flag.String("subject", "", `NATS subject (topic) to publish/subscribe to — required, except in "reconcile" and "advise" modes`)
+	msg := flag.String("msg", "", `Message payload to publish — required in "pub" mode, the request payload in "request" mode`)
 	natsURL := flag.String("url", nats.DefaultURL, "NATS server URL (default: nats://127.0.0.1:4222)")
+	edgeURL := flag.String("edge-url", defaultEdgeURL, `Local leafnode NATS server URL used as buffer — only in "edge" mode`)
+	edgeStream := flag.String("edge-stream", defaultEdgeStream, `Local JetStream stream buffering events — only in "edge" mode`)
+	drURL := flag.String("dr-url", "", `Disaster recovery cluster URL(s), used after a prolonged primary outage — only in "pub" and "sub" modes`)
+	proxyURL := flag.String("proxy", "", "HTTP or SOCKS5 proxy the NATS connections go through: http://[user:password@]host:port or socks5://[user:password@]host:port")
+	ipVersion := flag.String("ip", "", `Restrict the NATS connections to IPv4 ("4") or IPv6 ("6"), both by default`)
+	wsPath := flag.String("ws-path", "", "Path of the NATS WebSocket endpoint behind a reverse proxy (e.g. /nats), with ws:// and wss:// URLs")
+	failoverAfter := flag.Duration("failover-after", defaultFailoverAfter, "How long the primary cluster may stay unreachable before failing over to -dr-url")
+	credsFile := flag.String("creds", "", "NATS credentials file (user JWT + seed, see cmd/natsAuth) — replaces the user/password environment variables")
+	tlsCert := flag.String("tls-cert", "", "Client TLS certificate file (PEM) — loaded again on every reconnect")
+	tlsKey := flag.String("tls-key", "", "Client TLS private key file (PEM) — required with -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA certificate file (PEM) used to verify the NATS server")
+	drainTimeout := flag.Duration("drain-timeout", nats.DefaultDrainTimeout, "How long the connection may drain on shutdown (messages being handled, pending publishes) before it is closed, a second SIGINT/SIGTERM forces it")
+	reloadInterval := flag.Duration("reload-interval", defaultReloadInterval, "How often creds/TLS files and the -handler-config file are checked for changes, 0 disables polling (SIGHUP always reloads)")
+	reloadJitter := flag.Duration("reload-jitter", defaultReloadJitter, "Maximum random delay before re-authenticating after a rotation")
+	specsDir := flag.String("specs", defaultSpecsDir, `Directory of stream/consumer JSON specs — only in "reconcile" mode`)
+	reconcileInterval := flag.Duration("reconcile-interval", defaultReconcileInterval, `Delay between two reconciliations — only in "reconcile" mode`)
+	dryRun := flag.Bool("dry-run", false, `Only log the drift, do not change the server — in "reconcile" mode; print the test vectors as JSON, without connecting — in "conformance" mode`)
+	expectVersion := flag.Int("expect-version", 0, `Upcast CloudEvents to this data version before handling them, 0 prints raw messages — only in "sub" mode`)
+	listenAddr := flag.String("listen", defaultListenAddr, `HTTP listen address — only in "graphql" and "http" modes`)
+	allowOrigin := flag.String("allow-origin", "", `Comma separated host patterns of the web pages allowed to open a WebSocket (e.g. "app.example.com,*.example.org") — only in "graphql" mode`)
+	amqpURL := flag.String("amqp-url", "", `RabbitMQ URL, defaults to the AMQP_URL environment variable, then `+defaultAMQPURL+` — only in "amqp" mode`)
+	amqpExchange := flag.String("amqp-exchange", "", `RabbitMQ exchange receiving the NATS messages of -subject — only in "amqp" mode`)
+	amqpQueue := flag.String("amqp-queue", "", `RabbitMQ queue whose messages are published on NATS — only in "amqp" mode`)
+	sinkURL := flag.String("sink", "", `Cloud destination of the -subject messages: gcppubsub://projects/<p>/topics/<t>, awssns:///<topic-arn> or awssqs://<queue-host>/<account>/<queue> in "connector" mode, the http(s) URL receiving the CloudEvents (default: K_SINK) in "http" mode`)
+	sourceURL := flag.String("source", "", `Cloud origin of the messages published on NATS: gcppubsub://projects/<p>/subscriptions/<s> or awssqs://<queue-host>/<account>/<queue> — only in "connector" mode`)
+	headers := headerFlag{}
+	flag.Var(headers, "header", `Header key=value added to the message, can be repeated — only in "pub" and "request" modes`)
+	headerFile := flag.String("header-file", "", `File of headers added to the message, one "Key: value" or "key=value" per line — only in "pub" and "request" modes`)
+	headerMatch := headerFlag{}
+	flag.Var(headerMatch, "match-header", `Only print the messages whose header key matches the value pattern (e.g. ce-type=order.*), can be repeated — only in "sub" mode`)
+	maxReplies := flag.Int("max-replies", 1, `Number of replies to wait for, 0 collects all the replies until -timeout (scatter-gather) — only in "request" mode`)
+	timeout := flag.Duration("timeout", defaultRequestTimeout, `How long replies are awaited — only in "request" and "conformance" modes`)
+	retryNoResponder := flag.Bool("retry-on-no-responder", false, `Send the request again while nobody subscribes to the subject, until -timeout — only in "request" mode`)
+	oversize := flag.String("oversize", oversizeReject, `What to do with a message larger than the max_payload of the server: "reject" or "compress" (gzip) — only in "pub" mode`)
+	reply := flag.Bool("reply", false, `Publish the received events as NATS requests and return the reply as a Knative reply event in "http" mode; answer the test vectors as the reference consumer in "conformance" mode`)
+	spoolDir := flag.String("spool", "", `Directory, or bolt:// or redis:// store (see store.go), of the at-least-once spool: a message that cannot be published is kept there and published first by the next run, which only flushes the spool without -msg — only in "pub" mode`)
+	fallbackSubject := flag.String("fallback-subject", "", `Subject a message denied by the permissions of the user is published on instead, with a Denied-Subject header (see fallback.go) — only in "pub" mode`)
+	codecName := flag.String("codec", "", `Codec of the event data among the registered ones (see codec.go): "pub" encodes the JSON -msg with it, "sub" decodes the data with it — only in "pub" and "sub" modes`)
+	ceBatch := flag.Bool("ce-batch", false, `-msg is a JSON array of structured CloudEvents, published in one message (application/cloudevents-batch+json) — only in "pub" mode`)
+	schemaFile := flag.String("schema", "", `JSON Schema, Avro (.avsc) or Protobuf (.proto, file#Message) schema the -msg payload must match before being published — only in "pub" mode`)
+	streamName := flag.String("stream", "", `JetStream stream to inspect — required in "advise" mode; in "sub" mode with -durable or -ordered and in "audit" and "replay" modes, the stream to read, looked up from -subject by default; in "flow" mode, read the events kept in this stream instead of observing the traffic; in "trace" mode, the comma separated streams searched, all of them by default`)
+	dedupSource := flag.String("dedup", "", `Store of the ids of the events handled, memory:, bolt://<file>, kv://<bucket> or redis://<host> (see store.go): an event delivered again within -dedup-window is skipped — only in "sub" mode`)
+	dedupWindow := flag.Duration("dedup-window", defaultDedupWindow, `How long the ids of the events handled are kept by -dedup — only in "sub" mode`)
+	positionsSource := flag.String("positions", "", `Store of the last stream sequence handled by the -ordered consumer, resumed after on the next run, memory:, bolt://<file>, kv://<bucket> or redis://<host> (see store.go) — only in "sub" mode`)
+	durable := flag.String("durable", "", `Durable JetStream consumer reading the messages of -subject, acknowledged once handled — only in "sub" mode`)
+	ordered := flag.Bool("ordered", false, `Read the stream of -subject in strict order through an ordered consumer (read-only, recreated on gaps, no ack) — only in "sub" mode`)
+	deliver := flag.String("deliver", "all", `Where a -durable (when created) or -ordered consumer starts: "all", "new", "last" or "last-per-subject" — only in "sub" mode`)
+	deliverGroup := flag.String("deliver-group", "", `Share the -durable consumer among the instances of this deliver group (JetStream push consumer, queue group) — only in "sub" mode`)
+	deliverSubject := flag.String("deliver-subject", "", `Subject the -deliver-group push consumer delivers to, defaults to _push.<stream>.<durable> — only in "sub" mode`)
+	lagInterval := flag.Duration("lag-interval", defaultLagInterval, `Delay between two throughput and lag reports of a -deliver-group instance — only in "sub" mode`)
+	batch := flag.Int("batch", defaultPullBatch, `Messages requested per pull from the -durable consumer — only in "sub" mode`)
+	maxInFlight := flag.Int("max-in-flight", 1, `Messages of the -durable consumer handled at the same time, 1 keeps the order — only in "sub" mode`)
+	maxAckPending := flag.Int("max-ack-pending", defaultMaxAckPending, `Messages delivered and not acknowledged yet allowed by the server, for all the instances of the -durable consumer — only in "sub" mode`)
+	adaptive := flag.Bool("adaptive", false, `Adapt the in-flight limit of the -durable consumer to the latency and the error rate of the handler, up to -max-ack-pending — only in "sub" mode`)
+	sample := flag.String("sample", "", `Only handle a share of the matching messages, at random ("1%") or one in n ("1/100"), recorded in a Sample-Rate header — only in "sub" mode`)
+	slos := sloFlag{}
+	flag.Var(&slos, "slo", `Service level objective "<type>=<percent>%<<latency>" (e.g. order.created=99%<500ms, "*" for every type): share of the events handled within this end-to-end latency, burn rate logged when violated, can be repeated — only in "sub" mode`)
+	sloWindow := flag.Duration("slo-window", defaultSLOWindow, `Window the -slo objectives are evaluated over, and over its twelfth — only in "sub" mode`)
+	maxEventSize := flag.Int("max-event-size", defaultMaxEventSize, `Largest payload handled, in bytes, compressed or inflated, larger ones are rejected (see guard.go) — only in "sub" mode`)
+	maxJSONDepth := flag.Int("max-json-depth", defaultMaxJSONDepth, `Deepest nesting of the JSON payloads handled, deeper ones are rejected before being decoded — only in "sub" mode`)
+	strict := flag.Bool("strict", false, `Reject the messages that are not CloudEvents valid for the specification (attributes, time, data) — only in "sub" mode`)
+	quarantineSubject := flag.String("quarantine-subject", "", `Subject the rejected messages are published on, with Quarantine-Reason and Quarantine-Subject headers, instead of being dropped — only in "sub" mode`)
+	authConfigSource := flag.String("auth-config", "", `JSON file or kv://<bucket>/<key> of the API keys, OIDC provider and subjects allowed to each identity (see auth.go), applied live on every change — only in "http" and "graphql" modes`)
+	quotaConfigSource := flag.String("quota-config", "", `JSON file or kv://<bucket>/<key> of the API keys and quotas of the tenants (see quota.go), applied live on every change — only in "http" mode`)
+	handlerConfigSource := flag.String("handler-config", "", `JSON file or kv://<bucket>/<key> of filters, routes and handler settings, applied live on every change (replaces -match-header, -expect-version and -sample) — only in "sub" mode`)
+	sequenceField := flag.String("sequence-field", defaultSequenceField, `Field of the event data holding the sequence number of its producer, checked for gaps — only in "audit" mode`)
+	diagram := flag.String("diagram", diagramMermaid, `Format of the diagram printed on stdout: "mermaid" or "dot" (Graphviz) — only in "flow" mode`)
+	replayPrefix := flag.String("replay-prefix", defaultReplayPrefix, `Prefix of the subjects the replayed messages are published on (<prefix>.<subject>) — only in "replay" mode`)
+	speed := flag.String("speed", "", `Replay pace relative to the original one, e.g. 10x or 0.5x, as fast as possible by default — only in "replay" mode`)
+	realtime := flag.Bool("realtime", false, `Replay at the original pace, same as -speed 1x — only in "replay" mode`)
+	asOf := flag.String("as-of", "", `Rewrite the CloudEvents time of the replayed events as if this instant (RFC 3339, or "first" for the first replayed message) were now, scaled by -speed — only in "replay" mode`)
+	traceID := flag.String("trace-id", "", `CloudEvents id or correlationid of the events to trace — required in "trace" mode`)
+	since := flag.Duration("since", 0, `Only search the events stored during this last duration, 0 for all of them — only in "trace" mode`)
+	observe := flag.Duration("observe", defaultObserveWindow, `Traffic measurement duration — only in "advise", "analyze", "flow" and "latency" modes`)
+	inboxPrefix := flag.String("inbox-prefix", "", `Prefix of the reply inboxes of the requests (<prefix>.<random>) instead of _INBOX, for users only allowed to subscribe to their own inboxes`)
+	envPrefix := flag.String("env-prefix", "NATS", "Prefix of the <PREFIX>_USER and <PREFIX>_PASSWORD environment variables holding the credentials")
+	componentName := flag.String("name", "", `Component name in the heartbeats and the control subject (_ctl.natsPubSub.<name>), defaults to <mode>-<host>-<pid> — only in the long-running modes`)
+	heartbeatInterval := flag.Duration("heartbeat", defaultHeartbeatInterval, `Delay between two heartbeats on _sys.app.heartbeat.<name>, 0 disables them — only in the long-running modes (sub, edge, reconcile, graphql, amqp, connector, http)`)
+	resultFlag(flag.CommandLine)
 
 	flag.Parse()
+	result.Mode, result.Subject = *mode, *subject
 
 	// ─── Input Validation ──────────────────────────────────────────────
-	if *mode == "" || *subject == "" {
-		fmt.Fprintln(os.Stderr, "Error: -mode and -subject flags are required.")
-		flag.Usage()
-		os.Exit(1)
+	if *mode == "" || (*subject == "" && !slices.Contains(modesWithoutSubject, *mode)) {
+		usageError("-mode and -subject flags are required")
+	}
+
+	if !slices.Contains(modes, *mode) {
+		usageError("-mode must be one of %q, got %q", modes, *mode)
+	}
+
+	if *mode == modePub && *msg == "" && *spoolDir == "" {
+		usageError(`-msg flag is required when using -mode "pub", unless -spool is given`)
+	}
+
+	if *spoolDir != "" && *mode != modePub {
+		usageError(`-spool is only supported with -mode "pub"`)
+	}
+
+	if *fallbackSubject != "" {
+		switch {
+		case *mode != modePub:
+			usageError(`-fallback-subject is only supported with -mode "pub"`)
+		case strings.ContainsAny(*fallbackSubject, "*> "):
+			usageError("-fallback-subject %q must be a subject without wildcards", *fallbackSubject)
+		case *fallbackSubject == *subject:
+			usageError("-fallback-subject must differ from -subject")
+		}
+	}
+
+	if *schemaFile != "" {
+		if *mode != modePub {
+			usageError(`-schema is only supported with -mode "pub"`)
+		}
+		// Refuse to publish an event breaking its contract: consumers would
+		// have to deal with it, long after the producer is gone.
+		if err := validatePayload(*schemaFile, []byte(*msg)); err != nil {
+			err = fmt.Errorf("-msg does not match %s: %w", *schemaFile, err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(exitUsage, err)
+		}
+	}
+
+	if (len(headers) > 0 || *headerFile != "") && *mode != modePub && *mode != modeRequest {
+		usageError(`-header and -header-file are only supported with -mode "pub" or "request"`)
+	}
+	if *headerFile != "" {
+		if err := readHeaderFile(nats.Header(headers), *headerFile); err != nil {
+			err = fmt.Errorf("-header-file: %w", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(exitUsage, err)
+		}
+	}
+
+	if *ceBatch {
+		if *mode != modePub || *msg == "" {
+			usageError(`-ce-batch needs -mode "pub" and -msg`)
+		}
+		// Checked before connecting: a batch is refused as a whole.
+		bundled, err := bundleEvents(context.Background(), []byte(*msg))
+		if err != nil {
+			err = fmt.Errorf("-ce-batch: %w", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(exitUsage, err)
+		}
+		*msg = string(bundled)
+		nats.Header(headers).Set("Content-Type", ceBatchContentType)
+	}
+
+	if *codecName != "" {
+		c, err := codec.Lookup(*codecName)
+		switch {
+		case err != nil:
+			usageError("-codec: %v", err)
+		case *mode != modePub && *mode != modeSub:
+			usageError(`-codec is only supported with -mode "pub" or "sub"`)
+		case *mode == modePub && (*ceBatch || *schemaFile != ""):
+			usageError("-codec cannot be combined with -ce-batch or -schema, which need JSON")
+		case *mode == modePub && *msg != "":
+			encoded, err := encodeMsg(c, *msg)
+			if err != nil {
+				usageError("-codec %s: %v", *codecName, err)
+			}
+			*msg = string(encoded)
+			if nats.Header(headers).Get("Content-Type") == "" {
+				nats.Header(headers).Set("Content-Type", c.ContentType())
+			}
+		}
+	}
+
+	if len(headerMatch) > 0 && *mode != modeSub {
+		usageError(`-match-header is only supported with -mode "sub"`)
+	}
+
+	if *maxReplies < 0 {
+		usageError("-max-replies must be 0 (no limit) or more")
+	}
+
+	if *oversize != oversizeReject && *oversize != oversizeCompress {
+		usageError("-oversize must be %q or %q, got %q", oversizeReject, oversizeCompress, *oversize)
+	}
+
+	if *expectVersion != 0 && *mode != modeSub {
+		usageError(`-expect-version is only supported with -mode "sub"`)
+	}
+
+	if *mode == modeAMQP && *amqpExchange == "" && *amqpQueue == "" {
+		usageError(`-amqp-exchange and/or -amqp-queue are required when using -mode "amqp"`)
+	}
+
+	if *mode == modeConnector && *sinkURL == "" && *sourceURL == "" {
+		usageError(`-sink and/or -source are required when using -mode "connector"`)
+	}
+
+	if *reply && *mode != modeHTTP && *mode != modeConformance {
+		usageError(`-reply is only supported with -mode "http" and "conformance"`)
+	}
+
+	if *mode == modeAdvise && *streamName == "" {
+		usageError(`-stream flag is required when using -mode "advise"`)
+	}
+
+	if (*durable != "" || *adaptive || *ordered) && *mode != modeSub {
+		usageError(`-durable, -ordered and -adaptive are only supported with -mode "sub"`)
+	}
+
+	if *durable != "" && *ordered {
+		usageError("-durable and -ordered cannot be used together")
+	}
+
+	if _, ok := deliverPolicies[*deliver]; !ok {
+		usageError("-deliver must be %s, got %q", deliverNames(), *deliver)
+	}
+
+	if *batch < 1 || *maxInFlight < 1 || *maxAckPending < 1 {
+		usageError("-batch, -max-in-flight and -max-ack-pending must be 1 or more")
+	}
+
+	if *adaptive && *durable == "" {
+		usageError("-adaptive requires -durable")
+	}
+
+	if *deliverGroup != "" && *durable == "" {
+		usageError("-deliver-group requires -durable")
+	}
+
+	if *deliverSubject != "" && *deliverGroup == "" {
+		usageError("-deliver-subject requires -deliver-group")
+	}
+
+	if *deliverGroup != "" && *adaptive {
+		usageError("-adaptive is not supported with -deliver-group: the server pushes up to -max-ack-pending messages")
+	}
+
+	if *lagInterval <= 0 {
+		usageError("-lag-interval must be positive")
+	}
+
+	if (*durable != "" || *ordered) && *drURL != "" {
+		usageError("-durable and -ordered are not supported with -dr-url")
+	}
+
+	if *drURL != "" && *mode != modePub && *mode != modeSub {
+		usageError(`-dr-url is only supported with -mode "pub" or "sub"`)
+	}
+
+	if *handlerConfigSource != "" && *mode != modeSub {
+		usageError(`-handler-config is only supported with -mode "sub"`)
+	}
+
+	if *authConfigSource != "" && *mode != modeHTTP && *mode != modeGraphQL {
+		usageError(`-auth-config is only supported with -mode "http" and "graphql"`)
+	}
+
+	if *quotaConfigSource != "" && *mode != modeHTTP {
+		usageError(`-quota-config is only supported with -mode "http"`)
+	}
+
+	if (*dedupSource != "" || *positionsSource != "" || *dedupWindow != defaultDedupWindow) && *mode != modeSub {
+		usageError(`-dedup, -dedup-window and -positions are only supported with -mode "sub"`)
+	}
+	if *dedupWindow <= 0 {
+		usageError("-dedup-window must be positive")
+	}
+	if *positionsSource != "" && !*ordered {
+		usageError("-positions requires -ordered")
+	}
+	for _, source := range []string{*dedupSource, *positionsSource} {
+		if source != "" && !isStoreURL(source) {
+			usageError("%q is not a store URL: use %s, %s<file>, %s<bucket> or %s<host>", source, storeMemory, storeBolt, kvConfigScheme, storeRedis)
+		}
+	}
+	if strings.HasPrefix(*dedupSource, kvConfigScheme) && *drURL != "" {
+		usageError("-dedup %s… is not supported with -dr-url", kvConfigScheme)
+	}
+
+	if *sample != "" && *mode != modeSub {
+		usageError(`-sample is only supported with -mode "sub"`)
+	}
+
+	if len(slos) > 0 && *mode != modeSub {
+		usageError(`-slo is only supported with -mode "sub"`)
+	}
+	if *sloWindow < sloShortWindows*sloCheckInterval {
+		usageError("-slo-window must be at least %s", sloShortWindows*sloCheckInterval)
+	}
+
+	if *mode != modeSub && (*strict || *quarantineSubject != "") {
+		usageError(`-strict and -quarantine-subject are only supported with -mode "sub"`)
+	}
+	if *maxEventSize <= 0 || *maxJSONDepth <= 0 {
+		usageError("-max-event-size and -max-json-depth must be positive")
+	}
+	if *quarantineSubject != "" && (strings.ContainsAny(*quarantineSubject, "*> ") || subjectWithin(*quarantineSubject, *subject)) {
+		usageError("-quarantine-subject %q must be a subject without wildcards, outside of -subject", *quarantineSubject)
+	}
+
+	if *handlerConfigSource != "" && (len(headerMatch) > 0 || *expectVersion != 0 || *sample != "" || *mode == modeSub && *codecName != "") {
+		usageError("-handler-config replaces -match-header, -expect-version, -sample and -codec, set them in its match_header, expect_version, sample and codec")
+	}
+
+	if strings.HasPrefix(*handlerConfigSource, kvConfigScheme) && *drURL != "" {
+		usageError("-handler-config %s… is not supported with -dr-url", kvConfigScheme)
 	}
 
-	if *mode != modePub && *mode != modeSub {
-		fmt.Fprintf(os.Stderr, "Error: -mode must be %q or %q, got %q.\n", modePub, modeSub, *mode)
-		flag.Usage()
-		os.Exit(1)
+	if *sequenceField != defaultSequenceField && *mode != modeAudit {
+		usageError(`-sequence-field is only supported with -mode "audit"`)
 	}
 
-	if *mode == modePub && *msg == "" {
-		fmt.Fprintln(os.Stderr, `Error: -msg flag is required when using -mode "pub".`)
-		flag.Usage()
-		os.Exit(1)
+	if *mode == modeAudit && *drURL != "" {
+		usageError(`-dr-url is not supported with -mode "audit"`)
+	}
+
+	if (*replayPrefix != defaultReplayPrefix || *speed != "" || *realtime || *asOf != "") && *mode != modeReplay {
+		usageError(`-replay-prefix, -speed, -realtime and -as-of are only supported with -mode "replay"`)
+	}
+
+	replaySpeed, speedErr := parseSpeed(*speed)
+	if speedErr != nil {
+		usageError("-speed: %v", speedErr)
+	}
+	if *realtime {
+		if *speed != "" {
+			usageError("-realtime and -speed cannot be used together")
+		}
+		replaySpeed = 1
+	}
+
+	replayAsOf, asOfErr := parseAsOf(*asOf)
+	if asOfErr != nil {
+		usageError(`-as-of must be an RFC 3339 time or %q: %v`, asOfFirst, asOfErr)
+	}
+
+	if *mode == modeReplay && (*replayPrefix == "" || strings.ContainsAny(*replayPrefix, "*> ") || subjectWithin(*replayPrefix+"."+*subject, *subject)) {
+		usageError("-replay-prefix must be a subject prefix without wildcards, outside of -subject, got %q", *replayPrefix)
+	}
+
+	if *mode == modeReplay && *drURL != "" {
+		usageError(`-dr-url is not supported with -mode "replay"`)
+	}
+
+	if *diagram != diagramMermaid && *diagram != diagramDot {
+		usageError("-diagram must be %q or %q, got %q", diagramMermaid, diagramDot, *diagram)
+	}
+
+	if *mode == modeTrace && *traceID == "" {
+		usageError(`-trace-id flag is required when using -mode "trace"`)
+	}
+
+	if (*traceID != "" || *since != 0) && *mode != modeTrace {
+		usageError(`-trace-id and -since are only supported with -mode "trace"`)
+	}
+
+	if *since < 0 {
+		usageError("-since must be 0 (everything) or more")
+	}
+
+	if *diagram != diagramMermaid && *mode != modeFlow {
+		usageError(`-diagram is only supported with -mode "flow"`)
+	}
+
+	if *drainTimeout <= 0 {
+		usageError("-drain-timeout must be more than 0")
+	}
+
+	if *heartbeatInterval < 0 {
+		usageError("-heartbeat must be 0 (disabled) or more")
+	}
+
+	if *inboxPrefix != "" && !validInboxPrefix(*inboxPrefix) {
+		usageError("-inbox-prefix %q must be a subject without wildcards, spaces nor trailing dot", *inboxPrefix)
+	}
+
+	var dialer *transport.Dialer
+	if *proxyURL != "" || *ipVersion != "" {
+		var err error
+		if dialer, err = transport.NewDialer(*proxyURL, *ipVersion); err != nil {
+			usageError("%v", err)
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		usageError("-tls-cert and -tls-key must be used together")
 	}
 
 	// ─── Logger Setup ──────────────────────────────────────────────────
 	// Prefix the log output with the mode so it's easy to distinguish
 	// publisher vs subscriber output in your terminals.
-	l := log.New(os.Stdout, fmt.Sprintf("%s [%s] ", APP, *mode), log.LstdFlags)
+	// With -result-json -, stdout only carries the JSON summary, in "flow"
+	// mode the diagram, in "trace" mode the timeline.
+	logOut := os.Stdout
+	if resultFile == "-" || *mode == modeFlow || *mode == modeTrace {
+		logOut = os.Stderr
+	}
+	l := log.New(logOut, fmt.Sprintf("%s [%s] ", APP, *mode), log.LstdFlags)
 	l.Printf("🚀  Starting %s v%s in mode [%s], from %s\n", APP, VERSION, *mode, REPOSITORY)
 
+	var sp *spool
+	if *spoolDir != "" {
+		var err error
+		if sp, err = openSpool(*spoolDir); err != nil {
+			fail(l, exitFailure, "-spool: %v", err)
+		}
+		defer sp.close()
+	}
+
+	// The test vectors are documentation too: printed without a server.
+	if *mode == modeConformance && *dryRun {
+		printConformanceVectors()
+		writeResult(exitOK, nil)
+		return
+	}
+
 	// ─── Read credentials from environment ─────────────────────────────
 	// NATS_USER and NATS_PASSWORD should be set in your .env file
 	// and exported before running this program (e.g. via scripts/execWithEnv.sh).
-	natsUser := os.Getenv("NATS_USER")
-	natsPass := os.Getenv("NATS_PASSWORD")
-	if natsUser == "" || natsPass == "" {
-		l.Fatal("💥 NATS_USER and NATS_PASSWORD environment variables must be set")
+	// With -env-prefix ORDERS the program reads ORDERS_USER and ORDERS_PASSWORD
+	// instead, handy when one .env holds the users of several accounts.
+	// With -creds the environment is not used at all: the user JWT and its
+	// seed come from the credentials file (decentralized JWT auth).
+	var natsUser, natsPass string
+	if *credsFile == "" {
+		userEnv, passEnv := *envPrefix+"_USER", *envPrefix+"_PASSWORD"
+		natsUser = os.Getenv(userEnv)
+		natsPass = os.Getenv(passEnv)
+		if natsUser == "" || natsPass == "" {
+			fail(l, exitUsage, "%s and %s environment variables must be set (or use -creds)", userEnv, passEnv)
+		}
 	}
 
 	// ─── Connect to NATS ───────────────────────────────────────────────
@@ -108,29 +601,254 @@ func main() {
 	// It will automatically attempt to reconnect if the connection drops.
 	// The returned *nats.Conn is safe for concurrent use.
 	l.Printf("Connecting to NATS server at %s …", *natsURL)
-	// nats.UserInfo provides username/password authentication for the connection.
-	l.Printf("About to connect with user:%s and pass: %s !", natsUser, natsPass)
-	// maybe consider using nkey https://docs.nats.io/using-nats/developer/connecting/nkey
+	// nats.UserInfo provides username/password authentication for the connection,
+	// nats.UserCredentials signs the server nonce with the seed of the creds file.
+	// See https://docs.nats.io/using-nats/developer/connecting/creds
+	var authOpts []nats.Option
+	if *credsFile != "" {
+		l.Printf("About to connect with credentials file %s !", *credsFile)
+		authOpts = append(authOpts, nats.UserCredentials(*credsFile))
+	} else {
+		l.Printf("About to connect with user:%s !", natsUser)
+		authOpts = append(authOpts, nats.UserInfo(natsUser, natsPass))
+	}
+	authOpts = append(authOpts, tlsOptions(*tlsCert, *tlsKey, *tlsCA)...)
 	// Connections can be assigned a name which will appear in some of the server monitoring data
 	// it is highly recommended as a friendly connection name will help in monitoring, error reporting, debugging, and testing.
-	nc, err := nats.Connect(*natsURL, nats.Name(APP), nats.UserInfo(natsUser, natsPass))
+	opts := append([]nats.Option{nats.Name(APP), nats.DrainTimeout(*drainTimeout)}, authOpts...)
+	// The permissions violations are asynchronous: the ErrorHandler records
+	// them for the publishes to tell their own (see fallback.go).
+	opts = append(opts, nats.ErrorHandler(denials.errorHandler(l)))
+	if *inboxPrefix != "" {
+		// The replies of the requests then arrive on <prefix>.<random>, a
+		// subject the permissions of the user may allow (see request.go).
+		opts = append(opts, nats.CustomInboxPrefix(*inboxPrefix))
+	}
+	if dialer != nil {
+		// The dialer resolves the server names itself: through the proxy,
+		// or restricted to the IP version of -ip.
+		opts = append(opts, nats.SetCustomDialer(dialer), nats.SkipHostLookup())
+		if dialer.Proxy != nil {
+			l.Printf("🌐 Connecting through the proxy %s", dialer.Proxy.Redacted())
+		}
+	}
+	if *wsPath != "" {
+		opts = append(opts, nats.ProxyPath(*wsPath))
+	}
+	if *mode == modeEdge {
+		// The uplink to the hub is expected to be flaky at the edge: keep
+		// retrying in the background instead of failing at startup.
+		opts = append(opts, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	}
+	// With -dr-url, the connection is managed by a clusterFailover which
+	// switches to the DR cluster after a prolonged outage of the primary.
+	var fo *clusterFailover
+	var nc *nats.Conn
+	var err error
+	if *drURL != "" {
+		if fo, err = connectWithFailover(l, *natsURL, *drURL, *failoverAfter, opts); err == nil {
+			nc = fo.Conn()
+		}
+	} else {
+		nc, err = nats.Connect(*natsURL, opts...)
+	}
 	if err != nil {
-		l.Printf("💥 Failed to connect to NATS at %s: %v", *natsURL, err)
+		// With -spool, the message waits on disk for NATS to be back (see spool.go).
+		if sp != nil && *msg != "" && !errors.Is(err, nats.ErrAuthorization) {
+			spoolMessage(l, sp, newMsg(*subject, *msg, nats.Header(headers)), err)
+			writeResult(exitOK, nil)
+			return
+		}
 		if errors.Is(err, nats.ErrAuthorization) {
-			l.Fatalf("Authorization for user:%s and pass: %s failed", natsUser, natsPass)
+			if *credsFile != "" {
+				fail(l, exitConnection, "authorization with credentials file %s failed: %v", *credsFile, err)
+			}
+			fail(l, exitConnection, "authorization for user %s failed: %v", natsUser, err)
 		}
+		fail(l, exitConnection, "failed to connect to NATS at %s: %v", *natsURL, err)
+	}
+	// Always close the connection when done to release resources, after
+	// draining it so the pending publishes are not lost (see drain.go).
+	if fo != nil {
+		defer fo.Close()
+		defer func() { drainConn(l, fo.Conn()) }()
+	} else {
+		defer drainConn(l, nc)
 	}
-	// Always close the connection when done to release resources.
-	defer nc.Close()
 	l.Println("✅ Connected to NATS server successfully.")
 
+	// ─── Credential Rotation ───────────────────────────────────────────
+	// Re-authenticate when the creds/TLS files are rotated or on SIGHUP,
+	// so long-running subscribers survive credential renewals: every
+	// connection opened with them, the DR one after a failover included.
+	creds := &connSet{}
+	if fo != nil {
+		creds.add(fo.Conns)
+	} else {
+		creds.add(func() []*nats.Conn { return []*nats.Conn{nc} })
+	}
+	stopWatch := watchCredentials(creds, l, *reloadInterval, *reloadJitter, func() error {
+		return validateCredentials(*credsFile, *tlsCert, *tlsKey, *tlsCA)
+	}, *credsFile, *tlsCert, *tlsKey, *tlsCA)
+	defer stopWatch()
+
+	// ─── Heartbeats ────────────────────────────────────────────────────
+	// The long-running modes tell the fleet they are alive (see heartbeat.go).
+	name := *componentName
+	if name == "" {
+		name = defaultComponentName(*mode)
+	}
+	if slices.Contains(longRunningModes, *mode) && *heartbeatInterval > 0 {
+		stopHeartbeat := startHeartbeat(nc, l, name, *mode, *subject, *heartbeatInterval)
+		defer stopHeartbeat()
+	}
+
+	// ─── Control Subject ───────────────────────────────────────────────
+	// Operators pause, resume or throttle a subscriber without restarting
+	// it (see control.go).
+	flow := &flowControl{}
+	if *mode == modeSub {
+		stopControl := startControl(nc, l, name, flow)
+		defer stopControl()
+	}
+
+	// ─── Handler Config ────────────────────────────────────────────────
+	// Filters, routes and handler settings of "sub", from the flags or
+	// from -handler-config, reloaded live on every change (see
+	// handlerconfig.go).
+	cfg := &liveConfig{}
+	if *mode == modeSub {
+		apply := func(c handlerConfig) error { return cfg.apply(l, *subject, c, flow) }
+		if *handlerConfigSource == "" {
+			if err := apply(handlerConfig{MatchHeader: nats.Header(headerMatch), ExpectVersion: *expectVersion, Sample: *sample, Codec: *codecName}); err != nil {
+				usageError("%v", err)
+			}
+		} else {
+			stopConfig, err := watchHandlerConfig(nc, l, *handlerConfigSource, *reloadInterval, apply)
+			if err != nil {
+				fail(l, exitUsage, "invalid -handler-config %s: %v", *handlerConfigSource, err)
+			}
+			defer stopConfig()
+		}
+	}
+
+	// ─── Quotas ────────────────────────────────────────────────────────
+	// API keys and quotas of the tenants of the HTTP bridge, reloaded live
+	// like the handler config (see quota.go).
+	var quotas *quotaEnforcer
+	if *quotaConfigSource != "" {
+		quotas = newQuotaEnforcer()
+		stopQuotas, err := watchConfig(nc, l, "quota config", *quotaConfigSource, *reloadInterval, quotas.load)
+		if err != nil {
+			fail(l, exitUsage, "invalid -quota-config %s: %v", *quotaConfigSource, err)
+		}
+		defer stopQuotas()
+	}
+
+	// ─── Authentication ────────────────────────────────────────────────
+	// API keys and OIDC tokens of the gateways, and the subjects of each
+	// identity, reloaded live (see auth.go).
+	var auth *authenticator
+	if *authConfigSource != "" {
+		auth = &authenticator{}
+		stopAuth, err := watchConfig(nc, l, "auth config", *authConfigSource, *reloadInterval, func(data []byte) error {
+			return auth.load(data, *subject)
+		})
+		if err != nil {
+			fail(l, exitUsage, "invalid -auth-config %s: %v", *authConfigSource, err)
+		}
+		defer stopAuth()
+	}
+
+	// ─── State Stores ──────────────────────────────────────────────────
+	// The ids of the events handled and the positions of the ordered
+	// consumer, in the store chosen (see store.go).
+	var dedup *store.Dedup
+	var positions *store.Positions
+	for _, opt := range []struct {
+		name, source string
+		ttl          time.Duration // of the values, for the TTL of a kv:// bucket
+		open         func(s store.Store)
+	}{
+		{"-dedup", *dedupSource, *dedupWindow, func(s store.Store) { dedup = store.NewDedup(s, dedupPrefix, *dedupWindow) }},
+		{"-positions", *positionsSource, positionsRetention, func(s store.Store) {
+			positions = store.NewPositions(s, positionsPrefix, positionsRetention)
+		}},
+	} {
+		if opt.source == "" {
+			continue
+		}
+		ttl := opt.ttl
+		if *dedupSource == *positionsSource {
+			ttl = max(*dedupWindow, positionsRetention)
+		}
+		s, err := openStore(nc, opt.source, ttl)
+		if err != nil {
+			fail(l, exitUsage, "%s %s: %v", opt.name, opt.source, err)
+		}
+		defer s.Close()
+		opt.open(s)
+	}
+
 	// ─── Mode Dispatch ─────────────────────────────────────────────────
 	switch *mode {
 	case modePub:
-		publish(nc, l, *subject, *msg)
+		publish(nc, l, *subject, *msg, nats.Header(headers), *oversize, *fallbackSubject, sp)
+	case modeRequest:
+		request(nc, l, *subject, *msg, nats.Header(headers), *maxReplies, *timeout, *retryNoResponder)
 	case modeSub:
-		subscribe(nc, l, *subject)
+		sloCtx, stopSLOs := context.WithCancel(context.Background())
+		defer stopSLOs()
+		startSLOs(sloCtx, l, slos, *sloWindow)
+		guard := &payloadGuard{l: l, maxSize: *maxEventSize, maxDepth: *maxJSONDepth, strict: *strict, quarantine: *quarantineSubject}
+		subscribe(nc, l, *subject, fo, cfg, guard, dedup, consumerOptions{
+			stream:        *streamName,
+			durable:       *durable,
+			ordered:       *ordered,
+			deliver:       *deliver,
+			batch:         *batch,
+			maxInFlight:   *maxInFlight,
+			maxAckPending: *maxAckPending,
+			adaptive:      *adaptive,
+			deliverGroup:  *deliverGroup,
+			deliverSubj:   *deliverSubject,
+			lagInterval:   *lagInterval,
+			positions:     positions,
+		}, flow)
+	case modeEdge:
+		edge(nc, l, *subject, *edgeURL, *edgeStream, creds, authOpts...)
+	case modeReconcile:
+		reconcile(nc, l, *specsDir, *reconcileInterval, *dryRun)
+	case modeAdvise:
+		advise(nc, l, *streamName, *observe)
+	case modeAnalyze:
+		analyze(nc, l, *subject, *observe)
+	case modeLatency:
+		latency(nc, l, *subject, *observe)
+	case modeAudit:
+		audit(nc, l, *subject, *streamName, *sequenceField)
+	case modeFlow:
+		flowDiagram(nc, l, *subject, *streamName, *observe, *diagram)
+	case modeReplay:
+		replay(nc, l, *subject, *streamName, *replayPrefix, replaySpeed, *asOf != "", replayAsOf)
+	case modeGraphQL:
+		var origins []string
+		if *allowOrigin != "" {
+			origins = strings.Split(*allowOrigin, ",")
+		}
+		serveGraphQL(nc, l, *subject, *listenAddr, origins, auth)
+	case modeAMQP:
+		amqpBridge(nc, l, *subject, *amqpURL, *amqpExchange, *amqpQueue)
+	case modeConnector:
+		connector(nc, l, *subject, *sinkURL, *sourceURL)
+	case modeHTTP:
+		httpBridge(nc, l, *subject, *listenAddr, *sinkURL, *reply, quotas, auth)
+	case modeConformance:
+		conformance(nc, l, *subject, *timeout, *reply)
+	case modeTrace:
+		trace(nc, l, *subject, *traceID, *streamName, *since)
 	}
+	writeResult(exitOK, nil)
 }
 
 // publish sends a single message to the given NATS subject.
@@ -144,26 +862,79 @@ func main() {
 //
 //	If you need delivery guarantees (at-least-once, exactly-once),
 //	consider using NATS JetStream instead of core NATS Pub/Sub.
-func publish(nc *nats.Conn, l *log.Logger, subject, msg string) {
+func publish(nc *nats.Conn, l *log.Logger, subject, msg string, header nats.Header, oversize, fallbackSubject string, sp *spool) {
+	// A message larger than the max_payload of the server would be refused
+	// and the connection closed: check it first (see payload.go).
+	var m *nats.Msg
+	if msg != "" {
+		var err error
+		if m, err = checkPayload(nc, newMsg(subject, msg, header), oversize); err != nil {
+			fail(l, exitPublish, "refusing to publish: %v", err)
+		}
+	}
+
+	// With -spool, the messages spooled by the previous runs go first, so
+	// the order is preserved (see spool.go).
+	if sp != nil {
+		n, err := sp.flush(nc, l)
+		if err != nil {
+			if m == nil {
+				fail(l, exitPublish, "failed to flush the spool: %v", err)
+			}
+			spoolMessage(l, sp, m, err)
+			return
+		}
+		if n > 0 {
+			l.Printf("✅ %d spooled message(s) published", n)
+		}
+		if m == nil {
+			return
+		}
+	}
 	l.Printf("Publishing to subject %q …", subject)
 
 	// Publish takes a subject and a byte slice payload.
 	// NATS messages are opaque byte arrays — you can send JSON, Protobuf,
 	// plain text, or any binary format.
-	if err := nc.Publish(subject, []byte(msg)); err != nil {
-		l.Fatalf("💥 Failed to publish: %v", err)
+	check := checkPublishes(nc)
+	err := nc.PublishMsg(m)
+	if err == nil {
+		// Flush ensures all buffered messages are sent to the server.
+		// Without this, the program might exit before the message is actually
+		// transmitted over the network.
+		err = nc.Flush()
 	}
-
-	// Flush ensures all buffered messages are sent to the server.
-	// Without this, the program might exit before the message is actually
-	// transmitted over the network.
-	if err := nc.Flush(); err != nil {
-		l.Fatalf("💥 Failed to flush: %v", err)
+	if err != nil {
+		if sp != nil {
+			spoolMessage(l, sp, m, err)
+			return
+		}
+		fail(l, exitPublish, "failed to publish: %v", err)
 	}
+	// The server drops a message the user may not publish without failing
+	// the publish, only an asynchronous error tells it (see fallback.go).
+	if denied := check.denied(subject); denied != nil {
+		publishFallback(nc, l, m, denied, fallbackSubject, sp)
+		return
+	}
+	countPublished(len(m.Data))
 
 	l.Printf("✅ Message published — subject: %q, payload: %q", subject, msg)
 }
 
+// newMsg returns a message on subject with the payload msg and a copy of
+// header. A CloudEvent in binary mode (-header ce-type=…) starts a causal
+// chain: its missing id and correlationid are generated (see cloudevent.go).
+func newMsg(subject, msg string, header nats.Header) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Data = []byte(msg)
+	for k, values := range header {
+		m.Header[k] = values
+	}
+	stampCausation(context.Background(), m)
+	return m
+}
+
 // subscribe listens for messages on the given NATS subject.
 //
 // KEY CONCEPT — Async Subscription:
@@ -181,40 +952,170 @@ func publish(nc *nats.Conn, l *log.Logger, subject, msg string) {
 //	  >  — matches one or more tokens: "sensor.>"
 //	Example: subscribing to "events.>" will receive messages published to
 //	"events.user.login", "events.order.created", etc.
-func subscribe(nc *nats.Conn, l *log.Logger, subject string) {
+func subscribe(nc *nats.Conn, l *log.Logger, subject string, fo *clusterFailover, cfg *liveConfig, guard *payloadGuard, dedup *store.Dedup, co consumerOptions, flow *flowControl) {
+	ctx, stop := stopContext()
+	defer stop()
+	// The routes republish on the active connection (see failover.go).
+	forward := func(m *nats.Msg) error {
+		if fo != nil {
+			return fo.Conn().PublishMsg(m)
+		}
+		return nc.PublishMsg(m)
+	}
+	handle := messageHandler(ctx, cfg, guard, flow, forward)
+	// With -dedup, the events already handled are skipped (see store.go).
+	if dedup != nil {
+		handle = dedupHandler(l, dedup, handle)
+	}
+	// With -durable or -ordered, the messages are read from a JetStream
+	// consumer instead (see jsconsumer.go).
+	switch {
+	case co.deliverGroup != "":
+		consumePushGroup(nc, l, subject, co, handle)
+		return
+	case co.durable != "":
+		consumeJetStream(nc, l, subject, co, handle, flow)
+		return
+	case co.ordered:
+		consumeOrdered(nc, l, subject, co, handle)
+		return
+	}
 	l.Printf("Subscribing to subject %q — waiting for messages (Ctrl+C to quit) …", subject)
 
 	// The callback function is invoked asynchronously for every message
 	// that matches the subject. m.Data contains the raw payload bytes.
-	sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
-		l.Printf("📩 Received on [%s]: %s", m.Subject, string(m.Data))
-	})
+	handler := func(m *nats.Msg) {
+		if err := handle(m); err != nil {
+			l.Printf("⚠️  %v", err)
+		}
+	}
+	sub, err := nc.Subscribe(subject, handler)
 	if err != nil {
-		l.Fatalf("💥 Failed to subscribe: %v", err)
+		fail(l, exitFailure, "failed to subscribe: %v", err)
+	}
+
+	// With a DR cluster, the subscription follows the active connection:
+	// it is removed from the previous cluster (so it is not restored there
+	// on reconnect) and created again on the new one.
+	var subMu sync.Mutex
+	if fo != nil {
+		fo.OnSwitch(func(_, to *nats.Conn) {
+			subMu.Lock()
+			defer subMu.Unlock()
+			_ = sub.Unsubscribe()
+			newSub, err := to.Subscribe(subject, handler)
+			if err != nil {
+				l.Printf("💥 Failed to subscribe on the new cluster: %v", err)
+				return
+			}
+			sub = newSub
+			l.Printf("📡 Subscription to %q moved to %s", subject, to.ConnectedUrl())
+		})
 	}
 	// Unsubscribe is called when the function exits to cleanly remove
-	// the subscription from the server.
+	// the subscription from the server, unless the drain already did.
 	defer func() {
+		subMu.Lock()
+		defer subMu.Unlock()
+		if !sub.IsValid() {
+			return
+		}
 		if err := sub.Unsubscribe(); err != nil {
 			l.Printf("⚠️  Error during unsubscribe: %v", err)
 		}
 	}()
 
+	// Tell systemd (Type=notify units) that the subscriber is operational.
+	sdNotify("READY=1")
+
 	// ─── Graceful Shutdown ─────────────────────────────────────────────
 	// We block the main goroutine by waiting for an OS signal (SIGINT or
-	// SIGTERM). Without this, the program would exit immediately after
-	// subscribing, because Subscribe is non-blocking.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	// SIGTERM, or a stop request of the Windows service manager). Without
+	// this, the program would exit immediately after subscribing, because
+	// Subscribe is non-blocking.
+	sigCh := stopSignals()
 	sig := <-sigCh // Block until signal is received
 
 	l.Printf("🛑 Received signal %v — shutting down gracefully …", sig)
+	sdNotify("STOPPING=1")
 
 	// Drain ensures that all in-flight messages are processed before
 	// the connection is closed.  This is the recommended shutdown
-	// pattern for NATS subscribers.
-	if err := nc.Drain(); err != nil {
-		l.Printf("⚠️  Error during drain: %v", err)
+	// pattern for NATS subscribers; a second signal forces the close.
+	if fo != nil {
+		nc = fo.Conn()
 	}
+	drainConn(l, nc)
 	l.Println("👋 Bye!")
 }
+
+// messageHandler returns the handler of the "sub" mode, following the
+// configuration in force in cfg: it skips the messages not matching its
+// match_header or not sampled (see sample.go), waits while flow is paused or rate limited, inflates the
+// payloads compressed by "pub -oversize compress", rejects the messages
+// refused by guard (see guard.go), then republishes the message with
+// forward when a route matches, or prints it, upcast to its expect_version
+// when it is not 0. A CloudEvents batch is unbundled and its events handled
+// one by one. The error tells why a message could not be handled.
+func messageHandler(ctx context.Context, cfg *liveConfig, guard *payloadGuard, flow *flowControl, forward func(m *nats.Msg) error) func(m *nats.Msg) error {
+	// dispatch routes or prints one message, or one event of a batch.
+	// Its handling time and latency are measured by event type (see slo.go).
+	dispatch := func(c *compiledConfig, m *nats.Msg) (err error) {
+		done := trackEvent(m)
+		defer func() { done(err) }()
+		if to, ok := c.routeOf(m); ok {
+			out := &nats.Msg{Subject: to, Header: m.Header, Data: m.Data}
+			if err := forward(out); err != nil {
+				return fmt.Errorf("failed to route the message on [%s] to %q: %w", m.Subject, to, err)
+			}
+			countPublished(len(out.Data))
+			return nil
+		}
+		return c.handle(m)
+	}
+	return func(m *nats.Msg) error {
+		c := cfg.Load()
+		// The events of a batch are filtered one by one (see cebatch.go).
+		batch := isEventBatch(m)
+		if !batch && (!matchHeaders(m, c.MatchHeader) || !c.sampler.keep(m)) {
+			return nil
+		}
+		if !flow.wait(ctx) {
+			return fmt.Errorf("message on [%s] not handled: shutting down", m.Subject)
+		}
+		countReceived(len(m.Data))
+		received := guard.snapshot(m)
+		if len(m.Data) > guard.maxSize {
+			return guard.reject(received, fmt.Errorf("payload of %d bytes over -max-event-size %d", len(m.Data), guard.maxSize), forward)
+		}
+		if err := inflatePayload(m, guard.maxSize); err != nil {
+			return guard.reject(received, fmt.Errorf("invalid gzip payload: %w", err), forward)
+		}
+		if !batch {
+			if err := guard.check(m); err != nil {
+				return guard.reject(received, err, forward)
+			}
+			return dispatch(c, m)
+		}
+		// The batch is decoded as a whole first: it must be within the limits.
+		if err := guard.checkLimits(m); err != nil {
+			return guard.reject(received, err, forward)
+		}
+		events, err := unbundleEvents(m)
+		if err != nil {
+			return guard.reject(received, err, forward)
+		}
+		var errs []error
+		for _, ev := range events {
+			if !matchHeaders(ev, c.MatchHeader) || !c.sampler.keep(ev) {
+				continue
+			}
+			if err := guard.check(ev); err != nil {
+				errs = append(errs, guard.reject(ev, err, forward))
+				continue
+			}
+			errs = append(errs, dispatch(c, ev))
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,410 @@
+// oidc.go — Validation of the OIDC bearer tokens of the gateways.
+//
+// AN ID TOKEN, CHECKED LOCALLY:
+//
+//	An OpenID Connect provider (Keycloak, Entra ID, Okta, Dex, Google, …)
+//	signs JSON Web Tokens with its private keys and publishes the public
+//	ones (the JWKS) at the jwks_uri of its discovery document,
+//	<issuer>/.well-known/openid-configuration. A token is accepted when:
+//
+//	  - its signature verifies with the key named by its "kid", RS256,
+//	    RS384, RS512, PS256, PS384, PS512, ES256, ES384 or ES512 ("none"
+//	    and the HMAC algorithms, forgeable with a public key, never are,
+//	    nor RSA keys of less than 2048 bits);
+//	  - "iss" is the issuer and "aud" holds the audience;
+//	  - "exp" is not past and "nbf" not to come, a minute of clock skew
+//	    tolerated.
+//
+//	The keys are fetched once, then again at most every minute when a
+//	token names an unknown "kid" (the provider rotated its keys), and
+//	every hour. No request waits for the provider for a known key: old
+//	keys are still used while they are fetched again in the background,
+//	so the gateways keep working through an outage of the provider. One
+//	fetch runs at a time, the requests needing it wait for the same one,
+//	and a failed fetch is tried again after 1s, 2s, 4s… up to a minute.
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLeeway is the clock skew tolerated on exp and nbf.
+	oidcLeeway = time.Minute
+	// oidcKeysMaxAge is how long the keys of the provider are trusted.
+	oidcKeysMaxAge = time.Hour
+	// oidcMinRefresh is the least delay between two fetches of the keys,
+	// and the longest wait after a failed fetch.
+	oidcMinRefresh = time.Minute
+	// oidcMinBackoff is the wait after a first failed fetch, doubled by
+	// the next ones.
+	oidcMinBackoff = time.Second
+	// oidcTimeout bounds a request to the provider.
+	oidcTimeout = 10 * time.Second
+	// oidcMaxDocument is the largest discovery or JWKS document read.
+	oidcMaxDocument = 1 << 20
+	// oidcMinRSABits is the size of the smallest RSA key trusted.
+	oidcMinRSABits = 2048
+)
+
+// errOIDCUnavailable tells that the keys of the provider could not be
+// fetched: the token may be valid, the client should retry.
+var errOIDCUnavailable = errors.New("OIDC provider unavailable")
+
+// oidcVerifier checks the tokens of one issuer and audience.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	claim    string // claim naming the identity
+	jwksConf string // jwks_url of the config, "" to discover it
+	client   *http.Client
+
+	mu         sync.Mutex
+	jwksURL    string
+	keys       map[string]crypto.PublicKey // by kid
+	fetched    time.Time                   // last successful fetch
+	fetchErr   error                       // of the last fetch, nil when it succeeded
+	backoff    time.Duration               // wait after the last failed fetch
+	nextFetch  time.Time                   // no fetch starts before
+	refreshing chan struct{}               // closed at the end of the fetch running, nil for none
+}
+
+// jwk is a public key of a JWKS document (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify returns the identity claim of the token, when it is valid.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("token signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"`
+		Expires   *float64        `json:"exp"`
+		NotBefore *float64        `json:"nbf"`
+	}
+	var all map[string]any
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(payload, &claims)
+	}
+	if err == nil {
+		err = json.Unmarshal(payload, &all)
+	}
+	if err != nil {
+		return "", fmt.Errorf("token claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return "", fmt.Errorf("token issued by %q, not %q", claims.Issuer, v.issuer)
+	case !audienceHolds(claims.Audience, v.audience):
+		return "", fmt.Errorf("token not issued for the audience %q", v.audience)
+	case claims.Expires == nil:
+		return "", errors.New("token without expiry")
+	case now.Add(-oidcLeeway).After(unixTime(*claims.Expires)):
+		return "", errors.New("token expired")
+	case claims.NotBefore != nil && now.Add(oidcLeeway).Before(unixTime(*claims.NotBefore)):
+		return "", errors.New("token not valid yet")
+	}
+	identity, _ := all[v.claim].(string)
+	if identity == "" {
+		return "", fmt.Errorf("token without a %q claim", v.claim)
+	}
+	return identity, nil
+}
+
+// decodeSegment decodes a base64url segment of a token as JSON into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceHolds reports whether aud, a string or an array of strings,
+// holds audience.
+func audienceHolds(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	return json.Unmarshal(aud, &many) == nil && slices.Contains(many, audience)
+}
+
+// unixTime converts a NumericDate of a token to a time.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// verifySignature checks the signature of signed with key for alg.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 || !slices.Contains([]string{"RS", "PS", "ES"}, alg[:2]) {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || size != map[crypto.Hash]int{crypto.SHA256: 32, crypto.SHA384: 48, crypto.SHA512: 66}[hash] {
+			break
+		}
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("token algorithm %q does not match its key", alg)
+}
+
+// ─── Keys of the Provider ──────────────────────────────────────────────
+
+// key returns the public key kid of the provider. An empty kid names the
+// only key of the provider. A key older than oidcKeysMaxAge is returned
+// while the keys are fetched again; an unknown kid waits for a fetch.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	if k, ok := v.lookup(kid); ok {
+		if time.Since(v.fetched) >= oidcKeysMaxAge {
+			v.refresh()
+		}
+		v.mu.Unlock()
+		return k, nil
+	}
+	done := v.refresh()
+	if done == nil {
+		defer v.mu.Unlock()
+		return nil, v.missing(kid)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %v", errOIDCUnavailable, ctx.Err())
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, v.missing(kid)
+}
+
+// lookup returns the key kid, or the only key for an empty kid; v.mu is
+// held.
+func (v *oidcVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// missing returns the error of the key kid not found; v.mu is held.
+func (v *oidcVerifier) missing(kid string) error {
+	if v.fetchErr != nil {
+		return fmt.Errorf("%w: %v", errOIDCUnavailable, v.fetchErr)
+	}
+	return fmt.Errorf("token signed with the unknown key %q", kid)
+}
+
+// refresh starts fetching the keys, unless a fetch runs already or the
+// next one is not due, and returns the channel closed at the end of the
+// fetch running, nil when none does; v.mu is held. The fetch runs without
+// it: the requests whose key is known go on meanwhile.
+func (v *oidcVerifier) refresh() <-chan struct{} {
+	if v.refreshing != nil {
+		return v.refreshing
+	}
+	if time.Now().Before(v.nextFetch) {
+		return nil
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	jwksURL := v.jwksURL
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+		defer cancel()
+		jwksURL, keys, err := v.fetchKeys(ctx, jwksURL)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.refreshing, v.fetchErr = nil, err
+		if err != nil {
+			v.backoff = min(max(2*v.backoff, oidcMinBackoff), oidcMinRefresh)
+			v.nextFetch = time.Now().Add(v.backoff)
+			return
+		}
+		v.jwksURL, v.keys, v.fetched, v.backoff = jwksURL, keys, time.Now(), 0
+		v.nextFetch = v.fetched.Add(oidcMinRefresh)
+	}()
+	return done
+}
+
+// fetchKeys reads the jwks_uri of the discovery document, unless known
+// (jwksURL), then the keys.
+func (v *oidcVerifier) fetchKeys(ctx context.Context, jwksURL string) (string, map[string]crypto.PublicKey, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "", nil, err
+		}
+		if discovery.Issuer != v.issuer || discovery.JWKSURL == "" {
+			return "", nil, fmt.Errorf("discovery document of %q: issuer %q, jwks_uri %q", v.issuer, discovery.Issuer, discovery.JWKSURL)
+		}
+		jwksURL = discovery.JWKSURL
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &set); err != nil {
+		return "", nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("no usable signing key in %s", jwksURL)
+	}
+	return jwksURL, keys, nil
+}
+
+// getJSON decodes the JSON document at url into v.
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, into any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxDocument)).Decode(into); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// publicKey returns the RSA or EC public key of k.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		if bits := new(big.Int).SetBytes(n).BitLen(); bits < oidcMinRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits, less than %d", bits, oidcMinRSABits)
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, errors.New("invalid EC point")
+		}
+		point := make([]byte, 1+2*size)
+		point[0] = 4 // uncompressed
+		copy(point[1+size-len(x):], x)
+		copy(point[1+2*size-len(y):], y)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
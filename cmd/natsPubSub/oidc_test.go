@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAudience is the audience of the tokens of the tests.
+const testAudience = "events-gateway"
+
+// Keys of the tests, generated once: RSA ones take a while.
+var testKeys = sync.OnceValue(func() map[string]crypto.Signer {
+	keys := make(map[string]crypto.Signer)
+	for kid, bits := range map[string]int{"rsa": 2048, "rsa-small": 1024} {
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			panic(err)
+		}
+		keys[kid] = k
+	}
+	for kid, curve := range map[string]elliptic.Curve{"p256": elliptic.P256(), "p384": elliptic.P384(), "p521": elliptic.P521()} {
+		k, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		keys[kid] = k
+	}
+	return keys
+})
+
+// testProvider is an OIDC provider serving its discovery document and the
+// JWKS of its keys.
+type testProvider struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	kids    []string // keys published, of testKeys
+	failing bool     // answers 500 to the requests of the JWKS
+	fetches int      // requests of the JWKS
+}
+
+// newTestProvider starts a provider publishing the keys kids.
+func newTestProvider(t *testing.T, kids ...string) *testProvider {
+	t.Helper()
+	p := &testProvider{kids: kids}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": p.srv.URL, "jwks_uri": p.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.fetches++
+		if p.failing {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for _, kid := range p.kids {
+			set.Keys = append(set.Keys, jwkOf(kid, testKeys()[kid].Public()))
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// set changes the keys published, and whether the JWKS fails.
+func (p *testProvider) set(failing bool, kids ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failing, p.kids = failing, kids
+}
+
+// fetched returns the number of requests of the JWKS so far.
+func (p *testProvider) fetched() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
+
+// verifier returns a verifier of the tokens of p, discovering its keys.
+func (p *testProvider) verifier() *oidcVerifier {
+	return &oidcVerifier{issuer: p.srv.URL, audience: testAudience, claim: "sub", client: p.srv.Client()}
+}
+
+// claims returns valid claims of p for sub, modified by the pairs kv.
+func (p *testProvider) claims(sub string, kv ...any) map[string]any {
+	claims := map[string]any{"iss": p.srv.URL, "aud": testAudience, "sub": sub, "exp": time.Now().Add(time.Hour).Unix()}
+	for i := 0; i < len(kv); i += 2 {
+		if kv[i+1] == nil {
+			delete(claims, kv[i].(string))
+		} else {
+			claims[kv[i].(string)] = kv[i+1]
+		}
+	}
+	return claims
+}
+
+// jwkOf returns the JWK of the public key pub named kid.
+func jwkOf(kid string, pub crypto.PublicKey) jwk {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: enc(k.N.Bytes()), E: enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		point, _ := k.Bytes()
+		size := (len(point) - 1) / 2
+		return jwk{Kty: "EC", Kid: kid, Use: "sig", Crv: k.Curve.Params().Name, X: enc(point[1 : 1+size]), Y: enc(point[1+size:])}
+	}
+	panic("unsupported key")
+}
+
+// signToken returns the token of claims, signed for alg with the key kid
+// of testKeys. The "none" and HS256 algorithms are signed without it and
+// with its public key in DER, as a forger would.
+func signToken(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch {
+	case alg == "none":
+	case alg == "HS256":
+		secret, err := x509.MarshalPKIXPublicKey(testKeys()[kid].Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mac := hmac.New(crypto.SHA256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	default:
+		hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		var err error
+		switch k := testKeys()[kid].(type) {
+		case *rsa.PrivateKey:
+			if strings.HasPrefix(alg, "PS") {
+				signature, err = rsa.SignPSS(rand.Reader, k, hash, digest, nil)
+			} else {
+				signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+			}
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+			size := (k.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	p := newTestProvider(t, "rsa", "rsa-small", "p256", "p384", "p521")
+	v := p.verifier()
+	now := time.Now()
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		claims  map[string]any
+		wantErr string // "" for a valid token
+	}{
+		{"RS256", "RS256", "rsa", p.claims("alice"), ""},
+		{"RS384", "RS384", "rsa", p.claims("alice"), ""},
+		{"RS512", "RS512", "rsa", p.claims("alice"), ""},
+		{"PS256", "PS256", "rsa", p.claims("alice"), ""},
+		{"PS512", "PS512", "rsa", p.claims("alice"), ""},
+		{"ES256", "ES256", "p256", p.claims("alice"), ""},
+		{"ES384", "ES384", "p384", p.claims("alice"), ""},
+		{"ES512", "ES512", "p521", p.claims("alice"), ""},
+
+		// Algorithms and keys that do not go together.
+		{"none", "none", "rsa", p.claims("alice"), "unsupported token algorithm"},
+		{"HS256 with the RSA public key", "HS256", "rsa", p.claims("alice"), "unsupported token algorithm"},
+		{"HS256 with the EC public key", "HS256", "p256", p.claims("alice"), "unsupported token algorithm"},
+		{"ES256 naming an RSA key", "ES256", "rsa", p.claims("alice"), "does not match its key"},
+		{"RS256 naming an EC key", "RS256", "p256", p.claims("alice"), "does not match its key"},
+		{"ES384 naming a P-256 key", "ES384", "p256", p.claims("alice"), "does not match its key"},
+		{"RSA key of 1024 bits", "RS256", "rsa-small", p.claims("alice"), "unknown key"},
+
+		// Claims.
+		{"other issuer", "RS256", "rsa", p.claims("alice", "iss", "https://evil.example.com"), "token issued by"},
+		{"other audience", "RS256", "rsa", p.claims("alice", "aud", "other"), "audience"},
+		{"audience in an array", "RS256", "rsa", p.claims("alice", "aud", []string{"other", testAudience}), ""},
+		{"array without the audience", "RS256", "rsa", p.claims("alice", "aud", []string{"other", "more"}), "audience"},
+		{"no expiry", "RS256", "rsa", p.claims("alice", "exp", nil), "without expiry"},
+		{"expired within the skew", "RS256", "rsa", p.claims("alice", "exp", now.Add(-30*time.Second).Unix()), ""},
+		{"expired past the skew", "RS256", "rsa", p.claims("alice", "exp", now.Add(-2*time.Minute).Unix()), "expired"},
+		{"nbf within the skew", "RS256", "rsa", p.claims("alice", "nbf", now.Add(30*time.Second).Unix()), ""},
+		{"nbf past the skew", "RS256", "rsa", p.claims("alice", "nbf", now.Add(2*time.Minute).Unix()), "not valid yet"},
+		{"no identity", "RS256", "rsa", p.claims("", "sub", nil), `without a "sub" claim`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(context.Background(), signToken(t, tt.alg, tt.kid, tt.claims))
+			if tt.wantErr == "" {
+				if err != nil || got != "alice" {
+					t.Errorf("verify = %q, %v, want alice", got, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify = %q, %v, want an error containing %q", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	p := newTestProvider(t, "rsa", "p256")
+	v := p.verifier()
+	for _, kid := range []string{"rsa", "p256"} {
+		alg := map[string]string{"rsa": "RS256", "p256": "ES256"}[kid]
+		token := signToken(t, alg, kid, p.claims("alice"))
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(p.claims("mallory"))
+		parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+		if got, err := v.verify(context.Background(), strings.Join(parts, ".")); err == nil {
+			t.Errorf("verify of a %s token with other claims = %q, want an invalid signature", alg, got)
+		}
+	}
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!.e30.", "e30.e30.!!"} {
+		if _, err := v.verify(context.Background(), token); err == nil {
+			t.Errorf("verify(%q) = nil, want an error", token)
+		}
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	rsaKey := jwkOf("rsa", testKeys()["rsa"].Public())
+	ecKey := jwkOf("p256", testKeys()["p256"].Public())
+	tests := []struct {
+		name string
+		key  jwk
+		ok   bool
+	}{
+		{"RSA", rsaKey, true},
+		{"RSA of 1024 bits", jwkOf("rsa-small", testKeys()["rsa-small"].Public()), false},
+		{"RSA without exponent", jwk{Kty: "RSA", N: rsaKey.N}, false},
+		{"RSA with a huge exponent", jwk{Kty: "RSA", N: rsaKey.N, E: enc(make([]byte, 5))}, false},
+		{"EC P-256", ecKey, true},
+		{"EC on an unknown curve", jwk{Kty: "EC", Crv: "secp256k1", X: ecKey.X, Y: ecKey.Y}, false},
+		{"EC point off the curve", jwk{Kty: "EC", Crv: "P-256", X: ecKey.X, Y: ecKey.X}, false},
+		{"EC with coordinates too long", jwk{Kty: "EC", Crv: "P-256", X: enc(make([]byte, 33)), Y: ecKey.Y}, false},
+		{"EC with the RSA fields", jwk{Kty: "EC", Crv: "P-256", N: rsaKey.N, E: rsaKey.E}, false},
+		{"RSA with the EC fields", jwk{Kty: "RSA", Crv: "P-256", X: ecKey.X, Y: ecKey.Y}, false},
+		{"symmetric", jwk{Kty: "oct"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.key.publicKey(); (err == nil) != tt.ok {
+				t.Errorf("publicKey() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	p := newTestProvider(t, "rsa")
+	v := p.verifier()
+	ctx := context.Background()
+	if _, err := v.verify(ctx, signToken(t, "RS256", "rsa", p.claims("alice"))); err != nil {
+		t.Fatalf("verify = %v, want a valid token", err)
+	}
+	if got := p.fetched(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", got)
+	}
+
+	// The provider rotates its keys: a token of the new one is refused
+	// until a minute has passed since the last fetch…
+	p.set(false, "rsa", "p256")
+	token := signToken(t, "ES256", "p256", p.claims("alice"))
+	if _, err := v.verify(ctx, token); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("verify right after a fetch = %v, want the unknown key", err)
+	}
+	if got := p.fetched(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want still 1: not a minute since the last fetch", got)
+	}
+
+	// …then fetches the keys again, once.
+	v.mu.Lock()
+	v.nextFetch = time.Now().Add(-time.Second)
+	v.mu.Unlock()
+	if _, err := v.verify(ctx, token); err != nil {
+		t.Fatalf("verify after a minute = %v, want a valid token", err)
+	}
+	if got := p.fetched(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestFetchBackoff(t *testing.T) {
+	p := newTestProvider(t, "rsa")
+	p.set(true, "rsa")
+	v := p.verifier()
+	ctx := context.Background()
+	token := signToken(t, "RS256", "rsa", p.claims("alice"))
+
+	// Each failed fetch doubles the wait, up to a minute; no fetch starts
+	// within it.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if _, err := v.verify(ctx, token); !errors.Is(err, errOIDCUnavailable) {
+			t.Fatalf("verify %d = %v, want errOIDCUnavailable", i, err)
+		}
+		if _, err := v.verify(ctx, token); !errors.Is(err, errOIDCUnavailable) {
+			t.Fatalf("verify %d within the backoff = %v, want errOIDCUnavailable", i, err)
+		}
+		v.mu.Lock()
+		backoff, wait := v.backoff, time.Until(v.nextFetch)
+		v.nextFetch = time.Time{} // the wait is over
+		v.mu.Unlock()
+		if backoff != want || wait <= 0 || wait > want {
+			t.Errorf("after %d failed fetches: backoff %v, next fetch in %v, want %v", i+1, backoff, wait, want)
+		}
+		if got := p.fetched(); got != i+1 {
+			t.Errorf("JWKS fetched %d times, want %d", got, i+1)
+		}
+	}
+	v.mu.Lock()
+	v.backoff = 50 * time.Second
+	v.mu.Unlock()
+	_, _ = v.verify(ctx, token)
+	v.mu.Lock()
+	if v.backoff != oidcMinRefresh {
+		t.Errorf("backoff after 50s = %v, want at most %v", v.backoff, oidcMinRefresh)
+	}
+	v.nextFetch = time.Time{}
+	v.mu.Unlock()
+
+	// The provider is back: the keys are fetched, the backoff forgotten.
+	p.set(false, "rsa")
+	if _, err := v.verify(ctx, token); err != nil {
+		t.Fatalf("verify once the provider is back = %v, want a valid token", err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.backoff != 0 || v.fetchErr != nil {
+		t.Errorf("after a successful fetch: backoff %v, error %v, want none", v.backoff, v.fetchErr)
+	}
+}
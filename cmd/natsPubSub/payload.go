@@ -0,0 +1,109 @@
+// payload.go — Pre-flight validation of the message size against max_payload.
+//
+// MAX_PAYLOAD:
+//
+//	Every NATS server announces the largest message it accepts in its
+//	INFO (max_payload, 1 MB by default, at most 64 MB). A larger message
+//	is refused with a terse "maximum payload exceeded" and, worse, the
+//	server closes the connection of the publisher.
+//
+//	The "pub" mode checks the size of the message (payload + headers)
+//	before publishing it, and with -oversize:
+//	  reject    (default) fails with an error naming the limit and the fixes
+//	  compress  gzips the payload ("Content-Encoding: gzip" header) when it
+//	            does not fit; the "sub" mode inflates it transparently
+//
+//	Large objects (files, images, …) are better stored in the JetStream
+//	Object Store, and only a reference published as an event (the "claim
+//	check" pattern).
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// oversizeReject and oversizeCompress are the values of -oversize.
+	oversizeReject   = "reject"
+	oversizeCompress = "compress"
+	// contentEncodingHeader tells the subscribers how the payload is encoded.
+	contentEncodingHeader = "Content-Encoding"
+	// maxInflatedPayload bounds the size of an inflated payload (gzip bomb).
+	maxInflatedPayload = 64 << 20
+)
+
+// errPayloadTooLarge is returned for a message exceeding max_payload.
+var errPayloadTooLarge = errors.New("message exceeds max_payload")
+
+// checkPayload returns m ready to publish on nc, compressed when it does
+// not fit and policy is oversizeCompress, or errPayloadTooLarge.
+func checkPayload(nc *nats.Conn, m *nats.Msg, policy string) (*nats.Msg, error) {
+	limit := nc.MaxPayload()
+	size := len(m.Data) + headerSize(m.Header)
+	if int64(size) <= limit {
+		return m, nil
+	}
+	detail := "headers included"
+	if policy == oversizeCompress {
+		compressed, err := gzipMsg(m)
+		if err != nil {
+			return nil, err
+		}
+		size = len(compressed.Data) + headerSize(compressed.Header)
+		if int64(size) <= limit {
+			return compressed, nil
+		}
+		detail += ", gzipped"
+	}
+	return nil, fmt.Errorf("%w: %d bytes (%s) > max_payload of %d bytes announced by %s — raise max_payload in the server configuration, use -oversize compress, or publish a reference to an Object Store entry",
+		errPayloadTooLarge, size, detail, limit, nc.ConnectedUrlRedacted())
+}
+
+// gzipMsg returns a copy of m with a gzipped payload.
+func gzipMsg(m *nats.Msg) (*nats.Msg, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(m.Data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	compressed := nats.NewMsg(m.Subject)
+	for k, v := range m.Header {
+		compressed.Header[k] = v
+	}
+	compressed.Header.Set(contentEncodingHeader, "gzip")
+	compressed.Data = buf.Bytes()
+	return compressed, nil
+}
+
+// inflatePayload decodes in place the payload of a message published
+// with -oversize compress, at most limit bytes, leaving any other message
+// untouched.
+func inflatePayload(m *nats.Msg, limit int) error {
+	if m.Header.Get(contentEncodingHeader) != "gzip" {
+		return nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(m.Data))
+	if err != nil {
+		return err
+	}
+	limit = min(limit, maxInflatedPayload)
+	data, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > limit {
+		return fmt.Errorf("inflated payload larger than %d bytes", limit)
+	}
+	m.Data = data
+	m.Header.Del(contentEncodingHeader)
+	return nil
+}
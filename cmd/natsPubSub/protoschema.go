@@ -0,0 +1,558 @@
+// protoschema.go — Protocol Buffers schemas (.proto) as event contracts.
+//
+// THE JSON FORM OF PROTOBUF DATA:
+//
+//	The events of this program carry JSON: a .proto contract describes the
+//	canonical JSON mapping of its messages (protojson), the fields named
+//	by their json_name, lowerCamelCase by default. The message is
+//	translated to the JSON Schema subset of schema.go, so "schema diff" and
+//	-schema apply the same rules to it:
+//
+//	  Protobuf                                JSON Schema
+//	  ──────────────────────────────────────  ─────────────────────────────────────
+//	  message                                 object, the proto2 required fields required
+//	  enum                                    string of the value names
+//	  repeated T, map<K, V>                   array of T, object
+//	  int32, sint32, sfixed32                 integer within the 32-bit bounds
+//	  uint32, fixed32                         integer within 0 and 2³²-1
+//	  int64, uint64 (and the sint, fixed)     integer or string, as protojson writes them
+//	  float, double                           number
+//	  bool                                    boolean
+//	  string, bytes (base64)                  string
+//	  google.protobuf.Timestamp, Duration     string
+//	  google.protobuf.*Value wrappers         the value or null
+//
+//	Every proto3 field is optional and an old reader skips the unknown
+//	ones: adding or removing a field is compatible, changing its type or
+//	making an int32 an int64 is not. The root is the message named after
+//	"#" (order.proto#OrderCreated), by default the first one of the file.
+//	The types imported from other files, unknown here, accept any value.
+//
+//	The parser reads the declarations of proto2 and proto3 files (package,
+//	messages, nested types, enums, oneofs, maps, field options) and skips
+//	the rest (options, services, extensions, reserved ranges).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// protoFile holds the messages and enums of a .proto file, by full name
+// without the package.
+type protoFile struct {
+	pkg      string
+	messages map[string][]protoField
+	enums    map[string][]any
+	first    string // first top-level message
+}
+
+// protoField is a field of a message.
+type protoField struct {
+	label    string // "", "optional", "required" or "repeated"
+	typ      string // the value type for a map
+	jsonName string
+	isMap    bool
+	scope    string // full name of the message declaring it
+}
+
+// protoScalars are the JSON Schemas of the scalar types.
+var protoScalars = map[string]map[string]any{
+	"double":   {"type": "number"},
+	"float":    {"type": "number"},
+	"int32":    {"type": "integer", "minimum": float64(math.MinInt32), "maximum": float64(math.MaxInt32)},
+	"sint32":   {"type": "integer", "minimum": float64(math.MinInt32), "maximum": float64(math.MaxInt32)},
+	"sfixed32": {"type": "integer", "minimum": float64(math.MinInt32), "maximum": float64(math.MaxInt32)},
+	"uint32":   {"type": "integer", "minimum": float64(0), "maximum": float64(math.MaxUint32)},
+	"fixed32":  {"type": "integer", "minimum": float64(0), "maximum": float64(math.MaxUint32)},
+	"int64":    {"type": []any{"integer", "string"}},
+	"sint64":   {"type": []any{"integer", "string"}},
+	"sfixed64": {"type": []any{"integer", "string"}},
+	"uint64":   {"type": []any{"integer", "string"}, "minimum": float64(0)},
+	"fixed64":  {"type": []any{"integer", "string"}, "minimum": float64(0)},
+	"bool":     {"type": "boolean"},
+	"string":   {"type": "string"},
+	"bytes":    {"type": "string"},
+}
+
+// protoWellKnown are the JSON Schemas of the well-known types, imported
+// from google/protobuf.
+var protoWellKnown = map[string]map[string]any{
+	"google.protobuf.Timestamp":   {"type": "string"},
+	"google.protobuf.Duration":    {"type": "string"},
+	"google.protobuf.FieldMask":   {"type": "string"},
+	"google.protobuf.Struct":      {"type": "object"},
+	"google.protobuf.ListValue":   {"type": "array"},
+	"google.protobuf.Empty":       {"type": "object"},
+	"google.protobuf.Any":         {"type": "object"},
+	"google.protobuf.StringValue": {"type": []any{"null", "string"}},
+	"google.protobuf.BytesValue":  {"type": []any{"null", "string"}},
+	"google.protobuf.BoolValue":   {"type": []any{"null", "boolean"}},
+	"google.protobuf.DoubleValue": {"type": []any{"null", "number"}},
+	"google.protobuf.FloatValue":  {"type": []any{"null", "number"}},
+	"google.protobuf.Int32Value":  {"type": []any{"null", "integer"}, "minimum": float64(math.MinInt32), "maximum": float64(math.MaxInt32)},
+	"google.protobuf.UInt32Value": {"type": []any{"null", "integer"}, "minimum": float64(0), "maximum": float64(math.MaxUint32)},
+	"google.protobuf.Int64Value":  {"type": []any{"integer", "null", "string"}},
+	"google.protobuf.UInt64Value": {"type": []any{"integer", "null", "string"}, "minimum": float64(0)},
+}
+
+// protoToJSONSchema translates the message root ("" for the first one) of
+// the .proto file content.
+func protoToJSONSchema(content []byte, root string) (map[string]any, error) {
+	tokens, err := protoTokens(string(content))
+	if err != nil {
+		return nil, err
+	}
+	p := &protoParser{tokens: tokens, file: &protoFile{messages: make(map[string][]protoField), enums: make(map[string][]any)}}
+	if err := p.body(""); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	f := p.file
+	if root == "" {
+		root = f.first
+	}
+	root = strings.TrimPrefix(strings.TrimPrefix(root, "."), f.pkg+".")
+	if _, ok := f.messages[root]; !ok || root == "" {
+		return nil, fmt.Errorf("no message %q", root)
+	}
+	return f.message(root, make(map[string]bool)), nil
+}
+
+// message returns the JSON Schema of the message name; visiting holds the
+// messages being translated, to stop the recursion.
+func (f *protoFile) message(name string, visiting map[string]bool) map[string]any {
+	if visiting[name] {
+		return map[string]any{"type": "object"} // recursive: not expanded again
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	properties := make(map[string]any)
+	var required []any
+	for _, field := range f.messages[name] {
+		schema := f.fieldType(field.typ, field.scope, visiting)
+		switch {
+		case field.isMap:
+			schema = map[string]any{"type": "object"}
+		case field.label == "repeated":
+			schema = map[string]any{"type": "array", "items": schema}
+		case field.label == "required":
+			required = append(required, field.jsonName)
+		}
+		properties[field.jsonName] = schema
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fieldType returns the JSON Schema of the type typ of a field of the
+// message scope.
+func (f *protoFile) fieldType(typ, scope string, visiting map[string]bool) map[string]any {
+	if s, ok := protoScalars[typ]; ok {
+		return cloneSchema(s)
+	}
+	name, ok := f.resolve(typ, scope)
+	switch {
+	case !ok:
+		if s, known := protoWellKnown[strings.TrimPrefix(typ, ".")]; known {
+			return cloneSchema(s)
+		}
+		return map[string]any{} // imported: any value
+	case f.enums[name] != nil:
+		return map[string]any{"type": "string", "enum": f.enums[name]}
+	}
+	return f.message(name, visiting)
+}
+
+// resolve returns the full name, without the package, of the message or
+// enum typ used in the message scope, searched from the innermost scope
+// out as protoc does.
+func (f *protoFile) resolve(typ, scope string) (string, bool) {
+	known := func(name string) bool {
+		_, message := f.messages[name]
+		return message || f.enums[name] != nil
+	}
+	if strings.HasPrefix(typ, ".") {
+		name := strings.TrimPrefix(typ[1:], f.pkg+".")
+		if f.pkg == "" {
+			name = typ[1:]
+		}
+		return name, known(name)
+	}
+	for {
+		name := typ
+		if scope != "" {
+			name = scope + "." + typ
+		}
+		if known(name) {
+			return name, true
+		}
+		if scope == "" {
+			break
+		}
+		scope = scope[:max(0, strings.LastIndex(scope, "."))]
+	}
+	if name := strings.TrimPrefix(typ, f.pkg+"."); f.pkg != "" && known(name) {
+		return name, true
+	}
+	return "", false
+}
+
+// cloneSchema returns a copy of s, the translations being modified by their
+// users.
+func cloneSchema(s map[string]any) map[string]any {
+	c := make(map[string]any, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+// protoJSONName returns the default json_name of a field: lowerCamelCase.
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ─── Parser ────────────────────────────────────────────────────────────
+
+// protoParser reads the declarations of a .proto file from its tokens.
+type protoParser struct {
+	tokens []string
+	pos    int
+	file   *protoFile
+}
+
+// next returns the next token, "" at the end.
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// peek returns the next token without consuming it.
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// expect consumes the token want, or fails.
+func (p *protoParser) expect(want string) error {
+	if got := p.next(); got != want {
+		if got == "" {
+			got = "end of file"
+		}
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+// ident consumes an identifier, possibly qualified.
+func (p *protoParser) ident() (string, error) {
+	tok := p.next()
+	if tok == "" || !(tok[0] == '.' || tok[0] == '_' || unicode.IsLetter(rune(tok[0]))) {
+		return "", fmt.Errorf("expected a name, got %q", tok)
+	}
+	return tok, nil
+}
+
+// skipStatement skips a statement up to its ";", or its block.
+func (p *protoParser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return errors.New("unexpected end of file")
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				if p.peek() == ";" {
+					p.pos++
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// body reads the declarations of the file (scope "") or of the message
+// scope, up to its closing "}".
+func (p *protoParser) body(scope string) error {
+	for {
+		switch tok := p.peek(); tok {
+		case "":
+			if scope != "" {
+				return fmt.Errorf("message %q not closed", scope)
+			}
+			return nil
+		case "}":
+			if scope == "" {
+				return errors.New(`unexpected "}"`)
+			}
+			p.pos++
+			return nil
+		case ";":
+			p.pos++
+		case "package":
+			p.pos++
+			name, err := p.ident()
+			if err != nil {
+				return err
+			}
+			p.file.pkg = name
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			p.pos++
+			name, err := p.ident()
+			if err != nil {
+				return err
+			}
+			full := name
+			if scope != "" {
+				full = scope + "." + name
+			}
+			if _, dup := p.file.messages[full]; dup {
+				return fmt.Errorf("message %q defined twice", full)
+			}
+			p.file.messages[full] = nil
+			if scope == "" && p.file.first == "" {
+				p.file.first = full
+			}
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			if err := p.body(full); err != nil {
+				return err
+			}
+		case "enum":
+			p.pos++
+			if err := p.enum(scope); err != nil {
+				return err
+			}
+		case "oneof":
+			if scope == "" {
+				return errors.New("oneof outside of a message")
+			}
+			p.pos++
+			if _, err := p.ident(); err != nil {
+				return err
+			}
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			for p.peek() != "}" {
+				if p.peek() == "option" {
+					if err := p.skipStatement(); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := p.field(scope, ""); err != nil {
+					return err
+				}
+			}
+			p.pos++
+		case "syntax", "edition", "import", "option", "reserved", "extensions", "service", "extend":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		default:
+			if scope == "" {
+				return fmt.Errorf("unexpected %q", tok)
+			}
+			label := ""
+			if tok == "optional" || tok == "required" || tok == "repeated" {
+				label = p.next()
+			}
+			if err := p.field(scope, label); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// enum reads an enum declared in scope, after its keyword.
+func (p *protoParser) enum(scope string) error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		name = scope + "." + name
+	}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	var values []any
+	for {
+		switch tok := p.peek(); tok {
+		case "}":
+			p.pos++
+			if len(values) == 0 {
+				return fmt.Errorf("enum %q without values", name)
+			}
+			p.file.enums[name] = values
+			return nil
+		case ";":
+			p.pos++
+		case "option", "reserved":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		default:
+			value, err := p.ident()
+			if err != nil {
+				return fmt.Errorf("enum %q: %w", name, err)
+			}
+			values = append(values, value)
+			if err := p.skipStatement(); err != nil { // = number [options];
+				return err
+			}
+		}
+	}
+}
+
+// field reads a field of the message scope, after its label.
+func (p *protoParser) field(scope, label string) error {
+	field := protoField{label: label, scope: scope}
+	if p.peek() == "map" && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "<" {
+		p.pos += 2
+		field.isMap = true
+		for _, want := range []string{",", ">"} {
+			typ, err := p.ident()
+			if err != nil {
+				return err
+			}
+			field.typ = typ
+			if err := p.expect(want); err != nil {
+				return err
+			}
+		}
+	} else {
+		typ, err := p.ident()
+		if err != nil {
+			return fmt.Errorf("message %q: %w", scope, err)
+		}
+		if typ == "group" {
+			return fmt.Errorf("message %q: proto2 groups are deprecated, use a nested message", scope)
+		}
+		field.typ = typ
+	}
+	name, err := p.ident()
+	if err != nil {
+		return fmt.Errorf("message %q: %w", scope, err)
+	}
+	field.jsonName = protoJSONName(name)
+	if err := p.expect("="); err != nil {
+		return fmt.Errorf("message %q, field %q: %w", scope, name, err)
+	}
+	if _, err := strconv.ParseInt(p.next(), 0, 32); err != nil {
+		return fmt.Errorf("message %q, field %q: invalid number", scope, name)
+	}
+	if p.peek() == "[" { // [json_name = "…", deprecated = true, …]
+		p.pos++
+		for p.peek() != "]" && p.peek() != "" {
+			if p.next() == "json_name" && p.peek() == "=" {
+				p.pos++
+				if s, err := strconv.Unquote(p.next()); err == nil {
+					field.jsonName = s
+				}
+			}
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return fmt.Errorf("message %q, field %q: %w", scope, name, err)
+	}
+	p.file.messages[scope] = append(p.file.messages[scope], field)
+	return nil
+}
+
+// protoTokens splits a .proto file into its tokens: names, numbers,
+// quoted strings and punctuation, the comments left out.
+func protoTokens(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			i += end
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("comment not closed")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("string not closed")
+			}
+			s := src[i : j+1]
+			if c == '\'' { // strconv.Unquote reads '…' as a single rune
+				s = `"` + strings.ReplaceAll(s[1:len(s)-1], `"`, `\"`) + `"`
+			}
+			tokens = append(tokens, s)
+			i = j + 1
+		case c == '_' || c == '.' || c == '-' || c == '+' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
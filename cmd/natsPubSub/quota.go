@@ -0,0 +1,395 @@
+// quota.go — Per tenant quotas of the HTTP bridge.
+//
+// A SHARED BRIDGE:
+//
+//	One "http" bridge exposed to many producers is one NATS connection
+//	shared by all of them: a single misbehaving producer (a retry loop, a
+//	bulk import, 5 MB events) would take the whole throughput and the
+//	memory of the bridge. With -quota-config, every producer sends its API
+//	key in the X-API-Key header, the key tells its tenant, and each tenant
+//	has its own quotas:
+//
+//	  {
+//	    "header": "X-API-Key",
+//	    "tenants": {
+//	      "acme":    {"api_keys_sha256": ["9f86d0…"], "rate": 100, "burst": 200,
+//	                  "bytes_per_second": 1048576, "max_event_size": 262144},
+//	      "globex":  {"api_keys_sha256": ["60303a…", "fd61a0…"], "rate": 10}
+//	    },
+//	    "anonymous": {"rate": 1, "max_event_size": 4096}
+//	  }
+//
+//	  api_keys_sha256   SHA-256 of the API keys of the tenant, in hex
+//	                    (printf %s "$KEY" | sha256sum): the document holds
+//	                    no secret and may live in a ConfigMap or a KV bucket
+//	  rate, burst       events per second, and at once (rate by default)
+//	  bytes_per_second  bytes of events per second
+//	  max_event_size    largest event, in bytes
+//	  anonymous         the quotas shared by the requests without a known
+//	                    API key, refused with 401 when absent
+//
+//	0 or absent means no limit. The events over the rates are answered 429
+//	Too Many Requests with a Retry-After header, the ones over
+//	max_event_size 413 Payload Too Large; Knative and most HTTP clients
+//	retry the 429 later. A batch counts as one event, and an event refused
+//	uses up none of the quotas: one over the bandwidth gives its token of
+//	the rate back.
+//
+// RELOAD AND METRICS:
+//
+//	The document is reloaded as -handler-config is: a file checked every
+//	-reload-interval and on SIGHUP, or a kv://<bucket>/<key> watched for
+//	updates. The tenants keep their tokens across reloads. GET /metrics
+//	exposes the decisions by tenant in the Prometheus text format:
+//
+//	  natspubsub_quota_requests_total{tenant="acme",decision="rate_limited"} 12
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAPIKeyHeader carries the API key of the producers.
+	defaultAPIKeyHeader = "X-API-Key"
+	// anonymousTenant is the tenant of the requests without a known key.
+	anonymousTenant = "anonymous"
+)
+
+// Decisions of the quotas, the decision label of the metrics.
+const (
+	quotaAdmitted         = "admitted"
+	quotaRateLimited      = "rate_limited"
+	quotaBandwidthLimited = "bandwidth_limited"
+	quotaTooLarge         = "too_large"
+)
+
+// quotaDecisions lists the decisions in the order of the metrics.
+var quotaDecisions = []string{quotaAdmitted, quotaRateLimited, quotaBandwidthLimited, quotaTooLarge}
+
+// quotaConfig is the JSON document of -quota-config.
+type quotaConfig struct {
+	Header    string           `json:"header,omitempty"`
+	Tenants   map[string]quota `json:"tenants,omitempty"`
+	Anonymous *quota           `json:"anonymous,omitempty"`
+}
+
+// quota holds the limits of a tenant, 0 for no limit.
+type quota struct {
+	APIKeys        []string `json:"api_keys_sha256,omitempty"`
+	Rate           float64  `json:"rate,omitempty"`
+	Burst          int      `json:"burst,omitempty"`
+	BytesPerSecond int64    `json:"bytes_per_second,omitempty"`
+	MaxEventSize   int64    `json:"max_event_size,omitempty"`
+}
+
+// tokenBucket lets rate tokens per second through, up to capacity at once.
+type tokenBucket struct {
+	rate     float64 // 0 lets everything through
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// set changes the limits of the bucket, keeping its tokens.
+func (b *tokenBucket) set(now time.Time, rate, capacity float64) {
+	if b.rate <= 0 { // new, or unlimited until now: full
+		b.tokens, b.last = capacity, now
+	} else {
+		b.refill(now)
+	}
+	b.rate, b.capacity = rate, capacity
+	b.tokens = min(b.tokens, capacity)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// give puts n tokens back, up to the capacity.
+func (b *tokenBucket) give(n float64) {
+	if b.rate > 0 {
+		b.tokens = min(b.capacity, b.tokens+n)
+	}
+}
+
+// take removes n tokens, at most the capacity, and returns 0, or the wait
+// before they are available, removing none.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	n = min(n, b.capacity)
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// tenantQuota is the state of a tenant: its limits, buckets and counters.
+type tenantQuota struct {
+	quota
+	active    bool // still in the config: removed tenants keep their counters
+	events    tokenBucket
+	bandwidth tokenBucket
+	decisions map[string]int64
+	bytes     int64
+}
+
+// quotaEnforcer applies the quotas of -quota-config to the requests of the
+// HTTP bridge. Its methods accept a nil enforcer, admitting everything.
+type quotaEnforcer struct {
+	mu           sync.Mutex
+	header       string
+	keys         map[string]string // SHA-256 of the API key → tenant
+	anonymous    bool
+	tenants      map[string]*tenantQuota
+	unauthorized int64
+	now          func() time.Time // time.Now, but in the tests
+}
+
+func newQuotaEnforcer() *quotaEnforcer {
+	return &quotaEnforcer{tenants: make(map[string]*tenantQuota), now: time.Now}
+}
+
+// load applies a version of the -quota-config document.
+func (q *quotaEnforcer) load(data []byte) error {
+	var cfg quotaConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return err
+	}
+	keys, err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	all := make(map[string]quota, len(cfg.Tenants)+1)
+	maps.Copy(all, cfg.Tenants)
+	if cfg.Anonymous != nil {
+		all[anonymousTenant] = *cfg.Anonymous
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	for _, t := range q.tenants {
+		t.active = false
+	}
+	for name, limits := range all {
+		t := q.tenants[name]
+		if t == nil {
+			t = &tenantQuota{decisions: make(map[string]int64)}
+			q.tenants[name] = t
+		}
+		t.quota, t.active = limits, true
+		burst := float64(limits.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(limits.Rate))
+		}
+		t.events.set(now, limits.Rate, burst)
+		// A full second of bandwidth, and at least the largest event.
+		t.bandwidth.set(now, float64(limits.BytesPerSecond), float64(max(limits.BytesPerSecond, limits.MaxEventSize)))
+	}
+	q.header = http.CanonicalHeaderKey(cmp.Or(cfg.Header, defaultAPIKeyHeader))
+	q.keys = keys
+	q.anonymous = cfg.Anonymous != nil
+	return nil
+}
+
+// validate checks the document and returns its API keys by hash.
+func (cfg quotaConfig) validate() (map[string]string, error) {
+	if len(cfg.Tenants) == 0 && cfg.Anonymous == nil {
+		return nil, errors.New("no tenants and no anonymous quota")
+	}
+	if cfg.Anonymous != nil && len(cfg.Anonymous.APIKeys) > 0 {
+		return nil, errors.New("anonymous: api_keys_sha256 is not allowed")
+	}
+	keys := make(map[string]string)
+	for name, limits := range cfg.Tenants {
+		switch {
+		case name == "" || name == anonymousTenant:
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		case len(limits.APIKeys) == 0:
+			return nil, fmt.Errorf("tenant %q: no api_keys_sha256", name)
+		}
+		for _, key := range limits.APIKeys {
+			key = strings.ToLower(key)
+			if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("tenant %q: %q is not a SHA-256 in hex", name, key)
+			}
+			if other, dup := keys[key]; dup {
+				return nil, fmt.Errorf("tenant %q: API key %.8s… already given to %q", name, key, other)
+			}
+			keys[key] = name
+		}
+	}
+	for name, limits := range cfg.Tenants {
+		if err := limits.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+	}
+	if cfg.Anonymous != nil {
+		if err := cfg.Anonymous.validate(); err != nil {
+			return nil, fmt.Errorf("anonymous: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+func (limits quota) validate() error {
+	if limits.Rate < 0 || limits.Burst < 0 || limits.BytesPerSecond < 0 || limits.MaxEventSize < 0 {
+		return errors.New("negative limit")
+	}
+	if limits.Burst > 0 && limits.Rate == 0 {
+		return errors.New("burst without rate")
+	}
+	return nil
+}
+
+// admit identifies the tenant of r and takes one event of its rate, or
+// answers 401, 413 or 429 and returns false. The event is given back when
+// refused later, by admitBytes, tooLarge or release. maxSize is the largest event
+// of the tenant, 0 for no limit.
+func (q *quotaEnforcer) admit(w http.ResponseWriter, r *http.Request) (tenant string, maxSize int64, ok bool) {
+	if q == nil {
+		return "", 0, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tenant = anonymousTenant
+	if key := r.Header.Get(q.header); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		name, known := q.keys[hex.EncodeToString(sum[:])]
+		if !known {
+			q.unauthorized++
+			http.Error(w, "unknown API key", http.StatusUnauthorized)
+			return "", 0, false
+		}
+		tenant = name
+	} else if !q.anonymous {
+		q.unauthorized++
+		w.Header().Set("WWW-Authenticate", "ApiKey header="+strconv.Quote(q.header))
+		http.Error(w, "API key required in the "+q.header+" header", http.StatusUnauthorized)
+		return "", 0, false
+	}
+	t := q.tenants[tenant]
+	if t.MaxEventSize > 0 && r.ContentLength > t.MaxEventSize {
+		t.decisions[quotaTooLarge]++
+		http.Error(w, fmt.Sprintf("event larger than the %d bytes allowed", t.MaxEventSize), http.StatusRequestEntityTooLarge)
+		return "", 0, false
+	}
+	if wait := t.events.take(q.now(), 1); wait > 0 {
+		t.decisions[quotaRateLimited]++
+		tooManyRequests(w, wait, fmt.Sprintf("rate of %g events per second exceeded", t.Rate))
+		return "", 0, false
+	}
+	return tenant, t.MaxEventSize, true
+}
+
+// admitBytes takes size bytes of the bandwidth of tenant, or gives back
+// the event taken by admit, answers 429 and returns false.
+func (q *quotaEnforcer) admitBytes(w http.ResponseWriter, tenant string, size int) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenants[tenant]
+	if wait := t.bandwidth.take(q.now(), float64(size)); wait > 0 {
+		t.events.give(1)
+		t.decisions[quotaBandwidthLimited]++
+		tooManyRequests(w, wait, fmt.Sprintf("bandwidth of %d bytes per second exceeded", t.BytesPerSecond))
+		return false
+	}
+	t.decisions[quotaAdmitted]++
+	t.bytes += int64(size)
+	return true
+}
+
+// tooLarge counts an event of tenant refused while being read, and gives
+// back the event taken by admit.
+func (q *quotaEnforcer) tooLarge(tenant string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenants[tenant]
+	t.events.give(1)
+	t.decisions[quotaTooLarge]++
+}
+
+// release gives back the event taken by admit for a request of tenant
+// that failed before its bandwidth was taken (its body could not be read).
+func (q *quotaEnforcer) release(tenant string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tenants[tenant].events.give(1)
+}
+
+// tooManyRequests answers 429, telling the client when to retry.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, reason string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, reason, http.StatusTooManyRequests)
+}
+
+// serveMetrics writes the quota metrics in the Prometheus text format.
+func (q *quotaEnforcer) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	names := slices.Sorted(maps.Keys(q.tenants))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintln(w, "# HELP natspubsub_quota_requests_total Events POSTed to the HTTP bridge, by tenant and quota decision.")
+	fmt.Fprintln(w, "# TYPE natspubsub_quota_requests_total counter")
+	for _, name := range names {
+		for _, decision := range quotaDecisions {
+			fmt.Fprintf(w, "natspubsub_quota_requests_total{tenant=%q,decision=%q} %d\n", name, decision, q.tenants[name].decisions[decision])
+		}
+	}
+	fmt.Fprintln(w, "# HELP natspubsub_quota_unauthorized_total Requests refused for a missing or unknown API key.")
+	fmt.Fprintln(w, "# TYPE natspubsub_quota_unauthorized_total counter")
+	fmt.Fprintf(w, "natspubsub_quota_unauthorized_total %d\n", q.unauthorized)
+	fmt.Fprintln(w, "# HELP natspubsub_quota_bytes_total Bytes of the events admitted, by tenant.")
+	fmt.Fprintln(w, "# TYPE natspubsub_quota_bytes_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "natspubsub_quota_bytes_total{tenant=%q} %d\n", name, q.tenants[name].bytes)
+	}
+	fmt.Fprintln(w, "# HELP natspubsub_quota_rate Events per second allowed, by tenant, 0 for no limit.")
+	fmt.Fprintln(w, "# TYPE natspubsub_quota_rate gauge")
+	for _, name := range names {
+		if t := q.tenants[name]; t.active {
+			fmt.Fprintf(w, "natspubsub_quota_rate{tenant=%q} %g\n", name, t.Rate)
+		}
+	}
+	fmt.Fprintln(w, "# HELP natspubsub_quota_tokens Events a tenant may send at once, by tenant.")
+	fmt.Fprintln(w, "# TYPE natspubsub_quota_tokens gauge")
+	now := q.now()
+	for _, name := range names {
+		if t := q.tenants[name]; t.active && t.Rate > 0 {
+			t.events.refill(now)
+			fmt.Fprintf(w, "natspubsub_quota_tokens{tenant=%q} %g\n", name, math.Floor(t.events.tokens))
+		}
+	}
+}
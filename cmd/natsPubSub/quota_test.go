@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock of the quotas in the tests, moved by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestQuotas returns an enforcer of the document doc on a fake clock.
+// The API keys of the tenants are their names.
+func newTestQuotas(t *testing.T, doc string) (*quotaEnforcer, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q := newQuotaEnforcer()
+	q.now = clock.now
+	if err := q.load([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	return q, clock
+}
+
+// quotaDoc returns a -quota-config of the tenants, name → limits in JSON
+// without braces, each with its name as API key.
+func quotaDoc(tenants map[string]string) string {
+	var parts []string
+	for name, limits := range tenants {
+		if limits != "" {
+			limits = ", " + limits
+		}
+		parts = append(parts, fmt.Sprintf(`%q: {"api_keys_sha256": [%q]%s}`, name, sha256Hex(name), limits))
+	}
+	return `{"tenants": {` + strings.Join(parts, ", ") + `}}`
+}
+
+// post asks q to admit an event of key, of size bytes, and returns the
+// status of the answer and its Retry-After.
+func post(q *quotaEnforcer, key string, size int) (int, string) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", size)))
+	if key != "" {
+		r.Header.Set(defaultAPIKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	if tenant, _, ok := q.admit(w, r); ok {
+		q.admitBytes(w, tenant, size)
+	}
+	return w.Code, w.Header().Get("Retry-After")
+}
+
+func TestQuotaRefillAndBurst(t *testing.T) {
+	q, clock := newTestQuotas(t, quotaDoc(map[string]string{"acme": `"rate": 2, "burst": 4`}))
+	for i := range 4 {
+		if code, _ := post(q, "acme", 10); code != http.StatusOK {
+			t.Fatalf("event %d of the burst: status %d, want 200", i, code)
+		}
+	}
+	if code, retry := post(q, "acme", 10); code != http.StatusTooManyRequests || retry != "1" {
+		t.Fatalf("event over the burst: status %d, Retry-After %q, want 429 and 1", code, retry)
+	}
+
+	// Half a second gives one event back at 2 per second.
+	clock.advance(500 * time.Millisecond)
+	if code, _ := post(q, "acme", 10); code != http.StatusOK {
+		t.Errorf("after 500ms: status %d, want 200", code)
+	}
+	if code, _ := post(q, "acme", 10); code != http.StatusTooManyRequests {
+		t.Errorf("second event after 500ms: status %d, want 429", code)
+	}
+
+	// A long pause refills no more than the burst.
+	clock.advance(time.Hour)
+	admitted := 0
+	for range 10 {
+		if code, _ := post(q, "acme", 10); code == http.StatusOK {
+			admitted++
+		}
+	}
+	if admitted != 4 {
+		t.Errorf("after an hour: %d events admitted at once, want the burst of 4", admitted)
+	}
+}
+
+func TestQuotaDefaultBurst(t *testing.T) {
+	tests := []struct {
+		limits string
+		want   int
+	}{
+		{`"rate": 0.5`, 1},
+		{`"rate": 3`, 3},
+		{`"rate": 2.5`, 3},
+		{``, 20}, // no limit
+	}
+	for _, tt := range tests {
+		t.Run(tt.limits, func(t *testing.T) {
+			q, _ := newTestQuotas(t, quotaDoc(map[string]string{"acme": tt.limits}))
+			admitted := 0
+			for range 20 {
+				if code, _ := post(q, "acme", 10); code == http.StatusOK {
+					admitted++
+				}
+			}
+			if admitted != tt.want {
+				t.Errorf("%d events admitted at once, want %d", admitted, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaTenantsIsolated(t *testing.T) {
+	q, _ := newTestQuotas(t, quotaDoc(map[string]string{"acme": `"rate": 1`, "globex": `"rate": 1`}))
+	if code, _ := post(q, "acme", 10); code != http.StatusOK {
+		t.Fatalf("acme: status %d, want 200", code)
+	}
+	if code, _ := post(q, "acme", 10); code != http.StatusTooManyRequests {
+		t.Fatalf("acme over its rate: status %d, want 429", code)
+	}
+	if code, _ := post(q, "globex", 10); code != http.StatusOK {
+		t.Errorf("globex while acme is limited: status %d, want 200", code)
+	}
+	for _, key := range []string{"", "initech"} {
+		if code, _ := post(q, key, 10); code != http.StatusUnauthorized {
+			t.Errorf("key %q without anonymous quota: status %d, want 401", key, code)
+		}
+	}
+	if q.tenants["acme"].decisions[quotaRateLimited] != 1 || q.tenants["globex"].decisions[quotaRateLimited] != 0 || q.unauthorized != 2 {
+		t.Errorf("decisions: acme %v, globex %v, unauthorized %d", q.tenants["acme"].decisions, q.tenants["globex"].decisions, q.unauthorized)
+	}
+}
+
+func TestQuotaRefusedEventsUseNoToken(t *testing.T) {
+	q, clock := newTestQuotas(t, quotaDoc(map[string]string{"acme": `"rate": 2, "bytes_per_second": 100, "max_event_size": 100`}))
+	if code, _ := post(q, "acme", 80); code != http.StatusOK {
+		t.Fatalf("first event: status %d, want 200", code)
+	}
+	// Over the bandwidth: the event keeps its token of the rate.
+	if code, _ := post(q, "acme", 80); code != http.StatusTooManyRequests {
+		t.Fatalf("event over the bandwidth: status %d, want 429", code)
+	}
+	// Larger than max_event_size, told by its Content-Length or while read.
+	if code, _ := post(q, "acme", 101); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("event too large: status %d, want 413", code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(defaultAPIKeyHeader, "acme")
+	tenant, _, ok := q.admit(httptest.NewRecorder(), r)
+	if !ok {
+		t.Fatal("admit of a chunked event refused")
+	}
+	q.tooLarge(tenant)
+	if got := q.tenants["acme"].events.tokens; got != 1 {
+		t.Errorf("tokens of the rate = %g, want 1: only the admitted event took one", got)
+	}
+
+	clock.advance(time.Second)
+	if code, _ := post(q, "acme", 80); code != http.StatusOK {
+		t.Errorf("a second later: status %d, want 200", code)
+	}
+	got := q.tenants["acme"].decisions
+	if got[quotaAdmitted] != 2 || got[quotaBandwidthLimited] != 1 || got[quotaTooLarge] != 2 || q.tenants["acme"].bytes != 160 {
+		t.Errorf("decisions %v, %d bytes, want 2 admitted, 1 bandwidth limited, 2 too large, 160 bytes", got, q.tenants["acme"].bytes)
+	}
+}
+
+func TestQuotaReload(t *testing.T) {
+	q, clock := newTestQuotas(t, quotaDoc(map[string]string{"acme": `"rate": 1, "burst": 2`, "globex": `"rate": 1`}))
+	for range 2 {
+		post(q, "acme", 10)
+	}
+
+	// A reload keeps the tokens: a larger burst is not a free refill.
+	if err := q.load([]byte(quotaDoc(map[string]string{"acme": `"rate": 1, "burst": 5`, "initech": `"rate": 1`}))); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := post(q, "acme", 10); code != http.StatusTooManyRequests {
+		t.Errorf("acme right after the reload: status %d, want 429", code)
+	}
+	clock.advance(10 * time.Second)
+	admitted := 0
+	for range 10 {
+		if code, _ := post(q, "acme", 10); code == http.StatusOK {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Errorf("acme 10s after the reload: %d events admitted at once, want the new burst of 5", admitted)
+	}
+
+	// A new tenant starts full, a removed one is refused but keeps its
+	// counters for the metrics.
+	if code, _ := post(q, "initech", 10); code != http.StatusOK {
+		t.Errorf("initech, added: status %d, want 200", code)
+	}
+	if code, _ := post(q, "globex", 10); code != http.StatusUnauthorized {
+		t.Errorf("globex, removed: status %d, want 401", code)
+	}
+	if g := q.tenants["globex"]; g == nil || g.active {
+		t.Errorf("globex after its removal = %+v, want kept, inactive", g)
+	}
+
+	// A shorter burst takes the tokens over it away.
+	clock.advance(time.Hour)
+	if err := q.load([]byte(quotaDoc(map[string]string{"acme": `"rate": 1, "burst": 2`}))); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.tenants["acme"].events.tokens; got != 2 {
+		t.Errorf("acme tokens after a shorter burst = %g, want 2", got)
+	}
+	// An invalid document changes nothing.
+	if err := q.load([]byte(`{"tenants": {"acme": {"api_keys_sha256": ["x"], "rate": 1}}}`)); err == nil {
+		t.Error("load of an invalid document = nil, want an error")
+	}
+	if q.tenants["acme"].Burst != 2 || q.tenants["acme"].events.capacity != 2 {
+		t.Errorf("acme after an invalid document: %+v, want the burst of 2 kept", q.tenants["acme"].quota)
+	}
+}
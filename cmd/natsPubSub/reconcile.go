@@ -0,0 +1,253 @@
+// reconcile.go — Operator-style reconciler for JetStream streams and consumers.
+//
+// DESIRED STATE VS ACTUAL STATE:
+//
+//	Kubernetes popularized the "controller" pattern: you declare the state
+//	you want in files, and a loop continuously compares it with the real
+//	state, logging and correcting any drift. The "reconcile" mode applies
+//	this pattern to JetStream, a lightweight alternative to running the full
+//	NATS operator (NACK) when you only need streams and consumers.
+//
+// SPEC FILES:
+//
+//	Each *.json file of the -specs directory (e.g. a mounted ConfigMap)
+//	describes one stream and its consumers, with the field names of the
+//	JetStream API:
+//
+//	  {
+//	    "stream": {"name": "ORDERS", "subjects": ["orders.>"], "storage": "file", "max_age": 86400000000000},
+//	    "consumers": [{"durable_name": "billing", "ack_policy": "explicit", "filter_subject": "orders.created"}]
+//	  }
+//
+//	Only the fields written in the spec are compared: the server fills in
+//	many defaults (max_msgs: -1, …) that must not be reported as drift.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// defaultSpecsDir is where the reconciler looks for *.json specs.
+	defaultSpecsDir = "./streams"
+	// defaultReconcileInterval is the delay between two reconciliations.
+	defaultReconcileInterval = 30 * time.Second
+	// reconcileTimeout bounds the JetStream API calls of one reconciliation.
+	reconcileTimeout = 20 * time.Second
+)
+
+// streamSpec is the content of one spec file. The raw JSON of each resource
+// is kept to know which fields were explicitly declared.
+type streamSpec struct {
+	Stream    json.RawMessage   `json:"stream"`
+	Consumers []json.RawMessage `json:"consumers"`
+}
+
+// reconcile compares the specs of specsDir with the server every interval
+// until interrupted (Ctrl+C). With dryRun it only logs the drift.
+func reconcile(nc *nats.Conn, l *log.Logger, specsDir string, interval time.Duration, dryRun bool) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fail(l, exitFailure, "failed to create JetStream context: %v", err)
+	}
+
+	ctx, stop := stopContext()
+	defer stop()
+
+	l.Printf("🔁 Reconciling specs of %s every %v (dry-run: %v, Ctrl+C to quit) …", specsDir, interval, dryRun)
+	sdNotify("READY=1")
+
+	for ctx.Err() == nil {
+		runCtx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+		drift, err := reconcileOnce(runCtx, js, l, specsDir, dryRun)
+		cancel()
+		if err != nil {
+			l.Printf("⚠️  Reconciliation failed: %v", err)
+		} else if drift == 0 {
+			l.Println("✅ All streams and consumers match their specs")
+		}
+		sleepCtx(ctx, interval)
+	}
+
+	sdNotify("STOPPING=1")
+	l.Println("👋 Bye!")
+}
+
+// reconcileOnce loads every spec and reconciles it, returning the number of
+// resources found out of sync.
+func reconcileOnce(ctx context.Context, js jetstream.JetStream, l *log.Logger, specsDir string, dryRun bool) (int, error) {
+	// The directory is read again on every run: added, changed or removed
+	// files are picked up without restarting the reconciler.
+	files, err := filepath.Glob(filepath.Join(specsDir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no *.json spec found in %s", specsDir)
+	}
+	sort.Strings(files)
+
+	drift := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return drift, err
+		}
+		var spec streamSpec
+		if err := json.Unmarshal(content, &spec); err != nil {
+			l.Printf("⚠️  Skipping %s: invalid JSON: %v", file, err)
+			continue
+		}
+		n, err := reconcileStream(ctx, js, l, spec, dryRun)
+		drift += n
+		if err != nil {
+			l.Printf("⚠️  %s: %v", file, err)
+		}
+	}
+	return drift, nil
+}
+
+// reconcileStream creates or updates the stream of spec, then its consumers.
+func reconcileStream(ctx context.Context, js jetstream.JetStream, l *log.Logger, spec streamSpec, dryRun bool) (int, error) {
+	var desired jetstream.StreamConfig
+	if err := json.Unmarshal(spec.Stream, &desired); err != nil {
+		return 0, fmt.Errorf("invalid stream spec: %w", err)
+	}
+	if desired.Name == "" {
+		return 0, errors.New(`stream spec without "name"`)
+	}
+
+	drift := 0
+	stream, err := js.Stream(ctx, desired.Name)
+	switch {
+	case errors.Is(err, jetstream.ErrStreamNotFound):
+		drift++
+		l.Printf("➕ Stream %q is missing", desired.Name)
+		if dryRun {
+			// Without the stream, its consumers cannot be checked.
+			return drift + len(spec.Consumers), nil
+		}
+		if stream, err = js.CreateStream(ctx, desired); err != nil {
+			return drift, fmt.Errorf("create stream %q: %w", desired.Name, err)
+		}
+		l.Printf("✅ Stream %q created", desired.Name)
+	case err != nil:
+		return drift, fmt.Errorf("get stream %q: %w", desired.Name, err)
+	default:
+		diffs, err := declaredDiff(spec.Stream, stream.CachedInfo().Config)
+		if err != nil {
+			return drift, err
+		}
+		if len(diffs) > 0 {
+			drift++
+			logDrift(l, "stream "+desired.Name, diffs)
+			if !dryRun {
+				if stream, err = js.UpdateStream(ctx, desired); err != nil {
+					return drift, fmt.Errorf("update stream %q: %w", desired.Name, err)
+				}
+				l.Printf("✅ Stream %q updated", desired.Name)
+			}
+		}
+	}
+
+	for _, raw := range spec.Consumers {
+		n, err := reconcileConsumer(ctx, stream, l, raw, dryRun)
+		drift += n
+		if err != nil {
+			l.Printf("⚠️  stream %q: %v", desired.Name, err)
+		}
+	}
+	return drift, nil
+}
+
+// reconcileConsumer creates or updates one consumer of stream.
+func reconcileConsumer(ctx context.Context, stream jetstream.Stream, l *log.Logger, raw json.RawMessage, dryRun bool) (int, error) {
+	var desired jetstream.ConsumerConfig
+	if err := json.Unmarshal(raw, &desired); err != nil {
+		return 0, fmt.Errorf("invalid consumer spec: %w", err)
+	}
+	name := desired.Durable
+	if name == "" {
+		name = desired.Name
+	}
+	if name == "" {
+		return 0, errors.New(`consumer spec without "durable_name" or "name"`)
+	}
+	what := fmt.Sprintf("consumer %s > %s", stream.CachedInfo().Config.Name, name)
+
+	cons, err := stream.Consumer(ctx, name)
+	switch {
+	case errors.Is(err, jetstream.ErrConsumerNotFound):
+		l.Printf("➕ %s is missing", what)
+	case err != nil:
+		return 0, fmt.Errorf("get %s: %w", what, err)
+	default:
+		diffs, err := declaredDiff(raw, cons.CachedInfo().Config)
+		if err != nil {
+			return 0, err
+		}
+		if len(diffs) == 0 {
+			return 0, nil
+		}
+		logDrift(l, what, diffs)
+	}
+	if dryRun {
+		return 1, nil
+	}
+	if _, err := stream.CreateOrUpdateConsumer(ctx, desired); err != nil {
+		return 1, fmt.Errorf("apply %s: %w", what, err)
+	}
+	l.Printf("✅ %s applied", what)
+	return 1, nil
+}
+
+// fieldDiff is one declared field whose actual value differs.
+type fieldDiff struct {
+	Field           string
+	Desired, Actual any
+}
+
+// declaredDiff compares the fields present in the raw spec with the same
+// fields of the actual configuration, both seen through their JSON form.
+func declaredDiff(rawSpec json.RawMessage, actualConfig any) ([]fieldDiff, error) {
+	var desired map[string]any
+	if err := json.Unmarshal(rawSpec, &desired); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(actualConfig)
+	if err != nil {
+		return nil, err
+	}
+	var actual map[string]any
+	if err := json.Unmarshal(b, &actual); err != nil {
+		return nil, err
+	}
+
+	var diffs []fieldDiff
+	for field, want := range desired {
+		if got := actual[field]; !reflect.DeepEqual(want, got) {
+			diffs = append(diffs, fieldDiff{Field: field, Desired: want, Actual: got})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Field < diffs[j].Field })
+	return diffs, nil
+}
+
+// logDrift prints one line per drifting field of the resource.
+func logDrift(l *log.Logger, what string, diffs []fieldDiff) {
+	for _, d := range diffs {
+		l.Printf("🔀 Drift on %s: %s desired=%v actual=%v", what, d.Field, d.Desired, d.Actual)
+	}
+}
@@ -0,0 +1,144 @@
+// replay.go — Replay of the events kept in a stream, at a chosen pace.
+//
+// HISTORICAL CAPTURES AS TRAFFIC:
+//
+//	A stream holding a day of production events is the most realistic
+//	test data there is: real types, real sizes, real bursts. The "replay"
+//	mode reads the messages of -subject kept in the stream (-stream, or the
+//	stream capturing the subject) and publishes them again under
+//	-replay-prefix, so the copies do not mix with the live traffic:
+//
+//	  orders.created  ──replay──►  replay.orders.created
+//
+//	  go run . -mode replay -subject "orders.>"                  # as fast as possible
+//	  go run . -mode replay -subject "orders.>" -realtime        # the original pace
+//	  go run . -mode replay -subject "orders.>" -speed 10x       # ten times faster
+//	  go run . -mode replay -subject "orders.>" -speed 10x -as-of first
+//
+// TIME WARPING:
+//
+//	Replayed as they are, the events of last Tuesday look stale to any
+//	consumer checking their "time". With -as-of, the CloudEvents time of
+//	every replayed event is rewritten as if the instant -as-of (RFC 3339,
+//	or "first" for the first replayed message) were now, compressed like
+//	the pace by -speed: an event 10 minutes after -as-of, replayed at 10x,
+//	is dated 1 minute after the start of the replay, when it is published.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// defaultReplayPrefix prefixes the subjects of the replayed messages.
+	defaultReplayPrefix = "replay"
+	// asOfFirst is the -as-of value naming the first replayed message.
+	asOfFirst = "first"
+)
+
+// parseSpeed parses a -speed value, "10x", "0.5x" or "10"; "" means as
+// fast as possible (0).
+func parseSpeed(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(value), "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("expected a positive factor such as 10x or 0.5x, got %q", value)
+	}
+	return speed, nil
+}
+
+// parseAsOf parses a -as-of value, RFC 3339 or "first" (zero time).
+func parseAsOf(value string) (time.Time, error) {
+	if value == "" || value == asOfFirst {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// replay publishes again under prefix the messages of subject stored in
+// the stream, paced by speed (0 for no pacing). With warp, the CloudEvents
+// times are rewritten relative to asOf (the first message when zero).
+func replay(nc *nats.Conn, l *log.Logger, subject, streamName, prefix string, speed float64, warp bool, asOf time.Time) {
+	ctx, stop := stopContext()
+	defer stop()
+
+	factor := speed
+	if factor == 0 {
+		factor = 1 // no pacing, times rewritten at the original scale
+	}
+	var start, first time.Time
+	published := 0
+	readStored(ctx, nc, l, subject, streamName, func(m *nats.Msg, meta *jetstream.MsgMetadata) {
+		if start.IsZero() {
+			start, first = time.Now(), meta.Timestamp
+			if asOf.IsZero() {
+				asOf = first
+			}
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(meta.Timestamp.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 {
+				sleepCtx(ctx, wait)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if warp {
+			warpEventTime(m, func(t time.Time) time.Time {
+				return start.Add(time.Duration(float64(t.Sub(asOf)) / factor))
+			})
+		}
+		out := &nats.Msg{Subject: prefix + "." + m.Subject, Header: m.Header, Data: m.Data}
+		if err := nc.PublishMsg(out); err != nil {
+			l.Printf("⚠️  Failed to replay stream sequence %d: %v", meta.Sequence.Stream, err)
+			return
+		}
+		countPublished(len(out.Data))
+		published++
+	})
+	if err := nc.FlushWithContext(context.WithoutCancel(ctx)); err != nil {
+		fail(l, exitPublish, "failed to flush the replayed messages: %v", err)
+	}
+	l.Printf("✅ %d message(s) replayed on %s.%s", published, prefix, subject)
+}
+
+// warpEventTime rewrites the CloudEvents time of m with warp, in binary or
+// structured content mode. Other messages are left as they are.
+func warpEventTime(m *nats.Msg, warp func(time.Time) time.Time) {
+	for k, values := range m.Header {
+		if strings.EqualFold(k, cePrefix+"time") && len(values) > 0 {
+			if t, err := time.Parse(time.RFC3339Nano, values[0]); err == nil {
+				m.Header.Set(k, warp(t).UTC().Format(time.RFC3339Nano))
+			}
+			return
+		}
+	}
+	var envelope map[string]json.RawMessage
+	if json.Unmarshal(m.Data, &envelope) != nil || envelope["specversion"] == nil {
+		return
+	}
+	var value string
+	if json.Unmarshal(envelope["time"], &value) != nil {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return
+	}
+	envelope["time"], _ = json.Marshal(warp(t).UTC().Format(time.RFC3339Nano))
+	if data, err := json.Marshal(envelope); err == nil {
+		m.Data = data
+	}
+}
@@ -0,0 +1,160 @@
+// request.go — Request-reply and scatter-gather "request" mode.
+//
+// REQUEST-REPLY:
+//
+//	A request is a message published with a "reply-to" subject, a unique
+//	inbox (_INBOX.<random>) the requester subscribes to. Any subscriber of
+//	the request subject may answer by publishing on that inbox.
+//
+// SCATTER-GATHER:
+//
+//	nc.Request returns the first reply only. When several services answer
+//	the same subject (plain subscribers, not a queue group), all their
+//	replies arrive on the inbox: this mode keeps collecting them until
+//	-max-replies replies or -timeout, and prints every responder. Handy
+//	for service discovery ("who is there?") and fan-out queries.
+//
+//	  go run . -mode request -subject "inventory.stock.42" -msg "" -max-replies 0 -timeout 1s
+//
+//	-max-replies 1 (the default) is the classic request-reply, 0 waits
+//	for the whole -timeout.
+//
+// NO RESPONDERS VS TIMEOUT:
+//
+//	When nobody subscribes to the subject, the server answers at once
+//	with a "503 No Responders" status message: there is no need to wait
+//	for the timeout, the service is simply not there (not deployed yet,
+//	restarting, wrong subject or account). A timeout means somebody got
+//	the request but did not answer in time. Both end the program with a
+//	distinct exit code (see result.go), so scripts can tell them apart:
+//
+//	  0  at least one reply
+//	  3  timeout, no reply
+//	  4  no responders
+//
+//	With -retry-on-no-responder, the request is sent again (with a
+//	backoff) while there are no responders, until -timeout: handy to wait
+//	for a service being started.
+//
+// RESTRICTED INBOXES:
+//
+//	The requester must be allowed to subscribe to its inbox. A server
+//	granting "_INBOX.>" to every user lets them all read the replies of the
+//	others, so multi-tenant accounts give each user its own prefix instead:
+//
+//	  alice: { subscribe: "_INBOX_alice.>", publish: "orders.>" }
+//
+//	With -inbox-prefix _INBOX_alice the inboxes are _INBOX_alice.<random>,
+//	for this mode as well as the replies awaited by the "http" mode with
+//	-reply. Without it, the server refuses the subscription to the inbox
+//	with a "Permissions Violation" and the request ends with a timeout,
+//	although the service answered. The responders need no change: they
+//	publish on the reply subject they receive, which their own permissions
+//	must allow, typically with allow_responses.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultRequestTimeout is how long replies are awaited by default.
+const defaultRequestTimeout = 2 * time.Second
+
+// noRespondersStatus is the status header of the server reply to a
+// request nobody subscribes to.
+const noRespondersStatus = "503"
+
+// noResponderBackoff bounds the delay between two retries with -retry-on-no-responder.
+const noResponderBackoff = 2 * time.Second
+
+// validInboxPrefix reports whether prefix can prefix the reply inboxes: a
+// subject without wildcards nor trailing dot.
+func validInboxPrefix(prefix string) bool {
+	if strings.ContainsAny(prefix, "*> \t\r\n") || strings.HasPrefix(prefix, ".") || strings.HasSuffix(prefix, ".") {
+		return false
+	}
+	return !strings.Contains(prefix, "..")
+}
+
+// request sends a request and prints the replies, up to maxReplies (0 for
+// no limit) or until timeout.
+func request(nc *nats.Conn, l *log.Logger, subject, msg string, header nats.Header, maxReplies int, timeout time.Duration, retryNoResponder bool) {
+	m, err := checkPayload(nc, newMsg(subject, msg, header), oversizeReject)
+	if err != nil {
+		fail(l, exitPublish, "refusing to send the request: %v", err)
+	}
+
+	// KEY CONCEPT — one inbox, many replies:
+	// subscribing to our own unique inbox before publishing guarantees that
+	// no reply is missed, however fast the responders are.
+	m.Reply = nc.NewInbox()
+	replies := make(chan *nats.Msg, 64)
+	sub, err := nc.ChanSubscribe(m.Reply, replies)
+	if err != nil {
+		fail(l, exitFailure, "failed to subscribe to the reply inbox: %v", err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	l.Printf("Requesting on subject %q, waiting up to %v …", subject, timeout)
+	start := time.Now()
+	if err := nc.PublishMsg(m); err != nil {
+		fail(l, exitPublish, "failed to send the request: %v", err)
+	}
+	countPublished(len(m.Data))
+
+	ctx, stop := stopContext()
+	defer stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	received, backoff := 0, 100*time.Millisecond
+	for maxReplies == 0 || received < maxReplies {
+		select {
+		case r := <-replies:
+			if r.Header.Get("Status") == noRespondersStatus && len(r.Data) == 0 {
+				if received > 0 {
+					continue // the other responders are gone, keep the replies
+				}
+				if !retryNoResponder || time.Since(start)+backoff >= timeout {
+					fail(l, exitNoResponders, "no responders on %q: nobody subscribes to this subject", subject)
+				}
+				l.Printf("⏳ No responders on %q yet, retrying in %v …", subject, backoff)
+				sleepCtx(ctx, backoff)
+				backoff = min(2*backoff, noResponderBackoff)
+				if err := nc.PublishMsg(m); err != nil {
+					fail(l, exitPublish, "failed to send the request: %v", err)
+				}
+				countPublished(len(m.Data))
+				continue
+			}
+			received++
+			countReceived(len(r.Data))
+			l.Printf("📨 Reply #%d after %v: %s", received, time.Since(start).Round(time.Microsecond), r.Data)
+			for k, values := range r.Header {
+				l.Printf("   %s: %s", k, strings.Join(values, ", "))
+			}
+		case <-deadline.C:
+			if received == 0 {
+				fail(l, exitTimeout, "timeout: no reply on %q within %v", subject, timeout)
+			}
+			l.Printf("⏱️  Timeout after %s", replyCount(received))
+			return
+		case <-ctx.Done():
+			l.Printf("🛑 Interrupted after %s", replyCount(received))
+			return
+		}
+	}
+	l.Printf("✅ %s in %v", replyCount(received), time.Since(start).Round(time.Microsecond))
+}
+
+// replyCount returns "1 reply" or "n replies".
+func replyCount(n int) string {
+	if n == 1 {
+		return "1 reply"
+	}
+	return fmt.Sprintf("%d replies", n)
+}
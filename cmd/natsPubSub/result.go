@@ -0,0 +1,165 @@
+// result.go — Stable exit codes and the machine-readable -result-json summary.
+//
+// AUTOMATION:
+//
+//	Scripts, CI jobs and Kubernetes Jobs react to the exit code of a
+//	program, and sometimes need more than a code. The exit codes below
+//	are stable (the same in natsctl), and -result-json writes a summary of
+//	the run when the program ends, successfully or not:
+//
+//	  0  success
+//	  1  runtime failure (anything not listed below)
+//	  2  usage or validation error (flags, schema, header file, …)
+//	  3  timeout: no reply in time
+//	  4  no responders: nobody subscribes to the request subject
+//	  5  connection failure (unreachable server, authorization)
+//	  6  publish failure (refused, max_payload exceeded, flush)
+//
+//	  go run . -mode pub -subject x -msg hi -result-json result.json   # "-" for stdout
+//	  {"mode":"pub","subject":"x","status":"ok","exit_code":0,"published":1,"bytes":2,…}
+//
+//	The service, deploy and schema sub-commands accept -result-json too,
+//	their name as "mode".
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exit codes of the program, for scripts.
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitTimeout      = 3
+	exitNoResponders = 4
+	exitConnection   = 5
+	exitPublish      = 6
+)
+
+// runResult is the -result-json summary.
+type runResult struct {
+	Mode        string    `json:"mode"`
+	Subject     string    `json:"subject,omitempty"`
+	Status      string    `json:"status"` // "ok" or "error"
+	ExitCode    int       `json:"exit_code"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	DurationMS  int64     `json:"duration_ms"`
+	Published   int64     `json:"published"`             // messages and requests sent
+	Received    int64     `json:"received"`              // messages and replies received
+	Bytes       int64     `json:"bytes"`                 // payload bytes sent and received
+	Spooled     int64     `json:"spooled,omitempty"`     // messages kept in the -spool
+	Denied      int64     `json:"denied,omitempty"`      // messages refused by the permissions (see fallback.go)
+	Quarantined int64     `json:"quarantined,omitempty"` // messages rejected by the payload guard (see guard.go)
+}
+
+var (
+	resultMu   sync.Mutex
+	result     = runResult{StartedAt: time.Now().UTC()}
+	resultFile string // -result-json, "" when no summary is wanted
+)
+
+// countPublished adds a sent message of size bytes to the summary.
+func countPublished(size int) {
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	result.Published++
+	result.Bytes += int64(size)
+}
+
+// countReceived adds a received message of size bytes to the summary.
+func countReceived(size int) {
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	result.Received++
+	result.Bytes += int64(size)
+}
+
+// countSpooled adds a message kept in the -spool to the summary.
+func countSpooled() {
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	result.Spooled++
+}
+
+// countDenied adds a message refused by the permissions to the summary.
+func countDenied() {
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	result.Denied++
+}
+
+// countQuarantined adds a message rejected to the quarantine to the summary.
+func countQuarantined() {
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	result.Quarantined++
+}
+
+// writeResult writes the summary to resultFile, if any.
+func writeResult(code int, err error) {
+	if resultFile == "" {
+		return
+	}
+	resultMu.Lock()
+	r := result
+	resultMu.Unlock()
+	r.ExitCode, r.Status = code, "ok"
+	if code != exitOK {
+		r.Status = "error"
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.DurationMS = time.Since(r.StartedAt).Milliseconds()
+
+	data, _ := json.Marshal(r)
+	data = append(data, '\n')
+	if resultFile == "-" {
+		_, _ = os.Stdout.Write(data)
+		return
+	}
+	if werr := os.WriteFile(resultFile, data, 0o644); werr != nil {
+		fmt.Fprintf(os.Stderr, "Error: -result-json: %v\n", werr)
+	}
+}
+
+// exit writes the summary and ends the program with code.
+func exit(code int, err error) {
+	writeResult(code, err)
+	os.Exit(code)
+}
+
+// fail logs an error and ends the program with code, writing the summary.
+func fail(l *log.Logger, code int, format string, args ...any) {
+	err := fmt.Errorf(format, args...)
+	l.Printf("💥 %v", err)
+	exit(code, err)
+}
+
+// usageError reports an invalid command line and ends the program.
+func usageError(format string, args ...any) {
+	commandUsageError(flag.CommandLine, format, args...)
+}
+
+// commandUsageError reports an invalid use of the sub-command of fs, with
+// its usage, and ends the program.
+func commandUsageError(fs *flag.FlagSet, format string, args ...any) {
+	err := fmt.Errorf(format, args...)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	fs.Usage()
+	exit(exitUsage, err)
+}
+
+// resultFlag defines -result-json in fs, the flags of the program or of a
+// sub-command.
+func resultFlag(fs *flag.FlagSet) {
+	fs.StringVar(&resultFile, "result-json", "", `File receiving a JSON summary of the run (status, exit code, counts, duration, error) when the program ends, "-" for stdout (the logs then go to stderr)`)
+}
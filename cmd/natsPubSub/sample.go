@@ -0,0 +1,86 @@
+// sample.go — Sampling of the messages handled by the "sub" mode.
+//
+// WHY SAMPLE:
+//
+//	Watching or archiving every message of a subject carrying thousands of
+//	events per second costs as much as the production traffic itself,
+//	when a small share of it is enough to see what flows, check a schema
+//	or keep a representative history. With -sample (or "sample" in
+//	-handler-config), the "sub" mode only handles a share of the messages
+//	matching its filters, the others are skipped (and acknowledged):
+//
+//	  -sample 1%      each message is kept with a probability of 1%
+//	  -sample 1/100   every 100th message is kept, deterministically
+//
+//	A percentage suits several instances of a queue group, every one of
+//	them sampling its own share at random; "1/N" gives an exact count.
+//
+// RECORDED DECISION:
+//
+//	Every kept message carries the share kept in a Sample-Rate header
+//	("0.01"), printed and republished by the routes, so a downstream
+//	counting events knows each sampled one stands for 1/rate of them.
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// sampleRateHeader records on a sampled message the share of messages kept.
+const sampleRateHeader = "Sample-Rate"
+
+// sampler keeps a share of the messages, at random (rate) or one in every.
+// A nil sampler keeps them all.
+type sampler struct {
+	rate  float64
+	every uint64
+	seen  atomic.Uint64
+}
+
+// parseSample parses a -sample value, "<p>%" or "1/<n>", "" keeping all.
+func parseSample(value string) (*sampler, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return nil, nil
+	case strings.HasSuffix(value, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("sample %q: expected a percentage in ]0%%, 100%%]", value)
+		}
+		return &sampler{rate: percent / 100}, nil
+	case strings.HasPrefix(value, "1/"):
+		every, err := strconv.ParseUint(strings.TrimPrefix(value, "1/"), 10, 64)
+		if err != nil || every == 0 {
+			return nil, fmt.Errorf("sample %q: expected 1/<n> with n ≥ 1", value)
+		}
+		return &sampler{rate: 1 / float64(every), every: every}, nil
+	}
+	return nil, fmt.Errorf("sample %q: expected a percentage (1%%) or one in n messages (1/100)", value)
+}
+
+// keep reports whether the next message is kept, recording the decision in
+// its Sample-Rate header.
+func (s *sampler) keep(m *nats.Msg) bool {
+	if s == nil {
+		return true
+	}
+	if s.every > 0 {
+		if (s.seen.Add(1)-1)%s.every != 0 {
+			return false
+		}
+	} else if rand.Float64() >= s.rate {
+		return false
+	}
+	if m.Header == nil {
+		m.Header = nats.Header{}
+	}
+	m.Header.Set(sampleRateHeader, strconv.FormatFloat(s.rate, 'g', -1, 64))
+	return true
+}
@@ -0,0 +1,462 @@
+// schema.go — Event contract compatibility checker and publish-time validation.
+//
+// EVENTS ARE A CONTRACT:
+//
+//	A CloudEvent "data" follows a schema (the "dataschema" attribute points
+//	to it). Producers and consumers are deployed independently, so a new
+//	version of the schema must not break the consumers still running with
+//	the previous one. The rule applied here is the consumer-centric one:
+//
+//	  a change is COMPATIBLE when every event valid under the NEW schema is
+//	  also valid under the OLD schema.
+//
+//	  Compatible                                  Breaking
+//	  ──────────────────────────────────────────  ─────────────────────────────────────────────
+//	  new optional property                       property removed while it was required
+//	  optional property becomes required          required property becomes optional
+//	  type narrowed (number → integer)            type changed or widened (integer → number)
+//	  enum value removed, constraint tightened    enum value added, constraint loosened/removed
+//	                                              property added when additionalProperties=false
+//
+//	A breaking change needs a new event type (e.g. "order.created.v2") and a
+//	new dataschema URI, as recommended by the CloudEvents specification.
+//
+// USAGE:
+//
+//	natsPubSub schema diff schemas/order-v1.json schemas/order-v2.json
+//
+//	prints every change with its classification and exits with status 1
+//	when a breaking change is found, so it can gate a CI pipeline, 2 when
+//	a schema cannot be read (see result.go). The "pub" mode also accepts
+//	-schema to refuse publishing a payload that does not match the
+//	contract.
+//
+//	JSON Schema is read through the keywords shared by most event
+//	contracts: type, properties, required, additionalProperties, items,
+//	enum, pattern and the min/max bounds. Avro (.avsc) and Protobuf
+//	(.proto) schemas are translated to them, the JSON form of their data
+//	(see avroschema.go and protoschema.go); "file#Name" names the record or
+//	message of the event when the file declares several:
+//
+//	natsPubSub schema diff order-v1.proto#OrderCreated order-v2.proto#OrderCreated
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+const (
+	// cmdSchema is the first argument selecting the schema sub-command.
+	cmdSchema = "schema"
+)
+
+// lowerBounds and upperBounds are the JSON Schema constraints compared
+// numerically: loosening them lets through events the old schema rejects.
+var (
+	lowerBounds = []string{"minimum", "minLength", "minItems", "minProperties"}
+	upperBounds = []string{"maximum", "maxLength", "maxItems", "maxProperties"}
+)
+
+// schemaChange is one difference between two versions of a schema.
+type schemaChange struct {
+	Path     string
+	Breaking bool
+	Message  string
+}
+
+// schemaCommand handles "natsPubSub schema diff [flags] <old> <new>".
+func schemaCommand(args []string) {
+	result.Mode = cmdSchema
+	fs := flag.NewFlagSet(cmdSchema+" diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s diff [flags] <old-schema.json> <new-schema.json>\n", APP, cmdSchema)
+		fs.PrintDefaults()
+	}
+	resultFlag(fs)
+	if len(args) < 1 || args[0] != "diff" {
+		commandUsageError(fs, `the only schema sub-command is "diff"`)
+	}
+	_ = fs.Parse(args[1:])
+	if fs.NArg() != 2 {
+		commandUsageError(fs, "the old and the new schema are required")
+	}
+	l := log.New(os.Stderr, "", 0)
+	oldSchema, err := loadSchema(fs.Arg(0))
+	if err != nil {
+		fail(l, exitUsage, "%v", err)
+	}
+	newSchema, err := loadSchema(fs.Arg(1))
+	if err != nil {
+		fail(l, exitUsage, "%v", err)
+	}
+
+	// With -result-json -, stdout only carries the JSON summary.
+	out := io.Writer(os.Stdout)
+	if resultFile == "-" {
+		out = os.Stderr
+	}
+	changes := diffSchema("$", oldSchema, newSchema, nil)
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "✅ No change in the event contract")
+		writeResult(exitOK, nil)
+		return
+	}
+	breaking := 0
+	for _, c := range changes {
+		if c.Breaking {
+			breaking++
+			fmt.Fprintf(out, "❌ BREAKING   %-30s %s\n", c.Path, c.Message)
+		} else {
+			fmt.Fprintf(out, "✅ compatible %-30s %s\n", c.Path, c.Message)
+		}
+	}
+	fmt.Fprintf(out, "\n%d change(s), %d breaking\n", len(changes), breaking)
+	if breaking > 0 {
+		fmt.Fprintln(out, "ℹ️  publish the new version under a new event type and dataschema URI")
+		exit(exitFailure, fmt.Errorf("%d breaking change(s) in the event contract", breaking))
+	}
+	writeResult(exitOK, nil)
+}
+
+// loadSchema reads a JSON Schema file, or an Avro (.avsc) or Protobuf
+// (.proto) one translated to JSON Schema, "file#Name" naming its root
+// record or message.
+func loadSchema(file string) (map[string]any, error) {
+	root := ""
+	if i := strings.LastIndex(file, "#"); i > 0 && slices.Contains([]string{".avsc", ".proto"}, strings.ToLower(filepath.Ext(file[:i]))) {
+		file, root = file[:i], file[i+1:]
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var schema map[string]any
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".avsc":
+		schema, err = avroToJSONSchema(content, root)
+	case ".proto":
+		schema, err = protoToJSONSchema(content, root)
+	default:
+		if err := json.Unmarshal(content, &schema); err != nil {
+			return nil, fmt.Errorf("%s: invalid JSON: %w", file, err)
+		}
+		if t, _ := schema["type"].(string); t == "record" { // an Avro schema named .json
+			schema, err = avroToJSONSchema(content, "")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return schema, nil
+}
+
+// diffSchema appends to changes the differences between the old and new
+// schema of the value at path, recursing into properties and items.
+func diffSchema(path string, oldS, newS map[string]any, changes []schemaChange) []schemaChange {
+	add := func(breaking bool, format string, args ...any) {
+		changes = append(changes, schemaChange{Path: path, Breaking: breaking, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// ─── type ──────────────────────────────────────────────────────────
+	oldTypes, newTypes := schemaTypes(oldS), schemaTypes(newS)
+	if !slices.Equal(oldTypes, newTypes) {
+		add(!typesCovered(newTypes, oldTypes), "type %s → %s", typesString(oldTypes), typesString(newTypes))
+	}
+
+	// ─── properties and required ───────────────────────────────────────
+	oldProps, _ := oldS["properties"].(map[string]any)
+	newProps, _ := newS["properties"].(map[string]any)
+	oldReq, newReq := requiredSet(oldS), requiredSet(newS)
+	closed := oldS["additionalProperties"] == false
+	for _, name := range sortedKeys(newProps) {
+		if _, ok := oldProps[name]; ok {
+			continue
+		}
+		switch {
+		case closed:
+			add(true, "property %q added, the previous version forbids additional properties", name)
+		case newReq[name]:
+			add(false, "required property %q added", name)
+		default:
+			add(false, "optional property %q added", name)
+		}
+	}
+	for _, name := range sortedKeys(oldProps) {
+		newProp, ok := newProps[name]
+		if !ok {
+			add(oldReq[name] && !newReq[name], "property %q removed", name)
+			continue
+		}
+		oldSub, _ := oldProps[name].(map[string]any)
+		newSub, _ := newProp.(map[string]any)
+		if oldSub != nil && newSub != nil {
+			changes = diffSchema(path+"."+name, oldSub, newSub, changes)
+		}
+	}
+	for _, name := range sortedKeys(oldReq) {
+		if _, kept := newProps[name]; kept && !newReq[name] {
+			add(true, "property %q is no longer required", name)
+		}
+	}
+	for _, name := range sortedKeys(newReq) {
+		if _, existed := oldProps[name]; existed && !oldReq[name] {
+			add(false, "property %q is now required", name)
+		}
+	}
+	if closed && newS["additionalProperties"] != false {
+		add(true, "additional properties are now allowed")
+	} else if !closed && newS["additionalProperties"] == false {
+		add(false, "additional properties are now forbidden")
+	}
+
+	// ─── items ─────────────────────────────────────────────────────────
+	oldItems, _ := oldS["items"].(map[string]any)
+	newItems, _ := newS["items"].(map[string]any)
+	if oldItems != nil && newItems != nil {
+		changes = diffSchema(path+"[]", oldItems, newItems, changes)
+	}
+
+	// ─── enum ──────────────────────────────────────────────────────────
+	oldEnum, oldHasEnum := oldS["enum"].([]any)
+	newEnum, newHasEnum := newS["enum"].([]any)
+	switch {
+	case oldHasEnum && !newHasEnum:
+		add(true, "enum constraint removed")
+	case !oldHasEnum && newHasEnum:
+		add(false, "enum constraint added")
+	case oldHasEnum:
+		for _, v := range newEnum {
+			if !containsJSON(oldEnum, v) {
+				add(true, "enum value %s added", jsonString(v))
+			}
+		}
+		for _, v := range oldEnum {
+			if !containsJSON(newEnum, v) {
+				add(false, "enum value %s removed", jsonString(v))
+			}
+		}
+	}
+
+	// ─── pattern and bounds ────────────────────────────────────────────
+	if oldS["pattern"] != newS["pattern"] {
+		switch {
+		case newS["pattern"] == nil:
+			add(true, "pattern %s removed", jsonString(oldS["pattern"]))
+		case oldS["pattern"] == nil:
+			add(false, "pattern %s added", jsonString(newS["pattern"]))
+		default:
+			// Comparing two regular expressions is undecidable in general.
+			add(true, "pattern %s → %s (cannot be proven compatible)", jsonString(oldS["pattern"]), jsonString(newS["pattern"]))
+		}
+	}
+	for _, k := range append(slices.Clone(lowerBounds), upperBounds...) {
+		oldV, oldOK := oldS[k].(float64)
+		newV, newOK := newS[k].(float64)
+		lower := slices.Contains(lowerBounds, k)
+		switch {
+		case oldOK && !newOK:
+			add(true, "%s %s removed", k, jsonString(oldV))
+		case !oldOK && newOK:
+			add(false, "%s %s added", k, jsonString(newV))
+		case oldOK && oldV != newV:
+			add((lower && newV < oldV) || (!lower && newV > oldV), "%s %s → %s", k, jsonString(oldV), jsonString(newV))
+		}
+	}
+	return changes
+}
+
+// validateAgainstSchema returns the violations of value against schema.
+func validateAgainstSchema(path string, schema map[string]any, value any) []string {
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if types := schemaTypes(schema); types != nil && !slices.ContainsFunc(types, func(t string) bool { return jsonTypeIs(value, t) }) {
+		fail("expected %s, got %s", typesString(types), jsonTypeOf(value))
+		return errs
+	}
+	if enum, ok := schema["enum"].([]any); ok && !containsJSON(enum, value) {
+		fail("value %s is not one of %s", jsonString(value), jsonString(enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, name := range sortedKeys(requiredSet(schema)) {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			sub, known := props[name].(map[string]any)
+			switch {
+			case known:
+				errs = append(errs, validateAgainstSchema(path+"."+name, sub, v[name])...)
+			case schema["additionalProperties"] == false:
+				fail("property %q is not allowed", name)
+			}
+		}
+		checkBounds(schema, "Properties", float64(len(v)), fail)
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				errs = append(errs, validateAgainstSchema(fmt.Sprintf("%s[%d]", path, i), items, item)...)
+			}
+		}
+		checkBounds(schema, "Items", float64(len(v)), fail)
+	case string:
+		checkBounds(schema, "Length", float64(len([]rune(v))), fail)
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err != nil {
+				fail("invalid pattern %q in schema: %v", pattern, err)
+			} else if !re.MatchString(v) {
+				fail("%q does not match pattern %q", v, pattern)
+			}
+		}
+	case float64:
+		checkBounds(schema, "imum", v, fail)
+	}
+	return errs
+}
+
+// checkBounds checks n against the min<suffix> and max<suffix> keywords.
+func checkBounds(schema map[string]any, suffix string, n float64, fail func(string, ...any)) {
+	if limit, ok := schema["min"+suffix].(float64); ok && n < limit {
+		fail("%v is below min%s %v", n, suffix, limit)
+	}
+	if limit, ok := schema["max"+suffix].(float64); ok && n > limit {
+		fail("%v is above max%s %v", n, suffix, limit)
+	}
+}
+
+// validatePayload checks that payload is JSON matching the schema file,
+// a *broker.Error of kind broker.ErrSchemaValidation when not.
+func validatePayload(schemaFile string, payload []byte) error {
+	schema, err := loadSchema(schemaFile)
+	if err != nil {
+		return err
+	}
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return &broker.Error{Op: "validate", Kind: broker.ErrSchemaValidation, Err: fmt.Errorf("payload is not valid JSON: %w", err)}
+	}
+	if errs := validateAgainstSchema("$", schema, value); len(errs) > 0 {
+		return &broker.Error{Op: "validate", Kind: broker.ErrSchemaValidation, Err: errors.New(strings.Join(errs, "; "))}
+	}
+	return nil
+}
+
+// schemaTypes returns the sorted "type" of a schema, nil when any type is accepted.
+func schemaTypes(schema map[string]any) []string {
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// typesCovered reports whether every type of newTypes is accepted by oldTypes.
+func typesCovered(newTypes, oldTypes []string) bool {
+	if oldTypes == nil {
+		return true
+	}
+	if newTypes == nil {
+		return false
+	}
+	for _, t := range newTypes {
+		if !slices.Contains(oldTypes, t) && !(t == "integer" && slices.Contains(oldTypes, "number")) {
+			return false
+		}
+	}
+	return true
+}
+
+// typesString formats a type list, "any" when unrestricted.
+func typesString(types []string) string {
+	if types == nil {
+		return "any"
+	}
+	return strings.Join(types, "|")
+}
+
+// jsonTypeIs reports whether the decoded JSON value has the JSON Schema type t.
+func jsonTypeIs(value any, t string) bool {
+	if t == "integer" {
+		f, ok := value.(float64)
+		return ok && f == float64(int64(f))
+	}
+	return jsonTypeOf(value) == t
+}
+
+// jsonTypeOf returns the JSON Schema type name of a decoded JSON value.
+func jsonTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// requiredSet returns the "required" property names of a schema.
+func requiredSet(schema map[string]any) map[string]bool {
+	set := make(map[string]bool)
+	required, _ := schema["required"].([]any)
+	for _, r := range required {
+		if name, ok := r.(string); ok {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// containsJSON reports whether values holds a value equal to v once encoded.
+func containsJSON(values []any, v any) bool {
+	return slices.ContainsFunc(values, func(e any) bool { return jsonString(e) == jsonString(v) })
+}
+
+// jsonString returns the JSON encoding of v.
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sortedKeys returns the keys of m in alphabetical order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// exampleSchemas is the directory of the example contracts.
+const exampleSchemas = "../../configs/schemas"
+
+func TestSchemaDiffFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string // "✅|❌ path message"
+	}{
+		{"json", []string{
+			`✅ $ optional property "channel" added`,
+			`❌ $.currency enum value "USD" added`,
+			`❌ $.items[].quantity type integer → number`,
+			`❌ $ property "customerId" is no longer required`,
+		}},
+		{"avsc", []string{
+			`✅ $ optional property "channel" added`,
+			`❌ $.currency enum value "USD" added`,
+			`❌ $.customerId type string → null|string`,
+			`❌ $.items[].quantity minimum -2147483648 removed`,
+			`❌ $.items[].quantity maximum 2147483647 removed`,
+			`❌ $ property "customerId" is no longer required`,
+		}},
+		{"proto", []string{
+			`✅ $ optional property "channel" added`,
+			`❌ $.currency enum value "USD" added`,
+			`✅ $ property "customerId" removed`,
+			`❌ $.items[].quantity type integer → integer|string`,
+			`❌ $.items[].quantity minimum -2147483648 removed`,
+			`❌ $.items[].quantity maximum 2147483647 removed`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			oldS, err := loadSchema(filepath.Join(exampleSchemas, "order-created-v1."+tt.format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			newS, err := loadSchema(filepath.Join(exampleSchemas, "order-created-v2."+tt.format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range diffSchema("$", oldS, newS, nil) {
+				mark := "✅"
+				if c.Breaking {
+					mark = "❌"
+				}
+				got = append(got, fmt.Sprintf("%s %s %s", mark, c.Path, c.Message))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestAvroToJSONSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		root    string
+		want    string // JSON of the translation
+		wantErr string
+	}{
+		{"primitives", `{"type": "record", "name": "R", "fields": [
+			{"name": "b", "type": "boolean"}, {"name": "l", "type": "long"}, {"name": "d", "type": "double"},
+			{"name": "s", "type": "bytes", "default": ""}, {"name": "t", "type": {"type": "int", "logicalType": "date"}}]}`, "",
+			`{"properties":{"b":{"type":"boolean"},"d":{"type":"number"},"l":{"type":"integer"},"s":{"type":"string"},"t":{"maximum":2147483647,"minimum":-2147483648,"type":"integer"}},"required":["b","l","d","t"],"type":"object"}`, ""},
+		{"nullable record", `{"type": "record", "name": "R", "fields": [{"name": "a", "default": null,
+			"type": ["null", {"type": "record", "name": "A", "fields": [{"name": "x", "type": "string"}]}]}]}`, "",
+			`{"properties":{"a":{"properties":{"x":{"type":"string"}},"required":["x"],"type":["object","null"]}},"type":"object"}`, ""},
+		{"union of primitives", `{"type": "record", "name": "R", "fields": [{"name": "v", "type": ["int", "long", "string"]}]}`, "",
+			`{"properties":{"v":{"type":["integer","string"]}},"required":["v"],"type":"object"}`, ""},
+		{"enum with a default", `{"type": "record", "name": "R", "fields": [
+			{"name": "e", "type": {"type": "enum", "name": "E", "symbols": ["A", "B"], "default": "A"}}]}`, "",
+			`{"properties":{"e":{"type":"string"}},"required":["e"],"type":"object"}`, ""},
+		{"map", `{"type": "record", "name": "R", "fields": [{"name": "m", "type": {"type": "map", "values": "long"}}]}`, "",
+			`{"properties":{"m":{"type":"object"}},"required":["m"],"type":"object"}`, ""},
+		{"named type reused in its namespace", `{"type": "record", "name": "R", "namespace": "x.y", "fields": [
+			{"name": "a", "type": {"type": "fixed", "name": "Id", "size": 16}}, {"name": "b", "type": "Id"}, {"name": "c", "type": "x.y.Id"}]}`, "",
+			`{"properties":{"a":{"type":"string"},"b":{"type":"string"},"c":{"type":"string"}},"required":["a","b","c"],"type":"object"}`, ""},
+		{"recursive", `{"type": "record", "name": "Node", "fields": [{"name": "next", "type": ["null", "Node"], "default": null}]}`, "",
+			`{"properties":{"next":{"type":["object","null"]}},"type":"object"}`, ""},
+		{"union root by name", `[{"type": "record", "name": "A", "namespace": "n", "fields": []},
+			{"type": "record", "name": "B", "namespace": "n", "fields": [{"name": "x", "type": "long"}]}]`, "B",
+			`{"properties":{"x":{"type":"integer"}},"required":["x"],"type":"object"}`, ""},
+		{"union root by full name", `[{"type": "record", "name": "A", "namespace": "n", "fields": []},
+			{"type": "record", "name": "B", "namespace": "n", "fields": []}]`, "n.B",
+			`{"properties":{},"type":"object"}`, ""},
+		{"union root, first", `[{"type": "record", "name": "A", "fields": [{"name": "x", "type": "string"}]}]`, "",
+			`{"properties":{"x":{"type":"string"}},"required":["x"],"type":"object"}`, ""},
+
+		{"unknown root", `[{"type": "record", "name": "A", "fields": []}]`, "C", "", `no record "C"`},
+		{"root of a single record", `{"type": "record", "name": "A", "fields": []}`, "C", "", `not the record "C"`},
+		{"unknown type", `{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Missing"}]}`, "", "", `unknown type "Missing"`},
+		{"enum without symbols", `{"type": "record", "name": "R", "fields": [{"name": "e", "type": {"type": "enum", "name": "E", "symbols": []}}]}`, "", "", "without symbols"},
+		{"defined twice", `{"type": "record", "name": "R", "fields": [{"name": "a", "type": {"type": "fixed", "name": "F", "size": 1}},
+			{"name": "b", "type": {"type": "fixed", "name": "F", "size": 2}}]}`, "", "", "defined twice"},
+		{"field without a name", `{"type": "record", "name": "R", "fields": [{"type": "string"}]}`, "", "", "field without a name"},
+		{"not JSON", `record R {}`, "", "", "invalid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := avroToJSONSchema([]byte(tt.schema), tt.root)
+			checkTranslation(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestProtoToJSONSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		root    string
+		want    string // JSON of the translation
+		wantErr string
+	}{
+		{"scalars and json names", `syntax = "proto3";
+			message M {
+			  int32 small_int = 1;
+			  uint64 big = 2;
+			  bool ok = 3 [deprecated = true];
+			  bytes raw = 4 [json_name = "payload"];
+			  optional float ratio = 5;
+			}`, "",
+			`{"properties":{"big":{"minimum":0,"type":["integer","string"]},"ok":{"type":"boolean"},"payload":{"type":"string"},"ratio":{"type":"number"},"smallInt":{"maximum":2147483647,"minimum":-2147483648,"type":"integer"}},"type":"object"}`, ""},
+		{"nested types resolved from the inside out", `syntax = "proto3";
+			package shop.v1;
+			enum Status { UNKNOWN = 0; OPEN = 1; }
+			message Order {
+			  enum Status { NEW = 0; PAID = 1 [(custom) = "x"]; }
+			  message Line { string sku = 1; }
+			  Status status = 1;
+			  .shop.v1.Status global = 2;
+			  repeated Line lines = 3;
+			  map<string, Line> by_sku = 4;
+			  shop.v1.Order.Line first = 5;
+			}`, "",
+			`{"properties":{"bySku":{"type":"object"},"first":{"properties":{"sku":{"type":"string"}},"type":"object"},"global":{"enum":["UNKNOWN","OPEN"],"type":"string"},"lines":{"items":{"properties":{"sku":{"type":"string"}},"type":"object"},"type":"array"},"status":{"enum":["NEW","PAID"],"type":"string"}},"type":"object"}`, ""},
+		{"proto2 required, oneof and comments", `syntax = "proto2";
+			/* the event */
+			message E {
+			  required string id = 1; // always there
+			  optional string note = 2;
+			  oneof payload {
+			    string text = 3;
+			    int64 number = 4;
+			  }
+			  extensions 100 to 199;
+			  reserved 5, 6;
+			}`, "",
+			`{"properties":{"id":{"type":"string"},"note":{"type":"string"},"number":{"type":["integer","string"]},"text":{"type":"string"}},"required":["id"],"type":"object"}`, ""},
+		{"root by name, services and options skipped", `syntax = "proto3";
+			package p;
+			option go_package = "example.com/p";
+			message A { string a = 1; }
+			message B { google.protobuf.Timestamp at = 1; google.protobuf.Int32Value n = 2; other.Imported x = 3; }
+			service S { rpc Get(A) returns (B) { option idempotency_level = NO_SIDE_EFFECTS; } }`, "p.B",
+			`{"properties":{"at":{"type":"string"},"n":{"maximum":2147483647,"minimum":-2147483648,"type":["null","integer"]},"x":{}},"type":"object"}`, ""},
+		{"recursive", `message Node { Node next = 1; repeated Node children = 2; }`, "",
+			`{"properties":{"children":{"items":{"type":"object"},"type":"array"},"next":{"type":"object"}},"type":"object"}`, ""},
+
+		{"no message", `syntax = "proto3"; enum E { A = 0; }`, "", "", `no message ""`},
+		{"unknown root", `message A {}`, "B", "", `no message "B"`},
+		{"not closed", `message A { string a = 1;`, "", "", "not closed"},
+		{"missing number", `message A { string a; }`, "", "", `expected "="`},
+		{"invalid number", `message A { string a = x; }`, "", "", "invalid number"},
+		{"group", `syntax = "proto2"; message A { optional group G = 1 { } }`, "", "", "groups"},
+		{"defined twice", `message A {} message A {}`, "", "", "defined twice"},
+		{"comment not closed", `/* message A {}`, "", "", "comment not closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := protoToJSONSchema([]byte(tt.schema), tt.root)
+			checkTranslation(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+// checkTranslation compares a translation to the JSON want, or its error
+// to wantErr.
+func checkTranslation(t *testing.T, got map[string]any, err error, want, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("error = %v, want %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := jsonString(got); g != want {
+		t.Errorf("translation:\n%s\nwant:\n%s", g, want)
+	}
+}
+
+func TestValidatePayloadFormats(t *testing.T) {
+	tests := []struct {
+		schema  string
+		payload string
+		wantErr string // "" when valid
+	}{
+		{"order-created-v1.avsc", `{"orderId":"o-1","customerId":"c-1","amount":42.5,"currency":"CHF","items":[{"sku":"s","quantity":2}]}`, ""},
+		{"order-created-v1.avsc", `{"orderId":"o-1","customerId":"c-1","amount":42.5,"currency":"CHF"}`, ""}, // items has a default
+		{"order-created-v1.avsc", `{"orderId":"o-1","amount":42.5,"currency":"CHF"}`, `missing required property "customerId"`},
+		{"order-created-v1.avsc", `{"orderId":"o-1","customerId":"c-1","amount":1,"currency":"USD"}`, "is not one of"},
+		{"order-created-v1.avsc", `{"orderId":"o-1","customerId":"c-1","amount":1,"currency":"CHF","items":[{"sku":"s","quantity":3000000000}]}`, "above maximum"},
+		{"order-created-v2.avsc", `{"orderId":"o-1","customerId":null,"amount":1,"currency":"USD"}`, ""},
+		{"order-created-v1.proto", `{"orderId":"o-1","amount":1,"currency":"EUR","items":[{"sku":"s","quantity":2}],"createdAt":"2026-01-01T00:00:00Z"}`, ""},
+		{"order-created-v1.proto#OrderCreated", `{"orderId":1}`, "expected string"},
+		{"order-created-v1.proto#example.orders.OrderCreated", `{"currency":"USD"}`, "is not one of"},
+		{"order-created-v2.proto", `{"items":[{"quantity":"9007199254740993"}]}`, ""}, // int64 as a string
+		{"order-created-v1.proto#Missing", `{}`, `no message "Missing"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema+" "+tt.payload, func(t *testing.T) {
+			err := validatePayload(filepath.Join(exampleSchemas, tt.schema), []byte(tt.payload))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validatePayload = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validatePayload = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadSchemaAvroAsJSON(t *testing.T) {
+	// An Avro schema named .json is recognized by its "record" type.
+	content, err := os.ReadFile(filepath.Join(exampleSchemas, "order-created-v1.avsc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(file, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := loadSchema(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := schema["properties"].(map[string]any)["orderId"]; !ok || schema["type"] != "object" {
+		t.Errorf("loadSchema = %s, want the translation of the record", jsonString(schema))
+	}
+}
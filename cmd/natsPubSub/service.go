@@ -0,0 +1,154 @@
+// service.go — Run long-running modes as a systemd unit or a Windows service.
+//
+// LIFECYCLE INTEGRATION:
+//
+//	A subscriber or an edge agent is meant to run for months, not only in a
+//	terminal. The "service" sub-command registers this binary, with its
+//	operating flags, in the service manager of the platform:
+//
+//	  natsPubSub service install -name orders-sub -env-file /opt/app/.env -- -mode sub -subject "orders.>"
+//	  natsPubSub service start   -name orders-sub
+//	  natsPubSub service stop    -name orders-sub
+//	  natsPubSub service uninstall -name orders-sub
+//
+//	Linux   : a systemd unit of Type=notify is written to /etc/systemd/system
+//	          (see service_linux.go), readiness is reported with sd_notify.
+//	Windows : the binary is registered in the Service Control Manager and
+//	          answers its Stop/Shutdown requests (see service_windows.go).
+//
+// READINESS:
+//
+//	With Type=notify, systemd considers the unit started only when the
+//	program sends "READY=1" on the socket named in $NOTIFY_SOCKET. We send
+//	it once the subscription is really established, so dependent units and
+//	`systemctl start` wait for a working consumer, not just a running process.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+const (
+	// cmdService is the first argument selecting the service sub-command.
+	cmdService = "service"
+)
+
+// serviceActions lists the supported service sub-commands.
+var serviceActions = []string{"install", "uninstall", "start", "stop"}
+
+// serviceCommand handles "natsPubSub service <action> [flags] [-- run flags]".
+func serviceCommand(args []string) {
+	result.Mode = cmdService
+	fs := flag.NewFlagSet(cmdService, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %v [flags] [-- run flags]\n", APP, cmdService, serviceActions)
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", APP, "Name of the systemd unit / Windows service")
+	envFile := fs.String("env-file", "", "Environment file with NATS_USER/NATS_PASSWORD loaded by the service (systemd only)")
+	resultFlag(fs)
+	if len(args) < 1 {
+		commandUsageError(fs, "a service action is required")
+	}
+	action := args[0]
+	_ = fs.Parse(args[1:])
+	// Everything after "--" is kept verbatim as the flags of the service process.
+	runArgs := fs.Args()
+
+	var err error
+	switch action {
+	case "install":
+		if len(runArgs) == 0 {
+			commandUsageError(fs, "the flags of the service are required after --, e.g. -- -mode sub -subject greetings")
+		}
+		err = installService(*name, fmt.Sprintf("%s %v — %s", APP, runArgs, REPOSITORY), *envFile, runArgs)
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = startService(*name)
+	case "stop":
+		err = stopService(*name)
+	default:
+		commandUsageError(fs, "service action must be one of %v, got %q", serviceActions, action)
+	}
+	if err != nil {
+		fail(log.New(os.Stderr, "", 0), exitFailure, "service %s %s failed: %v", action, *name, err)
+	}
+	fmt.Printf("✅ service %s %s done\n", action, *name)
+	writeResult(exitOK, nil)
+}
+
+// ─── Shutdown requests ────────────────────────────────────────────────────
+// Long-running modes wait for SIGINT/SIGTERM. A Windows service receives no
+// signal but a Stop request from the SCM: requestStop forwards it to every
+// waiting mode as a synthetic SIGTERM.
+
+var (
+	stopMu        sync.Mutex
+	stopListeners []chan os.Signal
+)
+
+// stopSignals returns a channel receiving SIGINT and SIGTERM, and SIGTERM
+// as well when the service manager asks the program to stop.
+func stopSignals() chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	stopMu.Lock()
+	stopListeners = append(stopListeners, ch)
+	stopMu.Unlock()
+	return ch
+}
+
+// stopContext returns a context cancelled on the first stop signal.
+func stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := stopSignals()
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// requestStop delivers a SIGTERM to all channels returned by stopSignals.
+func requestStop() {
+	stopMu.Lock()
+	defer stopMu.Unlock()
+	for _, ch := range stopListeners {
+		select {
+		case ch <- syscall.SIGTERM:
+		default:
+		}
+	}
+}
+
+// sdNotify sends a state string (e.g. "READY=1", "STOPPING=1") to systemd.
+// It does nothing when the program is not started by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading "@" denotes a Linux abstract socket.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(state))
+}
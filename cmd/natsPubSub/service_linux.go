@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnitDir is where system wide units written by the administrator live.
+const systemdUnitDir = "/etc/systemd/system"
+
+// runService runs the program directly: on Linux, systemd talks to us with
+// signals and $NOTIFY_SOCKET, no special entry point is needed.
+func runService(run func()) {
+	run()
+}
+
+// installService writes a Type=notify systemd unit running this binary with
+// runArgs, then reloads systemd and enables the unit at boot.
+func installService(name, description, envFile string, runArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	execStart := []string{systemdQuote(exe)}
+	for _, a := range runArgs {
+		execStart = append(execStart, systemdQuote(a))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[Unit]\nDescription=%s\nAfter=network-online.target\nWants=network-online.target\n\n", description)
+	sb.WriteString("[Service]\n")
+	// Type=notify: the unit is "started" only once we send READY=1.
+	sb.WriteString("Type=notify\nNotifyAccess=main\n")
+	fmt.Fprintf(&sb, "ExecStart=%s\n", strings.Join(execStart, " "))
+	fmt.Fprintf(&sb, "WorkingDirectory=%s\n", workDir)
+	if envFile != "" {
+		absEnv, err := filepath.Abs(envFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, "EnvironmentFile=%s\n", absEnv)
+	}
+	// SIGTERM triggers the graceful drain of the subscription, give it time.
+	sb.WriteString("KillSignal=SIGTERM\nTimeoutStopSec=30s\nRestart=on-failure\nRestartSec=5s\n\n")
+	sb.WriteString("[Install]\nWantedBy=multi-user.target\n")
+
+	unitFile := filepath.Join(systemdUnitDir, name+".service")
+	if _, err := os.Stat(unitFile); err == nil {
+		return fmt.Errorf("unit %s already exists, uninstall it first", unitFile)
+	}
+	if err := os.WriteFile(unitFile, []byte(sb.String()), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("📝 wrote %s\n", unitFile)
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", name+".service")
+}
+
+// uninstallService stops and disables the unit, then removes its file.
+func uninstallService(name string) error {
+	unit := name + ".service"
+	_ = systemctl("stop", unit)
+	if err := systemctl("disable", unit); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(systemdUnitDir, unit)); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// startService starts the unit, systemctl returns once READY=1 was received.
+func startService(name string) error {
+	return systemctl("start", name+".service")
+}
+
+// stopService stops the unit (SIGTERM, then SIGKILL after TimeoutStopSec).
+func stopService(name string) error {
+	return systemctl("stop", name+".service")
+}
+
+// systemctl runs systemctl with args, forwarding its output.
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// systemdQuote quotes an ExecStart argument following systemd rules:
+// double quotes, with backslashes, quotes, '%' and '$' escaped.
+func systemdQuote(arg string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + r.Replace(arg) + `"`
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// errServiceUnsupported is returned by the service sub-commands on platforms
+// without systemd or SCM integration (e.g. macOS, use a launchd plist there).
+var errServiceUnsupported = errors.New("service management is not supported on " + runtime.GOOS)
+
+func runService(run func()) {
+	run()
+}
+
+func installService(_, _, _ string, _ []string) error { return errServiceUnsupported }
+
+func uninstallService(_ string) error { return errServiceUnsupported }
+
+func startService(_ string) error { return errServiceUnsupported }
+
+func stopService(_ string) error { return errServiceUnsupported }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runService runs the program under the Service Control Manager when it was
+// started as a Windows service, and directly otherwise.
+func runService(run func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		run()
+		return
+	}
+	if err := svc.Run(APP, &windowsService{run: run}); err != nil {
+		fail(log.Default(), exitFailure, "Windows service failed: %v", err)
+	}
+}
+
+// windowsService adapts the program to the svc.Handler interface.
+type windowsService struct {
+	run func()
+}
+
+// Execute is called by the SCM: it starts the program and translates the
+// Stop/Shutdown requests into the same graceful path as a SIGTERM.
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case c := <-requests:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				requestStop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// installService registers this binary, started automatically with runArgs.
+func installService(name, description, envFile string, runArgs []string) error {
+	if envFile != "" {
+		return errors.New("-env-file is not supported on Windows, use -creds or machine environment variables")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists, uninstall it first", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: description,
+		StartType:   mgr.StartAutomatic,
+	}, runArgs...)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// uninstallService marks the service for deletion.
+func uninstallService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		return s.Delete()
+	})
+}
+
+// startService asks the SCM to start the service.
+func startService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		return s.Start()
+	})
+}
+
+// stopService asks the SCM to stop the service.
+func stopService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		_, err := s.Control(svc.Stop)
+		return err
+	})
+}
+
+// withService opens the named service and calls fn with it.
+func withService(name string, fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("could not open service %s: %w", name, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
@@ -0,0 +1,327 @@
+// slo.go — Per event type metrics and service level objectives of "sub".
+//
+// METRICS BY EVENT TYPE:
+//
+//	The received/published counters of a subscriber say nothing of which
+//	events are slow or failing: a subject often carries several CloudEvents
+//	types from several producers. Every message handled by "sub" is counted
+//	under its CloudEvents type and source, with its handling time and its
+//	end-to-end latency (from the event "time" attribute to the end of its
+//	handling), as returned by the dump-stats control command:
+//
+//	  natsctl req _ctl.natsPubSub.billing dump-stats
+//	  {…,"events":[{"type":"order.created","source":"shop-eu","received":1250,"errors":3,
+//	                "handling_avg_ms":4.2,"handling_max_ms":61,"latency_avg_ms":38.5,"latency_max_ms":912},…]}
+//
+//	Messages that are not CloudEvents count under an empty type. Beyond
+//	1000 type/source pairs, the others count under the type "(other)".
+//
+// SERVICE LEVEL OBJECTIVES:
+//
+//	-slo states the share of the events of a type (or "*" for all) to be
+//	handled successfully within an end-to-end latency, e.g. 99% of the
+//	order.created events within 500ms of their creation:
+//
+//	  go run . -mode sub -subject "orders.>" -slo "order.created=99%<500ms" -slo "*=95%<2s"
+//
+//	Every minute, each objective is evaluated over -slo-window (1h) and
+//	over its last twelfth (5m), as a burn rate: the share of bad events
+//	divided by the share allowed, 1x consuming the error budget exactly
+//	over the window. When both windows burn faster than the budget allows,
+//	a warning is logged, a "🔥" fast burn from 14.4x (2% of a 30 days
+//	budget in an hour):
+//
+//	  ⚠️  SLO order.created=99%<500ms: 97.80% good over 1h0m0s (98.10% over 5m0s), burn rate 2.2x
+//
+//	An event without a "time" attribute, or handled with an error, is a
+//	bad event: its latency cannot be told, or it was not processed. The
+//	clocks of the producers and of the subscriber must be synchronized.
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxEventKeys bounds the type/source pairs counted apart.
+	maxEventKeys = 1000
+	// otherEvents is the type of the events beyond maxEventKeys.
+	otherEvents = "(other)"
+	// defaultSLOWindow is the default -slo-window, sloShortWindows the
+	// number of short windows in it.
+	defaultSLOWindow = time.Hour
+	sloShortWindows  = 12
+	// sloCheckInterval is the delay between two evaluations of the
+	// objectives, and the granularity of their windows.
+	sloCheckInterval = time.Minute
+	// fastBurnRate is the burn rate of a "🔥" fast burn.
+	fastBurnRate = 14.4
+)
+
+// eventKey identifies the events counted together.
+type eventKey struct {
+	Type, Source string
+}
+
+// eventCounters are the counters of the events of a key.
+type eventCounters struct {
+	received, errors, timed int64
+	handling, maxHandling   time.Duration
+	latency, maxLatency     time.Duration // end-to-end, of the timed events
+}
+
+// eventStat is the dump-stats view of the counters of a key.
+type eventStat struct {
+	Type          string  `json:"type"`
+	Source        string  `json:"source,omitempty"`
+	Received      int64   `json:"received"`
+	Errors        int64   `json:"errors"`
+	HandlingAvgMS float64 `json:"handling_avg_ms"`
+	HandlingMaxMS float64 `json:"handling_max_ms"`
+	LatencyAvgMS  float64 `json:"latency_avg_ms,omitempty"`
+	LatencyMaxMS  float64 `json:"latency_max_ms,omitempty"`
+}
+
+// eventMetrics holds the counters of the event keys and the objectives.
+type eventMetrics struct {
+	mu    sync.Mutex
+	byKey map[eventKey]*eventCounters
+	slos  []*slo
+}
+
+// events are the metrics of the events handled by "sub".
+var events = &eventMetrics{byKey: make(map[eventKey]*eventCounters)}
+
+// trackEvent starts measuring the handling of m; the returned function
+// records its end and the error of its handler.
+func trackEvent(m *nats.Msg) (done func(err error)) {
+	start := time.Now()
+	ev, _ := decodeCloudEvent(m)
+	key := eventKey{Type: ev.Attributes["type"], Source: ev.Attributes["source"]}
+	eventTime, timeErr := time.Parse(time.RFC3339Nano, ev.Attributes["time"])
+	return func(err error) {
+		now := time.Now()
+		handling, latency := now.Sub(start), now.Sub(eventTime)
+		timed := timeErr == nil
+
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		c := events.byKey[key]
+		if c == nil {
+			if len(events.byKey) >= maxEventKeys {
+				key = eventKey{Type: otherEvents}
+			}
+			if c = events.byKey[key]; c == nil {
+				c = &eventCounters{}
+				events.byKey[key] = c
+			}
+		}
+		c.received++
+		c.handling += handling
+		c.maxHandling = max(c.maxHandling, handling)
+		if err != nil {
+			c.errors++
+		}
+		if timed {
+			c.timed++
+			c.latency += latency
+			c.maxLatency = max(c.maxLatency, latency)
+		}
+		for _, s := range events.slos {
+			if s.eventType == "*" || s.eventType == ev.Attributes["type"] {
+				s.record(now, err == nil && timed && latency <= s.threshold)
+			}
+		}
+	}
+}
+
+// stats returns the counters of every key, the most received first.
+func (e *eventMetrics) stats() []eventStat {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]eventStat, 0, len(e.byKey))
+	for key, c := range e.byKey {
+		s := eventStat{
+			Type: key.Type, Source: key.Source, Received: c.received, Errors: c.errors,
+			HandlingAvgMS: milliseconds(c.handling / time.Duration(c.received)),
+			HandlingMaxMS: milliseconds(c.maxHandling),
+		}
+		if c.timed > 0 {
+			s.LatencyAvgMS = milliseconds(c.latency / time.Duration(c.timed))
+			s.LatencyMaxMS = milliseconds(c.maxLatency)
+		}
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b eventStat) int { return cmp.Compare(b.Received, a.Received) })
+	return list
+}
+
+// milliseconds returns d in milliseconds, rounded to 0.1ms.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Round(100*time.Microsecond)) / float64(time.Millisecond)
+}
+
+// ─── Service Level Objectives ──────────────────────────────────────────
+
+// slo is an objective of -slo: target of the events of eventType handled
+// within threshold, counted per minute over its window.
+type slo struct {
+	spec      string
+	eventType string // "*" for every type
+	target    float64
+	threshold time.Duration
+	minutes   []sloMinute // ring of the minutes of the window
+}
+
+// sloMinute counts the events of an objective during a minute.
+type sloMinute struct {
+	minute      int64 // Unix minute
+	good, total int64
+}
+
+// sloStat is the dump-stats view of an objective.
+type sloStat struct {
+	Objective string  `json:"objective"`
+	Window    string  `json:"window"`
+	Events    int64   `json:"events"`
+	Good      float64 `json:"good_percent"`
+	BurnRate  float64 `json:"burn_rate"`
+}
+
+// sloFlag collects repeated -slo flags.
+type sloFlag []*slo
+
+func (f *sloFlag) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, s := range *f {
+		specs = append(specs, s.spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *sloFlag) Set(spec string) error {
+	s, err := parseSLO(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// parseSLO parses an objective "<type>=<percent>%<<latency>", e.g.
+// "order.created=99%<500ms".
+func parseSLO(spec string) (*slo, error) {
+	eventType, objective, ok := strings.Cut(spec, "=")
+	percentText, latencyText, ok2 := strings.Cut(objective, "%<")
+	if !ok || !ok2 || strings.TrimSpace(eventType) == "" {
+		return nil, fmt.Errorf("expected <type>=<percent>%%<<latency> (e.g. order.created=99%%<500ms), got %q", spec)
+	}
+	percent, err := strconv.ParseFloat(percentText, 64)
+	if err != nil || percent <= 0 || percent >= 100 {
+		return nil, fmt.Errorf("slo %q: expected a percentage in ]0%%, 100%%[", spec)
+	}
+	threshold, err := time.ParseDuration(latencyText)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("slo %q: expected a positive latency, e.g. 500ms", spec)
+	}
+	return &slo{spec: spec, eventType: strings.TrimSpace(eventType), target: percent / 100, threshold: threshold}, nil
+}
+
+// record counts an event, good or bad, handled at now.
+func (s *slo) record(now time.Time, good bool) {
+	minute := now.Unix() / 60
+	m := &s.minutes[minute%int64(len(s.minutes))]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	m.total++
+	if good {
+		m.good++
+	}
+}
+
+// burn returns the events counted during the span before now, the share of
+// good ones and the burn rate of the error budget.
+func (s *slo) burn(now time.Time, span time.Duration) (total int64, good, rate float64) {
+	from := now.Unix()/60 - int64(span/time.Minute)
+	var goodCount int64
+	for _, m := range s.minutes {
+		if m.minute > from {
+			total += m.total
+			goodCount += m.good
+		}
+	}
+	if total == 0 {
+		return 0, 1, 0
+	}
+	good = float64(goodCount) / float64(total)
+	return total, good, (1 - good) / (1 - s.target)
+}
+
+// startSLOs evaluates the objectives every sloCheckInterval over window
+// (in whole minutes), logging their burn rates, until ctx is done.
+func startSLOs(ctx context.Context, l *log.Logger, slos []*slo, window time.Duration) {
+	if len(slos) == 0 {
+		return
+	}
+	window = window.Truncate(time.Minute)
+	events.mu.Lock()
+	for _, s := range slos {
+		s.minutes = make([]sloMinute, window/time.Minute)
+	}
+	events.slos = slos
+	events.mu.Unlock()
+	l.Printf("🎯 Tracking %d SLO(s) over %s", len(slos), window)
+
+	short := window / sloShortWindows
+	go func() {
+		ticker := time.NewTicker(sloCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				events.mu.Lock()
+				for _, s := range slos {
+					total, good, rate := s.burn(now, window)
+					_, shortGood, shortRate := s.burn(now, short)
+					if total == 0 || rate <= 1 || shortRate <= 1 {
+						continue
+					}
+					icon := "⚠️ "
+					if rate >= fastBurnRate && shortRate >= fastBurnRate {
+						icon = "🔥"
+					}
+					l.Printf("%s SLO %s: %.2f%% good over %s (%.2f%% over %s), burn rate %.1fx",
+						icon, s.spec, good*100, window, shortGood*100, short, rate)
+				}
+				events.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// sloStats returns the state of the objectives over their window.
+func (e *eventMetrics) sloStats() []sloStat {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	list := make([]sloStat, 0, len(e.slos))
+	for _, s := range e.slos {
+		window := time.Duration(len(s.minutes)) * time.Minute
+		total, good, rate := s.burn(now, window)
+		list = append(list, sloStat{Objective: s.spec, Window: window.String(), Events: total, Good: good * 100, BurnRate: rate})
+	}
+	return list
+}
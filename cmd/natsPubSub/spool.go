@@ -0,0 +1,461 @@
+// spool.go — At-least-once disk spool of the "pub" mode.
+//
+// WHY A SPOOL:
+//
+//	A publisher on a flaky site (a shop, a truck, a sensor gateway) cannot
+//	afford to lose an event because NATS was unreachable at that moment,
+//	and does not always have a local nats-server to buffer it (see the
+//	"edge" mode for that topology). With -spool <dir>, a message that
+//	cannot be published is appended to a write-ahead log on disk instead,
+//	and the program succeeds: the event is safe.
+//
+//	Every "pub" with -spool first publishes the spooled messages, oldest
+//	first, then the new one, so the order is preserved. While the spool
+//	cannot be emptied, new messages go to its end. A "pub" without -msg
+//	only flushes the spool, e.g. from a systemd timer or a cron job:
+//
+//	  go run . -mode pub -subject sensors.t1 -msg '{"t":21.5}' -spool /var/spool/natsPubSub
+//	  go run . -mode pub -subject sensors.t1 -spool /var/spool/natsPubSub   # flush only
+//
+// FORMAT AND GUARANTEES:
+//
+//	<dir>/spool.wal holds one JSON record per line (subject, headers,
+//	payload), appended and fsync'ed before the program reports success.
+//	The file is removed only after the server confirmed it received all
+//	the messages (Flush): a crash in between publishes them again. Each
+//	spooled message carries a Nats-Msg-Id header, so a JetStream stream
+//	deduplicates those retries within its duplicate window.
+//
+//	Messages exceeding the max_payload of the server could never be
+//	published: they are moved to <dir>/rejected.wal instead of blocking the
+//	spool. The messages the server denies (see fallback.go) stay in the
+//	spool, reported by an audit event at every flush, and go out with the
+//	first one after the permissions are fixed. A lock file serializes the
+//	programs sharing the directory, touched while held: only the one of a
+//	crashed program grows stale, removed by one waiter at a time.
+//
+// IN A STORE:
+//
+//	-spool also takes the URL of a store (see store.go): a BoltDB file
+//	(bolt:///var/spool/natsPubSub.db) or a Redis server (redis://host:6379/0),
+//	which several publishers may share. Each record is then a key,
+//	spool/<time>-<id>, read in the order of the keys and deleted after the
+//	Flush; the rejected ones move to spool-rejected/. A kv:// bucket or a
+//	memory: store cannot hold a spool: it keeps what NATS could not take,
+//	until the next run.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+const (
+	// spoolFile is the write-ahead log, spoolRejectedFile receives the
+	// messages too large for the server, spoolLockFile serializes writers.
+	spoolFile         = "spool.wal"
+	spoolRejectedFile = "rejected.wal"
+	spoolLockFile     = "spool.lock"
+	// spoolLockWait bounds the wait for the lock held by another program,
+	// a lock older than spoolLockStale was left by a crashed one: its
+	// holder touches it every spoolLockRefresh, however long the flush.
+	spoolLockWait    = 10 * time.Second
+	spoolLockStale   = time.Minute
+	spoolLockRefresh = spoolLockStale / 4
+	// spoolKeyPrefix and spoolRejectedPrefix prefix the keys of the records
+	// kept in a store.
+	spoolKeyPrefix      = "spool/"
+	spoolRejectedPrefix = "spool-rejected/"
+)
+
+// errSpoolLocked is returned when the lock stays held longer than spoolLockWait.
+var errSpoolLocked = errors.New("spool locked by another program")
+
+// spoolRecord is one line of the write-ahead log.
+type spoolRecord struct {
+	Subject   string      `json:"subject"`
+	Header    nats.Header `json:"header,omitempty"`
+	Data      []byte      `json:"data"`
+	SpooledAt time.Time   `json:"spooled_at"`
+}
+
+// spool is the on-disk spool of a directory, or of a store.
+type spool struct {
+	dir   string      // directory of the write-ahead log, or
+	store store.Store // store of the records, one key each
+	where string      // dir or the store URL, for the logs
+}
+
+// openSpool returns the spool of source, a directory (created if needed)
+// or the URL of a store.
+func openSpool(source string) (*spool, error) {
+	if isStoreURL(source) {
+		if source == storeMemory || strings.HasPrefix(source, kvConfigScheme) {
+			return nil, fmt.Errorf("%s cannot hold a spool, it must outlive the run and the NATS outages: use a directory, %s or %s", source, storeBolt, storeRedis)
+		}
+		s, err := openStore(nil, source, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &spool{store: s, where: source}, nil
+	}
+	if err := os.MkdirAll(source, 0o700); err != nil {
+		return nil, err
+	}
+	return &spool{dir: source, where: source}, nil
+}
+
+// close releases the store of the spool.
+func (s *spool) close() error {
+	if s.store != nil {
+		return s.store.Close()
+	}
+	return nil
+}
+
+// append durably adds m at the end of the spool.
+func (s *spool) append(m *nats.Msg) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if m.Header == nil {
+		m.Header = nats.Header{}
+	}
+	if m.Header.Get(nats.MsgIdHdr) == "" {
+		m.Header.Set(nats.MsgIdHdr, nuid.Next())
+	}
+	r := spoolRecord{Subject: m.Subject, Header: m.Header, Data: m.Data, SpooledAt: time.Now().UTC()}
+	if s.store != nil {
+		// The time first: the keys are listed in order.
+		return s.put(fmt.Sprintf("%s%020d-%s", spoolKeyPrefix, r.SpooledAt.UnixNano(), nuid.Next()), r)
+	}
+	return s.write(spoolFile, []spoolRecord{r})
+}
+
+// flush publishes the spooled messages in order and empties the spool once
+// the server confirmed it received them all. On error the spool is kept
+// whole: the messages already sent will be sent again (at-least-once).
+// The messages the server denied stay in the spool, reported by an audit
+// event each (see fallback.go), until the permissions are fixed.
+func (s *spool) flush(nc *nats.Conn, l *log.Logger) (int, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	records, keys, err := s.read()
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	l.Printf("📤 Flushing %d spooled message(s) …", len(records))
+	var rejected []spoolRecord
+	var rejectedKeys []string
+	var sent []int // indexes of the records published
+	check := checkPublishes(nc)
+	for i, r := range records {
+		m := &nats.Msg{Subject: r.Subject, Header: r.Header, Data: r.Data}
+		if int64(len(m.Data)+headerSize(m.Header)) > nc.MaxPayload() {
+			rejected = append(rejected, r)
+			if keys != nil {
+				rejectedKeys = append(rejectedKeys, keys[i])
+			}
+			continue
+		}
+		if err := nc.PublishMsg(m); err != nil {
+			return 0, err
+		}
+		sent = append(sent, i)
+	}
+	if err := nc.Flush(); err != nil {
+		return 0, err
+	}
+
+	// The server drops the messages it denies without failing the publish:
+	// the violations of the subjects published tell which.
+	deniedBy := make(map[string]error)
+	for _, i := range sent {
+		if _, checked := deniedBy[records[i].Subject]; !checked {
+			deniedBy[records[i].Subject] = check.denied(records[i].Subject)
+		}
+	}
+	var denied []spoolRecord
+	var deniedKeys []string
+	for _, i := range sent {
+		r := records[i]
+		if err := deniedBy[r.Subject]; err != nil {
+			denied = append(denied, r)
+			if keys != nil {
+				deniedKeys = append(deniedKeys, keys[i])
+			}
+			countDenied()
+			m := &nats.Msg{Subject: r.Subject, Header: r.Header, Data: r.Data}
+			auditDenial(nc, l, m, publishDenial{Subject: r.Subject, Error: err.Error(), Spooled: true})
+			continue
+		}
+		countPublished(len(r.Data))
+	}
+	if len(denied) > 0 {
+		l.Printf("🚫 %d spooled message(s) denied by the server, kept in %s until the permissions are fixed", len(denied), s.where)
+	}
+	published := len(sent) - len(denied)
+
+	if s.store != nil {
+		return published, s.clear(keys, rejected, rejectedKeys, deniedKeys, l)
+	}
+	if len(rejected) > 0 {
+		l.Printf("⚠️  %d spooled message(s) exceed max_payload, moved to %s", len(rejected), filepath.Join(s.dir, spoolRejectedFile))
+		if err := s.write(spoolRejectedFile, rejected); err != nil {
+			return 0, err
+		}
+	}
+	if len(denied) > 0 {
+		return published, s.rewrite(spoolFile, denied)
+	}
+	if err := os.Remove(filepath.Join(s.dir, spoolFile)); err != nil {
+		return 0, err
+	}
+	return published, nil
+}
+
+// clear deletes the keys of the records published from the store, once
+// the rejected ones are moved under spoolRejectedPrefix; the keys kept
+// stay.
+func (s *spool) clear(keys []string, rejected []spoolRecord, rejectedKeys, kept []string, l *log.Logger) error {
+	if len(rejected) > 0 {
+		l.Printf("⚠️  %d spooled message(s) exceed max_payload, moved to %s*", len(rejected), spoolRejectedPrefix)
+		for i, r := range rejected {
+			if err := s.put(spoolRejectedPrefix+strings.TrimPrefix(rejectedKeys[i], spoolKeyPrefix), r); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range keys {
+		if slices.Contains(kept, key) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := s.store.Delete(ctx, key)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores the record r under key.
+func (s *spool) put(key string, r spoolRecord) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return s.store.Put(ctx, key, value, 0)
+}
+
+// spoolMessage keeps m in the spool after the failure cause to publish it,
+// ending the program when even the disk refuses it.
+func spoolMessage(l *log.Logger, sp *spool, m *nats.Msg, cause error) {
+	if err := sp.append(m); err != nil {
+		fail(l, exitPublish, "failed to publish (%v) and to spool the message: %v", cause, err)
+	}
+	countSpooled()
+	l.Printf("💾 Message spooled in %s after: %v — the next \"pub -spool\" publishes it", sp.where, cause)
+}
+
+// read returns the records of the spool, oldest first, and their keys in
+// a store. A last line cut by a crash during its write is ignored: its
+// message was never acknowledged.
+func (s *spool) read() ([]spoolRecord, []string, error) {
+	if s.store != nil {
+		return s.readStore()
+	}
+	f, err := os.Open(filepath.Join(s.dir, spoolFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var records []spoolRecord
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return records, nil, nil // a last line without newline is a torn write
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var rec spoolRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", f.Name(), n, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// readStore returns the records kept in the store and their keys.
+func (s *spool) readStore() ([]spoolRecord, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	keys, err := s.store.List(ctx, spoolKeyPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make([]spoolRecord, 0, len(keys))
+	found := keys[:0]
+	for _, key := range keys {
+		value, err := s.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue // flushed meanwhile by another publisher
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var rec spoolRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", key, err)
+		}
+		records = append(records, rec)
+		found = append(found, key)
+	}
+	return records, found, nil
+}
+
+// write appends records to file and syncs it to the disk.
+func (s *spool) write(file string, records []spoolRecord) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, file), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewrite replaces file with records, atomically: a crash leaves the old
+// file or the new one.
+func (s *spool) rewrite(file string, records []spoolRecord) error {
+	tmp := file + ".tmp"
+	_ = os.Remove(filepath.Join(s.dir, tmp))
+	if err := s.write(tmp, records); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.dir, tmp), filepath.Join(s.dir, file))
+}
+
+// refreshLock touches the lock file path every spoolLockRefresh, so that
+// the other programs do not take it for the one of a crashed program, and
+// returns the function releasing it.
+func refreshLock(path string) (unlock func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(spoolLockRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				_ = os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped // no touch after the removal
+		_ = os.Remove(path)
+	}
+}
+
+// breakStaleLock removes the lock file path left by a crashed program,
+// found stale as stale, and reports whether the lock can be tried again.
+// Waiters finding it stale together would otherwise remove the lock the
+// first of them has just taken: the removal is serialized by a second lock
+// file, under which path must still be the same file, as old.
+func breakStaleLock(path string, stale os.FileInfo) bool {
+	breaker := path + ".break"
+	f, err := os.OpenFile(breaker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		// Another waiter is removing it, or crashed while doing so.
+		if info, err := os.Stat(breaker); err == nil && time.Since(info.ModTime()) > spoolLockStale {
+			_ = os.Remove(breaker)
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(breaker)
+	if info, err := os.Stat(path); err == nil && os.SameFile(info, stale) && info.ModTime().Equal(stale.ModTime()) {
+		_ = os.Remove(path)
+	}
+	return true
+}
+
+// lock takes the lock file of the spool, waiting for another program to
+// release it, and returns the function releasing it.
+func (s *spool) lock() (unlock func(), err error) {
+	if s.store != nil {
+		// A BoltDB file is locked while open; publishers sharing Redis may
+		// at worst send a record twice, deduplicated by its Nats-Msg-Id.
+		return func() {}, nil
+	}
+	path := filepath.Join(s.dir, spoolLockFile)
+	deadline := time.Now().Add(spoolLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return refreshLock(path), nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > spoolLockStale && breakStaleLock(path, info) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s", errSpoolLocked, path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeNATS is a server speaking enough of the NATS protocol for the
+// publishes: it records them, and answers a permissions violation to the
+// ones on a denied subject, as nats-server does.
+type fakeNATS struct {
+	mu        sync.Mutex
+	denied    []string // subjects denied to the client
+	published []string // subjects of the publishes accepted
+}
+
+// start listens on the loopback interface and returns the URL of the server.
+func (f *fakeNATS) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return "nats://" + ln.Addr().String()
+}
+
+// serve answers the client of conn until it goes.
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.WriteString(conn, `INFO {"server_id":"fake","version":"2.11.0","headers":true,"max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			_, _ = io.WriteString(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			// The last field is the size of what follows, headers included.
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+				return
+			}
+			subject := fields[1]
+			f.mu.Lock()
+			denied := slices.Contains(f.denied, subject)
+			if !denied {
+				f.published = append(f.published, subject)
+			}
+			f.mu.Unlock()
+			if denied {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to \"%s\"'\r\n", subject)
+			}
+		}
+	}
+}
+
+// allow stops denying the subjects.
+func (f *fakeNATS) allow() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.denied = nil
+}
+
+// received returns the subjects of the publishes accepted so far.
+func (f *fakeNATS) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.published)
+}
+
+// connectFake connects to f with the ErrorHandler of the program.
+func connectFake(t *testing.T, f *fakeNATS, l *log.Logger) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(f.start(t), nats.ErrorHandler(denials.errorHandler(l)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestFlushKeepsTheDenied(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	for _, where := range []string{"dir", "bolt"} {
+		t.Run(where, func(t *testing.T) {
+			f := &fakeNATS{denied: []string{"billing.invoice"}}
+			nc := connectFake(t, f, l)
+			source := t.TempDir()
+			if where == "bolt" {
+				source = storeBolt + filepath.Join(source, "spool.db")
+			}
+			sp, err := openSpool(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sp.close()
+			for _, subject := range []string{"orders.created", "billing.invoice", "orders.paid", "billing.invoice"} {
+				if err := sp.append(&nats.Msg{Subject: subject, Data: []byte("{}")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := sp.flush(nc, l)
+			if err != nil || n != 2 {
+				t.Fatalf("flush = %d, %v, want the 2 messages allowed", n, err)
+			}
+			got := f.received()
+			if want := []string{"orders.created", "orders.paid", deniedAuditSubject, deniedAuditSubject}; !slices.Equal(got, want) {
+				t.Errorf("server received %q, want %q: the allowed messages and an audit event per denied one", got, want)
+			}
+			records, _, err := sp.read()
+			if err != nil || len(records) != 2 || records[0].Subject != "billing.invoice" || records[1].Subject != "billing.invoice" {
+				t.Fatalf("spool after the flush = %+v, %v, want the 2 denied messages", records, err)
+			}
+
+			// Once the permissions are fixed, the next flush empties the spool.
+			f.allow()
+			if n, err := sp.flush(nc, l); err != nil || n != 2 {
+				t.Fatalf("flush after the fix = %d, %v, want the 2 denied messages", n, err)
+			}
+			if records, _, err := sp.read(); err != nil || len(records) != 0 {
+				t.Errorf("spool after the second flush = %+v, %v, want it empty", records, err)
+			}
+		})
+	}
+}
+
+func TestDeniedIsNotSticky(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	f := &fakeNATS{denied: []string{"billing.invoice"}}
+	nc := connectFake(t, f, l)
+
+	check := checkPublishes(nc)
+	_ = nc.Publish("billing.invoice", []byte("{}"))
+	_ = nc.Flush()
+	if err := check.denied("billing.invoice"); err == nil {
+		t.Fatal("denied(billing.invoice) = nil, want the violation of the server")
+	}
+	if err := check.denied("orders.created"); err != nil {
+		t.Errorf("denied(orders.created) = %v, want nil: another subject", err)
+	}
+
+	// LastError still holds the violation: the next publish, allowed now,
+	// is not denied for all that.
+	f.allow()
+	check = checkPublishes(nc)
+	_ = nc.Publish("billing.invoice", []byte("{}"))
+	_ = nc.Flush()
+	if err := check.denied("billing.invoice"); err != nil {
+		t.Errorf("denied(billing.invoice) after the fix = %v, want nil (LastError: %v)", err, nc.LastError())
+	}
+}
+
+// TestBreakStaleLock replays waiters finding the lock of a crashed program
+// stale together: the first removes it and takes a fresh lock, the others
+// must not remove that one.
+func TestBreakStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), spoolLockFile)
+	writeLock := func(mtime time.Time) os.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("1\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	stale := writeLock(time.Now().Add(-2 * spoolLockStale))
+
+	// Another waiter broke the stale lock and holds a fresh one.
+	if !breakStaleLock(path, stale) {
+		t.Fatal("breakStaleLock of a stale lock = false, want true")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("stale lock not removed: %v", err)
+	}
+	writeLock(time.Now())
+	if !breakStaleLock(path, stale) {
+		t.Error("breakStaleLock after the lock changed = false, want true")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("fresh lock removed by a waiter that found the old one stale: %v", err)
+	}
+
+	// While a waiter is removing it, the others wait.
+	stale = writeLock(time.Now().Add(-2 * spoolLockStale))
+	if err := os.WriteFile(path+".break", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if breakStaleLock(path, stale) {
+		t.Error("breakStaleLock while another waiter removes the lock = true, want false")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("lock removed while another waiter removes it: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// store.go — Where the state kept between runs lives: -spool, -dedup, -positions.
+//
+// ONE INTERFACE, FOUR BACKENDS:
+//
+//	The state of the program is read and written through the Store
+//	interface of pkg/store, and the flags holding it take the URL of the
+//	backend:
+//
+//	  memory:                               in process, lost at exit
+//	  bolt:///var/lib/natsPubSub/state.db   a BoltDB file on the local disk
+//	  kv://<bucket>                         a JetStream Key-Value bucket,
+//	                                        created if needed
+//	  redis://[user:password@]host:6379/0   a Redis server (rediss:// over TLS)
+//
+// WHAT IS KEPT:
+//
+//	-spool      the messages that could not be published (see spool.go),
+//	            in a directory, a BoltDB file or Redis
+//	-dedup      the ids of the events handled by "sub" (the CloudEvents id,
+//	            else the Nats-Msg-Id header) during -dedup-window: an event
+//	            delivered again meanwhile, by a retrying producer or after a
+//	            lost ack, is skipped. Unlike the duplicate window of a
+//	            stream, it works for core NATS subscriptions too, and
+//	            across the instances sharing the store.
+//	-positions  with -ordered, the stream sequence of the last message
+//	            handled, saved every second and on exit: a projection
+//	            rebuilt by an ordered consumer resumes after it instead of
+//	            starting over (-deliver only applies to the first run).
+//	            It is kept 30 days after the last run.
+//
+//	A kv:// bucket is created with the TTL of what it keeps (the longest
+//	when -dedup and -positions share it), which purges the ids of
+//	-dedup once their window is over.
+//
+//	  go run . -mode sub -subject "orders.>" -durable billing -dedup kv://dedup -dedup-window 10m
+//	  go run . -mode sub -subject "orders.>" -ordered -positions bolt://./orders-view.db
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/boltstore"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/memory"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/natskv"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/redisstore"
+)
+
+const (
+	// storeMemory, storeBolt, storeRedis and storeRedisTLS name the
+	// backends of the store URLs; kvConfigScheme names the Key-Value one.
+	storeMemory   = "memory:"
+	storeBolt     = "bolt://"
+	storeRedis    = "redis://"
+	storeRedisTLS = "rediss://"
+	// storeTimeout bounds one operation on a store.
+	storeTimeout = 10 * time.Second
+	// storeNamespace prefixes the keys of this program in Redis.
+	storeNamespace = APP + ":"
+	// dedupPrefix and positionsPrefix prefix the keys of -dedup and -positions.
+	dedupPrefix     = "dedup/"
+	positionsPrefix = "positions/"
+	// defaultDedupWindow is the default of -dedup-window, the default
+	// duplicate window of a stream.
+	defaultDedupWindow = 2 * time.Minute
+	// positionSaveInterval is the delay between two saves of -positions.
+	positionSaveInterval = time.Second
+	// positionsRetention is how long a position of -positions is kept
+	// after it was last saved; positionRefreshInterval is the delay after
+	// which a position not changed is saved again, to keep it.
+	positionsRetention      = 30 * 24 * time.Hour
+	positionRefreshInterval = time.Hour
+)
+
+// isStoreURL reports whether source is the URL of a store rather than a
+// directory.
+func isStoreURL(source string) bool {
+	return source == storeMemory || strings.Contains(source, "://")
+}
+
+// openStore opens the store of the URL source. nc and ttl, the TTL of a
+// bucket created, are only used by the kv:// stores; nc may be nil before
+// connecting.
+func openStore(nc *nats.Conn, source string, ttl time.Duration) (store.Store, error) {
+	switch {
+	case source == storeMemory:
+		return memory.New(), nil
+	case strings.HasPrefix(source, storeBolt):
+		return boltstore.Open(strings.TrimPrefix(source, storeBolt))
+	case strings.HasPrefix(source, storeRedis), strings.HasPrefix(source, storeRedisTLS):
+		opts, err := redis.ParseURL(source)
+		if err != nil {
+			return nil, err
+		}
+		return redisstore.New(redis.NewClient(opts), storeNamespace), nil
+	case strings.HasPrefix(source, kvConfigScheme):
+		bucket := strings.TrimPrefix(source, kvConfigScheme)
+		if nc == nil || bucket == "" || strings.Contains(bucket, "/") {
+			return nil, fmt.Errorf("expected %s<bucket>, with a NATS connection, got %q", kvConfigScheme, source)
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		kv, err := js.KeyValue(ctx, bucket)
+		if errors.Is(err, jetstream.ErrBucketNotFound) {
+			kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket, Description: "State of " + APP + " (see store.go)", TTL: ttl})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Key-Value bucket %q: %w", bucket, err)
+		}
+		return natskv.New(kv), nil
+	}
+	return nil, fmt.Errorf("unknown store %q, expected %s, %s<file>, %s<bucket> or %s<host>", source, storeMemory, storeBolt, kvConfigScheme, storeRedis)
+}
+
+// dedupHandler returns handle skipping the messages whose event id was
+// handled during the window of dedup, and marking the ones it handles.
+func dedupHandler(l *log.Logger, dedup *store.Dedup, handle func(m *nats.Msg) error) func(m *nats.Msg) error {
+	return func(m *nats.Msg) error {
+		id := m.Header.Get(nats.MsgIdHdr)
+		if ev, ok := decodeCloudEvent(m); ok && ev.Attributes["id"] != "" {
+			id = ev.Attributes["id"]
+		}
+		if id == "" {
+			return handle(m)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		seen, err := dedup.Seen(ctx, id)
+		if err != nil {
+			return fmt.Errorf("message on [%s] not handled, -dedup failed: %w", m.Subject, err)
+		}
+		if seen {
+			l.Printf("🔁 Event %s on [%s] already handled, skipped", id, m.Subject)
+			return nil
+		}
+		if err := handle(m); err != nil {
+			return err
+		}
+		// Not an error of the handling: the message must not be handled again.
+		if err := dedup.Mark(ctx, id); err != nil {
+			l.Printf("⚠️  Event %s handled, but not recorded by -dedup: %v", id, err)
+		}
+		return nil
+	}
+}
+
+// positionKey returns the key of the position of an ordered consumer of
+// subject in streamName, the subject encoded for the keys allowed.
+func positionKey(streamName, subject string) string {
+	return streamName + "/" + base64.RawURLEncoding.EncodeToString([]byte(subject))
+}
+
+// savePositions saves seq as the position key every positionSaveInterval
+// when it changed, or every positionRefreshInterval to keep it, until the
+// function returned is called, which saves it a last time.
+func savePositions(l *log.Logger, positions *store.Positions, key string, seq *atomic.Uint64) (stop func()) {
+	saved := seq.Load()
+	var savedAt time.Time // zero: the position loaded is refreshed first
+	save := func() {
+		current := seq.Load()
+		if current == 0 || (current == saved && time.Since(savedAt) < positionRefreshInterval) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := positions.Save(ctx, key, current); err != nil {
+			l.Printf("⚠️  Failed to save the position %d: %v", current, err)
+			return
+		}
+		saved, savedAt = current, time.Now()
+	}
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(positionSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-done:
+				save()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
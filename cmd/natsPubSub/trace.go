@@ -0,0 +1,327 @@
+// trace.go — Time-travel debugger: what happened to one event, or one chain.
+//
+// FROM ONE ID TO THE WHOLE STORY:
+//
+//	An incident report starts with one id found in a log line: the id of
+//	a CloudEvent, or the correlationid shared by a whole chain (see
+//	pkg/correlation). The "trace" mode searches the streams for every
+//	event related to it, orders them on a timeline and tells what
+//	happened:
+//
+//	  go run . -mode trace -subject ">" -trace-id 8fQf2oKkD5sFqyx3Xa1xWc
+//	  go run . -mode trace -subject "orders.>" -trace-id 8fQf2o… -stream ORDERS,ORDERS_ARCHIVE -since 24h
+//
+//	  TIME          OFFSET  SOURCE    TYPE               SUBJECT             ID     STORED IN
+//	  09:12:03.120  +0s     /shop     order.created      orders.created      A      ORDERS#42
+//	  09:12:03.205  +85ms   /billing  payment.requested  payments.requested  B ← A  PAYMENTS#17
+//
+//	  1. At 09:12:03.120, /shop published order.created (A) on orders.created, starting the chain.
+//	  2. 85ms later, /billing, handling order.created (A) of /shop, published payment.requested (B) …
+//
+// WHICH EVENTS ARE RELATED:
+//
+//	The events sharing the correlationid of the one traced, and,
+//	step by step, the causes ("causationid") and the consequences of every
+//	event found, so a chain whose correlationid was not propagated by one
+//	service is still followed across it. The same event kept in several
+//	streams (an archive sourcing the live stream) is shown once, with all
+//	its copies.
+//
+// WHERE IT SEARCHES:
+//
+//	The -subject messages of -stream (comma separated, every stream of
+//	the account by default) stored in the last -since (all of them by
+//	default), through ordered consumers that change nothing on the
+//	server. The timeline is on stdout, the logs on stderr.
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/correlation"
+)
+
+const (
+	// maxTraceEvents caps the events indexed while searching, about 150 bytes each.
+	maxTraceEvents = 5_000_000
+	// maxTraceData is the length of the data shown for each event of the timeline.
+	maxTraceData = 120
+)
+
+// traceCopy is where a copy of an event is stored.
+type traceCopy struct {
+	stream string
+	seq    uint64
+}
+
+// traceEntry is an event of the index built while searching.
+type traceEntry struct {
+	chain  correlation.Chain
+	copies []traceCopy
+}
+
+// tracedEvent is an event of the timeline.
+type tracedEvent struct {
+	correlation.Chain
+	eventType, source, subject string
+	time                       time.Time // CloudEvents time, or when it was stored
+	stored                     time.Time
+	data                       string
+	copies                     []traceCopy
+}
+
+// traceIndex locates the events read and their links.
+type traceIndex struct {
+	events     map[string]*traceEntry // event id → entry
+	correlated map[string][]string    // correlation id → event ids
+	caused     map[string][]string    // causation id → event ids
+	overflow   bool
+	withoutID  int // messages that are not CloudEvents with an id
+}
+
+// trace searches the streams for the events related to id, then prints
+// their timeline and the narrative of what happened.
+func trace(nc *nats.Conn, l *log.Logger, subject, id, streamNames string, since time.Duration) {
+	ctx, stop := stopContext()
+	defer stop()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fail(l, exitFailure, "failed to create JetStream context: %v", err)
+	}
+	var streams []string
+	if streamNames != "" {
+		streams = strings.Split(streamNames, ",")
+	} else {
+		names := js.StreamNames(ctx)
+		for name := range names.Name() {
+			streams = append(streams, name)
+		}
+		if err := names.Err(); err != nil {
+			fail(l, exitFailure, "failed to list the streams: %v", err)
+		}
+		slices.Sort(streams)
+	}
+	var from time.Time
+	if since > 0 {
+		from = time.Now().Add(-since)
+	}
+
+	// ─── Index ─────────────────────────────────────────────────────────
+	idx := &traceIndex{events: make(map[string]*traceEntry), correlated: make(map[string][]string), caused: make(map[string][]string)}
+	for _, name := range streams {
+		_, err := readStream(ctx, js, l, subject, name, from, func(m *nats.Msg, meta *jetstream.MsgMetadata) {
+			idx.add(m, traceCopy{stream: name, seq: meta.Sequence.Stream})
+		})
+		if err != nil {
+			l.Printf("⚠️  Stream %q skipped: %v", name, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if idx.withoutID > 0 {
+		l.Printf("ℹ️  %d message(s) without CloudEvents id ignored", idx.withoutID)
+	}
+	if idx.overflow {
+		l.Printf("⚠️  More than %d events: the later ones were not searched, narrow -subject, -stream or -since", maxTraceEvents)
+	}
+
+	// ─── Related Events ────────────────────────────────────────────────
+	related, missing := idx.related(id)
+	if len(related) == 0 {
+		fail(l, exitFailure, "no event with the id or correlationid %q in %d stream(s)", id, len(streams))
+	}
+	events := make([]*tracedEvent, 0, len(related))
+	for _, eventID := range related {
+		ev, err := fetchTraced(ctx, js, idx.events[eventID])
+		if err != nil {
+			l.Printf("⚠️  Event %s not read again: %v", eventID, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	slices.SortStableFunc(events, func(a, b *tracedEvent) int {
+		return cmp.Or(a.time.Compare(b.time), a.stored.Compare(b.stored))
+	})
+	l.Printf("🕰️  %d related event(s) found, timeline on stdout", len(events))
+	writeTimeline(os.Stdout, id, events, missing)
+	countReceived(len(events))
+}
+
+// add indexes the message m, stored at where.
+func (idx *traceIndex) add(m *nats.Msg, where traceCopy) {
+	ev, ok := decodeCloudEvent(m)
+	if !ok || ev.Attributes["id"] == "" {
+		idx.withoutID++
+		return
+	}
+	chain := correlation.FromAttributes(ev.Attributes)
+	if entry, known := idx.events[chain.ID]; known {
+		entry.copies = append(entry.copies, where)
+		return
+	}
+	if len(idx.events) >= maxTraceEvents {
+		idx.overflow = true
+		return
+	}
+	idx.events[chain.ID] = &traceEntry{chain: chain, copies: []traceCopy{where}}
+	idx.correlated[chain.CorrelationID] = append(idx.correlated[chain.CorrelationID], chain.ID)
+	if chain.CausationID != "" {
+		idx.caused[chain.CausationID] = append(idx.caused[chain.CausationID], chain.ID)
+	}
+}
+
+// related returns the ids of the events related to id: those of its chain,
+// their causes and consequences, transitively. missing lists the causes
+// referred to but not found.
+func (idx *traceIndex) related(id string) (related, missing []string) {
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	visit := func(ids ...string) {
+		for _, other := range ids {
+			if other != "" && !seen[other] {
+				seen[other] = true
+				queue = append(queue, other)
+			}
+		}
+	}
+	visit(idx.correlated[id]...) // id is a correlation id
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		entry, ok := idx.events[current]
+		if !ok {
+			if current != id {
+				missing = append(missing, current)
+			}
+			continue
+		}
+		related = append(related, current)
+		visit(entry.chain.CausationID)
+		visit(idx.caused[current]...)
+		visit(idx.correlated[entry.chain.CorrelationID]...)
+	}
+	slices.Sort(missing)
+	return related, missing
+}
+
+// fetchTraced reads the first copy of the indexed event again, for its
+// attributes and data.
+func fetchTraced(ctx context.Context, js jetstream.JetStream, entry *traceEntry) (*tracedEvent, error) {
+	first := entry.copies[0]
+	s, err := js.Stream(ctx, first.stream)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := s.GetMsg(ctx, first.seq)
+	if err != nil {
+		return nil, err
+	}
+	ev, _ := decodeCloudEvent(&nats.Msg{Subject: raw.Subject, Header: raw.Header, Data: raw.Data})
+	t, err := time.Parse(time.RFC3339Nano, ev.Attributes["time"])
+	if err != nil {
+		t = raw.Time
+	}
+	data := strings.Join(strings.Fields(string(ev.Data)), " ")
+	if len(data) > maxTraceData {
+		data = data[:maxTraceData] + "…"
+	}
+	return &tracedEvent{
+		Chain:     entry.chain,
+		eventType: ev.Attributes["type"],
+		source:    cmp.Or(ev.Attributes["source"], unknownProducer),
+		subject:   raw.Subject,
+		time:      t,
+		stored:    raw.Time,
+		data:      data,
+		copies:    entry.copies,
+	}, nil
+}
+
+// writeTimeline prints the timeline of events, sorted by time, and the
+// narrative of what happened.
+func writeTimeline(w io.Writer, id string, events []*tracedEvent, missing []string) {
+	if len(events) == 0 {
+		return
+	}
+	start, end := events[0].time, events[len(events)-1].time
+	sources := make(map[string]bool)
+	byID := make(map[string]*tracedEvent, len(events))
+	for _, ev := range events {
+		sources[ev.source] = true
+		byID[ev.ID] = ev
+	}
+	fmt.Fprintf(w, "Trace of %s: %d event(s), %d source(s), %s → %s (%v)\n\n",
+		id, len(events), len(sources), start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano), end.Sub(start))
+
+	// ─── Timeline ──────────────────────────────────────────────────────
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tOFFSET\tSOURCE\tTYPE\tSUBJECT\tID\tSTORED IN")
+	for _, ev := range events {
+		link := ev.ID
+		if ev.CausationID != "" {
+			link += " ← " + ev.CausationID
+		}
+		copies := make([]string, len(ev.copies))
+		for i, c := range ev.copies {
+			copies[i] = fmt.Sprintf("%s#%d", c.stream, c.seq)
+		}
+		fmt.Fprintf(tw, "%s\t+%v\t%s\t%s\t%s\t%s\t%s\n", ev.time.UTC().Format("15:04:05.000"), ev.time.Sub(start),
+			ev.source, ev.eventType, ev.subject, link, strings.Join(copies, ", "))
+	}
+	tw.Flush()
+
+	// ─── Narrative ─────────────────────────────────────────────────────
+	fmt.Fprintln(w, "\nWhat happened:")
+	var previous time.Time
+	for i, ev := range events {
+		when := fmt.Sprintf("At %s", ev.time.UTC().Format("15:04:05.000"))
+		if i > 0 {
+			when = fmt.Sprintf("%v later", ev.time.Sub(previous))
+		}
+		previous = ev.time
+		what := fmt.Sprintf("%s published %s (%s) on %s", ev.source, ev.eventType, ev.ID, ev.subject)
+		cause, known := byID[ev.CausationID]
+		switch {
+		case ev.CausationID == "":
+			what += ", starting the chain"
+		case known:
+			what = fmt.Sprintf("%s, handling %s (%s) of %s, %s", ev.source, cause.eventType, cause.ID, cause.source, strings.TrimPrefix(what, ev.source+" "))
+		default:
+			what += fmt.Sprintf(", caused by %s, not found in the streams searched", ev.CausationID)
+		}
+		fmt.Fprintf(w, "  %d. %s, %s.\n", i+1, when, what)
+		if ev.data != "" {
+			fmt.Fprintf(w, "     data: %s\n", ev.data)
+		}
+		if known && ev.time.Before(cause.time) {
+			fmt.Fprintf(w, "     ⚠️  %v before its cause: the clocks of %s and %s disagree\n", cause.time.Sub(ev.time), cause.source, ev.source)
+		}
+	}
+
+	// ─── Loose Ends ────────────────────────────────────────────────────
+	var leaves []string
+	for _, ev := range events {
+		if ev.CausationID != "" && !slices.ContainsFunc(events, func(other *tracedEvent) bool { return other.CausationID == ev.ID }) {
+			leaves = append(leaves, fmt.Sprintf("%s (%s)", ev.eventType, ev.ID))
+		}
+	}
+	if len(leaves) > 0 {
+		fmt.Fprintf(w, "\nEnd of the chain: %s caused no further event.\n", strings.Join(leaves, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "Not found: %s, outside of the streams, -subject or -since searched (or expired).\n", strings.Join(missing, ", "))
+	}
+}
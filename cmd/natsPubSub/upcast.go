@@ -0,0 +1,76 @@
+// upcast.go — Versioned event upcasting in the subscriber.
+//
+// With -expect-version N, the "sub" mode reads the type and version of each
+// CloudEvent (binary mode headers or structured JSON), migrates older
+// versions to N with the upcasters registered below (see pkg/upcast), and
+// prints the data as the version N handler would see it:
+//
+//	go run . -mode sub -subject "orders.>" -expect-version 2
+//
+// Events of an unknown version path are reported, not silently dropped.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/upcast"
+)
+
+// upcasters returns the registry of the event migrations known by this
+// program, one function per version step.
+func upcasters() *upcast.Registry {
+	r := upcast.NewRegistry()
+
+	// order.created v1 → v2: the "channel" property appeared in v2
+	// (configs/schemas/order-created-v2.json), v1 orders all came from the web shop.
+	r.Register("order.created", 1, func(data json.RawMessage) (json.RawMessage, error) {
+		var order map[string]any
+		if err := json.Unmarshal(data, &order); err != nil {
+			return nil, err
+		}
+		if _, ok := order["channel"]; !ok {
+			order["channel"] = "web"
+		}
+		return json.Marshal(order)
+	})
+	return r
+}
+
+// upcastHandler returns a message handler printing the data of every
+// event upcast to version want.
+func upcastHandler(l *log.Logger, r *upcast.Registry, want int) func(m *nats.Msg) error {
+	return func(m *nats.Msg) error {
+		eventType, version, data, ok := parseEvent(m)
+		if !ok {
+			return fmt.Errorf("received on [%s] a message that is not a CloudEvent: %s", m.Subject, string(m.Data))
+		}
+		upcastData, err := r.Upcast(eventType, version, want, data)
+		if err != nil {
+			return fmt.Errorf("cannot handle %s v%d on [%s]: %w", eventType, version, m.Subject, err)
+		}
+		if version < want {
+			l.Printf("⬆️  Upcast %s v%d → v%d", eventType, version, want)
+		}
+		l.Printf("📩 Received %s v%d on [%s]: %s", eventType, want, m.Subject, string(upcastData))
+		return nil
+	}
+}
+
+// parseEvent extracts the type, the data version and the data of a
+// CloudEvent. Events without a version are version 1.
+func parseEvent(m *nats.Msg) (eventType string, version int, data json.RawMessage, ok bool) {
+	ev, ok := decodeCloudEvent(m)
+	if !ok {
+		return "", 0, nil, false
+	}
+	version = 1
+	if v, err := strconv.Atoi(ev.Attributes[upcast.VersionAttribute]); err == nil {
+		version = v
+	}
+	return ev.Attributes["type"], version, ev.Data, true
+}
@@ -0,0 +1,160 @@
+// bench.go — "bench" and "monitor" sub-commands.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// benchCommand measures the core NATS throughput: -pubs publishers share
+// -msgs messages, each of the -subs subscribers receives all of them. Every
+// client has its own connection, as separate processes would.
+func benchCommand(args []string) {
+	fs := newFlagSet(usageOf("bench"))
+	msgs := fs.Int("msgs", 100_000, "Number of messages to publish")
+	size := fs.Int("size", 128, "Payload size in bytes")
+	pubs := fs.Int("pubs", 1, "Number of concurrent publishers")
+	subs := fs.Int("subs", 1, "Number of concurrent subscribers")
+	pos := parseArgs(fs, args, 1, 1)
+	subject := pos[0]
+
+	var received sync.WaitGroup
+	subDurations := make([]time.Duration, *subs)
+	for i := range *subs {
+		nc := connect()
+		defer nc.Close()
+		received.Add(1)
+		var count int
+		var start time.Time
+		_, err := nc.Subscribe(subject, func(*nats.Msg) {
+			if count == 0 {
+				start = time.Now()
+			}
+			count++
+			if count == *msgs {
+				subDurations[i] = time.Since(start)
+				received.Done()
+			}
+		})
+		if err != nil {
+			l.Fatalf("💥 Failed to subscribe: %v", err)
+		}
+		if err := nc.Flush(); err != nil { // subscription registered before publishing
+			l.Fatalf("💥 Flush failed: %v", err)
+		}
+	}
+
+	payload := make([]byte, *size)
+	start := time.Now()
+	var published sync.WaitGroup
+	for i := range *pubs {
+		n := *msgs / *pubs
+		if i < *msgs%*pubs {
+			n++
+		}
+		nc := connect()
+		defer nc.Close()
+		published.Add(1)
+		go func() {
+			defer published.Done()
+			for range n {
+				if err := nc.Publish(subject, payload); err != nil {
+					l.Printf("⚠️  Publish failed: %v", err)
+					return
+				}
+			}
+			_ = nc.Flush()
+		}()
+	}
+	published.Wait()
+	printRate("pub", *msgs, *size, time.Since(start))
+
+	if *subs == 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() { received.Wait(); close(done) }()
+	select {
+	case <-done:
+		for i, d := range subDurations {
+			printRate(fmt.Sprintf("sub #%d", i+1), *msgs, *size, d)
+		}
+	case <-time.After(apiTimeout):
+		l.Fatalf("💥 Subscribers did not receive all the messages, slow consumers? (see natsctl monitor)")
+	}
+}
+
+// printRate prints the throughput of n messages of size bytes in d.
+func printRate(who string, n, size int, d time.Duration) {
+	seconds := max(d.Seconds(), 1e-9)
+	fmt.Printf("%-8s %d msgs in %v: %.0f msgs/s, %.2f MB/s\n", who, n, d.Round(time.Millisecond), float64(n)/seconds, float64(n*size)/seconds/1e6)
+}
+
+// varz holds the /varz fields shown by monitorCommand.
+type varz struct {
+	Connections   int     `json:"connections"`
+	Subscriptions int     `json:"subscriptions"`
+	SlowConsumers int64   `json:"slow_consumers"`
+	InMsgs        int64   `json:"in_msgs"`
+	OutMsgs       int64   `json:"out_msgs"`
+	InBytes       int64   `json:"in_bytes"`
+	OutBytes      int64   `json:"out_bytes"`
+	Mem           int64   `json:"mem"`
+	CPU           float64 `json:"cpu"`
+}
+
+// monitorCommand prints the activity of the server every -interval, from
+// its HTTP monitoring endpoint (port 8222, no NATS credentials needed).
+func monitorCommand(args []string) {
+	fs := newFlagSet(usageOf("monitor"))
+	monitorURL := fs.String("monitor-url", "http://127.0.0.1:8222", "HTTP monitoring endpoint of the NATS server")
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	parseArgs(fs, args, 0, 0)
+
+	ctx, stop := stopContext()
+	defer stop()
+	client := &http.Client{Timeout: apiTimeout}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	fmt.Printf("%-8s %6s %6s %10s %10s %10s %10s %8s %6s\n", "TIME", "CONNS", "SUBS", "IN MSG/S", "OUT MSG/S", "IN KB/S", "OUT KB/S", "MEM MB", "SLOW")
+	var prev *varz
+	for {
+		var v varz
+		if err := getJSON(client, *monitorURL+"/varz", &v); err != nil {
+			l.Printf("⚠️  %v", err)
+		} else {
+			if prev != nil {
+				s := interval.Seconds()
+				fmt.Printf("%-8s %6d %6d %10.0f %10.0f %10.1f %10.1f %8d %6d\n", time.Now().Format(time.TimeOnly), v.Connections, v.Subscriptions,
+					float64(v.InMsgs-prev.InMsgs)/s, float64(v.OutMsgs-prev.OutMsgs)/s,
+					float64(v.InBytes-prev.InBytes)/s/1024, float64(v.OutBytes-prev.OutBytes)/s/1024,
+					v.Mem>>20, v.SlowConsumers)
+			}
+			prev = &v
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getJSON decodes the JSON document at url into v.
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,317 @@
+// cani.go — "can-i" sub-command: subject permission simulation.
+//
+// WHY IS MY PUBLISH DENIED?
+//
+//	A "Permissions Violation" only says which subject was refused, not
+//	which rule refused it. "can-i" evaluates the permissions of a user
+//	offline, the way nats-server does, and explains the decision:
+//
+//	  natsctl can-i pub orders.created                          # user of -creds / the context
+//	  natsctl can-i sub "orders.>" -jwt ./nats_auth/app_user.creds
+//	  natsctl can-i req orders.status.42 -config server.conf -user alice
+//
+//	The answer is "yes" or "no" followed by the reasons, and the exit code
+//	is 0 or 1, so scripts and CI checks can use it; 2 tells a question
+//	that could not be answered (usage, unreadable or invalid file).
+//
+// RULES (nats-server):
+//
+//   - without allow list, every subject not denied is allowed
+//   - with an allow list, only the subjects it covers are allowed
+//   - deny always wins over allow
+//   - a wildcard subscription must be covered by one allow entry; a deny
+//     entry only overlapping it filters the denied messages out
+//   - "req" publishes on the subject and subscribes to the reply inbox
+//     (_INBOX.>, or <prefix>.> with the global -inbox-prefix), "reply"
+//     subscribes to the subject and publishes on the inbox, unless
+//     allow_responses lets it answer the requests it received
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// inboxSubjects returns the reply subjects of the requests of the client
+// library, under the global -inbox-prefix when given.
+func inboxSubjects() string {
+	if *inboxPrefix != "" {
+		return *inboxPrefix + ".>"
+	}
+	return nats.InboxPrefix + ">"
+}
+
+// permissions are the subject permissions of one user.
+type permissions struct {
+	who               string
+	pubAllow, pubDeny []string
+	subAllow, subDeny []string
+	responses         string   // allow_responses limits, "" when not granted
+	notes             []string // caveats of the source
+}
+
+// canICommand reports whether an operation on a subject would be allowed.
+func canICommand(args []string) {
+	fs := newFlagSet(usageOf("can-i"))
+	jwtFile := fs.String("jwt", "", "User JWT or credentials file, defaults to the global -creds")
+	confFile := fs.String("config", "", "nats-server configuration file declaring the user (with -user)")
+	user := fs.String("user", "", "User name (or nkey) to look up in -config")
+	pos := parseArgs(fs, args, 2, 2)
+	verb, subject := pos[0], pos[1]
+
+	var p permissions
+	var err error
+	switch {
+	case *confFile != "":
+		if *user == "" {
+			usageError(fs, "-config needs the -user to look up")
+		}
+		p, err = configPermissions(*confFile, *user)
+	case *jwtFile != "":
+		p, err = jwtPermissions(*jwtFile)
+	case *credsFile != "":
+		p, err = jwtPermissions(*credsFile)
+	default:
+		usageError(fs, "no permissions to check: use -jwt, -config with -user, or a context with creds")
+	}
+	// An unreadable or invalid file must not exit with 1, the "no" of the
+	// answer.
+	if err != nil {
+		l.Printf("💥 %v", err)
+		os.Exit(exitUsage)
+	}
+
+	if (verb == "pub" || verb == "req") && strings.ContainsAny(subject, "*>") {
+		usageError(fs, "messages cannot be published on the wildcard subject %q", subject)
+	}
+	var allowed bool
+	var reasons []string
+	switch verb {
+	case "pub":
+		allowed, reasons = p.canPublish(subject)
+	case "sub":
+		allowed, reasons = p.canSubscribe(subject)
+	case "req":
+		pubOK, pubReasons := p.canPublish(subject)
+		subOK, subReasons := p.canSubscribe(inboxSubjects())
+		allowed, reasons = pubOK && subOK, append(pubReasons, subReasons...)
+	case "reply":
+		subOK, subReasons := p.canSubscribe(subject)
+		pubOK, pubReasons := p.canPublish(inboxSubjects())
+		if !pubOK && p.responses != "" {
+			pubOK, pubReasons = true, []string{"replies allowed by allow_responses (" + p.responses + ")"}
+		}
+		allowed, reasons = pubOK && subOK, append(subReasons, pubReasons...)
+	default:
+		usageError(fs, "the verb must be pub, sub, req or reply, got %q", verb)
+	}
+
+	answer := "no"
+	if allowed {
+		answer = "yes"
+	}
+	fmt.Printf("%s — %s %q as %s\n", answer, verb, subject, p.who)
+	for _, r := range append(reasons, p.notes...) {
+		fmt.Printf("  - %s\n", r)
+	}
+	if !allowed {
+		os.Exit(1)
+	}
+}
+
+// canPublish applies the publish permissions to subject.
+func (p permissions) canPublish(subject string) (bool, []string) {
+	allowed, reasons := decide("publish", subject, p.pubAllow, p.pubDeny)
+	if !allowed && p.responses != "" {
+		reasons = append(reasons, "replying to a received request on its reply subject is still allowed (allow_responses "+p.responses+")")
+	}
+	return allowed, reasons
+}
+
+// canSubscribe applies the subscribe permissions to subject.
+func (p permissions) canSubscribe(subject string) (bool, []string) {
+	allowed, reasons := decide("subscribe", subject, p.subAllow, p.subDeny)
+	if allowed {
+		for _, d := range p.subDeny {
+			if subjectsIntersect(d, subject) {
+				reasons = append(reasons, fmt.Sprintf("messages on %q will not be delivered (subscribe deny entry)", d))
+			}
+		}
+	}
+	return allowed, reasons
+}
+
+// decide applies an allow and a deny list to subject.
+func decide(op, subject string, allow, deny []string) (bool, []string) {
+	for _, d := range deny {
+		if subjectCovers(d, subject) {
+			return false, []string{fmt.Sprintf("%s %q denied by deny entry %q", op, subject, d)}
+		}
+	}
+	if len(allow) == 0 {
+		return true, []string{fmt.Sprintf("%s %q allowed: no %s allow list, and no deny entry covers it", op, subject, op)}
+	}
+	for _, a := range allow {
+		if subjectCovers(a, subject) {
+			return true, []string{fmt.Sprintf("%s %q allowed by allow entry %q", op, subject, a)}
+		}
+	}
+	return false, []string{fmt.Sprintf("%s %q covered by no allow entry %q", op, subject, allow)}
+}
+
+// subjectCovers reports whether every subject matched by subject (which may
+// contain wildcards) is matched by pattern.
+func subjectCovers(pattern, subject string) bool {
+	pt, st := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range pt {
+		switch {
+		case p == ">":
+			return len(st) > i
+		case i >= len(st) || st[i] == ">":
+			return false
+		case p == "*":
+		case p != st[i]:
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
+
+// subjectsIntersect reports whether a subject is matched by both a and b.
+func subjectsIntersect(a, b string) bool {
+	at, bt := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		switch {
+		case at[i] == ">" || bt[i] == ">":
+			return true
+		case at[i] == "*" || bt[i] == "*" || at[i] == bt[i]:
+		default:
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
+
+// jwtPermissions reads the permissions of a user JWT or credentials file.
+func jwtPermissions(path string) (permissions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return permissions{}, err
+	}
+	token, err := jwt.ParseDecoratedJWT(data)
+	if err != nil {
+		return permissions{}, err
+	}
+	claims, err := jwt.DecodeUserClaims(strings.TrimSpace(token))
+	if err != nil {
+		return permissions{}, fmt.Errorf("%s: %w", path, err)
+	}
+	p := permissions{
+		who:      fmt.Sprintf("%s (user JWT %s)", claims.Name, path),
+		pubAllow: claims.Pub.Allow, pubDeny: claims.Pub.Deny,
+		subAllow: claims.Sub.Allow, subDeny: claims.Sub.Deny,
+	}
+	if claims.Resp != nil {
+		p.responses = fmt.Sprintf("max %d, ttl %v", claims.Resp.MaxMsgs, claims.Resp.Expires)
+	}
+	if claims.IssuerAccount != "" && claims.Pub.Empty() && claims.Sub.Empty() {
+		p.notes = append(p.notes, "issued by a signing key of account "+claims.IssuerAccount+": a scoped signing key replaces these permissions by its template, see the account JWT")
+	}
+	if claims.Expires != 0 && time.Unix(claims.Expires, 0).Before(time.Now()) {
+		p.notes = append(p.notes, "this JWT expired on "+time.Unix(claims.Expires, 0).Format(time.RFC3339)+": the connection itself would be refused")
+	}
+	return p, nil
+}
+
+// configPermissions reads the permissions of a user of a server
+// configuration: in "authorization" or in one of the "accounts".
+func configPermissions(path, user string) (permissions, error) {
+	conf, err := parseConfFile(path)
+	if err != nil {
+		return permissions{}, err
+	}
+	type scope struct {
+		name  string
+		block map[string]any
+	}
+	var scopes []scope
+	if auth, ok := confGet(conf, "authorization").(map[string]any); ok {
+		scopes = append(scopes, scope{"authorization", auth})
+	}
+	if accounts, ok := confGet(conf, "accounts").(map[string]any); ok {
+		for name, a := range accounts {
+			if block, ok := a.(map[string]any); ok {
+				scopes = append(scopes, scope{"account " + name, block})
+			}
+		}
+	}
+
+	for _, s := range scopes {
+		users, _ := confGet(s.block, "users").([]any)
+		if confGet(s.block, "user") != nil { // single user authorization block
+			users = append(users, s.block)
+		}
+		for _, u := range users {
+			entry, ok := u.(map[string]any)
+			if !ok || confGet(entry, "user") != user && confGet(entry, "nkey") != user {
+				continue
+			}
+			p := permissions{who: fmt.Sprintf("%s (%s, %s)", user, path, s.name)}
+			perms, ok := confGet(entry, "permissions").(map[string]any)
+			if !ok {
+				if perms, ok = confGet(s.block, "default_permissions").(map[string]any); ok {
+					p.notes = append(p.notes, "no permissions for this user, default_permissions of "+s.name+" apply")
+				}
+			}
+			p.pubAllow, p.pubDeny = confPermission(perms, "publish", "pub")
+			p.subAllow, p.subDeny = confPermission(perms, "subscribe", "sub")
+			switch r := confGet(perms, "allow_responses").(type) {
+			case string:
+				if r == "true" {
+					p.responses = "max 1, ttl 2m0s" // server defaults
+				}
+			case map[string]any:
+				p.responses = fmt.Sprintf("max %v, ttl %v", confGet(r, "max"), confGet(r, "expires"))
+			}
+			return p, nil
+		}
+	}
+	return permissions{}, fmt.Errorf("user %q not found in %s", user, path)
+}
+
+// confPermission returns the allow and deny lists of the publish or
+// subscribe permission: a subject, a list of subjects (both allow) or
+// an {allow, deny} map.
+func confPermission(perms map[string]any, keys ...string) (allow, deny []string) {
+	for _, k := range keys {
+		switch v := confGet(perms, k).(type) {
+		case string, []any:
+			return confStrings(v), nil
+		case map[string]any:
+			return confStrings(confGet(v, "allow")), confStrings(confGet(v, "deny"))
+		}
+	}
+	return nil, nil
+}
+
+// confStrings returns a string or a list of strings of the configuration.
+func confStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
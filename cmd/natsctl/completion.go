@@ -0,0 +1,268 @@
+// completion.go — Shell completion scripts and the hidden "__complete" command.
+//
+// HOW IT WORKS:
+//
+//	The scripts printed by "natsctl completion bash|zsh|fish" contain no
+//	word list: on every <TAB>, the shell runs
+//
+//	  natsctl __complete <words before the cursor…> <word under the cursor>
+//
+//	which prints the candidates, one per line. Sub-commands and verbs are
+//	known offline, while stream, consumer and bucket names and subjects
+//	are queried live from the server, with the global flags typed on the
+//	command line (-url, -creds, -context, …). A server that does not answer within
+//	completeTimeout simply yields no candidate.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// completeCommand is the hidden sub-command called by the scripts.
+	completeCommand = "__complete"
+	// completeTimeout bounds the server queries of one completion.
+	completeTimeout = 2 * time.Second
+	// maxSubjectCandidates caps the subjects read from the streams.
+	maxSubjectCandidates = 1000
+)
+
+// completionScripts are the scripts of each supported shell.
+var completionScripts = map[string]string{
+	"bash": `_natsctl() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local IFS=$'\n'
+	COMPREPLY=($(natsctl __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" "$cur" 2>/dev/null))
+}
+complete -o default -F _natsctl natsctl
+`,
+	"zsh": `#compdef natsctl
+_natsctl() {
+	local -a candidates
+	candidates=("${(@f)$(natsctl __complete "${(@)words[2,CURRENT-1]}" "${words[CURRENT]}" 2>/dev/null)}")
+	compadd -a candidates
+}
+compdef _natsctl natsctl
+`,
+	"fish": `complete -c natsctl -f -a '(natsctl __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`,
+}
+
+// completionCommand prints the completion script of a shell.
+func completionCommand(args []string) {
+	fs := newFlagSet(usageOf("completion"))
+	pos := parseArgs(fs, args, 1, 1)
+	script, ok := completionScripts[pos[0]]
+	if !ok {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	fmt.Print(script)
+}
+
+// complete prints the candidates for the last word of args.
+func complete(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	words, current := args[:len(args)-1], args[len(args)-1]
+	if strings.HasPrefix(current, "-") {
+		return // flags are not completed
+	}
+
+	// The global flags before the sub-command select the server to query.
+	// Parse errors are not reported: the line is still being typed.
+	globals := flag.NewFlagSet(APP, flag.ContinueOnError)
+	globals.SetOutput(io.Discard)
+	flag.VisitAll(func(f *flag.Flag) { globals.Var(f.Value, f.Name, f.Usage) })
+	if globals.Parse(words) != nil || applyContext(explicitFlags(globals)) != nil {
+		return
+	}
+	for _, candidate := range candidates(positionalWords(globals.Args())) {
+		if strings.HasPrefix(candidate, current) {
+			fmt.Println(candidate)
+		}
+	}
+}
+
+// candidates returns the possible values of the word following words
+// (the sub-command and its positional arguments).
+func candidates(words []string) []string {
+	if len(words) == 0 {
+		names := make([]string, 0, len(commands))
+		for _, c := range commands {
+			names = append(names, c.name)
+		}
+		return names
+	}
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == words[0] })
+	if i < 0 {
+		return nil
+	}
+	c, args := commands[i], words[1:]
+	if len(c.verbs) > 0 && len(args) == 0 {
+		return c.verbs
+	}
+
+	switch c.name {
+	case "pub", "sub", "req", "bench", "forget":
+		if len(args) == 0 {
+			return liveNames(subjectNames)
+		}
+	case "can-i":
+		if len(args) == 1 {
+			return liveNames(subjectNames)
+		}
+	case "stream":
+		if args[0] != "ls" && len(args) == 1 {
+			return liveNames(streamNames)
+		}
+	case "consumer":
+		switch {
+		case len(args) == 1:
+			return liveNames(streamNames)
+		case args[0] != "ls" && len(args) == 2:
+			return liveNames(func(ctx context.Context, js jetstream.JetStream) []string { return consumerNames(ctx, js, args[1]) })
+		}
+	case "migrate":
+		switch len(args) {
+		case 0, 2:
+			return liveNames(streamNames)
+		case 1:
+			return liveNames(func(ctx context.Context, js jetstream.JetStream) []string { return consumerNames(ctx, js, args[0]) })
+		}
+	case "lvc", "purge":
+		if len(args) == 0 {
+			return liveNames(streamNames)
+		}
+	case "ctx":
+		if args[0] != "ls" && args[0] != "add" && len(args) == 1 {
+			return contextNames()
+		}
+	case "kv":
+		switch {
+		case args[0] != "ls" && len(args) == 1:
+			return liveNames(bucketNames)
+		case (args[0] == "get" || args[0] == "put" || args[0] == "del") && len(args) == 2:
+			return liveNames(func(ctx context.Context, js jetstream.JetStream) []string { return keyNames(ctx, js, args[1]) })
+		}
+	}
+	return nil
+}
+
+// boolFlags are the sub-command flags without value.
+var boolFlags = map[string]bool{"retry-on-no-responder": true, "compact": true, "dry-run": true, "no-pause": true}
+
+// positionalWords drops the sub-command flags (and their values, when not
+// given with "=") from words, keeping the positional arguments.
+func positionalWords(words []string) []string {
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		switch w := words[i]; {
+		case !strings.HasPrefix(w, "-"):
+			positional = append(positional, w)
+		case !strings.Contains(w, "=") && !boolFlags[strings.TrimLeft(w, "-")]:
+			i++ // skip the value
+		}
+	}
+	return positional
+}
+
+// liveNames connects quickly to the server and returns the names listed by fn.
+func liveNames(fn func(context.Context, jetstream.JetStream) []string) []string {
+	opts := append([]nats.Option{nats.Name(APP), nats.Timeout(completeTimeout), nats.NoReconnect()}, authOptions()...)
+	nc, err := nats.Connect(*natsURL, opts...)
+	if err != nil {
+		return nil
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completeTimeout)
+	defer cancel()
+	return fn(ctx, js)
+}
+
+// streamNames returns the names of the streams.
+func streamNames(ctx context.Context, js jetstream.JetStream) []string {
+	var names []string
+	for name := range js.StreamNames(ctx).Name() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// consumerNames returns the names of the consumers of stream.
+func consumerNames(ctx context.Context, js jetstream.JetStream, stream string) []string {
+	s, err := js.Stream(ctx, stream)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for name := range s.ConsumerNames(ctx).Name() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// bucketNames returns the names of the key-value buckets.
+func bucketNames(ctx context.Context, js jetstream.JetStream) []string {
+	var names []string
+	for name := range js.KeyValueStoreNames(ctx).Name() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// keyNames returns the keys of bucket.
+func keyNames(ctx context.Context, js jetstream.JetStream, bucket string) []string {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil
+	}
+	keys, _ := kv.Keys(ctx)
+	return keys
+}
+
+// subjectNames returns the subjects bound to the streams and the subjects
+// holding stored messages, the best knowledge of the server about the
+// subjects in use (core NATS subjects exist only while messages flow).
+func subjectNames(ctx context.Context, js jetstream.JetStream) []string {
+	seen := make(map[string]bool)
+	streams := js.ListStreams(ctx)
+	for info := range streams.Info() {
+		for _, subject := range info.Config.Subjects {
+			seen[subject] = true
+		}
+		if len(seen) >= maxSubjectCandidates {
+			continue
+		}
+		s, err := js.Stream(ctx, info.Config.Name)
+		if err != nil {
+			continue
+		}
+		stored, err := s.Info(ctx, jetstream.WithSubjectFilter(">"))
+		if err != nil {
+			continue
+		}
+		for subject := range stored.State.Subjects {
+			if len(seen) < maxSubjectCandidates {
+				seen[subject] = true
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
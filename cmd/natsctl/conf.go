@@ -0,0 +1,204 @@
+// conf.go — Minimal reader of the nats-server configuration format.
+//
+// The server configuration is a relaxed JSON: keys and values may be
+// unquoted, "=", ":" or nothing separate them, commas are optional, "#"
+// and "//" start comments, "$NAME" refers to a variable defined earlier or
+// to an environment variable (kept as is when undefined), and
+// "include <file>" inserts another file. This reader covers what "can-i"
+// needs (maps, arrays, strings); numbers and booleans are kept as strings.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// confParser reads one configuration file.
+type confParser struct {
+	data  string
+	pos   int
+	dir   string           // of the file, for the includes
+	scope []map[string]any // enclosing maps, for the variables
+}
+
+// parseConfFile reads a server configuration file.
+func parseConfFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &confParser{data: string(data), dir: filepath.Dir(path)}
+	m := make(map[string]any)
+	if err := p.parseMap(m, 0); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// parseMap reads "key value" entries into m until end (0 for the end of the file).
+func (p *confParser) parseMap(m map[string]any, end byte) error {
+	p.scope = append(p.scope, m)
+	defer func() { p.scope = p.scope[:len(p.scope)-1] }()
+	for {
+		p.skipBlank(true)
+		if p.pos >= len(p.data) {
+			if end != 0 {
+				return fmt.Errorf("missing %q", end)
+			}
+			return nil
+		}
+		if p.data[p.pos] == end {
+			p.pos++
+			return nil
+		}
+		key := p.readKey()
+		if key == "" {
+			return fmt.Errorf("unexpected %q at offset %d", p.data[p.pos], p.pos)
+		}
+		p.skipBlank(false)
+		if p.pos < len(p.data) && (p.data[p.pos] == '=' || p.data[p.pos] == ':') {
+			p.pos++
+			p.skipBlank(false)
+		}
+		if strings.EqualFold(key, "include") {
+			path := p.readToken()
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(p.dir, path)
+			}
+			included, err := parseConfFile(path)
+			if err != nil {
+				return err
+			}
+			for k, v := range included {
+				m[k] = v
+			}
+			continue
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		m[key] = v
+	}
+}
+
+// parseValue reads a map, an array, a string or a variable.
+func (p *confParser) parseValue() (any, error) {
+	if p.pos >= len(p.data) {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch c := p.data[p.pos]; c {
+	case '{':
+		p.pos++
+		m := make(map[string]any)
+		return m, p.parseMap(m, '}')
+	case '[':
+		p.pos++
+		var list []any
+		for {
+			p.skipBlank(true)
+			if p.pos >= len(p.data) {
+				return nil, fmt.Errorf("missing ']'")
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case '$':
+		name := p.readToken()[1:]
+		for i := len(p.scope) - 1; i >= 0; i-- {
+			if v := confGet(p.scope[i], name); v != nil {
+				return v, nil
+			}
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v, nil
+		}
+		// Unknown here, e.g. a password only set where the server runs:
+		// kept as is, "can-i" does not need it.
+		return "$" + name, nil
+	default:
+		return p.readToken(), nil
+	}
+}
+
+// readKey reads a quoted or bare key.
+func (p *confParser) readKey() string {
+	if c := p.data[p.pos]; c == '"' || c == '\'' {
+		return p.readQuoted()
+	}
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n=:{[,;#", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// readToken reads a quoted string, or a bare value ending at the end of
+// the line, a separator or a closing bracket.
+func (p *confParser) readToken() string {
+	if c := p.data[p.pos]; c == '"' || c == '\'' {
+		return p.readQuoted()
+	}
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune("\r\n,;]}#", rune(p.data[p.pos])) {
+		if strings.HasPrefix(p.data[p.pos:], "//") {
+			break
+		}
+		p.pos++
+	}
+	return strings.TrimSpace(p.data[start:p.pos])
+}
+
+// readQuoted reads a string between quotes, with backslash escapes.
+func (p *confParser) readQuoted() string {
+	quote := p.data[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.data) && p.data[p.pos] != quote {
+		if p.data[p.pos] == '\\' && p.pos+1 < len(p.data) {
+			p.pos++
+		}
+		b.WriteByte(p.data[p.pos])
+		p.pos++
+	}
+	p.pos++ // closing quote
+	return b.String()
+}
+
+// skipBlank skips spaces and comments, and also newlines and separators
+// when entries is true.
+func (p *confParser) skipBlank(entries bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case entries && strings.ContainsRune("\r\n,;", rune(c)):
+			p.pos++
+		case c == '#' || strings.HasPrefix(p.data[p.pos:], "//"):
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// confGet returns the value of key in m: the keys are case insensitive.
+func confGet(m map[string]any, key string) any {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+// context.go — "ctx" sub-command: named connection contexts (profiles).
+//
+// SWITCHING SERVERS:
+//
+//	Typing -url and -creds on every command is tedious and error prone
+//	when going back and forth between local, staging and production. A
+//	context stores them under a name:
+//
+//	  natsctl ctx add prod -url nats://prod:4222 -creds ~/nats/prod.creds -description "production"
+//	  natsctl ctx use prod
+//	  natsctl stream ls                  # on prod
+//	  natsctl -context local stream ls   # once on another context
+//
+//	The selected context is, by priority: -context, the NATS_CONTEXT
+//	environment variable, then the one chosen with "ctx use". A global
+//	flag given on the command line always wins over the context.
+//
+//	Contexts are JSON files in <user config dir>/natsctl/contexts/ (e.g.
+//	~/.config/natsctl/contexts/prod.json on Linux), readable by their owner
+//	only. They hold the path of the credentials file, never its content.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// natsContext is a stored connection context.
+type natsContext struct {
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Creds       string `json:"creds,omitempty"`
+	EnvPrefix   string `json:"env_prefix,omitempty"`
+	InboxPrefix string `json:"inbox_prefix,omitempty"`
+}
+
+// contextName restricts the names to safe file names.
+var contextName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ctxCommand manages the contexts.
+func ctxCommand(args []string) {
+	fs := newFlagSet(usageOf("ctx"))
+	url := fs.String("url", "", "NATS server URL of the context")
+	creds := fs.String("creds", "", "Credentials file of the context, stored as an absolute path")
+	envPrefix := fs.String("env-prefix", "", "Prefix of the <PREFIX>_USER and <PREFIX>_PASSWORD environment variables of the context")
+	inbox := fs.String("inbox-prefix", "", "Prefix of the reply inboxes of the context, instead of _INBOX")
+	description := fs.String("description", "", "Free text shown by ctx ls")
+	pos := parseArgs(fs, args, 1, 2)
+
+	switch {
+	case pos[0] == "ls" && len(pos) == 1:
+		current := selectedContext()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tNAME\tURL\tDESCRIPTION")
+		for _, name := range contextNames() {
+			c, err := loadContext(name)
+			if err != nil {
+				l.Printf("⚠️  %v", err)
+				continue
+			}
+			marker := ""
+			if name == current {
+				marker = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", marker, name, c.URL, c.Description)
+		}
+		_ = tw.Flush()
+	case pos[0] == "add" && len(pos) == 2:
+		c := natsContext{Description: *description, URL: *url, EnvPrefix: *envPrefix, InboxPrefix: *inbox}
+		if *creds != "" {
+			abs, err := filepath.Abs(*creds)
+			if err != nil {
+				l.Fatalf("💥 %v", err)
+			}
+			c.Creds = abs
+		}
+		if err := saveContext(pos[1], c); err != nil {
+			l.Fatalf("💥 Failed to save context %q: %v", pos[1], err)
+		}
+		fmt.Printf("Context %q saved\n", pos[1])
+	case pos[0] == "use" && len(pos) == 2:
+		if _, err := loadContext(pos[1]); err != nil {
+			l.Fatalf("💥 %v", err)
+		}
+		if err := os.WriteFile(contextPath(currentContextFile), []byte(pos[1]+"\n"), 0o600); err != nil {
+			l.Fatalf("💥 Failed to select context %q: %v", pos[1], err)
+		}
+		fmt.Printf("Using context %q\n", pos[1])
+	case pos[0] == "show" && len(pos) <= 2:
+		name := selectedContext()
+		if len(pos) == 2 {
+			name = pos[1]
+		}
+		if name == "" {
+			l.Fatalf("💥 No context selected, see natsctl ctx use")
+		}
+		c, err := loadContext(name)
+		if err != nil {
+			l.Fatalf("💥 %v", err)
+		}
+		printJSON(c)
+	case pos[0] == "rm" && len(pos) == 2:
+		if err := os.Remove(contextPath("contexts", pos[1]+".json")); err != nil {
+			l.Fatalf("💥 Failed to remove context %q: %v", pos[1], err)
+		}
+		if selectedContext() == pos[1] {
+			_ = os.Remove(contextPath(currentContextFile))
+		}
+		fmt.Printf("Context %q removed\n", pos[1])
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// currentContextFile holds the name of the context chosen with "ctx use".
+const currentContextFile = "context.txt"
+
+// contextPath returns a path under the natsctl configuration directory.
+func contextPath(elem ...string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		l.Fatalf("💥 No user configuration directory: %v", err)
+	}
+	return filepath.Join(append([]string{dir, APP}, elem...)...)
+}
+
+// selectedContext returns the name of the context in use, "" for none.
+func selectedContext() string {
+	if *contextFlag != "" {
+		return *contextFlag
+	}
+	if name := os.Getenv("NATS_CONTEXT"); name != "" {
+		return name
+	}
+	data, err := os.ReadFile(contextPath(currentContextFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// contextNames returns the names of the stored contexts, sorted.
+func contextNames() []string {
+	files, _ := filepath.Glob(contextPath("contexts", "*.json"))
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), ".json"))
+	}
+	return names
+}
+
+// loadContext reads a stored context.
+func loadContext(name string) (natsContext, error) {
+	var c natsContext
+	if !contextName.MatchString(name) {
+		return c, fmt.Errorf("invalid context name %q", name)
+	}
+	data, err := os.ReadFile(contextPath("contexts", name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, fmt.Errorf("unknown context %q, see natsctl ctx ls", name)
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("context %q: %w", name, err)
+	}
+	return c, nil
+}
+
+// saveContext writes a context, readable by its owner only.
+func saveContext(name string, c natsContext) error {
+	if !contextName.MatchString(name) {
+		return fmt.Errorf("invalid context name %q (letters, digits, '.', '_' and '-')", name)
+	}
+	if err := os.MkdirAll(contextPath("contexts"), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(contextPath("contexts", name+".json"), append(data, '\n'), 0o600)
+}
+
+// applyContext sets the global flags not given on the command line (set
+// lists the given ones) from the selected context.
+func applyContext(set map[string]bool) error {
+	name := selectedContext()
+	if name == "" {
+		return nil
+	}
+	c, err := loadContext(name)
+	if err != nil {
+		return err
+	}
+	for flagName, value := range map[string]string{"url": c.URL, "creds": c.Creds, "env-prefix": c.EnvPrefix, "inbox-prefix": c.InboxPrefix} {
+		if value != "" && !set[flagName] {
+			if err := flag.Set(flagName, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
@@ -0,0 +1,421 @@
+// doctor.go — "doctor" sub-command: diagnosis of the environment.
+//
+// WHY:
+//
+//	"It does not connect" has a dozen causes: a firewall, the monitoring
+//	port instead of the client one, a certificate issued for another name
+//	or expired, a wrong creds file, JetStream disabled for the account, a
+//	subject denied by the permissions… each with its own cryptic error.
+//	"doctor" runs the checks one after the other and tells, for every
+//	failure, what to do about it:
+//
+//	  natsctl doctor
+//	  ✅ reachable    nats://nats.example.com:4222 (n1, v2.11.4), INFO in 12.4ms
+//	  ❌ tls          certificate valid for nats.internal, not nats.example.com
+//	     → connect with one of nats.internal, 10.0.0.4, or reissue the certificate with nats.example.com
+//	  …
+//	  6 passed, 1 warning(s), 1 failed
+//
+// THE CHECKS:
+//
+//	reachable    a TCP connection to every server of -url, reading the INFO
+//	             the server sends first (no credentials needed)
+//	tls          the certificate chain, verified against the system roots,
+//	             for the host name of the URL, and its expiry
+//	connect      the connection with the credentials of the global flags
+//	rtt          the round trip time to the server
+//	version      the server version, 2.10 at least for the JetStream
+//	             features used in this repository
+//	jetstream    JetStream enabled for the account, and its storage usage
+//	max-payload  the largest message accepted by the server
+//	permissions  publish, subscribe and request/reply on -subject
+//
+//	The command exits with 1 when a check failed, for scripts and CI jobs.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/transport"
+)
+
+const (
+	// minServerMajor.minServerMinor is the oldest server version advised.
+	minServerMajor, minServerMinor = 2, 10
+	// slowRTT is the round trip time from which the server is deemed far.
+	slowRTT = 100 * time.Millisecond
+	// certRenewal is how long before its expiry a certificate is reported.
+	certRenewal = 30 * 24 * time.Hour
+	// defaultMaxPayload is the max_payload of a default server configuration.
+	defaultMaxPayload = 1 << 20
+)
+
+// serverInfo holds the fields of the INFO of a server used by doctor.
+type serverInfo struct {
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	TLSRequired  bool   `json:"tls_required"`
+	TLSAvailable bool   `json:"tls_available"`
+}
+
+// doctor prints the results of the checks and counts them.
+type doctor struct {
+	passed, warned, failed int
+}
+
+// pass reports a successful check.
+func (d *doctor) pass(check, format string, args ...any) {
+	d.passed++
+	fmt.Printf("✅ %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// warn reports a check that passed with a caveat, and what to do about it.
+func (d *doctor) warn(check, hint, format string, args ...any) {
+	d.warned++
+	fmt.Printf("⚠️  %-12s %s\n", check, fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("   → %s\n", hint)
+	}
+}
+
+// fail reports a failed check, and what to do about it.
+func (d *doctor) fail(check, hint, format string, args ...any) {
+	d.failed++
+	fmt.Printf("❌ %-12s %s\n", check, fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("   → %s\n", hint)
+	}
+}
+
+// doctorCommand runs the checks and exits with 1 when one of them failed.
+func doctorCommand(args []string) {
+	fs := newFlagSet(usageOf("doctor"))
+	subject := fs.String("subject", "natsctl.doctor", "Subject of the permissions check, published and subscribed to")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for the reply of the permissions check")
+	parseArgs(fs, args, 0, 0)
+	dialer, err := transport.NewDialer(*proxyURL, *ipVersion)
+	if err != nil {
+		usageError(fs, "%v", err)
+	}
+
+	d := &doctor{}
+	d.checkServers(dialer)
+	d.checkConnection(*subject, *timeout)
+	fmt.Printf("\n%d passed, %d warning(s), %d failed\n", d.passed, d.warned, d.failed)
+	if d.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// ─── Without Credentials ───────────────────────────────────────────────
+
+// checkServers checks the reachability and the TLS certificate of every
+// server of the -url list.
+func (d *doctor) checkServers(dialer *transport.Dialer) {
+	for _, raw := range strings.Split(*natsURL, ",") {
+		raw = strings.TrimSpace(raw)
+		if !strings.Contains(raw, "://") {
+			raw = "nats://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			d.fail("reachable", "fix the URL, e.g. nats://host:4222 or tls://host:4222", "invalid server URL %q: %v", raw, err)
+			continue
+		}
+		if u.Scheme == "ws" || u.Scheme == "wss" {
+			d.pass("reachable", "%s: WebSocket, checked by the connection below", u.Redacted())
+			continue
+		}
+		host, port := u.Hostname(), u.Port()
+		if port == "" {
+			port = "4222"
+		}
+		start := time.Now()
+		info, certs, err := probeServer(dialer, u.Scheme, host, net.JoinHostPort(host, port))
+		if err != nil {
+			d.fail("reachable", probeHint(err, *proxyURL), "%s: %v", u.Redacted(), err)
+			continue
+		}
+		d.pass("reachable", "%s (%s, v%s), INFO in %v", u.Redacted(), info.ServerName, info.Version, time.Since(start).Round(10*time.Microsecond))
+		d.checkTLS(host, info, certs)
+	}
+}
+
+// probeServer connects to address, reads the INFO of the server and, when
+// TLS is required or asked by the tls:// scheme, the certificates of the
+// server, not verified yet.
+func probeServer(dialer *transport.Dialer, scheme, host, address string) (serverInfo, []*x509.Certificate, error) {
+	var info serverInfo
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return info, nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(transport.DefaultTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return info, nil, fmt.Errorf("connected, but no NATS INFO received: %w", err)
+	}
+	payload, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return info, nil, fmt.Errorf("connected, but no NATS INFO received: got %.40q", line)
+	}
+	if err := json.Unmarshal([]byte(payload), &info); err != nil {
+		return info, nil, fmt.Errorf("invalid INFO: %w", err)
+	}
+	if !info.TLSRequired && scheme != "tls" {
+		return info, nil, nil
+	}
+	if !info.TLSRequired && !info.TLSAvailable {
+		return info, nil, errors.New("tls:// asked, but the server does not offer TLS")
+	}
+	// Verified by checkTLS, to tell what is wrong with the chain.
+	tc := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		return info, nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return info, tc.ConnectionState().PeerCertificates, nil
+}
+
+// probeHint returns what to do about the error of probeServer.
+func probeHint(err error, proxy string) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "the host name does not resolve: check the URL, or the DNS of this machine"
+	case errors.Is(err, broker.ErrPermission):
+		return "the proxy refused the credentials or this destination: check the user of -proxy and its rules"
+	case strings.Contains(err.Error(), "refused"):
+		return "nothing listens on this port: is the server running, and is it its client port (4222 by default)?"
+	case strings.Contains(err.Error(), "no NATS INFO"):
+		return "this port is not a NATS client port: monitoring (8222), cluster (6222) and WebSocket ports speak other protocols"
+	case proxy != "" && strings.Contains(err.Error(), "proxy"):
+		return "the proxy refused or failed the tunnel: check -proxy and that it allows this port"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "no answer: a firewall drops the packets, or the host is down"
+	}
+	return ""
+}
+
+// checkTLS verifies the certificate chain of host, or reports that the
+// connection is not encrypted.
+func (d *doctor) checkTLS(host string, info serverInfo, certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+			d.pass("tls", "not used, local server")
+			return
+		}
+		hint := "enable tls { } in the server configuration, then use tls:// URLs"
+		if info.TLSAvailable {
+			hint = "the server offers TLS: use a tls:// URL"
+		}
+		d.warn("tls", hint, "not used: credentials and events travel in clear to %s", host)
+		return
+	}
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	names := strings.Join(append(leaf.DNSNames, ipStrings(leaf.IPAddresses)...), ", ")
+	switch {
+	case errors.As(err, &unknown):
+		d.fail("tls", "add the CA certificate to the trust store of this machine, or have the server use a certificate of a public CA",
+			"certificate of %s issued by %s, not trusted by this machine", host, leaf.Issuer.String())
+	case errors.As(err, &hostname):
+		d.fail("tls", fmt.Sprintf("connect with one of %s, or reissue the certificate with %s", names, host),
+			"certificate valid for %s, not %s", names, host)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		d.fail("tls", "renew the certificate of the server (see the rotation in cmd/natsPubSub/credentials.go)",
+			"certificate of %s expired on %s", host, leaf.NotAfter.Format(time.DateOnly))
+	case err != nil:
+		d.fail("tls", "", "certificate of %s: %v", host, err)
+	case time.Until(leaf.NotAfter) < certRenewal:
+		d.warn("tls", "renew the certificate of the server before it expires",
+			"certificate of %s expires in %d day(s), on %s", host, int(time.Until(leaf.NotAfter).Hours()/24), leaf.NotAfter.Format(time.DateOnly))
+	default:
+		d.pass("tls", "certificate valid for %s, issued by %s, until %s", host, leaf.Issuer.String(), leaf.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// ipStrings returns the text of ips.
+func ipStrings(ips []net.IP) []string {
+	texts := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		texts = append(texts, ip.String())
+	}
+	return texts
+}
+
+// ─── With Credentials ──────────────────────────────────────────────────
+
+// checkConnection connects with the global flags and runs the checks
+// needing a connection.
+func (d *doctor) checkConnection(subject string, timeout time.Duration) {
+	asyncErrs := make(chan error, 16)
+	nc, err := dial(nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		select {
+		case asyncErrs <- err:
+		default:
+		}
+	}))
+	if err != nil {
+		d.fail("connect", connectHint(err), "%v", err)
+		return
+	}
+	defer nc.Close()
+	d.pass("connect", "connected to %s", nc.ConnectedUrlRedacted())
+
+	if rtt, err := nc.RTT(); err != nil {
+		d.fail("rtt", "", "%v", err)
+	} else if rtt >= slowRTT {
+		d.warn("rtt", "connect to a closer server of the cluster, or run a leaf node next to the clients",
+			"%v: every request and synchronous publish pays it", rtt.Round(10*time.Microsecond))
+	} else {
+		d.pass("rtt", "%v", rtt.Round(10*time.Microsecond))
+	}
+
+	version := nc.ConnectedServerVersion()
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		d.warn("version", "", "unknown server version %q", version)
+	} else if major < minServerMajor || major == minServerMajor && minor < minServerMinor {
+		d.warn("version", fmt.Sprintf("upgrade nats-server to %d.%d or later", minServerMajor, minServerMinor),
+			"v%s: consumers with several filter subjects, subject transforms and per-message TTLs need a newer server", version)
+	} else {
+		d.pass("version", "v%s", version)
+	}
+
+	d.checkJetStream(nc)
+
+	if maxPayload := nc.MaxPayload(); maxPayload < defaultMaxPayload {
+		d.warn("max-payload", "raise max_payload in the server configuration, or keep the events small (natsPubSub -compress)",
+			"%d bytes, below the default 1 MB: larger events are refused", maxPayload)
+	} else {
+		d.pass("max-payload", "%d bytes", maxPayload)
+	}
+
+	d.checkPermissions(nc, subject, timeout, asyncErrs)
+}
+
+// connectHint returns what to do about the connection error err.
+func connectHint(err error) string {
+	text := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, nats.ErrAuthorization) || strings.Contains(text, "authorization"):
+		if *credsFile != "" {
+			return fmt.Sprintf("the server refused the credentials of %s: expired or revoked user, or another account (natsctl -creds …)", *credsFile)
+		}
+		return fmt.Sprintf("the server requires credentials: -creds <file>, or %s_USER and %s_PASSWORD in the environment", *envPrefix, *envPrefix)
+	case errors.Is(err, nats.ErrNoServers):
+		return "no server reachable, see the reachable checks above"
+	case strings.Contains(text, "x509") || strings.Contains(text, "tls"):
+		return "see the tls check above"
+	case strings.Contains(text, "creds") || strings.Contains(text, "no such file"):
+		return "check the path and the content of the credentials file (natsAuth generates them)"
+	}
+	return ""
+}
+
+// checkJetStream checks JetStream is enabled for the account, and its
+// storage usage.
+func (d *doctor) checkJetStream(nc *nats.Conn) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		d.fail("jetstream", "", "%v", err)
+		return
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	account, err := js.AccountInfo(ctx)
+	switch {
+	case errors.Is(err, jetstream.ErrJetStreamNotEnabled):
+		d.warn("jetstream", "start nats-server with -js, or jetstream { } in its configuration, for streams and buckets",
+			"not enabled on the server: only core NATS is available")
+		return
+	case errors.Is(err, jetstream.ErrJetStreamNotEnabledForAccount):
+		d.warn("jetstream", "enable JetStream for the account: jetstream: enabled in its configuration, or limits in its JWT (nsc edit account --js-disk-storage …)",
+			"not enabled for this account")
+		return
+	case err != nil:
+		d.fail("jetstream", "", "%v", err)
+		return
+	}
+	detail := fmt.Sprintf("%d stream(s), %d consumer(s), %.2f MB stored", account.Streams, account.Consumers, float64(account.Store)/1e6)
+	if limit := account.Limits.MaxStore; limit > 0 && float64(account.Store) > 0.9*float64(limit) {
+		d.warn("jetstream", "raise the storage limit of the account, or tighten the retention of its streams (natsPubSub -mode advise)",
+			"%s, over 90%% of the %.2f MB allowed", detail, float64(limit)/1e6)
+		return
+	}
+	d.pass("jetstream", "%s", detail)
+}
+
+// checkPermissions publishes a request on subject, answered by a
+// subscription of the same connection: publish, subscribe and the replies
+// on the inbox must all be allowed.
+func (d *doctor) checkPermissions(nc *nats.Conn, subject string, timeout time.Duration, asyncErrs <-chan error) {
+	hint := fmt.Sprintf("ask for publish and subscribe permissions on %s (see natsctl can-i), the replies need subscribe on %s.> and publish to it",
+		subject, inboxOf(nc))
+	sub, err := nc.Subscribe(subject, func(m *nats.Msg) { _ = m.Respond(m.Data) })
+	if err != nil {
+		d.fail("permissions", hint, "subscribe to %s: %v", subject, err)
+		return
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	_ = nc.Flush()
+
+	token := []byte(nuid.Next())
+	reply, err := nc.Request(subject, token, timeout)
+	// The violations are reported asynchronously, shortly after.
+	var denied []string
+	grace := time.After(100 * time.Millisecond)
+collect:
+	for {
+		select {
+		case asyncErr := <-asyncErrs:
+			if errors.Is(asyncErr, nats.ErrPermissionViolation) {
+				denied = append(denied, asyncErr.Error())
+			}
+		case <-grace:
+			break collect
+		}
+	}
+	switch {
+	case len(denied) > 0:
+		d.fail("permissions", hint, "%s", strings.Join(denied, "; "))
+	case errors.Is(err, nats.ErrNoResponders):
+		d.fail("permissions", hint, "no subscriber received the request on %s: subscribe denied?", subject)
+	case err != nil:
+		d.fail("permissions", hint, "request on %s: %v", subject, err)
+	case string(reply.Data) != string(token):
+		d.warn("permissions", "choose a subject of your own with -subject", "%s already has another responder", subject)
+	default:
+		d.pass("permissions", "publish, subscribe and request/reply allowed on %s", subject)
+	}
+}
+
+// inboxOf returns the prefix of the reply inboxes of nc.
+func inboxOf(nc *nats.Conn) string {
+	inbox := nc.NewInbox()
+	return inbox[:strings.LastIndex(inbox, ".")]
+}
@@ -0,0 +1,81 @@
+// fleet.go — "fleet" sub-command: the long-running components alive.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/heartbeat"
+)
+
+// fleetCommand lists the components alive, from their heartbeats (see
+// pkg/heartbeat): it pings them all, then listens to the replies and the
+// heartbeats during -wait.
+func fleetCommand(args []string) {
+	fs := newFlagSet(usageOf("fleet"))
+	wait := fs.Duration("wait", 2*time.Second, "How long replies and heartbeats are collected")
+	parseArgs(fs, args, 0, 0)
+
+	nc := connect()
+	defer nc.Close()
+
+	type seen struct {
+		status heartbeat.Status
+		at     time.Time
+	}
+	beats := make(chan *nats.Msg, 256)
+	hbSub, err := nc.ChanSubscribe(heartbeat.SubjectPrefix+".>", beats)
+	if err != nil {
+		l.Fatalf("💥 Failed to subscribe to the heartbeats: %v", err)
+	}
+	defer func() { _ = hbSub.Unsubscribe() }()
+	inbox := nc.NewInbox()
+	pongSub, err := nc.ChanSubscribe(inbox, beats)
+	if err != nil {
+		l.Fatalf("💥 Failed to subscribe to the ping replies: %v", err)
+	}
+	defer func() { _ = pongSub.Unsubscribe() }()
+	if err := nc.PublishRequest(heartbeat.PingSubject, inbox, nil); err != nil {
+		l.Printf("💥 Failed to ping the components: %v", err)
+		os.Exit(exitPublish)
+	}
+
+	fleet := make(map[string]seen)
+	deadline := time.After(*wait)
+collect:
+	for {
+		select {
+		case m := <-beats:
+			status, err := heartbeat.Decode(m.Data)
+			if err != nil {
+				continue // no responders status, or not a heartbeat
+			}
+			fleet[status.Name] = seen{status: status, at: time.Now()}
+		case <-deadline:
+			break collect
+		}
+	}
+
+	now := time.Now()
+	var names []string
+	for name, s := range fleet {
+		if s.status.Alive(s.at, now) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("No component alive")
+		return
+	}
+	sort.Strings(names)
+	fmt.Printf("%-28s %-10s %-20s %-16s %7s %10s %10s %10s\n", "NAME", "MODE", "SUBJECT", "HOST", "PID", "UPTIME", "RECEIVED", "PUBLISHED")
+	for _, name := range names {
+		s := fleet[name].status
+		fmt.Printf("%-28s %-10s %-20s %-16s %7d %10v %10d %10d\n", s.Name, s.Mode, s.Subject, s.Host, s.PID,
+			now.Sub(s.StartedAt).Round(time.Second), s.Received, s.Published)
+	}
+}
@@ -0,0 +1,282 @@
+// init.go — "init" sub-command: first-time setup wizard.
+//
+// FROM ZERO TO A WORKING CONTEXT:
+//
+//	A newcomer has to find the URL of the server, the way to authenticate,
+//	whether JetStream is enabled, then learn "ctx add" before the first
+//	"stream ls" works. "init" asks these questions one by one, checks the
+//	answers against the server, and saves them as a context (see
+//	context.go) used by the other commands from then on:
+//
+//	  natsctl init                 # interactive, saves the context "default"
+//	  natsctl init staging -yes    # every default answer, for scripts
+//
+//	Each question shows its default answer in brackets, taken from the
+//	global flags, NATS_URL and the selected context: Enter keeps it.
+//
+// WHAT IT CHECKS AND CREATES:
+//
+//	The connection is tried with the answers, and asked again on failure;
+//	the server name, version, round trip time and maximum payload are
+//	printed. With JetStream, it creates the stream DEMO on the subjects
+//	demo.> (24h of retention) and stores a first CloudEvent in it, ready
+//	for "natsctl sub demo.>" or "natsctl stream info DEMO".
+//
+// CREDENTIALS:
+//
+//	As for any context, no secret is saved: a credentials file is stored
+//	as its path, a user and password are read from the environment
+//	variables <PREFIX>_USER and <PREFIX>_PASSWORD, which must be set
+//	before running "init".
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// demoStream is the stream created by init, on the subjects demoSubjects.
+	demoStream   = "DEMO"
+	demoSubjects = "demo.>"
+	demoSubject  = "demo.hello"
+)
+
+// Authentication methods offered by init.
+const (
+	authNone  = "none"
+	authCreds = "creds"
+	authUser  = "user"
+)
+
+// wizard asks the questions of init on stderr, stdout being kept for the
+// results, and reads the answers on stdin.
+type wizard struct {
+	in       *bufio.Reader
+	defaults bool // -yes: every answer is the default one
+}
+
+// ask returns the answer to question, def when empty or at the end of the
+// input.
+func (w *wizard) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	if w.defaults {
+		fmt.Fprintln(os.Stderr, def)
+		return def
+	}
+	line, err := w.in.ReadString('\n')
+	if errors.Is(err, io.EOF) && line == "" {
+		fmt.Fprintln(os.Stderr)
+		w.defaults = true // no more answers to read
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	return def
+}
+
+// choose asks question until the answer is one of choices.
+func (w *wizard) choose(question string, choices []string, def string) string {
+	for {
+		answer := w.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", ")), def)
+		if slices.Contains(choices, answer) {
+			return answer
+		}
+		fmt.Fprintf(os.Stderr, "Please answer one of %s.\n", strings.Join(choices, ", "))
+	}
+}
+
+// confirm asks a yes/no question.
+func (w *wizard) confirm(question string, def bool) bool {
+	answer := "n"
+	if def {
+		answer = "y"
+	}
+	return w.choose(question, []string{"y", "n"}, answer) == "y"
+}
+
+// initCommand walks through the setup of a context, checking it against the
+// server.
+func initCommand(args []string) {
+	fs := newFlagSet(usageOf("init"))
+	yes := fs.Bool("yes", false, "Accept every default answer without asking, for scripts")
+	pos := parseArgs(fs, args, 0, 1)
+	name := "default"
+	if len(pos) == 1 {
+		name = pos[0]
+	}
+	if !contextName.MatchString(name) {
+		usageError(fs, "invalid context name %q (letters, digits, '.', '_' and '-')", name)
+	}
+	w := &wizard{in: bufio.NewReader(os.Stdin), defaults: *yes}
+	fmt.Fprintf(os.Stderr, "👋 %s v%s setup: press Enter to keep the [default] answers.\n\n", APP, VERSION)
+
+	nc := askConnection(w)
+	defer nc.Close()
+
+	js, jsErr := jetstream.New(nc)
+	var account *jetstream.AccountInfo
+	if jsErr == nil {
+		ctx, cancel := apiContext()
+		account, jsErr = js.AccountInfo(ctx)
+		cancel()
+	}
+	if w.confirm("Is JetStream enabled on this server", jsErr == nil) {
+		if jsErr != nil {
+			l.Printf("⚠️  JetStream is not available to this account: %v", jsErr)
+			l.Printf("   start the server with -js, or enable it for the account, then run init again")
+		} else {
+			l.Printf("✅ JetStream: %d stream(s), %.2f MB of file storage used", account.Streams, float64(account.Store)/1e6)
+			if w.confirm(fmt.Sprintf("Create the demo stream %s on %s", demoStream, demoSubjects), true) {
+				createDemo(js)
+			}
+		}
+	}
+
+	fmt.Fprintln(os.Stderr)
+	for {
+		name = w.ask("Save as context", name)
+		if contextName.MatchString(name) {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "Please use letters, digits, '.', '_' and '-' only.")
+		name = "default"
+	}
+	c := natsContext{Description: "created by natsctl init", URL: *natsURL, InboxPrefix: *inboxPrefix}
+	if *credsFile != "" {
+		c.Creds = *credsFile
+	} else if os.Getenv(*envPrefix+"_USER") != "" {
+		c.EnvPrefix = *envPrefix
+	}
+	if err := saveContext(name, c); err != nil {
+		l.Fatalf("💥 Failed to save context %q: %v", name, err)
+	}
+	fmt.Printf("Context %q saved in %s\n", name, contextPath("contexts", name+".json"))
+	if w.confirm("Use it by default", true) {
+		if err := os.WriteFile(contextPath(currentContextFile), []byte(name+"\n"), 0o600); err != nil {
+			l.Fatalf("💥 Failed to select context %q: %v", name, err)
+		}
+		fmt.Printf("Using context %q\n", name)
+	}
+
+	fmt.Fprintln(os.Stderr, "\n🚀 Ready. Try:")
+	fmt.Fprintf(os.Stderr, "  %s sub %q\n", APP, demoSubjects)
+	fmt.Fprintf(os.Stderr, "  %s pub %s '{\"hello\":\"world\"}'\n", APP, demoSubject)
+	if jsErr == nil {
+		fmt.Fprintf(os.Stderr, "  %s stream info %s\n", APP, demoStream)
+	}
+}
+
+// askConnection asks the URL and the authentication method until the
+// connection succeeds, setting the global flags to the answers.
+func askConnection(w *wizard) *nats.Conn {
+	for {
+		*natsURL = w.ask("NATS server URL", *natsURL)
+		method := authNone
+		switch {
+		case *credsFile != "":
+			method = authCreds
+		case os.Getenv(*envPrefix+"_USER") != "":
+			method = authUser
+		}
+		switch w.choose("Authentication", []string{authNone, authCreds, authUser}, method) {
+		case authNone:
+			*credsFile = ""
+			*envPrefix = "" // no <PREFIX>_USER to pick up
+		case authCreds:
+			path := w.ask("Credentials file", *credsFile)
+			abs, err := filepath.Abs(path)
+			if _, statErr := os.Stat(abs); path == "" || err != nil || statErr != nil {
+				l.Printf("❌ Credentials file %q not found", path)
+				w.retry()
+				continue
+			}
+			*credsFile = abs
+		case authUser:
+			*credsFile = ""
+			*envPrefix = w.ask("Prefix of the <PREFIX>_USER and <PREFIX>_PASSWORD environment variables", cmp.Or(*envPrefix, "NATS"))
+			if os.Getenv(*envPrefix+"_USER") == "" || os.Getenv(*envPrefix+"_PASSWORD") == "" {
+				l.Printf("❌ %s_USER and %s_PASSWORD must be set in the environment, passwords are never stored", *envPrefix, *envPrefix)
+				w.retry()
+				continue
+			}
+		}
+
+		start := time.Now()
+		nc, err := dial()
+		if err != nil {
+			l.Printf("❌ Failed to connect to %s: %v", *natsURL, err)
+			w.retry()
+			continue
+		}
+		rtt, err := nc.RTT()
+		if err != nil {
+			rtt = time.Since(start)
+		}
+		l.Printf("✅ Connected to %s (%s, server v%s), round trip %v, max payload %d bytes",
+			nc.ConnectedUrlRedacted(), nc.ConnectedServerName(), nc.ConnectedServerVersion(),
+			rtt.Round(10*time.Microsecond), nc.MaxPayload())
+		return nc
+	}
+}
+
+// retry gives up when the answers are not read from the user, as asking
+// again would loop on the same answers.
+func (w *wizard) retry() {
+	if w.defaults {
+		os.Exit(exitConnection)
+	}
+	fmt.Fprintln(os.Stderr, "Let's try again.")
+}
+
+// createDemo creates the demo stream when missing and stores a first event.
+func createDemo(js jetstream.JetStream) {
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:        demoStream,
+		Description: "Demo stream created by natsctl init",
+		Subjects:    []string{demoSubjects},
+		Storage:     jetstream.FileStorage,
+		MaxAge:      24 * time.Hour,
+	})
+	switch {
+	case errors.Is(err, jetstream.ErrStreamNameAlreadyInUse):
+		l.Printf("ℹ️  Stream %s already exists, kept as is", demoStream)
+	case err != nil:
+		l.Printf("⚠️  Failed to create the stream %s: %v", demoStream, err)
+		return
+	default:
+		l.Printf("✅ Stream %s created on %s", demoStream, demoSubjects)
+	}
+	m := nats.NewMsg(demoSubject)
+	m.Header.Set("ce-specversion", "1.0")
+	m.Header.Set("ce-type", "demo.hello")
+	m.Header.Set("ce-source", APP+"/init")
+	m.Header.Set("ce-id", nuid.Next())
+	m.Header.Set("ce-time", time.Now().UTC().Format(time.RFC3339Nano))
+	m.Header.Set("Content-Type", "application/json")
+	m.Data = []byte(`{"hello":"world"}`)
+	ack, err := js.PublishMsg(ctx, m)
+	if err != nil {
+		l.Printf("⚠️  Failed to publish on %s: %v", demoSubject, err)
+		return
+	}
+	l.Printf("✅ First event stored in %s at sequence %d", ack.Stream, ack.Sequence)
+}
@@ -0,0 +1,148 @@
+// lvc.go — "lvc" sub-command: last value cache of a stream.
+//
+// MATERIALIZED VIEW:
+//
+//	A stream keeps the history of every subject; most readers only want
+//	the current state: the last price per instrument, the last position
+//	per vehicle, the last status per order. "lvc" reads the last message of
+//	every subject of the stream (one direct get each when the stream
+//	allows it, served by any replica) and prints them as one JSON object:
+//
+//	  natsctl lvc PRICES -filter "prices.eur.>"
+//	  {"prices.eur.btc": {"sequence": 1042, "time": "…", "data": {"bid": 61250.5}}, …}
+//
+//	-kv writes the view into a key-value bucket (created with a history
+//	of 1 when missing), one key per subject, for the services reading the
+//	state with a simple "kv get" instead of scanning the stream:
+//
+//	  natsctl lvc PRICES -kv PRICES_LAST && natsctl kv get PRICES_LAST prices.eur.btc
+//
+// COMPACTION:
+//
+//	-compact sets max_msgs_per_subject to 1 on the stream: the server
+//	deletes the older messages at once and keeps the stream itself as the
+//	last value cache from then on. The history is lost for good.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// validKey matches the keys accepted by a key-value bucket.
+var validKey = regexp.MustCompile(`^[-/_=.a-zA-Z0-9]+$`)
+
+// lastValue is the last message of a subject in the view.
+type lastValue struct {
+	Sequence uint64              `json:"sequence"`
+	Time     time.Time           `json:"time"`
+	Header   map[string][]string `json:"header,omitempty"`
+	Data     json.RawMessage     `json:"data"` // as is when JSON, else a JSON string
+	raw      []byte              // the payload, written to the bucket
+}
+
+// lvcCommand prints the last message of every subject of a stream, and
+// optionally stores them in a bucket or compacts the stream.
+func lvcCommand(args []string) {
+	fs := newFlagSet(usageOf("lvc"))
+	filter := fs.String("filter", ">", "Only the subjects of the stream matching this pattern")
+	bucket := fs.String("kv", "", "Key-value bucket receiving the last value of every subject, created when missing")
+	compact := fs.Bool("compact", false, "Keep only the last message per subject in the stream (max_msgs_per_subject=1), deleting the older ones")
+	pos := parseArgs(fs, args, 1, 1)
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := stopContext()
+	defer cancel()
+
+	callCtx, callCancel := apiContext()
+	s, err := js.Stream(callCtx, pos[0])
+	if err != nil {
+		l.Fatalf("💥 Stream %q: %v", pos[0], err)
+	}
+	info, err := s.Info(callCtx, jetstream.WithSubjectFilter(*filter))
+	callCancel()
+	if err != nil {
+		l.Fatalf("💥 Failed to list the subjects of %q: %v", pos[0], err)
+	}
+
+	view := make(map[string]lastValue, len(info.State.Subjects))
+	for subject := range info.State.Subjects {
+		callCtx, callCancel := context.WithTimeout(ctx, apiTimeout)
+		m, err := s.GetLastMsgForSubject(callCtx, subject)
+		callCancel()
+		if ctx.Err() != nil {
+			l.Fatalf("💥 Interrupted after %d of %d subjects", len(view), len(info.State.Subjects))
+		}
+		if err != nil {
+			l.Printf("⚠️  Last message of %q: %v", subject, err)
+			continue
+		}
+		data := json.RawMessage(m.Data)
+		if !json.Valid(m.Data) {
+			data, _ = json.Marshal(string(m.Data))
+		}
+		view[subject] = lastValue{Sequence: m.Sequence, Time: m.Time, Header: m.Header, Data: data, raw: m.Data}
+	}
+
+	if *bucket != "" {
+		writeLastValues(ctx, js, *bucket, s, view)
+	}
+	if *compact {
+		compactStream(ctx, js, s)
+	}
+	printJSON(view)
+}
+
+// writeLastValues puts the data of every subject of view under the key of
+// the same name in bucket, created when missing.
+func writeLastValues(ctx context.Context, js jetstream.JetStream, bucket string, s jetstream.Stream, view map[string]lastValue) {
+	callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	kv, err := js.KeyValue(callCtx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		cfg := s.CachedInfo().Config
+		kv, err = js.CreateKeyValue(callCtx, jetstream.KeyValueConfig{
+			Bucket:      bucket,
+			Description: fmt.Sprintf("Last value per subject of the stream %s", cfg.Name),
+			History:     1,
+			Storage:     cfg.Storage,
+			Replicas:    cfg.Replicas,
+		})
+	}
+	if err != nil {
+		l.Fatalf("💥 Bucket %q: %v", bucket, err)
+	}
+	var written int
+	for subject, v := range view {
+		if !validKey.MatchString(subject) {
+			l.Printf("⚠️  Subject %q is not a valid key, skipped", subject)
+			continue
+		}
+		if _, err := kv.Put(ctx, subject, v.raw); err != nil {
+			l.Fatalf("💥 Failed to put %q: %v", subject, err)
+		}
+		written++
+	}
+	l.Printf("🗂️  %d last values written to the bucket %q", written, bucket)
+}
+
+// compactStream keeps only the last message of every subject of s.
+func compactStream(ctx context.Context, js jetstream.JetStream, s jetstream.Stream) {
+	cfg := s.CachedInfo().Config
+	if cfg.MaxMsgsPerSubject == 1 {
+		return
+	}
+	cfg.MaxMsgsPerSubject = 1
+	callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if _, err := js.UpdateStream(callCtx, cfg); err != nil {
+		l.Fatalf("💥 Failed to compact %q: %v", cfg.Name, err)
+	}
+	l.Printf("🗜️  Stream %q compacted: only the last message per subject is kept from now on", cfg.Name)
+}
@@ -0,0 +1,400 @@
+// migrate.go — "migrate" sub-command: moving a durable consumer to a new stream.
+//
+// CHANGING THE STREAM LAYOUT UNDER A RUNNING CONSUMER:
+//
+//	A stream is split by region, its subjects renamed (orders.* becoming
+//	v2.orders.*), or its events copied into a new stream with other limits,
+//	usually by sourcing the old one, so both hold the same events for a
+//	while. The durable consumers of the old stream must then go on in the
+//	new one exactly where they are: a new consumer delivering "all"
+//	handles the history again, one delivering "new" skips what arrived
+//	meanwhile. "migrate" finds the right sequence:
+//
+//	  natsctl migrate ORDERS billing ORDERS_V2 -filter "v2.orders.>" -dry-run
+//	  natsctl migrate ORDERS billing ORDERS_V2 -filter "v2.orders.>"
+//
+// THE STEPS:
+//
+//	(1) pause the old consumer (NATS 2.11, or stop its instances and use
+//	    -no-pause), then wait until its in-flight messages are acknowledged;
+//	(2) record the cutover: the last stream sequence it delivered;
+//	(3) find in the new stream the first event it did not handle, by its
+//	    id (Nats-Msg-Id, ce-id or the "id" of a structured CloudEvent),
+//	    among the events stored within -window of it;
+//	(4) verify the overlap: -verify events on each side of the cutover are
+//	    looked up in the new stream, the handled ones must all be before
+//	    the start sequence (no duplicate), the others all from it on (no
+//	    loss);
+//	(5) create the new durable consumer, with the settings of the old one,
+//	    delivering from the start sequence, the cutover recorded in its
+//	    metadata.
+//
+//	Any failure resumes the old consumer and changes nothing. On success
+//	the old consumer is kept, paused, for a rollback: remove it with
+//	"natsctl consumer rm" once the instances run on the new one.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// migratePause is how long the old consumer is paused: until removed.
+	migratePause = 365 * 24 * time.Hour
+	// migratePoll is the delay between two checks of the in-flight messages.
+	migratePoll = 250 * time.Millisecond
+)
+
+// streamEvent is an event of a stream, located by its sequence and time.
+type streamEvent struct {
+	seq  uint64
+	id   string
+	time time.Time
+}
+
+// migrateCommand moves a durable consumer to a new stream, without loss or
+// duplication of the events both streams hold.
+func migrateCommand(args []string) {
+	fs := newFlagSet(usageOf("migrate"))
+	filter := fs.String("filter", "", "Comma separated subject filters of the new consumer, those of the old one by default")
+	durable := fs.String("durable", "", "Name of the new durable consumer, the name of the old one by default")
+	window := fs.Duration("window", 5*time.Minute, "How far apart in time the two copies of an event may have been stored")
+	verify := fs.Int("verify", 100, "Events looked up in the new stream on each side of the cutover")
+	drainTimeout := fs.Duration("drain-timeout", time.Minute, "How long the in-flight messages of the old consumer may take to be acknowledged")
+	noPause := fs.Bool("no-pause", false, "Do not pause the old consumer (servers before 2.11): its instances must be stopped beforehand")
+	dryRun := fs.Bool("dry-run", false, "Only find and verify the cutover, change nothing")
+	pos := parseArgs(fs, args, 3, 3)
+	if *verify < 1 || *window <= 0 {
+		usageError(fs, "-verify and -window must be positive")
+	}
+	oldStream, oldName, newStream := pos[0], pos[1], pos[2]
+	newName := cmp.Or(*durable, oldName)
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := stopContext()
+	defer cancel()
+
+	callCtx, callCancel := apiContext()
+	old, err := js.Consumer(callCtx, oldStream, oldName)
+	if err != nil {
+		callCancel()
+		l.Fatalf("💥 Consumer %q of %q: %v", oldName, oldStream, err)
+	}
+	cfg := old.CachedInfo().Config
+	oldS, err := js.Stream(callCtx, oldStream)
+	if err != nil {
+		callCancel()
+		l.Fatalf("💥 Stream %q: %v", oldStream, err)
+	}
+	newS, err := js.Stream(callCtx, newStream)
+	if err != nil {
+		callCancel()
+		l.Fatalf("💥 Stream %q: %v", newStream, err)
+	}
+	if _, err := newS.Consumer(callCtx, newName); err == nil {
+		callCancel()
+		l.Fatalf("💥 Consumer %q already exists in %q, choose another -durable", newName, newStream)
+	}
+	callCancel()
+	if cfg.AckPolicy == jetstream.AckNonePolicy {
+		l.Fatalf("💥 Consumer %q acknowledges nothing: what it handled is unknown", oldName)
+	}
+	oldFilters := cfg.FilterSubjects
+	if cfg.FilterSubject != "" {
+		oldFilters = []string{cfg.FilterSubject}
+	}
+	newFilters := oldFilters
+	if *filter != "" {
+		newFilters = strings.Split(*filter, ",")
+	}
+
+	// ─── 1. Pause and Drain ────────────────────────────────────────────
+	paused := false
+	abort := func(format string, args ...any) {
+		if paused {
+			resumeCtx, resumeCancel := apiContext()
+			if _, err := js.ResumeConsumer(resumeCtx, oldStream, oldName); err != nil {
+				l.Printf("⚠️  Failed to resume %q, run: natsctl consumer info %s %s: %v", oldName, oldStream, oldName, err)
+			} else {
+				l.Printf("▶️  Consumer %q resumed", oldName)
+			}
+			resumeCancel()
+		}
+		l.Fatalf("💥 "+format, args...)
+	}
+	if !*dryRun && !*noPause {
+		callCtx, callCancel := apiContext()
+		_, err := js.PauseConsumer(callCtx, oldStream, oldName, time.Now().Add(migratePause))
+		callCancel()
+		if err != nil {
+			l.Fatalf("💥 Failed to pause %q: %v\n   → before NATS 2.11, stop its instances and use -no-pause", oldName, err)
+		}
+		paused = true
+		l.Printf("⏸️  Consumer %q of %q paused", oldName, oldStream)
+	}
+	cutover, err := drainConsumer(ctx, old, *drainTimeout, *dryRun)
+	if err != nil {
+		abort("%v", err)
+	}
+
+	// ─── 2 and 3. Cutover and Start Sequence ───────────────────────────
+	n := uint64(*verify)
+	handled, err := streamEvents(ctx, oldS, oldFilters, cutover-min(cutover, n-1), cutover, *verify)
+	if err == nil && cutover == 0 {
+		handled = nil
+	}
+	var pending []streamEvent
+	if err == nil {
+		pending, err = streamEvents(ctx, oldS, oldFilters, cutover+1, 0, *verify)
+	}
+	if err != nil {
+		abort("Failed to read %q: %v", oldStream, err)
+	}
+	if len(handled)+len(pending) == 0 {
+		abort("No event of %q around the sequence %d to align %q on: create the consumer by hand", oldStream, cutover, newStream)
+	}
+	for _, ev := range append(handled, pending...) {
+		if ev.id == "" {
+			abort("The event %d of %q has no id (Nats-Msg-Id, ce-id): the streams cannot be aligned", ev.seq, oldStream)
+		}
+	}
+	found, err := findEvents(ctx, newS, newFilters, append(handled, pending...), *window)
+	if err != nil {
+		abort("Failed to read %q: %v", newStream, err)
+	}
+
+	var start uint64
+	var anchor streamEvent
+	if len(pending) > 0 {
+		anchor = pending[0]
+		seq, ok := found[anchor.id]
+		if !ok {
+			abort("The first event to handle, %s (sequence %d of %q), is not in %q (yet?): it would be lost", anchor.id, anchor.seq, oldStream, newStream)
+		}
+		start = seq
+	} else {
+		anchor = handled[len(handled)-1]
+		seq, ok := found[anchor.id]
+		if !ok {
+			abort("The last event handled, %s (sequence %d of %q), is not in %q (yet?)", anchor.id, anchor.seq, oldStream, newStream)
+		}
+		start = seq + 1
+	}
+	fmt.Printf("Cutover:  %s/%s handled up to the sequence %d\n", oldStream, oldName, cutover)
+	fmt.Printf("Start:    %s/%s delivers from the sequence %d (anchored on %s)\n", newStream, newName, start, anchor.id)
+
+	// ─── 4. Overlap ────────────────────────────────────────────────────
+	var duplicates, lost []string
+	for _, ev := range handled {
+		if seq, ok := found[ev.id]; ok && seq >= start {
+			duplicates = append(duplicates, fmt.Sprintf("%s (%d → %d)", ev.id, ev.seq, seq))
+		}
+	}
+	for _, ev := range pending {
+		if seq, ok := found[ev.id]; !ok || seq < start {
+			lost = append(lost, fmt.Sprintf("%s (%d)", ev.id, ev.seq))
+		}
+	}
+	fmt.Printf("Verified: %d handled events, %d to handle\n", len(handled), len(pending))
+	if len(duplicates)+len(lost) > 0 {
+		if len(duplicates) > 0 {
+			l.Printf("❌ Handled again from the sequence %d: %s", start, strings.Join(duplicates, ", "))
+		}
+		if len(lost) > 0 {
+			l.Printf("❌ Not delivered from the sequence %d: %s", start, strings.Join(lost, ", "))
+		}
+		abort("The two streams do not hold the events in the same order around the cutover")
+	}
+	l.Printf("✅ No duplicate and no loss around the cutover")
+	if *dryRun {
+		return
+	}
+
+	// ─── 5. New Consumer ───────────────────────────────────────────────
+	newCfg := cfg
+	newCfg.Name, newCfg.Durable = "", newName
+	newCfg.FilterSubject, newCfg.FilterSubjects = "", nil
+	if len(newFilters) == 1 {
+		newCfg.FilterSubject = newFilters[0]
+	} else {
+		newCfg.FilterSubjects = newFilters
+	}
+	newCfg.DeliverPolicy, newCfg.OptStartSeq, newCfg.OptStartTime = jetstream.DeliverByStartSequencePolicy, start, nil
+	newCfg.PauseUntil = nil
+	newCfg.Metadata = maps.Clone(cfg.Metadata)
+	if newCfg.Metadata == nil {
+		newCfg.Metadata = make(map[string]string)
+	}
+	newCfg.Metadata["migrated_from"] = oldStream + "/" + oldName
+	newCfg.Metadata["cutover_sequence"] = strconv.FormatUint(cutover, 10)
+	newCfg.Metadata["cutover_time"] = time.Now().UTC().Format(time.RFC3339)
+	callCtx, callCancel = apiContext()
+	_, err = js.CreateConsumer(callCtx, newStream, newCfg)
+	callCancel()
+	if err != nil {
+		abort("Failed to create %q in %q: %v", newName, newStream, err)
+	}
+	fmt.Printf("Consumer %q created in %q\n", newName, newStream)
+	if paused {
+		l.Printf("ℹ️  %q is kept paused in %q for a rollback: natsctl consumer rm %s %s once the instances run on %q", oldName, oldStream, oldStream, oldName, newStream)
+	} else {
+		l.Printf("ℹ️  Keep the instances of %q stopped, and start them on %q", oldName, newStream)
+	}
+}
+
+// drainConsumer waits until the consumer has no message in flight and
+// returns the last stream sequence it delivered. With dryRun it does not
+// wait, and returns its acknowledgement floor.
+func drainConsumer(ctx context.Context, c jetstream.Consumer, timeout time.Duration, dryRun bool) (uint64, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+		info, err := c.Info(callCtx)
+		cancel()
+		switch {
+		case err != nil:
+			return 0, err
+		case info.NumAckPending == 0:
+			return info.Delivered.Stream, nil
+		case dryRun:
+			l.Printf("ℹ️  %d messages in flight, the cutover is their acknowledgement floor", info.NumAckPending)
+			return info.AckFloor.Stream, nil
+		case time.Now().After(deadline):
+			return 0, fmt.Errorf("%d messages still in flight after %v: are the instances stuck? (see -drain-timeout)", info.NumAckPending, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, errors.New("interrupted")
+		case <-time.After(migratePoll):
+		}
+	}
+}
+
+// streamEvents returns the events of the stream matching filters from the
+// sequence first to last (0 for the end of the stream), limit at most.
+func streamEvents(ctx context.Context, s jetstream.Stream, filters []string, first, last uint64, limit int) ([]streamEvent, error) {
+	var events []streamEvent
+	err := scanStream(ctx, s, filters, first, func(m *jetstream.RawStreamMsg) bool {
+		if last > 0 && m.Sequence > last {
+			return false
+		}
+		events = append(events, streamEvent{seq: m.Sequence, id: eventID(m), time: m.Time})
+		return len(events) < limit
+	})
+	return events, err
+}
+
+// findEvents returns the sequences of the events of the stream whose ids
+// are those of events, looked up among the events stored within window of
+// theirs.
+func findEvents(ctx context.Context, s jetstream.Stream, filters []string, events []streamEvent, window time.Duration) (map[string]uint64, error) {
+	wanted := make(map[string]bool, len(events))
+	from, to := events[0].time, events[0].time
+	for _, ev := range events {
+		wanted[ev.id] = true
+		from, to = minTime(from, ev.time), maxTime(to, ev.time)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	info, err := s.Info(callCtx)
+	var first uint64
+	if err == nil {
+		first, err = firstSeqAt(callCtx, s, info.State, from.Add(-window))
+	}
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]uint64, len(events))
+	err = scanStream(ctx, s, filters, first, func(m *jetstream.RawStreamMsg) bool {
+		if id := eventID(m); wanted[id] {
+			if _, dup := found[id]; !dup {
+				found[id] = m.Sequence
+			}
+		}
+		return len(found) < len(wanted) && !m.Time.After(to.Add(window))
+	})
+	return found, err
+}
+
+// scanStream calls visit with the messages of the stream matching filters
+// (all of them when empty) from the sequence first, until it returns false
+// or the end of the stream.
+func scanStream(ctx context.Context, s jetstream.Stream, filters []string, first uint64, visit func(m *jetstream.RawStreamMsg) bool) error {
+	subject := ">"
+	if len(filters) == 1 {
+		subject = filters[0]
+	}
+	for seq := max(first, 1); ; {
+		callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+		m, err := s.GetMsg(callCtx, seq, jetstream.WithGetMsgSubject(subject))
+		cancel()
+		switch {
+		case errors.Is(err, jetstream.ErrMsgNotFound):
+			return nil
+		case ctx.Err() != nil:
+			return fmt.Errorf("interrupted at the sequence %d", seq)
+		case err != nil:
+			return err
+		}
+		seq = m.Sequence + 1
+		if len(filters) > 1 && !coveredByAny(filters, m.Subject) {
+			continue
+		}
+		if !visit(m) {
+			return nil
+		}
+	}
+}
+
+// coveredByAny reports whether one of the patterns covers subject.
+func coveredByAny(patterns []string, subject string) bool {
+	for _, p := range patterns {
+		if subjectCovers(p, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventID returns the id of the event: its Nats-Msg-Id, its CloudEvents
+// id in binary or structured mode, "" when it has none.
+func eventID(m *jetstream.RawStreamMsg) string {
+	for _, name := range []string{"Nats-Msg-Id", "ce-id", "Ce-Id"} {
+		if id := m.Header.Get(name); id != "" {
+			return id
+		}
+	}
+	if strings.HasPrefix(m.Header.Get("Content-Type"), "application/cloudevents+json") {
+		var ev struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(m.Data, &ev) == nil {
+			return ev.ID
+		}
+	}
+	return ""
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
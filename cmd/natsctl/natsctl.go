@@ -0,0 +1,285 @@
+// natsctl.go — Day-to-day NATS command line, organized in sub-commands.
+//
+// PURPOSE:
+//
+//	natsPubSub grew one -mode per feature behind a single flat set of
+//	flags, fine for long-running services but clumsy at the terminal.
+//	natsctl offers the everyday operations as sub-commands, each with its
+//	own flags, and shell completion of the names known by the server:
+//
+//	  natsctl init                      # first-time setup wizard
+//	  natsctl doctor                    # what is wrong with the connection
+//	  natsctl pub orders.created '{"id":1}' -count 3
+//	  natsctl sub "orders.>" -queue workers
+//	  natsctl req time.now ""
+//	  natsctl stream ls | info ORDERS | rm ORDERS
+//	  natsctl consumer ls ORDERS | info ORDERS billing | rm ORDERS billing
+//	  natsctl kv ls | keys CONFIG | get CONFIG key | put CONFIG key value | del CONFIG key
+//	  natsctl lvc PRICES -kv PRICES_LAST
+//	  natsctl purge ORDERS -subject "orders.test.>" -before 720h
+//	  natsctl forget "users.123.>"
+//	  natsctl migrate ORDERS billing ORDERS_V2 -filter "v2.orders.>" -dry-run
+//	  natsctl bench orders.bench -msgs 100000 -size 128
+//	  natsctl monitor -monitor-url http://127.0.0.1:8222
+//	  natsctl fleet
+//	  natsctl can-i pub orders.created -config server.conf -user alice
+//
+// CONNECTION:
+//
+//	The global flags come before the sub-command:
+//	  natsctl -url nats://prod:4222 -creds ./nats_auth/app_user.creds stream ls
+//	Without -creds, the <PREFIX>_USER and <PREFIX>_PASSWORD variables are
+//	used when they are set (see -env-prefix), and NATS_URL replaces the
+//	default URL. Named contexts store these flags (see context.go):
+//	  natsctl ctx add prod -url nats://prod:4222 -creds ./prod.creds && natsctl ctx use prod
+//	Behind a firewall only letting out 443, the WebSocket port of the
+//	server and -proxy reach it (see pkg/transport):
+//	  natsctl -url wss://nats.example.com:443 -proxy http://proxy.corp:3128 stream ls
+//
+// SHELL COMPLETION:
+//
+//	  source <(natsctl completion bash)     # or zsh, fish
+//
+//	Sub-commands are completed offline; stream, consumer and bucket names
+//	and subjects are queried live from the server (see completion.go).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/transport"
+)
+
+const (
+	APP        = "natsctl"
+	VERSION    = "0.1.0"
+	REPOSITORY = "https://github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats"
+	// apiTimeout bounds one JetStream API call.
+	apiTimeout = 10 * time.Second
+)
+
+// command is a natsctl sub-command.
+type command struct {
+	name  string
+	usage string
+	verbs []string // second level words, for the usage and the completion
+	run   func(args []string)
+}
+
+// commands lists the sub-commands, in the order of the usage.
+var commands []command
+
+func init() {
+	// Assigned in init: completion reads commands, which would otherwise
+	// be an initialization cycle.
+	commands = []command{
+		{name: "init", usage: "init [context] [-yes]", run: initCommand},
+		{name: "doctor", usage: "doctor [-subject s] [-timeout d]", run: doctorCommand},
+		{name: "pub", usage: "pub <subject> <message> [-count n] [-header k=v]", run: pubCommand},
+		{name: "sub", usage: `sub <subject> [-queue group] [-count n]`, run: subCommand},
+		{name: "req", usage: "req <subject> <message> [-timeout d] [-retry-on-no-responder]", run: reqCommand},
+		{name: "stream", usage: "stream ls | info <stream> | rm <stream>", verbs: []string{"ls", "info", "rm"}, run: streamCommand},
+		{name: "consumer", usage: "consumer ls <stream> | info <stream> <consumer> | rm <stream> <consumer>", verbs: []string{"ls", "info", "rm"}, run: consumerCommand},
+		{name: "kv", usage: "kv ls | keys <bucket> | get <bucket> <key> | put <bucket> <key> <value> | del <bucket> <key>", verbs: []string{"ls", "keys", "get", "put", "del"}, run: kvCommand},
+		{name: "lvc", usage: "lvc <stream> [-filter subj] [-kv bucket] [-compact]", run: lvcCommand},
+		{name: "purge", usage: "purge <stream> [-subject subj] [-before t] [-after t]", run: purgeCommand},
+		{name: "migrate", usage: "migrate <stream> <durable> <new-stream> [-filter s] [-durable name] [-dry-run]", run: migrateCommand},
+		{name: "forget", usage: "forget <subject pattern> [-dry-run]", run: forgetCommand},
+		{name: "bench", usage: "bench <subject> [-msgs n] [-size bytes] [-pubs n] [-subs n]", run: benchCommand},
+		{name: "fleet", usage: "fleet [-wait d]", run: fleetCommand},
+		{name: "monitor", usage: "monitor [-monitor-url url] [-interval d]", run: monitorCommand},
+		{name: "can-i", usage: "can-i pub|sub|req|reply <subject> [-jwt file | -config nats.conf -user name]", verbs: []string{"pub", "sub", "req", "reply"}, run: canICommand},
+		{name: "ctx", usage: "ctx ls | add <name> [-url u] [-creds f] [-env-prefix p] [-inbox-prefix p] [-description d] | use <name> | show [name] | rm <name>", verbs: []string{"ls", "add", "use", "show", "rm"}, run: ctxCommand},
+		{name: "completion", usage: "completion bash | zsh | fish", verbs: []string{"bash", "zsh", "fish"}, run: completionCommand},
+	}
+}
+
+// ─── Global Flags ──────────────────────────────────────────────────────
+var (
+	natsURL     = flag.String("url", defaultURL(), "NATS server URL, defaults to the NATS_URL environment variable")
+	credsFile   = flag.String("creds", "", "NATS credentials file (user JWT + seed, see cmd/natsAuth)")
+	envPrefix   = flag.String("env-prefix", "NATS", "Prefix of the <PREFIX>_USER and <PREFIX>_PASSWORD environment variables holding the credentials")
+	proxyURL    = flag.String("proxy", "", "HTTP or SOCKS5 proxy the connection goes through: http://[user:password@]host:port or socks5://[user:password@]host:port")
+	ipVersion   = flag.String("ip", "", `Restrict the connection to IPv4 ("4") or IPv6 ("6")`)
+	inboxPrefix = flag.String("inbox-prefix", "", "Prefix of the reply inboxes of req and fleet instead of _INBOX, for users only allowed to subscribe to their own inboxes")
+	contextFlag = flag.String("context", "", "Connection context to use, defaults to the NATS_CONTEXT environment variable, then to the one of ctx use")
+)
+
+// Exit codes, for scripts: the same as natsPubSub (see its result.go).
+// Other failures exit with 1, like a "no" of can-i.
+const (
+	exitUsage        = 2
+	exitTimeout      = 3
+	exitNoResponders = 4
+	exitConnection   = 5
+	exitPublish      = 6
+)
+
+// l logs the errors on stderr: stdout only carries the command results,
+// so they can be piped (natsctl stream info ORDERS | jq .state).
+var l = log.New(os.Stderr, APP+" ", 0)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	if name == completeCommand {
+		complete(args)
+		return
+	}
+	if name != "ctx" {
+		if err := applyContext(explicitFlags(flag.CommandLine)); err != nil {
+			l.Fatalf("💥 %v", err)
+		}
+	}
+	for _, c := range commands {
+		if c.name == name {
+			c.run(args)
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Error: unknown command %q.\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
+
+// usage prints the sub-commands and the global flags.
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s v%s, from %s\n\nUsage: %s [global flags] <command> …\n\nCommands:\n", APP, VERSION, REPOSITORY, APP)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nGlobal flags:")
+	flag.PrintDefaults()
+}
+
+// defaultURL returns NATS_URL, or the default URL of the client library.
+func defaultURL() string {
+	if u := os.Getenv("NATS_URL"); u != "" {
+		return u
+	}
+	return nats.DefaultURL
+}
+
+// authOptions returns the authentication options of the global flags.
+func authOptions() []nats.Option {
+	if *credsFile != "" {
+		return []nats.Option{nats.UserCredentials(*credsFile)}
+	}
+	if user, pass := os.Getenv(*envPrefix+"_USER"), os.Getenv(*envPrefix+"_PASSWORD"); user != "" {
+		return []nats.Option{nats.UserInfo(user, pass)}
+	}
+	return nil
+}
+
+// connect opens a connection with the global flags, exiting on failure.
+func connect() *nats.Conn {
+	nc, err := dial()
+	if err != nil {
+		l.Printf("💥 Failed to connect to NATS at %s: %v", *natsURL, err)
+		os.Exit(exitConnection)
+	}
+	return nc
+}
+
+// dial opens a connection with the global flags and the extra options.
+func dial(extra ...nats.Option) (*nats.Conn, error) {
+	opts := append([]nats.Option{nats.Name(APP)}, authOptions()...)
+	opts = append(opts, extra...)
+	if *inboxPrefix != "" {
+		opts = append(opts, nats.CustomInboxPrefix(*inboxPrefix))
+	}
+	if *proxyURL != "" || *ipVersion != "" {
+		dialer, err := transport.NewDialer(*proxyURL, *ipVersion)
+		if err != nil {
+			l.Printf("💥 %v", err)
+			os.Exit(exitUsage)
+		}
+		opts = append(opts, nats.SetCustomDialer(dialer), nats.SkipHostLookup())
+	}
+	return nats.Connect(*natsURL, opts...)
+}
+
+// connectJetStream opens a connection and its JetStream context.
+func connectJetStream() (*nats.Conn, jetstream.JetStream) {
+	nc := connect()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		l.Fatalf("💥 Failed to create JetStream context: %v", err)
+	}
+	return nc, js
+}
+
+// parseArgs parses the flags of fs wherever they are among the positional
+// arguments ("pub subject msg -count 3" as well as "pub -count 3 subject
+// msg"), and checks the number of positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, minArgs, maxArgs int) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args) // flag.ExitOnError
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) < minArgs || len(positional) > maxArgs {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	return positional
+}
+
+// newFlagSet returns the flag set of a sub-command, printing usage on errors.
+func newFlagSet(usageLine string) *flag.FlagSet {
+	name, _, _ := strings.Cut(usageLine, " ")
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", APP, usageLine)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usageError reports an invalid use of the sub-command of fs and exits.
+func usageError(fs *flag.FlagSet, format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", fmt.Errorf(format, args...))
+	fs.Usage()
+	os.Exit(exitUsage)
+}
+
+// usageOf returns the usage line of the named command.
+func usageOf(name string) string {
+	for _, c := range commands {
+		if c.name == name {
+			return c.usage
+		}
+	}
+	return name
+}
+
+// stopContext returns a context cancelled by Ctrl+C or SIGTERM.
+func stopContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// apiContext returns a context bounding a JetStream API call.
+func apiContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), apiTimeout)
+}
@@ -0,0 +1,152 @@
+// pubsub.go — "pub", "sub" and "req" sub-commands.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// headerFlags collects the repeated -header k=v flags.
+type headerFlags nats.Header
+
+func (h headerFlags) String() string { return "" }
+
+func (h headerFlags) Set(kv string) error {
+	k, v, ok := strings.Cut(kv, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", kv)
+	}
+	nats.Header(h).Add(k, v)
+	return nil
+}
+
+// pubCommand publishes a message, -count times.
+func pubCommand(args []string) {
+	fs := newFlagSet(usageOf("pub"))
+	count := fs.Int("count", 1, "Number of times the message is published")
+	header := headerFlags{}
+	fs.Var(header, "header", "Header key=value, can be repeated")
+	pos := parseArgs(fs, args, 2, 2)
+
+	nc := connect()
+	defer nc.Close()
+	m := nats.NewMsg(pos[0])
+	m.Data = []byte(pos[1])
+	for k, v := range header {
+		m.Header[k] = v
+	}
+	// The server would refuse the message and close the connection.
+	if size, limit := msgSize(m), nc.MaxPayload(); size > limit {
+		l.Printf("💥 Message of %d bytes (headers included) exceeds the max_payload of %d bytes of %s", size, limit, nc.ConnectedUrlRedacted())
+		os.Exit(exitPublish)
+	}
+	for i := 0; i < *count; i++ {
+		if err := nc.PublishMsg(m); err != nil {
+			l.Printf("💥 Publish failed: %v", err)
+			os.Exit(exitPublish)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		l.Printf("💥 Flush failed: %v", err)
+		os.Exit(exitPublish)
+	}
+	fmt.Printf("Published %d message(s) on %q\n", *count, pos[0])
+}
+
+// subCommand prints the messages of a subject until interrupted, or until
+// -count messages have been received.
+func subCommand(args []string) {
+	fs := newFlagSet(usageOf("sub"))
+	queue := fs.String("queue", "", "Queue group: the messages are shared among its members")
+	count := fs.Int("count", 0, "Exit after this number of messages, 0 runs until interrupted")
+	pos := parseArgs(fs, args, 1, 1)
+
+	nc := connect()
+	defer nc.Close()
+	ctx, stop := stopContext()
+	defer stop()
+
+	var received atomic.Int64
+	sub, err := nc.QueueSubscribe(pos[0], *queue, func(m *nats.Msg) {
+		n := received.Add(1)
+		if *count > 0 && n > int64(*count) {
+			return
+		}
+		fmt.Printf("[#%d] %s %s\n", n, time.Now().Format(time.TimeOnly), m.Subject)
+		for k, values := range m.Header {
+			for _, v := range values {
+				fmt.Printf("  %s: %s\n", k, v)
+			}
+		}
+		fmt.Printf("%s\n\n", m.Data)
+		if *count > 0 && n == int64(*count) {
+			stop()
+		}
+	})
+	if err != nil {
+		l.Fatalf("💥 Failed to subscribe: %v", err)
+	}
+	<-ctx.Done()
+	_ = sub.Drain()
+}
+
+// reqCommand sends a request and prints the reply. No responders and
+// timeout end with distinct exit codes; with -retry-on-no-responder, the
+// request is sent again while nobody subscribes to the subject.
+func reqCommand(args []string) {
+	fs := newFlagSet(usageOf("req"))
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for the reply")
+	retry := fs.Bool("retry-on-no-responder", false, "Send the request again while nobody subscribes to the subject, until -timeout")
+	pos := parseArgs(fs, args, 2, 2)
+
+	nc := connect()
+	defer nc.Close()
+	deadline := time.Now().Add(*timeout)
+	backoff := 100 * time.Millisecond
+	for {
+		reply, err := nc.Request(pos[0], []byte(pos[1]), time.Until(deadline))
+		switch {
+		case err == nil:
+			for k, values := range reply.Header {
+				for _, v := range values {
+					fmt.Printf("%s: %s\n", k, v)
+				}
+			}
+			fmt.Printf("%s\n", reply.Data)
+			return
+		case errors.Is(err, nats.ErrNoResponders):
+			if !*retry || time.Now().Add(backoff).After(deadline) {
+				l.Printf("💥 No responders on %q: nobody subscribes to this subject", pos[0])
+				os.Exit(exitNoResponders)
+			}
+			time.Sleep(backoff)
+			backoff = min(2*backoff, 2*time.Second)
+		case errors.Is(err, nats.ErrTimeout):
+			l.Printf("💥 Timeout: no reply on %q within %v", pos[0], *timeout)
+			os.Exit(exitTimeout)
+		default:
+			l.Fatalf("💥 Request on %q failed: %v", pos[0], err)
+		}
+	}
+}
+
+// msgSize returns the size of m counted against max_payload: payload and
+// headers ("NATS/1.0" line and "key: value" lines).
+func msgSize(m *nats.Msg) int64 {
+	size := len(m.Data)
+	if len(m.Header) > 0 {
+		size += len("NATS/1.0\r\n\r\n")
+		for k, values := range m.Header {
+			for _, v := range values {
+				size += len(k) + len(": ") + len(v) + len("\r\n")
+			}
+		}
+	}
+	return int64(size)
+}
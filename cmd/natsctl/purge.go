@@ -0,0 +1,248 @@
+// purge.go — "purge" and "forget" sub-commands: deleting stored events.
+//
+// PURGE BY SUBJECT AND TIME:
+//
+//	Retention limits (max_age, max_msgs) apply to a whole stream. "purge"
+//	removes the messages of a subject filter older than an instant, or
+//	within a time range, e.g. the debug events of last night:
+//
+//	  natsctl purge ORDERS -subject "orders.test.>" -before 720h
+//	  natsctl purge ORDERS -after 2026-10-15T22:00:00Z -before 2026-10-16T06:00:00Z
+//
+//	The instants are RFC 3339 times or durations before now. Without
+//	-after, one purge request of the server removes everything before the
+//	first message stored at or after -before; with -after, the messages of
+//	the range are deleted one by one.
+//
+// FORGETTING AN ENTITY (GDPR):
+//
+//	A data deletion request ("forget the user 123") must reach every copy
+//	of the events: the stream they were published to, the archive streams
+//	sourcing or mirroring it, the key-value buckets holding their state.
+//	"forget" purges the subjects matching a pattern from every stream of
+//	the account, including the keys of the same names in the buckets:
+//
+//	  natsctl forget "users.123.>" -dry-run     # what would be deleted
+//	  natsctl forget "users.123.>"
+//
+//	This supposes the entity is a token of the subjects, the usual design
+//	of event subjects (<domain>.<id>.<event>). Copies outside this server
+//	(other accounts, leaf node buffers, disk spools, backups) are not
+//	reached: run it there as well.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// kvStreamPrefix starts the names of the streams of the key-value buckets.
+const kvStreamPrefix = "KV_"
+
+// purgeCommand removes the messages of a stream matching a subject filter
+// and stored before an instant, or within a time range.
+func purgeCommand(args []string) {
+	fs := newFlagSet(usageOf("purge"))
+	subject := fs.String("subject", "", "Only the messages of the subjects matching this pattern, all of them by default")
+	beforeFlag := fs.String("before", "", "Only the messages stored before this instant: RFC 3339 time or duration before now (e.g. 720h)")
+	afterFlag := fs.String("after", "", "Only the messages stored at or after this instant: RFC 3339 time or duration before now")
+	pos := parseArgs(fs, args, 1, 1)
+	now := time.Now()
+	before, err := parseInstant(*beforeFlag, now)
+	if err != nil {
+		usageError(fs, "-before: %v", err)
+	}
+	after, err := parseInstant(*afterFlag, now)
+	if err != nil {
+		usageError(fs, "-after: %v", err)
+	}
+	if *beforeFlag == "" && *afterFlag == "" && *subject == "" {
+		usageError(fs, "purging the whole stream needs -subject \">\", or -before / -after")
+	}
+	if *beforeFlag != "" && *afterFlag != "" && !after.Before(before) {
+		usageError(fs, "-after must be before -before")
+	}
+
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := stopContext()
+	defer cancel()
+	callCtx, callCancel := context.WithTimeout(ctx, apiTimeout)
+	defer callCancel()
+	s, err := js.Stream(callCtx, pos[0])
+	if err != nil {
+		l.Fatalf("💥 Stream %q: %v", pos[0], err)
+	}
+	state := s.CachedInfo().State
+	filter := *subject
+	if filter == "" {
+		filter = ">"
+	}
+
+	// The sequence of the first message stored at or after each bound.
+	end := state.LastSeq + 1
+	if *beforeFlag != "" {
+		if end, err = firstSeqAt(callCtx, s, state, before); err != nil {
+			l.Fatalf("💥 Failed to find the messages before %s: %v", before.Format(time.RFC3339), err)
+		}
+	}
+	if *afterFlag == "" {
+		opts := []jetstream.StreamPurgeOpt{jetstream.WithPurgeSubject(filter)}
+		if end <= state.LastSeq {
+			opts = append(opts, jetstream.WithPurgeSequence(end))
+		}
+		if end > state.FirstSeq {
+			if err := s.Purge(callCtx, opts...); err != nil {
+				l.Fatalf("💥 Failed to purge %q: %v", pos[0], err)
+			}
+		}
+	} else {
+		start, err := firstSeqAt(callCtx, s, state, after)
+		if err != nil {
+			l.Fatalf("💥 Failed to find the messages after %s: %v", after.Format(time.RFC3339), err)
+		}
+		deleteRange(ctx, s, filter, start, end)
+	}
+
+	infoCtx, infoCancel := apiContext()
+	defer infoCancel()
+	info, err := s.Info(infoCtx)
+	if err != nil {
+		l.Fatalf("💥 Stream %q: %v", pos[0], err)
+	}
+	fmt.Printf("Stream %q: %d messages deleted, %d left\n", pos[0], state.Msgs-info.State.Msgs, info.State.Msgs)
+}
+
+// deleteRange deletes the messages of the subjects matching filter whose
+// sequence is within [start, end).
+func deleteRange(ctx context.Context, s jetstream.Stream, filter string, start, end uint64) {
+	for seq := start; seq < end; {
+		callCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+		m, err := s.GetMsg(callCtx, seq, jetstream.WithGetMsgSubject(filter))
+		if err == nil && m.Sequence < end {
+			err = s.DeleteMsg(callCtx, m.Sequence)
+		}
+		cancel()
+		switch {
+		case errors.Is(err, jetstream.ErrMsgNotFound):
+			return
+		case ctx.Err() != nil:
+			l.Fatalf("💥 Interrupted at the sequence %d", seq)
+		case err != nil:
+			l.Fatalf("💥 Failed to delete the message %d: %v", seq, err)
+		case m.Sequence >= end:
+			return
+		}
+		seq = m.Sequence + 1
+	}
+}
+
+// firstSeqAt returns the sequence of the first message of the stream
+// stored at or after t, state.LastSeq+1 when there is none. The stored
+// times growing with the sequences, it is a binary search costing a few
+// message gets.
+func firstSeqAt(ctx context.Context, s jetstream.Stream, state jetstream.StreamState, t time.Time) (uint64, error) {
+	switch {
+	case state.Msgs == 0 || state.LastTime.Before(t):
+		return state.LastSeq + 1, nil
+	case !state.FirstTime.Before(t):
+		return state.FirstSeq, nil
+	}
+	lo, hi := state.FirstSeq, state.LastSeq
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		// The first message at or after mid, mid may have been deleted.
+		m, err := s.GetMsg(ctx, mid, jetstream.WithGetMsgSubject(">"))
+		if err != nil {
+			return 0, err
+		}
+		if m.Time.Before(t) {
+			lo = m.Sequence + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// parseInstant parses an RFC 3339 time or a duration before now, the
+// zero time when s is empty.
+func parseInstant(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a positive duration", s)
+	}
+	return now.Add(-d), nil
+}
+
+// forgetCommand purges the subjects matching a pattern from every stream
+// and bucket of the account.
+func forgetCommand(args []string) {
+	fs := newFlagSet(usageOf("forget"))
+	dryRun := fs.Bool("dry-run", false, "Only print the number of messages that would be deleted")
+	pos := parseArgs(fs, args, 1, 1)
+	pattern := pos[0]
+	if first, _, _ := strings.Cut(pattern, "."); first == "*" || first == ">" {
+		usageError(fs, "the pattern %q must start with a literal token, it would forget whole domains", pattern)
+	}
+
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tFILTER\tMESSAGES")
+	var total uint64
+	streams := js.ListStreams(ctx)
+	for info := range streams.Info() {
+		name, filter := info.Config.Name, pattern
+		if bucket, ok := strings.CutPrefix(name, kvStreamPrefix); ok {
+			filter = "$KV." + bucket + "." + pattern
+		}
+		s, err := js.Stream(ctx, name)
+		if err != nil {
+			l.Fatalf("💥 Stream %q: %v", name, err)
+		}
+		stored, err := s.Info(ctx, jetstream.WithSubjectFilter(filter))
+		if err != nil {
+			l.Fatalf("💥 Failed to list the subjects of %q: %v", name, err)
+		}
+		var count uint64
+		for _, n := range stored.State.Subjects {
+			count += n
+		}
+		if count == 0 {
+			continue
+		}
+		if !*dryRun {
+			if err := s.Purge(ctx, jetstream.WithPurgeSubject(filter)); err != nil {
+				l.Fatalf("💥 Failed to purge %q from %q: %v", filter, name, err)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", name, filter, count)
+		total += count
+	}
+	_ = tw.Flush()
+	if err := streams.Err(); err != nil {
+		l.Fatalf("💥 Failed to list streams: %v", err)
+	}
+	if *dryRun {
+		fmt.Printf("%d messages of %q would be deleted\n", total, pattern)
+		return
+	}
+	fmt.Printf("%d messages of %q deleted\n", total, pattern)
+}
@@ -0,0 +1,157 @@
+// stream.go — "stream", "consumer" and "kv" sub-commands.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// streamCommand lists, shows or deletes streams.
+func streamCommand(args []string) {
+	fs := newFlagSet(usageOf("stream"))
+	pos := parseArgs(fs, args, 1, 2)
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	switch {
+	case pos[0] == "ls" && len(pos) == 1:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSUBJECTS\tMESSAGES\tBYTES\tCONSUMERS")
+		streams := js.ListStreams(ctx)
+		for info := range streams.Info() {
+			fmt.Fprintf(tw, "%s\t%v\t%d\t%d\t%d\n", info.Config.Name, info.Config.Subjects, info.State.Msgs, info.State.Bytes, info.State.Consumers)
+		}
+		_ = tw.Flush()
+		if err := streams.Err(); err != nil {
+			l.Fatalf("💥 Failed to list streams: %v", err)
+		}
+	case pos[0] == "info" && len(pos) == 2:
+		s, err := js.Stream(ctx, pos[1])
+		if err != nil {
+			l.Fatalf("💥 Stream %q: %v", pos[1], err)
+		}
+		printJSON(s.CachedInfo())
+	case pos[0] == "rm" && len(pos) == 2:
+		if err := js.DeleteStream(ctx, pos[1]); err != nil {
+			l.Fatalf("💥 Failed to delete stream %q: %v", pos[1], err)
+		}
+		fmt.Printf("Stream %q deleted\n", pos[1])
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// consumerCommand lists, shows or deletes the consumers of a stream.
+func consumerCommand(args []string) {
+	fs := newFlagSet(usageOf("consumer"))
+	pos := parseArgs(fs, args, 2, 3)
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	s, err := js.Stream(ctx, pos[1])
+	if err != nil {
+		l.Fatalf("💥 Stream %q: %v", pos[1], err)
+	}
+	switch {
+	case pos[0] == "ls" && len(pos) == 2:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tFILTER\tPENDING\tACK PENDING\tREDELIVERED")
+		consumers := s.ListConsumers(ctx)
+		for info := range consumers.Info() {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", info.Name, info.Config.FilterSubject, info.NumPending, info.NumAckPending, info.NumRedelivered)
+		}
+		_ = tw.Flush()
+		if err := consumers.Err(); err != nil {
+			l.Fatalf("💥 Failed to list consumers: %v", err)
+		}
+	case pos[0] == "info" && len(pos) == 3:
+		c, err := s.Consumer(ctx, pos[2])
+		if err != nil {
+			l.Fatalf("💥 Consumer %q: %v", pos[2], err)
+		}
+		printJSON(c.CachedInfo())
+	case pos[0] == "rm" && len(pos) == 3:
+		if err := s.DeleteConsumer(ctx, pos[2]); err != nil {
+			l.Fatalf("💥 Failed to delete consumer %q: %v", pos[2], err)
+		}
+		fmt.Printf("Consumer %q deleted\n", pos[2])
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// kvCommand reads and writes the key-value buckets.
+func kvCommand(args []string) {
+	fs := newFlagSet(usageOf("kv"))
+	pos := parseArgs(fs, args, 1, 4)
+	nc, js := connectJetStream()
+	defer nc.Close()
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	if pos[0] == "ls" && len(pos) == 1 {
+		names := js.KeyValueStoreNames(ctx)
+		for name := range names.Name() {
+			fmt.Println(name)
+		}
+		if err := names.Error(); err != nil {
+			l.Fatalf("💥 Failed to list buckets: %v", err)
+		}
+		return
+	}
+	if len(pos) < 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	kv, err := js.KeyValue(ctx, pos[1])
+	if err != nil {
+		l.Fatalf("💥 Bucket %q: %v", pos[1], err)
+	}
+	switch {
+	case pos[0] == "keys" && len(pos) == 2:
+		keys, err := kv.ListKeys(ctx)
+		if err != nil {
+			l.Fatalf("💥 Failed to list keys: %v", err)
+		}
+		for key := range keys.Keys() {
+			fmt.Println(key)
+		}
+	case pos[0] == "get" && len(pos) == 3:
+		entry, err := kv.Get(ctx, pos[2])
+		if err != nil {
+			l.Fatalf("💥 Key %q: %v", pos[2], err)
+		}
+		fmt.Printf("%s\n", entry.Value())
+	case pos[0] == "put" && len(pos) == 4:
+		revision, err := kv.Put(ctx, pos[2], []byte(pos[3]))
+		if err != nil {
+			l.Fatalf("💥 Failed to put %q: %v", pos[2], err)
+		}
+		fmt.Printf("%s revision %d\n", pos[2], revision)
+	case pos[0] == "del" && len(pos) == 3:
+		if err := kv.Delete(ctx, pos[2]); err != nil {
+			l.Fatalf("💥 Failed to delete %q: %v", pos[2], err)
+		}
+		fmt.Printf("%s deleted\n", pos[2])
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		l.Fatalf("💥 %v", err)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,160 @@
+// Package broker defines the broker-agnostic publish/subscribe interfaces
+// of the application code, implemented by the backends in the
+// sub-packages.
+//
+// WHY AN ABSTRACTION:
+//
+//	Handlers written against *nats.Conn need a running nats-server to be
+//	tested, and are tied to NATS forever. Written against Publisher and
+//	Subscriber, the same code runs on:
+//
+//	  natsbroker.New(nc)   NATS core, the production backend
+//	  memory.New()         in process, synchronous: unit tests without server
+//
+//	and on any future backend implementing the interfaces:
+//
+//	  func registerBilling(b broker.Broker) error {
+//	      _, err := b.Subscribe("orders.created", func(ctx context.Context, m *broker.Message) error {
+//	          return b.Publish(ctx, &broker.Message{Subject: "billing.invoiced", Data: invoice(m.Data)})
+//	      })
+//	      return err
+//	  }
+//
+// BATCHES:
+//
+//	A sink writing to a database handles hundreds of messages per
+//	statement; acknowledging them one by one would cost as many round
+//	trips. A BatchConsumer returns them as a slice, acknowledged together:
+//
+//	  batch, err := consumer.FetchBatch(ctx, 500)
+//	  if err := insertAll(batch.Messages); err != nil {
+//	      return batch.NakAll(ctx)   // all delivered again
+//	  }
+//	  return batch.AckAll(ctx)
+//
+// ERRORS:
+//
+//	The backends return an *Error whose kind is one of ErrConnect,
+//	ErrPermission, ErrPublishTimeout, ErrNoResponders,
+//	ErrSchemaValidation or ErrClosed, whatever the backend: the policy of
+//	the application (retry, spool, alert, drop) is written once with
+//	errors.Is, and tested with the memory backend (see errors.go).
+//
+// SUBJECTS:
+//
+//	Every backend follows the NATS subject syntax: tokens separated by
+//	".", "*" matching one token and ">" the remaining ones (see Match).
+package broker
+
+import (
+	"context"
+	"strings"
+)
+
+// Message is a message published or received, independent of the backend.
+type Message struct {
+	Subject string
+	Header  map[string][]string // case-sensitive keys, as in the NATS protocol
+	Data    []byte
+	Reply   string // subject expecting a reply, "" for none
+}
+
+// HeaderValue returns the first value of the header key, "" when absent.
+func (m *Message) HeaderValue(key string) string {
+	if values := m.Header[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Handler handles a received message. The errors are reported to the
+// error callback of the backend; a backend with acknowledgements would
+// redeliver the message.
+type Handler func(ctx context.Context, m *Message) error
+
+// Publisher sends messages.
+type Publisher interface {
+	// Publish sends m on m.Subject. ctx bounds the wait of the backends
+	// confirming the publication.
+	Publish(ctx context.Context, m *Message) error
+}
+
+// Subscription is an active subscription of a Subscriber.
+type Subscription interface {
+	// Unsubscribe stops the delivery of the messages.
+	Unsubscribe() error
+}
+
+// Subscriber delivers the messages of subjects to handlers.
+type Subscriber interface {
+	// Subscribe calls h for every message whose subject matches the
+	// pattern subject.
+	Subscribe(subject string, h Handler) (Subscription, error)
+	// QueueSubscribe is Subscribe within the queue group queue: each message
+	// goes to one subscriber of the group only.
+	QueueSubscribe(subject, queue string, h Handler) (Subscription, error)
+}
+
+// Broker is a Publisher and a Subscriber sharing one connection.
+type Broker interface {
+	Publisher
+	Subscriber
+	// Close ends the subscriptions, after the messages being handled.
+	Close() error
+}
+
+// ─── Batches ───────────────────────────────────────────────────────────
+
+// Batch is a set of messages fetched at once and acknowledged together,
+// e.g. by a handler inserting them with one bulk statement.
+type Batch struct {
+	Messages []*Message
+	ackAll   func(ctx context.Context) error
+	nakAll   func(ctx context.Context) error
+}
+
+// NewBatch returns the batch of msgs, acknowledged by ackAll and delivered
+// again by nakAll; it is meant for the backends.
+func NewBatch(msgs []*Message, ackAll, nakAll func(ctx context.Context) error) *Batch {
+	return &Batch{Messages: msgs, ackAll: ackAll, nakAll: nakAll}
+}
+
+// AckAll acknowledges every message of the batch, once they are all handled.
+func (b *Batch) AckAll(ctx context.Context) error {
+	if len(b.Messages) == 0 {
+		return nil
+	}
+	return b.ackAll(ctx)
+}
+
+// NakAll asks for every message of the batch to be delivered again.
+func (b *Batch) NakAll(ctx context.Context) error {
+	if len(b.Messages) == 0 {
+		return nil
+	}
+	return b.nakAll(ctx)
+}
+
+// BatchConsumer fetches the messages of a durable consumer by batches.
+type BatchConsumer interface {
+	// FetchBatch returns up to n messages, fewer (even none) when no more
+	// arrive before ctx is done or the wait of the backend ends.
+	FetchBatch(ctx context.Context, n int) (*Batch, error)
+}
+
+// Match reports whether subject matches pattern, in the NATS subject
+// syntax: "*" matches one token, a trailing ">" one or more tokens.
+func Match(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range p {
+		switch {
+		case token == ">" && i == len(p)-1:
+			return len(s) > i
+		case i >= len(s):
+			return false
+		case token != "*" && token != s[i]:
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
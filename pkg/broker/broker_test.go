@@ -0,0 +1,36 @@
+package broker
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.updated", false},
+		{"orders.created", "orders", false},
+		{"orders", "orders.created", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.eu", false},
+		{"*.created", "orders.created", true},
+		{"*.*", "orders.created", true},
+		{"*", "orders", true},
+		{"*", "orders.created", false},
+		{"orders.>", "orders.created", true},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{">", "orders.created.eu", true},
+		{"*.>", "orders", false},
+		{"*.>", "orders.created", true},
+		{"orders.>.eu", "orders.>.eu", true}, // ">" is a wildcard at the end only
+		{"orders.>.eu", "orders.created.eu", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.subject); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.subject, got, tt.want)
+		}
+	}
+}
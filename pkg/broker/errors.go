@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// The kinds of errors returned by the backends, for the application to
+// decide what to do without parsing messages or knowing the backend:
+//
+//	err := b.Publish(ctx, m)
+//	switch {
+//	case errors.Is(err, broker.ErrPermission):        // not retried: fix the account
+//	case errors.Is(err, broker.ErrPublishTimeout):    // maybe delivered: retry with the same id
+//	case errors.Is(err, broker.ErrConnect):           // spool it until the server is back
+//	}
+//
+// They match the exit codes of natsPubSub and natsctl: ErrConnect 5,
+// ErrPublishTimeout and ErrPermission on publish 6, ErrNoResponders 4,
+// ErrSchemaValidation 2.
+var (
+	// ErrClosed is returned by the operations on a closed broker.
+	ErrClosed = errors.New("broker closed")
+	// ErrConnect is returned when the server cannot be reached, or the
+	// connection is lost when the operation needs it.
+	ErrConnect = errors.New("connection failed")
+	// ErrPermission is returned when the server refuses the credentials,
+	// or the operation on the subject to the account.
+	ErrPermission = errors.New("permission denied")
+	// ErrPublishTimeout is returned when the server did not confirm a
+	// publication in time: the message may have been delivered or not.
+	ErrPublishTimeout = errors.New("publish timeout")
+	// ErrNoResponders is returned when nobody receives a request, or no
+	// stream stores a subject.
+	ErrNoResponders = errors.New("no responders")
+	// ErrSchemaValidation is returned when a message does not match its
+	// contract (see Validate): it will never be accepted as it is.
+	ErrSchemaValidation = errors.New("schema validation failed")
+)
+
+// Error is an error of a backend on an operation, carrying its kind (one
+// of the Err variables above, nil when none applies) and the error of the
+// backend. Both match errors.Is:
+//
+//	errors.Is(err, broker.ErrPermission)         // the kind
+//	errors.Is(err, nats.ErrPermissionViolation)  // the cause
+//
+//	var be *broker.Error
+//	if errors.As(err, &be) {
+//	    log.Printf("%s on %s refused", be.Op, be.Subject)
+//	}
+type Error struct {
+	Op      string // "connect", "publish", "subscribe", "fetch", "ack", …
+	Subject string // "" when the operation has none
+	Kind    error
+	Err     error
+}
+
+// Error implements error as "<op> <subject>: <kind>: <cause>".
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Subject != "" {
+		b.WriteString(" " + e.Subject)
+	}
+	for _, err := range e.Unwrap() {
+		b.WriteString(": " + err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the kind and the cause, for errors.Is and errors.As.
+func (e *Error) Unwrap() []error {
+	var errs []error
+	for _, err := range []error{e.Kind, e.Err} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ─── Validation ────────────────────────────────────────────────────────
+
+// Validate returns a Publisher checking every message with validate
+// before handing it to p. A message refused is not published, and
+// Publish returns an *Error of kind ErrSchemaValidation wrapping the
+// error of validate:
+//
+//	pub := broker.Validate(b, func(m *broker.Message) error {
+//	    return orderSchema.Validate(m.Data)
+//	})
+func Validate(p Publisher, validate func(m *Message) error) Publisher {
+	return validating{p: p, validate: validate}
+}
+
+// validating is the Publisher returned by Validate.
+type validating struct {
+	p        Publisher
+	validate func(m *Message) error
+}
+
+// Publish implements Publisher.
+func (v validating) Publish(ctx context.Context, m *Message) error {
+	if err := v.validate(m); err != nil {
+		return &Error{Op: "publish", Subject: m.Subject, Kind: ErrSchemaValidation, Err: err}
+	}
+	return v.p.Publish(ctx, m)
+}
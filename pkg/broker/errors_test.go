@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestErrorUnwrap(t *testing.T) {
+	cause := &fs.PathError{Op: "open", Path: "creds", Err: fs.ErrPermission}
+	tests := []struct {
+		name    string
+		err     error
+		kinds   []error // matching errors.Is
+		others  []error // not matching it
+		message string
+	}{
+		{
+			name:    "kind and cause",
+			err:     &Error{Op: "publish", Subject: "orders", Kind: ErrPermission, Err: cause},
+			kinds:   []error{ErrPermission, fs.ErrPermission},
+			others:  []error{ErrConnect, ErrClosed},
+			message: "publish orders: permission denied: open creds: permission denied",
+		},
+		{
+			name:    "wrapped by fmt.Errorf",
+			err:     fmt.Errorf("saving: %w", &Error{Op: "put", Kind: ErrClosed, Err: cause}),
+			kinds:   []error{ErrClosed, fs.ErrPermission},
+			others:  []error{ErrPermission},
+			message: "saving: put: broker closed: open creds: permission denied",
+		},
+		{
+			name:    "no kind",
+			err:     &Error{Op: "fetch", Err: cause},
+			kinds:   []error{fs.ErrPermission},
+			others:  []error{ErrPermission, ErrClosed, ErrConnect, ErrPublishTimeout, ErrNoResponders, ErrSchemaValidation},
+			message: "fetch: open creds: permission denied",
+		},
+		{
+			name:    "no cause",
+			err:     &Error{Op: "get", Kind: ErrClosed},
+			kinds:   []error{ErrClosed},
+			others:  []error{fs.ErrPermission},
+			message: "get: broker closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range tt.kinds {
+				if !errors.Is(tt.err, kind) {
+					t.Errorf("errors.Is(%v, %v) = false, want true", tt.err, kind)
+				}
+			}
+			for _, other := range tt.others {
+				if errors.Is(tt.err, other) {
+					t.Errorf("errors.Is(%v, %v) = true, want false", tt.err, other)
+				}
+			}
+			if got := tt.err.Error(); got != tt.message {
+				t.Errorf("Error() = %q, want %q", got, tt.message)
+			}
+			var be *Error
+			if !errors.As(tt.err, &be) {
+				t.Errorf("errors.As(%v, *Error) = false, want true", tt.err)
+			}
+		})
+	}
+
+	t.Run("As reaches the cause", func(t *testing.T) {
+		err := fmt.Errorf("loading: %w", &Error{Op: "dial", Kind: ErrConnect, Err: cause})
+		var pe *fs.PathError
+		if !errors.As(err, &pe) || pe.Path != "creds" {
+			t.Errorf("errors.As(%v, *fs.PathError) = %v, want the cause", err, pe)
+		}
+	})
+}
+
+// publisher records the messages published.
+type publisher []*Message
+
+func (p *publisher) Publish(_ context.Context, m *Message) error {
+	*p = append(*p, m)
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	invalid := errors.New("missing id")
+	var published publisher
+	pub := Validate(&published, func(m *Message) error {
+		if len(m.Data) == 0 {
+			return invalid
+		}
+		return nil
+	})
+
+	if err := pub.Publish(context.Background(), &Message{Subject: "orders", Data: []byte("{}")}); err != nil {
+		t.Fatalf("Publish(valid) = %v", err)
+	}
+	err := pub.Publish(context.Background(), &Message{Subject: "orders"})
+	if !errors.Is(err, ErrSchemaValidation) || !errors.Is(err, invalid) {
+		t.Errorf("Publish(invalid) = %v, want ErrSchemaValidation wrapping %v", err, invalid)
+	}
+	var be *Error
+	if !errors.As(err, &be) || be.Op != "publish" || be.Subject != "orders" {
+		t.Errorf("Publish(invalid) = %#v, want an *Error on publish orders", err)
+	}
+	if len(published) != 1 {
+		t.Errorf("%d messages published, want 1: the invalid one must not be", len(published))
+	}
+}
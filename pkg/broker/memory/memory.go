@@ -0,0 +1,248 @@
+// Package memory is the in-process backend of the broker interfaces, for
+// the unit tests of the handlers: no server, no goroutine, deterministic.
+//
+//	b := memory.New()
+//	_ = registerBilling(b)
+//	_ = b.Publish(ctx, &broker.Message{Subject: "orders.created", Data: order})
+//	invoices := b.Published("billing.>")   // what the handler published
+//
+// Publish calls the handlers of the matching subscriptions synchronously,
+// in the order of the subscriptions, before it returns; the members of a
+// queue group receive the messages in turn. A handler publishing in turn
+// is served the same way, depth first.
+//
+// A Consumer (b.Consumer("orders.>")) keeps the messages until they are
+// acknowledged, for the handlers reading batches (broker.BatchConsumer).
+//
+// FailPublish makes the publications on some subjects fail with an error
+// of the broker taxonomy, to test the error policy of the application
+// without a server denying them:
+//
+//	b.FailPublish("billing.>", broker.ErrPermission)
+//	err := registerBilling(b)   // must not retry a permission error
+package memory
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+var _ broker.Broker = (*Broker)(nil)
+
+// Broker implements broker.Broker in memory. It is safe for concurrent use.
+type Broker struct {
+	// OnError receives the errors of the handlers, they are dropped when nil.
+	OnError func(m *broker.Message, err error)
+
+	mu        sync.Mutex
+	closed    bool
+	subs      []*subscription
+	turns     map[string]int // queue group → deliveries, to take turns
+	published []*broker.Message
+	failures  []failure // in the order of FailPublish, the first matching wins
+}
+
+// failure is a FailPublish: the kind of the publish error on the subjects
+// matching pattern.
+type failure struct {
+	pattern string
+	kind    error
+}
+
+// subscription is a subscription of a Broker.
+type subscription struct {
+	b              *Broker
+	subject, queue string
+	h              broker.Handler
+}
+
+// New returns an empty in-memory broker.
+func New() *Broker {
+	return &Broker{turns: make(map[string]int)}
+}
+
+// FailPublish makes Publish fail with an *broker.Error of kind on the
+// subjects matching pattern, without recording nor delivering the
+// message; a nil kind ends the failures of pattern. When several patterns
+// match a subject, the one given first decides, calling FailPublish again
+// on a pattern changes its kind but not its rank.
+func (b *Broker) FailPublish(pattern string, kind error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := slices.IndexFunc(b.failures, func(f failure) bool { return f.pattern == pattern })
+	switch {
+	case kind == nil && i >= 0:
+		b.failures = slices.Delete(b.failures, i, i+1)
+	case kind == nil:
+	case i >= 0:
+		b.failures[i].kind = kind
+	default:
+		b.failures = append(b.failures, failure{pattern: pattern, kind: kind})
+	}
+}
+
+// Publish records m and hands it to the matching subscriptions.
+func (b *Broker) Publish(ctx context.Context, m *broker.Message) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return &broker.Error{Op: "publish", Subject: m.Subject, Kind: broker.ErrClosed}
+	}
+	for _, f := range b.failures {
+		if broker.Match(f.pattern, m.Subject) {
+			b.mu.Unlock()
+			return &broker.Error{Op: "publish", Subject: m.Subject, Kind: f.kind}
+		}
+	}
+	b.published = append(b.published, m)
+	var targets []*subscription
+	var keys []string // queue groups, in the order of their first member
+	groups := make(map[string][]*subscription)
+	for _, s := range b.subs {
+		key := s.subject + " " + s.queue
+		switch {
+		case !broker.Match(s.subject, m.Subject):
+		case s.queue == "":
+			targets = append(targets, s)
+		default:
+			if groups[key] == nil {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], s)
+		}
+	}
+	for _, key := range keys {
+		targets = append(targets, groups[key][b.turns[key]%len(groups[key])])
+		b.turns[key]++
+	}
+	b.mu.Unlock()
+
+	for _, s := range targets {
+		// Every handler gets its own copy, as from a network.
+		c := *m
+		if err := s.h(ctx, &c); err != nil && b.OnError != nil {
+			b.OnError(&c, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe implements broker.Subscriber.
+func (b *Broker) Subscribe(subject string, h broker.Handler) (broker.Subscription, error) {
+	return b.QueueSubscribe(subject, "", h)
+}
+
+// QueueSubscribe implements broker.Subscriber, "" being no queue group.
+func (b *Broker) QueueSubscribe(subject, queue string, h broker.Handler) (broker.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, &broker.Error{Op: "subscribe", Subject: subject, Kind: broker.ErrClosed}
+	}
+	s := &subscription{b: b, subject: subject, queue: queue, h: h}
+	b.subs = append(b.subs, s)
+	return s, nil
+}
+
+// Unsubscribe implements broker.Subscription.
+func (s *subscription) Unsubscribe() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	for i, other := range s.b.subs {
+		if other == s {
+			s.b.subs = append(s.b.subs[:i:i], s.b.subs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Close ends the subscriptions; the messages published stay readable.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed, b.subs = true, nil
+	return nil
+}
+
+// Published returns the messages published on the subjects matching
+// pattern (">" for all of them), oldest first.
+func (b *Broker) Published(pattern string) []*broker.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var list []*broker.Message
+	for _, m := range b.published {
+		if broker.Match(pattern, m.Subject) {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// Consumer keeps the messages published on a subject until they are
+// acknowledged, like a durable JetStream consumer; it implements
+// broker.BatchConsumer.
+type Consumer struct {
+	mu      sync.Mutex
+	pending []*broker.Message // not fetched yet, or delivered again
+}
+
+var _ broker.BatchConsumer = (*Consumer)(nil)
+
+// Consumer returns a consumer of the messages published on the subjects
+// matching subject from now on.
+func (b *Broker) Consumer(subject string) (*Consumer, error) {
+	c := &Consumer{}
+	_, err := b.Subscribe(subject, func(_ context.Context, m *broker.Message) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pending = append(c.pending, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FetchBatch implements broker.BatchConsumer without waiting: it returns
+// the first n messages pending, or the error of ctx once done, as the
+// wait of a server would end. NakAll puts them back in front, unless the
+// batch was acknowledged or put back already.
+func (c *Consumer) FetchBatch(ctx context.Context, n int) (*broker.Batch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n = min(n, len(c.pending))
+	msgs := c.pending[:n:n]
+	c.pending = c.pending[n:]
+	settled := false // by AckAll or NakAll, guarded by c.mu
+	ackAll := func(context.Context) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		settled = true
+		return nil
+	}
+	nakAll := func(context.Context) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !settled {
+			c.pending = append(append([]*broker.Message{}, msgs...), c.pending...)
+			settled = true
+		}
+		return nil
+	}
+	return broker.NewBatch(msgs, ackAll, nakAll), nil
+}
+
+// Pending returns the number of messages not fetched yet.
+func (c *Consumer) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
@@ -0,0 +1,311 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// record returns a handler appending name to *got.
+func record(got *[]string, name string) broker.Handler {
+	return func(context.Context, *broker.Message) error {
+		*got = append(*got, name)
+		return nil
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		subs [][3]string // subject, queue, name of the handler
+		want []string    // handlers called by 4 publications on orders.created
+	}{
+		{
+			name: "plain subscriptions all receive",
+			subs: [][3]string{{"orders.*", "", "a"}, {"orders.>", "", "b"}},
+			want: []string{"a", "b", "a", "b", "a", "b", "a", "b"},
+		},
+		{
+			name: "queue group members take turns",
+			subs: [][3]string{{"orders.*", "q", "a"}, {"orders.*", "q", "b"}, {"orders.*", "q", "c"}},
+			want: []string{"a", "b", "c", "a"},
+		},
+		{
+			name: "groups and plain subscriptions",
+			subs: [][3]string{{"orders.*", "q", "a"}, {"orders.>", "", "p"}, {"orders.*", "q", "b"}, {"orders.*", "r", "c"}},
+			want: []string{"p", "a", "c", "p", "b", "c", "p", "a", "c", "p", "b", "c"},
+		},
+		{
+			name: "same queue name on other subjects are other groups",
+			subs: [][3]string{{"orders.*", "q", "a"}, {"orders.>", "q", "b"}, {"billing.*", "q", "x"}},
+			want: []string{"a", "b", "a", "b", "a", "b", "a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			var got []string
+			for _, s := range tt.subs {
+				if _, err := b.QueueSubscribe(s[0], s[1], record(&got, s[2])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range 4 {
+				if err := b.Publish(context.Background(), &broker.Message{Subject: "orders.created"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("handlers called %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeLeavesTheGroup(t *testing.T) {
+	b := New()
+	var got []string
+	_, _ = b.QueueSubscribe("orders.*", "q", record(&got, "a"))
+	sub, _ := b.QueueSubscribe("orders.*", "q", record(&got, "b"))
+	_ = sub.Unsubscribe()
+	for range 3 {
+		_ = b.Publish(context.Background(), &broker.Message{Subject: "orders.created"})
+	}
+	if want := []string{"a", "a", "a"}; !slices.Equal(got, want) {
+		t.Errorf("handlers called %q, want %q", got, want)
+	}
+}
+
+func TestFailPublish(t *testing.T) {
+	type fail struct {
+		pattern string
+		kind    error
+	}
+	tests := []struct {
+		name    string
+		fails   []fail
+		subject string
+		want    error // kind of the error, nil when published
+	}{
+		{"no failure", nil, "billing.invoice", nil},
+		{"matching", []fail{{"billing.>", broker.ErrPermission}}, "billing.invoice", broker.ErrPermission},
+		{"not matching", []fail{{"billing.>", broker.ErrPermission}}, "orders.created", nil},
+		{
+			name:    "first given wins",
+			fails:   []fail{{"billing.*", broker.ErrPublishTimeout}, {"billing.>", broker.ErrPermission}, {">", broker.ErrConnect}},
+			subject: "billing.invoice",
+			want:    broker.ErrPublishTimeout,
+		},
+		{
+			name:    "first given wins, the other way round",
+			fails:   []fail{{">", broker.ErrConnect}, {"billing.>", broker.ErrPermission}, {"billing.*", broker.ErrPublishTimeout}},
+			subject: "billing.invoice",
+			want:    broker.ErrConnect,
+		},
+		{
+			name:    "kind changed in place",
+			fails:   []fail{{"billing.*", broker.ErrPublishTimeout}, {"billing.>", broker.ErrPermission}, {"billing.*", broker.ErrNoResponders}},
+			subject: "billing.invoice",
+			want:    broker.ErrNoResponders,
+		},
+		{
+			name:    "nil kind ends the failure",
+			fails:   []fail{{"billing.*", broker.ErrPublishTimeout}, {"billing.>", broker.ErrPermission}, {"billing.*", nil}},
+			subject: "billing.invoice",
+			want:    broker.ErrPermission,
+		},
+		{"nil kind of an unknown pattern", []fail{{"billing.*", nil}}, "billing.invoice", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			var got []string
+			_, _ = b.Subscribe(">", record(&got, "h"))
+			for _, f := range tt.fails {
+				b.FailPublish(f.pattern, f.kind)
+			}
+			// The same outcome every time: the order of the failures is not random.
+			for i := range 20 {
+				err := b.Publish(context.Background(), &broker.Message{Subject: tt.subject})
+				if tt.want == nil {
+					if err != nil {
+						t.Fatalf("publication %d: %v, want nil", i, err)
+					}
+					continue
+				}
+				var be *broker.Error
+				if !errors.As(err, &be) || be.Kind != tt.want || be.Op != "publish" || be.Subject != tt.subject {
+					t.Fatalf("publication %d: %v, want an *broker.Error of kind %v", i, err, tt.want)
+				}
+			}
+			delivered := 20
+			if tt.want != nil {
+				delivered = 0
+			}
+			if len(got) != delivered || len(b.Published(">")) != delivered {
+				t.Errorf("%d delivered, %d recorded, want %d", len(got), len(b.Published(">")), delivered)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	b := New()
+	_ = b.Publish(context.Background(), &broker.Message{Subject: "orders.created"})
+	_ = b.Close()
+	err := b.Publish(context.Background(), &broker.Message{Subject: "orders.created"})
+	if !errors.Is(err, broker.ErrClosed) {
+		t.Errorf("Publish after Close = %v, want ErrClosed", err)
+	}
+	if _, err := b.Subscribe(">", record(new([]string), "h")); !errors.Is(err, broker.ErrClosed) {
+		t.Errorf("Subscribe after Close = %v, want ErrClosed", err)
+	}
+	if n := len(b.Published(">")); n != 1 {
+		t.Errorf("%d messages published readable after Close, want 1", n)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	b := New()
+	var errs []string
+	b.OnError = func(m *broker.Message, err error) { errs = append(errs, fmt.Sprintf("%s: %v", m.Subject, err)) }
+	_, _ = b.Subscribe("orders.*", func(context.Context, *broker.Message) error { return errors.New("boom") })
+	if err := b.Publish(context.Background(), &broker.Message{Subject: "orders.created"}); err != nil {
+		t.Fatalf("Publish = %v, the errors of the handlers are not returned", err)
+	}
+	if want := []string{"orders.created: boom"}; !slices.Equal(errs, want) {
+		t.Errorf("OnError got %q, want %q", errs, want)
+	}
+}
+
+// publish publishes a message on orders.created for every data.
+func publish(t *testing.T, b *Broker, data ...string) {
+	t.Helper()
+	for _, d := range data {
+		if err := b.Publish(context.Background(), &broker.Message{Subject: "orders.created", Data: []byte(d)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fetch fetches a batch of up to n messages and returns it with their data.
+func fetch(t *testing.T, c *Consumer, n int) (*broker.Batch, []string) {
+	t.Helper()
+	batch, err := c.FetchBatch(context.Background(), n)
+	if err != nil {
+		t.Fatalf("FetchBatch(%d) = %v", n, err)
+	}
+	var data []string
+	for _, m := range batch.Messages {
+		data = append(data, string(m.Data))
+	}
+	return batch, data
+}
+
+func TestFetchBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []string
+		n       []int      // sizes of the successive fetches
+		want    [][]string // their messages
+	}{
+		{"full batches", []string{"1", "2", "3", "4"}, []int{2, 2}, [][]string{{"1", "2"}, {"3", "4"}}},
+		{"partial batch", []string{"1", "2", "3"}, []int{2, 2, 2}, [][]string{{"1", "2"}, {"3"}, nil}},
+		{"fewer pending than asked", []string{"1", "2"}, []int{500}, [][]string{{"1", "2"}}},
+		{"nothing pending", nil, []int{10}, [][]string{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			c, err := b.Consumer("orders.>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			publish(t, b, tt.pending...)
+			for i, n := range tt.n {
+				batch, got := fetch(t, c, n)
+				if !slices.Equal(got, tt.want[i]) {
+					t.Errorf("fetch %d of %d = %q, want %q", i, n, got, tt.want[i])
+				}
+				if err := batch.AckAll(context.Background()); err != nil {
+					t.Errorf("AckAll = %v", err)
+				}
+			}
+			if c.Pending() != 0 {
+				t.Errorf("%d pending after the fetches, want 0", c.Pending())
+			}
+		})
+	}
+}
+
+func TestFetchBatchDone(t *testing.T) {
+	b := New()
+	c, _ := b.Consumer("orders.>")
+	publish(t, b, "1", "2")
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tt := range []struct {
+		ctx  context.Context
+		want error
+	}{{expired, context.DeadlineExceeded}, {canceled, context.Canceled}} {
+		if batch, err := c.FetchBatch(tt.ctx, 10); !errors.Is(err, tt.want) || batch != nil {
+			t.Errorf("FetchBatch(done) = %v, %v, want nil, %v", batch, err, tt.want)
+		}
+	}
+	if c.Pending() != 2 {
+		t.Errorf("%d pending after the failed fetches, want 2: none is lost", c.Pending())
+	}
+}
+
+func TestNakAll(t *testing.T) {
+	b := New()
+	c, _ := b.Consumer("orders.>")
+	publish(t, b, "1", "2", "3", "4", "5")
+
+	// The first batch is handled, the second fails: only it comes back, in
+	// front of the messages not fetched yet.
+	first, _ := fetch(t, c, 2)
+	_ = first.AckAll(context.Background())
+	second, _ := fetch(t, c, 2)
+	_ = second.NakAll(context.Background())
+	publish(t, b, "6")
+	if _, got := fetch(t, c, 10); !slices.Equal(got, []string{"3", "4", "5", "6"}) {
+		t.Errorf("after NakAll, fetched %q, want [3 4 5 6]", got)
+	}
+
+	// A batch is settled once: NakAll after AckAll, or twice, delivers nothing again.
+	publish(t, b, "7", "8")
+	acked, _ := fetch(t, c, 1)
+	_ = acked.AckAll(context.Background())
+	_ = acked.NakAll(context.Background())
+	naked, _ := fetch(t, c, 1)
+	_ = naked.NakAll(context.Background())
+	_ = naked.NakAll(context.Background())
+	if _, got := fetch(t, c, 10); !slices.Equal(got, []string{"8"}) {
+		t.Errorf("after NakAll of settled batches, fetched %q, want [8]", got)
+	}
+
+	// An empty batch has nothing to acknowledge or put back.
+	empty, _ := fetch(t, c, 10)
+	if err := empty.NakAll(context.Background()); err != nil || c.Pending() != 0 {
+		t.Errorf("NakAll(empty) = %v, %d pending, want nil, 0", err, c.Pending())
+	}
+}
+
+func TestConsumerFromNow(t *testing.T) {
+	b := New()
+	publish(t, b, "before")
+	c, _ := b.Consumer("orders.*")
+	publish(t, b, "after")
+	_ = b.Publish(context.Background(), &broker.Message{Subject: "billing.invoice"})
+	if _, got := fetch(t, c, 10); !slices.Equal(got, []string{"after"}) {
+		t.Errorf("fetched %q, want [after]: the messages of its subjects published since", got)
+	}
+}
@@ -0,0 +1,81 @@
+package natsbroker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// DefaultFetchWait bounds a FetchBatch when its context has no deadline.
+const DefaultFetchWait = 5 * time.Second
+
+var _ broker.BatchConsumer = (*BatchConsumer)(nil)
+
+// BatchConsumer implements broker.BatchConsumer on a JetStream pull
+// consumer.
+//
+// AckAll costs one confirmed round trip whatever the size of the batch:
+// with the AckAll policy of the consumer (jetstream.AckAllPolicy, best for
+// batches), acknowledging the last message acknowledges all the previous
+// ones; with the AckExplicit policy, the acks of the other messages are
+// sent without waiting, and the server confirming the one of the last
+// message, sent after them on the same connection, confirms them all.
+type BatchConsumer struct {
+	cons jetstream.Consumer
+}
+
+// NewBatchConsumer returns the batch consumer of the pull consumer cons.
+func NewBatchConsumer(cons jetstream.Consumer) *BatchConsumer {
+	return &BatchConsumer{cons: cons}
+}
+
+// FetchBatch implements broker.BatchConsumer, waiting until the deadline
+// of ctx, or DefaultFetchWait, for the messages to arrive.
+func (c *BatchConsumer) FetchBatch(ctx context.Context, n int) (*broker.Batch, error) {
+	wait := DefaultFetchWait
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+	if wait < time.Millisecond {
+		return nil, context.DeadlineExceeded
+	}
+	subject := c.cons.CachedInfo().Config.FilterSubject
+	fetched, err := c.cons.Fetch(n, jetstream.FetchMaxWait(wait))
+	if err != nil {
+		return nil, Classify("fetch", subject, err)
+	}
+	var jms []jetstream.Msg
+	var msgs []*broker.Message
+	for jm := range fetched.Messages() {
+		jms = append(jms, jm)
+		msgs = append(msgs, &broker.Message{Subject: jm.Subject(), Header: jm.Headers(), Data: jm.Data(), Reply: jm.Reply()})
+	}
+	if err := fetched.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && len(jms) == 0 {
+		return nil, Classify("fetch", subject, err)
+	}
+
+	ackAll := func(ctx context.Context) error {
+		last := jms[len(jms)-1]
+		if c.cons.CachedInfo().Config.AckPolicy != jetstream.AckAllPolicy {
+			for _, jm := range jms[:len(jms)-1] {
+				if err := jm.Ack(); err != nil {
+					return Classify("ack", jm.Subject(), err)
+				}
+			}
+		}
+		return Classify("ack", last.Subject(), last.DoubleAck(ctx))
+	}
+	nakAll := func(context.Context) error {
+		var errs []error
+		for _, jm := range jms {
+			errs = append(errs, Classify("nak", jm.Subject(), jm.Nak()))
+		}
+		return errors.Join(errs...)
+	}
+	return broker.NewBatch(msgs, ackAll, nakAll), nil
+}
@@ -0,0 +1,134 @@
+// Package natsbroker is the NATS core backend of the broker interfaces.
+//
+//	b, err := natsbroker.Connect(url, nats.Name("billing"))
+//	b.OnError = func(m *broker.Message, err error) { log.Printf("%s: %v", m.Subject, err) }
+//
+// The handlers run on the goroutine of their subscription, one message at
+// a time, as with nc.Subscribe. Close drains the connection: the messages
+// being handled end and the pending publishes are flushed.
+//
+// The errors of NATS are returned as *broker.Error, of the kind matching
+// the nats.Err… cause (see Classify). The permission violations of a
+// publication are asynchronous in NATS: they reach the nats.ErrorHandler
+// of the connection, which may classify them too.
+package natsbroker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// closePoll is how often Close checks the end of the drain.
+const closePoll = 10 * time.Millisecond
+
+var _ broker.Broker = (*Broker)(nil)
+
+// Broker implements broker.Broker on a NATS connection.
+type Broker struct {
+	nc *nats.Conn
+	// OnError receives the errors of the handlers, they are dropped when nil.
+	OnError func(m *broker.Message, err error)
+}
+
+// New returns the broker of the connection nc, which Close drains.
+func New(nc *nats.Conn) *Broker {
+	return &Broker{nc: nc}
+}
+
+// Connect connects to the NATS servers of url and returns their broker.
+// The error is of kind broker.ErrPermission when the credentials are
+// refused, broker.ErrConnect otherwise.
+func Connect(url string, opts ...nats.Option) (*Broker, error) {
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		err = Classify("connect", "", err)
+		var be *broker.Error
+		if errors.As(err, &be) && be.Kind == nil {
+			be.Kind = broker.ErrConnect
+		}
+		return nil, err
+	}
+	return New(nc), nil
+}
+
+// Classify returns err, an error of NATS on op, as a *broker.Error of the
+// kind matching it, nil for a nil err.
+func Classify(op, subject string, err error) error {
+	var be *broker.Error
+	if err == nil || errors.As(err, &be) {
+		return err
+	}
+	be = &broker.Error{Op: op, Subject: subject, Err: err}
+	switch {
+	case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrConnectionDraining):
+		be.Kind = broker.ErrClosed
+	case errors.Is(err, nats.ErrNoServers), errors.Is(err, nats.ErrDisconnected),
+		errors.Is(err, nats.ErrInvalidConnection), errors.Is(err, nats.ErrConnectionReconnecting):
+		be.Kind = broker.ErrConnect
+	case errors.Is(err, nats.ErrAuthorization), errors.Is(err, nats.ErrAuthExpired),
+		errors.Is(err, nats.ErrAuthRevoked), errors.Is(err, nats.ErrAccountAuthExpired),
+		errors.Is(err, nats.ErrPermissionViolation):
+		be.Kind = broker.ErrPermission
+	case errors.Is(err, nats.ErrNoResponders), errors.Is(err, jetstream.ErrNoStreamResponse):
+		be.Kind = broker.ErrNoResponders
+	case op == "publish" && (errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded)):
+		be.Kind = broker.ErrPublishTimeout
+	}
+	return be
+}
+
+// Conn returns the underlying connection, for the NATS specific features.
+func (b *Broker) Conn() *nats.Conn {
+	return b.nc
+}
+
+// Publish sends m, and waits until the server received it when ctx has a
+// deadline.
+func (b *Broker) Publish(ctx context.Context, m *broker.Message) error {
+	err := b.nc.PublishMsg(&nats.Msg{Subject: m.Subject, Reply: m.Reply, Header: nats.Header(m.Header), Data: m.Data})
+	if _, bounded := ctx.Deadline(); err == nil && bounded {
+		err = b.nc.FlushWithContext(ctx)
+	}
+	return Classify("publish", m.Subject, err)
+}
+
+// Subscribe implements broker.Subscriber.
+func (b *Broker) Subscribe(subject string, h broker.Handler) (broker.Subscription, error) {
+	return b.QueueSubscribe(subject, "", h)
+}
+
+// QueueSubscribe implements broker.Subscriber, "" being no queue group.
+func (b *Broker) QueueSubscribe(subject, queue string, h broker.Handler) (broker.Subscription, error) {
+	sub, err := b.nc.QueueSubscribe(subject, queue, func(nm *nats.Msg) {
+		m := &broker.Message{Subject: nm.Subject, Header: nm.Header, Data: nm.Data, Reply: nm.Reply}
+		if err := h(context.Background(), m); err != nil && b.OnError != nil {
+			b.OnError(m, err)
+		}
+	})
+	if err != nil {
+		return nil, Classify("subscribe", subject, err)
+	}
+	return sub, nil
+}
+
+// Close drains the connection and waits until it is closed, within the
+// nats.DrainTimeout of the connection.
+func (b *Broker) Close() error {
+	if err := b.nc.Drain(); err != nil {
+		b.nc.Close()
+		if errors.Is(err, nats.ErrConnectionClosed) {
+			return nil
+		}
+		return Classify("close", "", err)
+	}
+	for !b.nc.IsClosed() {
+		time.Sleep(closePoll)
+	}
+	return nil
+}
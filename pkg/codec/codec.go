@@ -0,0 +1,183 @@
+// Package codec encodes and decodes the data of the events in the formats
+// registered by name, open to the formats of the application.
+//
+// WHY A REGISTRY:
+//
+//	JSON suits most events, not all of them: a telemetry pipeline may use
+//	FlatBuffers or Protocol Buffers for their size, a company may have its
+//	own binary format. The programs select a codec by its name in their
+//	configuration ("codec": "flatbuffers"), and any package can add one,
+//	usually from its init function, the way database/sql drivers do:
+//
+//	  package fbcodec
+//
+//	  func init() { codec.Register("flatbuffers", Codec{}) }
+//
+//	  // in the program:
+//	  import _ "example.com/events/fbcodec"
+//
+//	The "json" and "text" codecs are always registered.
+//
+// CONTENT TYPE:
+//
+//	Every codec tells the media type of its encoding, set in the
+//	Content-Type header (or the datacontenttype attribute of a CloudEvent)
+//	of the messages it encodes, so that the receivers find the codec to
+//	decode them with ForContentType.
+//
+// ERRORS:
+//
+//	Data that does not decode into the value asked will never do: the
+//	built-in codecs return it as a *broker.Error of kind
+//	broker.ErrSchemaValidation, and the codecs of the application should.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"slices"
+	"sync"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// ErrUnknownCodec is returned for a name no codec was registered with.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Codec encodes and decodes the data of the events.
+type Codec interface {
+	// ContentType returns the media type of the encoded data.
+	ContentType() string
+	// Encode returns the encoding of v.
+	Encode(v any) ([]byte, error)
+	// Decode decodes data into the value pointed to by v.
+	Decode(data []byte, v any) error
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+func init() {
+	Register("json", JSON{})
+	Register("text", Text{})
+}
+
+// Register makes c available under name. It panics when name is empty,
+// c is nil or a codec is already registered under name, a programming
+// error found at start-up.
+func Register(name string, c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case name == "":
+		panic("codec: Register with an empty name")
+	case c == nil:
+		panic(fmt.Sprintf("codec: Register %q with a nil codec", name))
+	case codecs[name] != nil:
+		panic(fmt.Sprintf("codec: Register called twice for %q", name))
+	}
+	codecs[name] = c
+}
+
+// Lookup returns the codec registered under name.
+func Lookup(name string) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered: %q", ErrUnknownCodec, name, namesLocked())
+	}
+	return c, nil
+}
+
+// ForContentType returns the name and the codec of the media type of
+// contentType, parameters ignored, and whether one is registered. When
+// several codecs share a media type, the first name in order wins.
+func ForContentType(contentType string) (string, Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil, false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, name := range namesLocked() {
+		if ct, _, err := mime.ParseMediaType(codecs[name].ContentType()); err == nil && ct == mediaType {
+			return name, codecs[name], true
+		}
+	}
+	return "", nil, false
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ─── Built-in Codecs ───────────────────────────────────────────────────
+
+// JSON is the "json" codec, encoding/json.
+type JSON struct{}
+
+// ContentType returns application/json.
+func (JSON) ContentType() string { return "application/json" }
+
+// Encode returns the JSON encoding of v.
+func (JSON) Encode(v any) ([]byte, error) { return json.Marshal(v) }
+
+// Decode decodes the JSON data into v, a *broker.Error of kind
+// broker.ErrSchemaValidation when data does not fit it.
+func (JSON) Decode(data []byte, v any) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return &broker.Error{Op: "decode", Kind: broker.ErrSchemaValidation, Err: err}
+	}
+	return nil
+}
+
+// Text is the "text" codec, UTF-8 text as is.
+type Text struct{}
+
+// ContentType returns text/plain.
+func (Text) ContentType() string { return "text/plain; charset=utf-8" }
+
+// Encode returns v, a string, a []byte or a fmt.Stringer, as bytes.
+func (Text) Encode(v any) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		return []byte(t), nil
+	case []byte:
+		return t, nil
+	case fmt.Stringer:
+		return []byte(t.String()), nil
+	}
+	return nil, fmt.Errorf("codec text: cannot encode %T", v)
+}
+
+// Decode sets v, a *string, *[]byte or *any, to data.
+func (Text) Decode(data []byte, v any) error {
+	switch t := v.(type) {
+	case *string:
+		*t = string(data)
+	case *[]byte:
+		*t = slices.Clone(data)
+	case *any:
+		*t = string(data)
+	default:
+		return fmt.Errorf("codec text: cannot decode into %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// upper is a codec of the tests: text in upper case.
+type upper struct{ mediaType string }
+
+func (u upper) ContentType() string { return u.mediaType }
+
+func (upper) Encode(v any) ([]byte, error) { return bytes.ToUpper([]byte(v.(string))), nil }
+
+func (upper) Decode(data []byte, v any) error {
+	*v.(*string) = strings.ToLower(string(data))
+	return nil
+}
+
+func init() {
+	Register("upper", upper{"text/x-upper"})
+	Register("zjson", upper{"application/json"}) // after "json" in order
+}
+
+func TestRoundTrip(t *testing.T) {
+	type order struct {
+		ID    string  `json:"id"`
+		Total float64 `json:"total"`
+	}
+	tests := []struct {
+		name        string
+		contentType string // of the received message
+		want        string // codec negotiated
+		value       any
+		into        func() any // new value to decode into
+	}{
+		{"json", "application/json", "json", order{"o-1", 12.5}, func() any { return new(order) }},
+		{"json with parameters", "application/json; charset=utf-8", "json", map[string]any{"id": "o-1"}, func() any { return new(map[string]any) }},
+		{"json in upper case", "Application/JSON", "json", []any{"a", 1.0}, func() any { return new([]any) }},
+		{"text", "text/plain", "text", "hello", func() any { return new(string) }},
+		{"text with charset", "text/plain; charset=utf-8", "text", "héllo", func() any { return new(string) }},
+		{"text as bytes", "text/plain", "text", []byte("raw"), func() any { return new([]byte) }},
+		{"registered by the application", "text/x-upper", "upper", "shout", func() any { return new(string) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, c, ok := ForContentType(tt.contentType)
+			if !ok || name != tt.want {
+				t.Fatalf("ForContentType(%q) = %q, %v, want %q", tt.contentType, name, ok, tt.want)
+			}
+			byName, err := Lookup(name)
+			if err != nil || byName != c {
+				t.Fatalf("Lookup(%q) = %v, %v, want the codec of ForContentType", name, byName, err)
+			}
+			// What the sender encodes, the receiver finds the codec of.
+			if back, _, _ := ForContentType(c.ContentType()); back != name {
+				t.Errorf("ForContentType(%q) = %q, want %q", c.ContentType(), back, name)
+			}
+			data, err := c.Encode(tt.value)
+			if err != nil {
+				t.Fatalf("Encode(%v) = %v", tt.value, err)
+			}
+			v := tt.into()
+			if err := c.Decode(data, v); err != nil {
+				t.Fatalf("Decode(%q) = %v", data, err)
+			}
+			if got := reflect.ValueOf(v).Elem().Interface(); !reflect.DeepEqual(got, tt.value) {
+				t.Errorf("round trip of %#v = %#v", tt.value, got)
+			}
+		})
+	}
+}
+
+func TestUnknownContentType(t *testing.T) {
+	for _, contentType := range []string{"application/x-protobuf", "text/html", "", "application/json;;", "json"} {
+		if name, c, ok := ForContentType(contentType); ok || name != "" || c != nil {
+			t.Errorf("ForContentType(%q) = %q, %v, %v, want no codec", contentType, name, c, ok)
+		}
+	}
+}
+
+func TestLookupUnknown(t *testing.T) {
+	_, err := Lookup("flatbuffers")
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("Lookup(flatbuffers) = %v, want ErrUnknownCodec", err)
+	}
+	// The error tells what the configuration may use instead.
+	if !strings.Contains(err.Error(), `"json"`) || !strings.Contains(err.Error(), `"text"`) {
+		t.Errorf("Lookup(flatbuffers) = %v, want the registered names", err)
+	}
+	if names := Names(); !slices.Equal(names, []string{"json", "text", "upper", "zjson"}) {
+		t.Errorf("Names() = %q", names)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Codec
+	}{
+		{"", JSON{}},
+		{"nil", nil},
+		{"json", JSON{}},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q, %v) did not panic", tt.name, tt.c)
+				}
+			}()
+			Register(tt.name, tt.c)
+		}()
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var order struct{ ID string }
+	err := JSON{}.Decode([]byte(`{"ID": 42}`), &order)
+	if !errors.Is(err, broker.ErrSchemaValidation) {
+		t.Errorf("JSON Decode of a mistyped field = %v, want ErrSchemaValidation", err)
+	}
+	if err := (JSON{}).Decode([]byte("not json"), &order); !errors.Is(err, broker.ErrSchemaValidation) {
+		t.Errorf("JSON Decode of invalid data = %v, want ErrSchemaValidation", err)
+	}
+	if _, err := (Text{}).Encode(42); err == nil {
+		t.Error("Text Encode(42) succeeded")
+	}
+	var n int
+	if err := (Text{}).Decode([]byte("42"), &n); err == nil {
+		t.Error("Text Decode into *int succeeded")
+	}
+}
@@ -0,0 +1,99 @@
+// Package correlation propagates the correlation and causation IDs of
+// CloudEvents along the chains of events handled and published.
+//
+// CAUSAL CHAINS:
+//
+//	One click on "Buy" becomes order.created, then payment.requested,
+//	payment.captured, stock.reserved, shipment.planned… published by as
+//	many services. To follow such a chain in the logs or an event store,
+//	every event carries two extension attributes:
+//
+//	  correlationid  the ID shared by the whole chain: the id of its first event
+//	  causationid    the id of the event whose handling published this one
+//
+//	  order.created     id=A  correlationid=A
+//	  payment.requested id=B  correlationid=A  causationid=A
+//	  payment.captured  id=C  correlationid=A  causationid=B
+//
+// THROUGH THE CONTEXT:
+//
+//	A handler does not pass the IDs around by hand: the received event is
+//	put in the context.Context of its handling, and every event published
+//	with that context inherits from it:
+//
+//	  ctx = correlation.NewContext(ctx, correlation.FromAttributes(received))
+//	  …
+//	  for name, value := range correlation.Next(ctx, newID).Attributes() {
+//	      outgoing[name] = value   // "ce-"+name header in binary content mode
+//	  }
+//
+//	Without an event in the context, Next starts a new chain.
+package correlation
+
+import "context"
+
+const (
+	// CorrelationAttribute is the CloudEvents extension attribute holding the ID of the chain.
+	CorrelationAttribute = "correlationid"
+	// CausationAttribute is the CloudEvents extension attribute holding the id of the cause.
+	CausationAttribute = "causationid"
+)
+
+// Chain locates an event in its causal chain.
+type Chain struct {
+	ID            string // id of the event
+	CorrelationID string // id of the first event of the chain
+	CausationID   string // id of the event that caused this one, "" for the first
+}
+
+// FromAttributes returns the chain of the event with these CloudEvents
+// attributes, by lower case name. An event published before the IDs were
+// propagated starts its own chain.
+func FromAttributes(attrs map[string]string) Chain {
+	c := Chain{ID: attrs["id"], CorrelationID: attrs[CorrelationAttribute], CausationID: attrs[CausationAttribute]}
+	if c.CorrelationID == "" {
+		c.CorrelationID = c.ID
+	}
+	return c
+}
+
+// Attributes returns the correlationid and causationid attributes of c,
+// without the empty ones.
+func (c Chain) Attributes() map[string]string {
+	attrs := make(map[string]string, 2)
+	if c.CorrelationID != "" {
+		attrs[CorrelationAttribute] = c.CorrelationID
+	}
+	if c.CausationID != "" {
+		attrs[CausationAttribute] = c.CausationID
+	}
+	return attrs
+}
+
+// contextKey is the key of the handled event in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the chain of the event handled.
+func NewContext(ctx context.Context, c Chain) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the chain of the event handled with ctx, if any.
+func FromContext(ctx context.Context) (Chain, bool) {
+	c, ok := ctx.Value(contextKey{}).(Chain)
+	return c, ok && c.ID != ""
+}
+
+// Next returns the chain of the new event id published while handling the
+// event of ctx: same correlation, caused by it. Without an event in ctx,
+// id starts a new chain.
+func Next(ctx context.Context, id string) Chain {
+	parent, ok := FromContext(ctx)
+	if !ok {
+		return Chain{ID: id, CorrelationID: id}
+	}
+	if parent.CorrelationID == "" {
+		parent.CorrelationID = parent.ID
+	}
+	return Chain{ID: id, CorrelationID: parent.CorrelationID, CausationID: parent.ID}
+}
@@ -0,0 +1,609 @@
+// Package gocdk is the driver of the Go Cloud Development Kit pubsub API
+// (gocloud.dev/pubsub) on NATS, for the applications written against its
+// portable types: they get the CloudEvents and JetStream features of this
+// repository by changing a URL.
+//
+//	import _ "github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/gocdk"
+//
+//	topic, err := pubsub.OpenTopic(ctx, "natsce://orders.created?jetstream&source=/shop&type=order.created")
+//	err = topic.Send(ctx, &pubsub.Message{Body: order, Metadata: map[string]string{"ce-subject": id}})
+//
+//	sub, err := pubsub.OpenSubscription(ctx, "natsce://orders.>?stream=ORDERS&durable=billing")
+//	msg, err := sub.Receive(ctx)
+//	msg.Ack()
+//
+// THE URLS:
+//
+//	natsce://<subject>, wildcards written as they are (natsce://orders.>:
+//	net/url refuses the escapes %3E and %2A in a host), with the query
+//	parameters:
+//
+//	  topic         jetstream        publish to a stream, waiting for its ack
+//	                source, type     make every message a CloudEvent (below)
+//	  subscription  queue=<group>    core NATS queue group
+//	                stream=<name>    JetStream, with the durable pull consumer
+//	                durable=<name>   of stream, created on the subject if missing
+//
+//	The server is the one of $NATS_URL (nats://localhost:4222 by default);
+//	use URLOpener for a connection of your own. The scheme is not "nats",
+//	the one of the official gocloud.dev/pubsub/natspubsub driver, so both
+//	drivers may be imported by the same program.
+//
+// CLOUDEVENTS:
+//
+//	The metadata of a message are its NATS headers, so the "ce-*" metadata
+//	are the attributes of a CloudEvent in binary content mode, read and
+//	written by every mode of natsPubSub. With source= on the topic, the
+//	missing required attributes are filled in (specversion, a new id,
+//	source, type, time). The "ce-id" of a message is its Nats-Msg-Id too:
+//	a message sent twice by a retrying application is stored once by the
+//	duplicate window of the stream.
+//
+// ACKNOWLEDGEMENTS AND ERRORS:
+//
+//	Core NATS subscriptions have nothing to acknowledge (Nack is not
+//	supported); the JetStream ones ack and nak each message. gcerrors.Code
+//	classifies the errors of nats.go (nats.ErrPermissionViolation is
+//	PermissionDenied, nats.ErrTimeout on a publication DeadlineExceeded…),
+//	and ErrorAs gives them back:
+//
+//	  var apiErr *jetstream.APIError
+//	  if topic.ErrorAs(err, &apiErr) { … apiErr.ErrorCode … }
+//
+// This package is its own module, depending on nats.go and the Go CDK
+// only: the Go CDK and its cloud dependencies are downloaded by the
+// applications using it, not by the ones of the rest of this repository.
+package gocdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"gocloud.dev/pubsub/driver"
+)
+
+// Scheme is the URL scheme registered with pubsub.DefaultURLMux, not
+// "nats": gocloud.dev/pubsub/natspubsub registers that one, and a program
+// importing both would panic at init.
+const Scheme = "natsce"
+
+const (
+	// receiveWait bounds a ReceiveBatch waiting for the first message; the
+	// portable type calls it again.
+	receiveWait = time.Second
+	// ceAttributePrefix prefixes the CloudEvents attributes in the headers.
+	ceAttributePrefix = "ce-"
+)
+
+// sendBatcherOpts and recvBatcherOpts size the batches of the portable
+// types: a publication is one message, a JetStream fetch up to 100.
+var (
+	sendBatcherOpts = &batcher.Options{MaxBatchSize: 1, MaxHandlers: 100}
+	recvBatcherOpts = &batcher.Options{MaxBatchSize: 100, MaxHandlers: 1}
+	ackBatcherOpts  = &batcher.Options{MaxBatchSize: 100, MaxHandlers: 2}
+)
+
+// errNotOpened is returned by the topics and subscriptions of no connection.
+var errNotOpened = errors.New("gocdk: not opened")
+
+func init() {
+	o := new(lazyURLOpener)
+	pubsub.DefaultURLMux().RegisterTopic(Scheme, o)
+	pubsub.DefaultURLMux().RegisterSubscription(Scheme, o)
+}
+
+// lazyURLOpener connects to $NATS_URL on the first URL opened. A failed
+// connection is not kept: the next URL opened tries again.
+type lazyURLOpener struct {
+	mu     sync.Mutex
+	opener *URLOpener
+}
+
+// open returns the URLOpener of the default connection, connecting when
+// there is none yet.
+func (o *lazyURLOpener) open() (*URLOpener, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.opener != nil {
+		return o.opener, nil
+	}
+	server := os.Getenv("NATS_URL")
+	if server == "" {
+		server = nats.DefaultURL
+	}
+	nc, err := nats.Connect(server, nats.Name("gocdk"))
+	if err != nil {
+		return nil, opError("connect", "", err)
+	}
+	o.opener = &URLOpener{Connection: nc}
+	return o.opener, nil
+}
+
+// OpenTopicURL implements pubsub.TopicURLOpener.
+func (o *lazyURLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	opener, err := o.open()
+	if err != nil {
+		return nil, fmt.Errorf("open topic %v: %w", u, err)
+	}
+	return opener.OpenTopicURL(ctx, u)
+}
+
+// OpenSubscriptionURL implements pubsub.SubscriptionURLOpener.
+func (o *lazyURLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
+	opener, err := o.open()
+	if err != nil {
+		return nil, fmt.Errorf("open subscription %v: %w", u, err)
+	}
+	return opener.OpenSubscriptionURL(ctx, u)
+}
+
+// URLOpener opens the natsce:// URLs on Connection.
+type URLOpener struct {
+	Connection *nats.Conn
+}
+
+// OpenTopicURL implements pubsub.TopicURLOpener.
+func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	opts := TopicOptions{Source: u.Query().Get("source"), Type: u.Query().Get("type")}
+	_, opts.JetStream = u.Query()["jetstream"]
+	for param := range u.Query() {
+		if param != "jetstream" && param != "source" && param != "type" {
+			return nil, fmt.Errorf("open topic %v: unknown query parameter %q", u, param)
+		}
+	}
+	return OpenTopic(o.Connection, subjectOf(u), &opts)
+}
+
+// OpenSubscriptionURL implements pubsub.SubscriptionURLOpener.
+func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
+	q := u.Query()
+	opts := SubscriptionOptions{Queue: q.Get("queue"), Stream: q.Get("stream"), Durable: q.Get("durable")}
+	for param := range q {
+		if param != "queue" && param != "stream" && param != "durable" {
+			return nil, fmt.Errorf("open subscription %v: unknown query parameter %q", u, param)
+		}
+	}
+	return OpenSubscription(ctx, o.Connection, subjectOf(u), &opts)
+}
+
+// subjectOf returns the subject of a natsce:// URL, its host and path.
+func subjectOf(u *url.URL) string {
+	return path.Join(u.Host, u.Path)
+}
+
+// ─── Topics ────────────────────────────────────────────────────────────
+
+// TopicOptions are the options of OpenTopic.
+type TopicOptions struct {
+	// JetStream publishes to the stream of the subject, waiting for its
+	// ack: a message not stored is an error of Send.
+	JetStream bool
+	// Source, when set, makes every message a CloudEvent of this source,
+	// of Type unless its "ce-type" metadata says otherwise.
+	Source string
+	Type   string
+}
+
+// topic implements driver.Topic.
+type topic struct {
+	nc      *nats.Conn
+	js      jetstream.JetStream // nil for core NATS
+	subject string
+	opts    TopicOptions
+}
+
+var _ driver.Topic = (*topic)(nil)
+
+// OpenTopic returns the topic publishing on subject with nc.
+func OpenTopic(nc *nats.Conn, subject string, opts *TopicOptions) (*pubsub.Topic, error) {
+	dt, err := openTopic(nc, subject, opts)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewTopic(dt, sendBatcherOpts), nil
+}
+
+// openTopic returns the driver of OpenTopic.
+func openTopic(nc *nats.Conn, subject string, opts *TopicOptions) (*topic, error) {
+	if opts == nil {
+		opts = &TopicOptions{}
+	}
+	if opts.Source == "" && opts.Type != "" {
+		return nil, fmt.Errorf("topic %q: a CloudEvents type needs a source", subject)
+	}
+	t := &topic{nc: nc, subject: subject, opts: *opts}
+	if opts.JetStream {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return nil, err
+		}
+		t.js = js
+	}
+	return t, nil
+}
+
+// SendBatch implements driver.Topic.
+func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
+	if t == nil || t.nc == nil {
+		return errNotOpened
+	}
+	for _, dm := range ms {
+		m := t.natsMsg(dm)
+		if dm.BeforeSend != nil {
+			if err := dm.BeforeSend(asNatsMsg(m)); err != nil {
+				return err
+			}
+		}
+		if err := t.publish(ctx, m); err != nil {
+			return err
+		}
+		if dm.AfterSend != nil {
+			if err := dm.AfterSend(asNatsMsg(m)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// natsMsg returns the NATS message of dm, a CloudEvent with -source.
+func (t *topic) natsMsg(dm *driver.Message) *nats.Msg {
+	m := nats.NewMsg(t.subject)
+	m.Data = dm.Body
+	for key, value := range dm.Metadata {
+		m.Header.Set(key, value)
+	}
+	if t.opts.Source != "" {
+		defaults := map[string]string{
+			"specversion": "1.0",
+			"id":          nuid.Next(),
+			"source":      t.opts.Source,
+			"type":        t.opts.Type,
+			"time":        time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		for name, value := range defaults {
+			if m.Header.Get(ceAttributePrefix+name) == "" && value != "" {
+				m.Header.Set(ceAttributePrefix+name, value)
+			}
+		}
+	}
+	if id := m.Header.Get(ceAttributePrefix + "id"); id != "" && m.Header.Get(nats.MsgIdHdr) == "" {
+		m.Header.Set(nats.MsgIdHdr, id)
+	}
+	return m
+}
+
+// publish sends m, to the stream and waiting for its ack with JetStream.
+func (t *topic) publish(ctx context.Context, m *nats.Msg) error {
+	if t.js != nil {
+		_, err := t.js.PublishMsg(ctx, m)
+		return opError("publish", m.Subject, err)
+	}
+	return opError("publish", m.Subject, t.nc.PublishMsg(m))
+}
+
+// IsRetryable implements driver.Topic.
+func (*topic) IsRetryable(error) bool { return false }
+
+// As implements driver.Topic, for *nats.Conn.
+func (t *topic) As(i any) bool {
+	c, ok := i.(**nats.Conn)
+	if ok && t != nil {
+		*c = t.nc
+	}
+	return ok && t != nil
+}
+
+// ErrorAs implements driver.Topic.
+func (*topic) ErrorAs(err error, i any) bool { return errorAs(err, i) }
+
+// ErrorCode implements driver.Topic.
+func (*topic) ErrorCode(err error) gcerrors.ErrorCode { return errorCode(err) }
+
+// Close implements driver.Topic, leaving the connection open.
+func (*topic) Close() error { return nil }
+
+// asNatsMsg returns the As function of m, for **nats.Msg.
+func asNatsMsg(m *nats.Msg) func(any) bool {
+	return func(i any) bool {
+		p, ok := i.(**nats.Msg)
+		if ok {
+			*p = m
+		}
+		return ok
+	}
+}
+
+// ─── Subscriptions ─────────────────────────────────────────────────────
+
+// SubscriptionOptions are the options of OpenSubscription.
+type SubscriptionOptions struct {
+	// Queue is the queue group of a core NATS subscription.
+	Queue string
+	// Stream and Durable select the JetStream pull consumer, created on
+	// the subject when missing; both or none.
+	Stream  string
+	Durable string
+}
+
+// subscription implements driver.Subscription.
+type subscription struct {
+	sub  *nats.Subscription // core NATS
+	cons jetstream.Consumer // JetStream
+}
+
+var _ driver.Subscription = (*subscription)(nil)
+
+// OpenSubscription returns the subscription of subject with nc.
+func OpenSubscription(ctx context.Context, nc *nats.Conn, subject string, opts *SubscriptionOptions) (*pubsub.Subscription, error) {
+	ds, err := openSubscription(ctx, nc, subject, opts)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewSubscription(ds, recvBatcherOpts, ackBatcherOpts), nil
+}
+
+// openSubscription returns the driver of OpenSubscription.
+func openSubscription(ctx context.Context, nc *nats.Conn, subject string, opts *SubscriptionOptions) (*subscription, error) {
+	if opts == nil {
+		opts = &SubscriptionOptions{}
+	}
+	switch {
+	case (opts.Stream == "") != (opts.Durable == ""):
+		return nil, fmt.Errorf("subscription %q: stream and durable go together", subject)
+	case opts.Stream != "" && opts.Queue != "":
+		return nil, fmt.Errorf("subscription %q: a queue group is for core NATS, the durable consumer is shared already", subject)
+	case opts.Stream == "":
+		sub, err := nc.QueueSubscribeSync(subject, opts.Queue)
+		if err != nil {
+			return nil, opError("subscribe", subject, err)
+		}
+		return &subscription{sub: sub}, nil
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	cons, err := js.Consumer(ctx, opts.Stream, opts.Durable)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		cons, err = js.CreateConsumer(ctx, opts.Stream, jetstream.ConsumerConfig{
+			Durable:       opts.Durable,
+			FilterSubject: subject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+		})
+	}
+	if err != nil {
+		return nil, opError("subscribe", subject, err)
+	}
+	return &subscription{cons: cons}, nil
+}
+
+// ReceiveBatch implements driver.Subscription, waiting up to receiveWait
+// for the first message.
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	switch {
+	case s == nil || (s.sub == nil && s.cons == nil):
+		return nil, errNotOpened
+	case s.cons != nil:
+		return s.fetch(ctx, maxMessages)
+	}
+	wait, cancel := context.WithTimeout(ctx, receiveWait)
+	defer cancel()
+	m, err := s.sub.NextMsgWithContext(wait)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, opError("receive", s.sub.Subject, err)
+	}
+	ms := []*driver.Message{coreMessage(m)}
+	for len(ms) < maxMessages {
+		if pending, _, _ := s.sub.Pending(); pending == 0 {
+			break
+		}
+		m, err := s.sub.NextMsgWithContext(ctx)
+		if err != nil {
+			break
+		}
+		ms = append(ms, coreMessage(m))
+	}
+	return ms, nil
+}
+
+// fetch receives up to maxMessages of the JetStream consumer.
+func (s *subscription) fetch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	wait, cancel := context.WithTimeout(ctx, receiveWait)
+	defer cancel()
+	subject := s.cons.CachedInfo().Config.FilterSubject
+	fetched, err := s.cons.Fetch(maxMessages, jetstream.FetchContext(wait))
+	if err != nil {
+		return nil, opError("fetch", subject, err)
+	}
+	var ms []*driver.Message
+	for jm := range fetched.Messages() {
+		ms = append(ms, jetStreamMessage(jm))
+	}
+	if err := fetched.Error(); err != nil && len(ms) == 0 && ctx.Err() == nil &&
+		!errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, opError("fetch", subject, err)
+	}
+	return ms, nil
+}
+
+// coreMessage returns the driver message of a core NATS message.
+func coreMessage(m *nats.Msg) *driver.Message {
+	return &driver.Message{
+		LoggableID: m.Header.Get(nats.MsgIdHdr),
+		Body:       m.Data,
+		Metadata:   metadata(m.Header),
+		AsFunc:     asNatsMsg(m),
+	}
+}
+
+// jetStreamMessage returns the driver message of a JetStream message, its
+// AckID.
+func jetStreamMessage(jm jetstream.Msg) *driver.Message {
+	id := jm.Headers().Get(nats.MsgIdHdr)
+	if meta, err := jm.Metadata(); err == nil && id == "" {
+		id = fmt.Sprintf("%s/%d", meta.Stream, meta.Sequence.Stream)
+	}
+	return &driver.Message{
+		LoggableID: id,
+		Body:       jm.Data(),
+		Metadata:   metadata(nats.Header(jm.Headers())),
+		AckID:      jm,
+		AsFunc: func(i any) bool {
+			p, ok := i.(*jetstream.Msg)
+			if ok {
+				*p = jm
+			}
+			return ok
+		},
+	}
+}
+
+// metadata returns the first value of every header.
+func metadata(h nats.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	md := make(map[string]string, len(h))
+	for key, values := range h {
+		if len(values) > 0 {
+			md[key] = values[0]
+		}
+	}
+	return md
+}
+
+// SendAcks implements driver.Subscription, acknowledging the JetStream
+// messages.
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	var errs []error
+	for _, id := range ackIDs {
+		if jm, ok := id.(jetstream.Msg); ok {
+			errs = append(errs, opError("ack", jm.Subject(), jm.Ack()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CanNack implements driver.Subscription: JetStream redelivers, core
+// NATS does not.
+func (s *subscription) CanNack() bool {
+	return s != nil && s.cons != nil
+}
+
+// SendNacks implements driver.Subscription.
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	var errs []error
+	for _, id := range ackIDs {
+		if jm, ok := id.(jetstream.Msg); ok {
+			errs = append(errs, opError("nak", jm.Subject(), jm.Nak()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IsRetryable implements driver.Subscription.
+func (*subscription) IsRetryable(error) bool { return false }
+
+// As implements driver.Subscription, for *nats.Subscription or
+// jetstream.Consumer.
+func (s *subscription) As(i any) bool {
+	if s == nil {
+		return false
+	}
+	switch p := i.(type) {
+	case **nats.Subscription:
+		*p = s.sub
+		return s.sub != nil
+	case *jetstream.Consumer:
+		*p = s.cons
+		return s.cons != nil
+	}
+	return false
+}
+
+// ErrorAs implements driver.Subscription.
+func (*subscription) ErrorAs(err error, i any) bool { return errorAs(err, i) }
+
+// ErrorCode implements driver.Subscription.
+func (*subscription) ErrorCode(err error) gcerrors.ErrorCode { return errorCode(err) }
+
+// Close implements driver.Subscription, unsubscribing a core NATS
+// subscription and leaving a durable consumer in place.
+func (s *subscription) Close() error {
+	if s == nil || s.sub == nil {
+		return nil
+	}
+	return s.sub.Unsubscribe()
+}
+
+// ─── Errors ────────────────────────────────────────────────────────────
+
+// errorType is the type of the error interface.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// errorAs is errors.As, false instead of panicking for a target that is
+// not a pointer to an error type.
+func errorAs(err error, target any) bool {
+	t := reflect.TypeOf(target)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return false
+	}
+	if e := t.Elem(); e.Kind() != reflect.Interface && !e.Implements(errorType) {
+		return false
+	}
+	return errors.As(err, target)
+}
+
+// opError wraps the error of nats.go of op on subject, nil for no error.
+func opError(op, subject string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if subject == "" {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return fmt.Errorf("%s %s: %w", op, subject, err)
+}
+
+// errorCode returns the gcerrors code of an error of nats.go.
+func errorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case errors.Is(err, errNotOpened), errors.Is(err, nats.ErrNoResponders), errors.Is(err, jetstream.ErrNoStreamResponse),
+		errors.Is(err, jetstream.ErrStreamNotFound), errors.Is(err, jetstream.ErrConsumerNotFound):
+		return gcerrors.NotFound
+	case errors.Is(err, nats.ErrAuthorization), errors.Is(err, nats.ErrAuthExpired),
+		errors.Is(err, nats.ErrAuthRevoked), errors.Is(err, nats.ErrAccountAuthExpired),
+		errors.Is(err, nats.ErrPermissionViolation):
+		return gcerrors.PermissionDenied
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return gcerrors.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrConnectionDraining),
+		errors.Is(err, nats.ErrNoServers), errors.Is(err, nats.ErrDisconnected),
+		errors.Is(err, nats.ErrInvalidConnection), errors.Is(err, nats.ErrConnectionReconnecting):
+		return gcerrors.FailedPrecondition
+	case errors.Is(err, nats.ErrBadSubject):
+		return gcerrors.InvalidArgument
+	case errors.Is(err, nats.ErrMaxPayload), errors.Is(err, nats.ErrReconnectBufExceeded):
+		return gcerrors.ResourceExhausted
+	}
+	return gcerrors.Unknown
+}
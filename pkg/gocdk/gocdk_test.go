@@ -0,0 +1,454 @@
+package gocdk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/driver"
+	"gocloud.dev/pubsub/drivertest"
+)
+
+// harness runs the conformance tests of the Go CDK on the server of
+// $NATS_URL, with JetStream enabled for the JetStream ones.
+type harness struct {
+	nc        *nats.Conn
+	js        jetstream.JetStream
+	jetStream bool
+	durables  int // durable consumers created, to name the next one
+}
+
+// newHarness returns the drivertest.HarnessMaker of core NATS, or of
+// JetStream.
+func newHarness(jetStream bool) drivertest.HarnessMaker {
+	return func(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+		server := os.Getenv("NATS_URL")
+		if server == "" {
+			t.Skip("NATS_URL not set: no server for the conformance tests")
+		}
+		nc, err := nats.Connect(server)
+		if err != nil {
+			return nil, err
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return &harness{nc: nc, js: js, jetStream: jetStream}, nil
+	}
+}
+
+// name returns the subject and stream name of a test.
+func name(testName string) string {
+	return "gocdk_" + strings.NewReplacer("/", "_", " ", "_", ".", "_").Replace(testName)
+}
+
+func (h *harness) CreateTopic(ctx context.Context, testName string) (driver.Topic, func(), error) {
+	subject := name(testName)
+	cleanup := func() {}
+	if h.jetStream {
+		if _, err := h.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{Name: subject, Subjects: []string{subject}}); err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { _ = h.js.DeleteStream(context.Background(), subject) }
+	}
+	dt, err := openTopic(h.nc, subject, &TopicOptions{JetStream: h.jetStream})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return dt, cleanup, nil
+}
+
+func (h *harness) MakeNonexistentTopic(context.Context) (driver.Topic, error) {
+	return (*topic)(nil), nil
+}
+
+func (h *harness) CreateSubscription(ctx context.Context, dt driver.Topic, testName string) (driver.Subscription, func(), error) {
+	t := dt.(*topic)
+	opts := &SubscriptionOptions{}
+	if h.jetStream {
+		h.durables++
+		opts.Stream, opts.Durable = t.subject, fmt.Sprintf("%s_%d", name(testName), h.durables)
+	}
+	ds, err := openSubscription(ctx, h.nc, t.subject, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ds, func() { _ = ds.Close() }, nil
+}
+
+func (h *harness) MakeNonexistentSubscription(context.Context) (driver.Subscription, func(), error) {
+	return (*subscription)(nil), func() {}, nil
+}
+
+func (h *harness) Close() {
+	h.nc.Close()
+}
+
+func (h *harness) MaxBatchSizes() (int, int) {
+	return sendBatcherOpts.MaxBatchSize, 0
+}
+
+func (*harness) SupportsMultipleSubscriptions() bool {
+	return true
+}
+
+// asTest checks the types given by As and ErrorAs.
+type asTest struct {
+	jetStream bool
+}
+
+func (asTest) Name() string {
+	return "nats"
+}
+
+func (asTest) TopicCheck(t *pubsub.Topic) error {
+	var nc *nats.Conn
+	if !t.As(&nc) {
+		return errors.New("topic.As(*nats.Conn) failed")
+	}
+	return nil
+}
+
+func (a asTest) SubscriptionCheck(s *pubsub.Subscription) error {
+	if a.jetStream {
+		var cons jetstream.Consumer
+		if !s.As(&cons) {
+			return errors.New("subscription.As(jetstream.Consumer) failed")
+		}
+		return nil
+	}
+	var sub *nats.Subscription
+	if !s.As(&sub) {
+		return errors.New("subscription.As(*nats.Subscription) failed")
+	}
+	return nil
+}
+
+func (asTest) TopicErrorCheck(t *pubsub.Topic, err error) error {
+	var s string
+	if t.ErrorAs(err, &s) {
+		return errors.New("topic.ErrorAs(*string) succeeded")
+	}
+	return nil
+}
+
+func (asTest) SubscriptionErrorCheck(s *pubsub.Subscription, err error) error {
+	var str string
+	if s.ErrorAs(err, &str) {
+		return errors.New("subscription.ErrorAs(*string) succeeded")
+	}
+	return nil
+}
+
+func (a asTest) MessageCheck(m *pubsub.Message) error {
+	if a.jetStream {
+		var jm jetstream.Msg
+		if !m.As(&jm) {
+			return errors.New("message.As(jetstream.Msg) failed")
+		}
+		return nil
+	}
+	var nm *nats.Msg
+	if !m.As(&nm) {
+		return errors.New("message.As(*nats.Msg) failed")
+	}
+	return nil
+}
+
+func (asTest) BeforeSend(as func(any) bool) error {
+	var m *nats.Msg
+	if !as(&m) {
+		return errors.New("BeforeSend As(*nats.Msg) failed")
+	}
+	return nil
+}
+
+func (asTest) AfterSend(as func(any) bool) error {
+	return nil
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness(false), []drivertest.AsTest{asTest{}})
+}
+
+func TestConformanceJetStream(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness(true), []drivertest.AsTest{asTest{jetStream: true}})
+}
+
+// ─── Without a server ──────────────────────────────────────────────────
+
+func TestSubjectOf(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"natsce://orders.created", "orders.created"},
+		{"natsce://orders.created?jetstream&source=/shop", "orders.created"},
+		{"natsce://orders.>?stream=ORDERS&durable=billing", "orders.>"},
+		{"natsce://orders.*.eu", "orders.*.eu"},
+		{"natsce://orders.created/", "orders.created"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) = %v", tt.url, err)
+		}
+		if got := subjectOf(u); got != tt.want {
+			t.Errorf("subjectOf(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want gcerrors.ErrorCode
+	}{
+		{"not opened", errNotOpened, gcerrors.NotFound},
+		{"no responders", opError("publish", "orders", nats.ErrNoResponders), gcerrors.NotFound},
+		{"no stream", opError("publish", "orders", jetstream.ErrNoStreamResponse), gcerrors.NotFound},
+		{"stream not found", opError("subscribe", "orders", jetstream.ErrStreamNotFound), gcerrors.NotFound},
+		{"permission violation", opError("publish", "orders", nats.ErrPermissionViolation), gcerrors.PermissionDenied},
+		{"authorization", opError("connect", "", nats.ErrAuthorization), gcerrors.PermissionDenied},
+		{"publish timeout", opError("publish", "orders", nats.ErrTimeout), gcerrors.DeadlineExceeded},
+		{"deadline", opError("fetch", "orders", context.DeadlineExceeded), gcerrors.DeadlineExceeded},
+		{"canceled", opError("fetch", "orders", context.Canceled), gcerrors.Canceled},
+		{"no servers", opError("connect", "", nats.ErrNoServers), gcerrors.FailedPrecondition},
+		{"connection closed", opError("publish", "orders", nats.ErrConnectionClosed), gcerrors.FailedPrecondition},
+		{"bad subject", opError("publish", "", nats.ErrBadSubject), gcerrors.InvalidArgument},
+		{"max payload", opError("publish", "orders", nats.ErrMaxPayload), gcerrors.ResourceExhausted},
+		{"other", errors.New("boom"), gcerrors.Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpError(t *testing.T) {
+	if err := opError("publish", "orders", nil); err != nil {
+		t.Errorf("opError(nil) = %v, want nil", err)
+	}
+	cause := &jetstream.APIError{Code: 503, ErrorCode: jetstream.JSErrCodeJetStreamNotEnabled, Description: "jetstream not enabled"}
+	err := opError("publish", "orders", cause)
+	if got, want := err.Error(), "publish orders: "+cause.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	var apiErr *jetstream.APIError
+	if !errorAs(err, &apiErr) || apiErr != cause {
+		t.Errorf("errorAs(%v, *jetstream.APIError) = %v, want the cause", err, apiErr)
+	}
+	// Targets errors.As would panic on are refused.
+	var s string
+	for _, target := range []any{nil, apiErr, &s} {
+		if errorAs(err, target) {
+			t.Errorf("errorAs(%v, %T) = true, want false", err, target)
+		}
+	}
+}
+
+func TestNatsMsg(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TopicOptions
+		metadata map[string]string
+		want     map[string]string // headers wanted, "*" for any value
+	}{
+		{
+			name:     "plain message",
+			metadata: map[string]string{"region": "eu"},
+			want:     map[string]string{"region": "eu"},
+		},
+		{
+			name: "CloudEvent of the topic",
+			opts: TopicOptions{Source: "/shop", Type: "order.created"},
+			want: map[string]string{
+				"ce-specversion": "1.0", "ce-id": "*", "ce-source": "/shop", "ce-type": "order.created", "ce-time": "*",
+				nats.MsgIdHdr: "*",
+			},
+		},
+		{
+			name:     "attributes of the message win",
+			opts:     TopicOptions{Source: "/shop", Type: "order.created"},
+			metadata: map[string]string{"ce-id": "o-1", "ce-type": "order.paid", "ce-subject": "o-1"},
+			want: map[string]string{
+				"ce-specversion": "1.0", "ce-id": "o-1", "ce-source": "/shop", "ce-type": "order.paid", "ce-time": "*",
+				"ce-subject": "o-1", nats.MsgIdHdr: "o-1",
+			},
+		},
+		{
+			name:     "CloudEvent of the application",
+			metadata: map[string]string{"ce-id": "o-2", "ce-source": "/app"},
+			want:     map[string]string{"ce-id": "o-2", "ce-source": "/app", nats.MsgIdHdr: "o-2"},
+		},
+		{
+			name:     "message id of the application kept",
+			metadata: map[string]string{"ce-id": "o-3", nats.MsgIdHdr: "dedup-3"},
+			want:     map[string]string{"ce-id": "o-3", nats.MsgIdHdr: "dedup-3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dt, err := openTopic(nil, "orders.created", &tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := dt.natsMsg(&driver.Message{Body: []byte(`{"id":"o-1"}`), Metadata: tt.metadata})
+			if m.Subject != "orders.created" || string(m.Data) != `{"id":"o-1"}` {
+				t.Errorf("natsMsg = %s %q, want the subject of the topic and the body", m.Subject, m.Data)
+			}
+			if len(m.Header) != len(tt.want) {
+				t.Errorf("headers %v, want %v", m.Header, tt.want)
+			}
+			for key, want := range tt.want {
+				if got := m.Header.Get(key); got == "" || (want != "*" && got != want) {
+					t.Errorf("header %s = %q, want %q", key, got, want)
+				}
+			}
+			if id := m.Header.Get("ce-id"); id != "" && tt.metadata["ce-id"] == "" && m.Header.Get(nats.MsgIdHdr) != id {
+				t.Errorf("Nats-Msg-Id %q, want the generated ce-id %q", m.Header.Get(nats.MsgIdHdr), id)
+			}
+			if ts := m.Header.Get("ce-time"); ts != "" {
+				if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+					t.Errorf("ce-time %q: %v", ts, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCoreMessage(t *testing.T) {
+	m := nats.NewMsg("orders.created")
+	m.Data = []byte("{}")
+	m.Header.Set(nats.MsgIdHdr, "o-1")
+	m.Header.Set("ce-type", "order.created")
+	m.Header.Add("tag", "first")
+	m.Header.Add("tag", "second")
+
+	dm := coreMessage(m)
+	if dm.LoggableID != "o-1" || string(dm.Body) != "{}" || dm.AckID != nil {
+		t.Errorf("coreMessage = %+v, want the id and body, no AckID", dm)
+	}
+	want := map[string]string{nats.MsgIdHdr: "o-1", "ce-type": "order.created", "tag": "first"}
+	if !maps.Equal(dm.Metadata, want) {
+		t.Errorf("Metadata = %v, want %v", dm.Metadata, want)
+	}
+	var got *nats.Msg
+	if !dm.AsFunc(&got) || got != m {
+		t.Error("As(*nats.Msg) did not give the message")
+	}
+	var jm jetstream.Msg
+	if dm.AsFunc(&jm) {
+		t.Error("As(jetstream.Msg) of a core NATS message succeeded")
+	}
+	if md := metadata(nil); md != nil {
+		t.Errorf("metadata(nil) = %v, want nil", md)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	o := &URLOpener{}
+	topics := []string{
+		"natsce://orders?jetstrem",
+		"natsce://orders?type=order.created",
+	}
+	for _, raw := range topics {
+		u, _ := url.Parse(raw)
+		if _, err := o.OpenTopicURL(context.Background(), u); err == nil {
+			t.Errorf("OpenTopicURL(%s) succeeded", raw)
+		}
+	}
+	subscriptions := []string{
+		"natsce://orders?durabel=billing",
+		"natsce://orders?stream=ORDERS",
+		"natsce://orders?durable=billing",
+		"natsce://orders?stream=ORDERS&durable=billing&queue=q",
+	}
+	for _, raw := range subscriptions {
+		u, _ := url.Parse(raw)
+		if _, err := o.OpenSubscriptionURL(context.Background(), u); err == nil {
+			t.Errorf("OpenSubscriptionURL(%s) succeeded", raw)
+		}
+	}
+}
+
+// fakeServer listens on the loopback interface and answers the handshake
+// of a NATS client, enough for nats.Connect to succeed.
+func fakeServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.WriteString(conn, `INFO {"server_id":"fake","version":"2.11.0","headers":true,"max_payload":1048576}`+"\r\n")
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "PING") {
+						_, _ = io.WriteString(conn, "PONG\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + ln.Addr().String()
+}
+
+func TestLazyURLOpenerRetries(t *testing.T) {
+	// A port nothing listens on: the one of a listener closed.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback listener: %v", err)
+	}
+	closed.Close()
+
+	o := new(lazyURLOpener)
+	t.Setenv("NATS_URL", "nats://"+closed.Addr().String())
+	for i := range 2 {
+		if _, err := o.open(); errorCode(err) != gcerrors.FailedPrecondition {
+			t.Fatalf("open %d without a server = %v, want a connection error", i, err)
+		}
+	}
+
+	t.Setenv("NATS_URL", fakeServer(t))
+	opener, err := o.open()
+	if err != nil {
+		t.Fatalf("open once the server is up = %v, want the connection", err)
+	}
+	defer opener.Connection.Close()
+	if again, err := o.open(); err != nil || again != opener {
+		t.Errorf("open again = %v, %v, want the same connection", again, err)
+	}
+}
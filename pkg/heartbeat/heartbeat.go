@@ -0,0 +1,140 @@
+// Package heartbeat defines the liveness events of the long-running
+// components and how they are found.
+//
+// WHY HEARTBEATS:
+//
+//	A subscriber, a bridge or a gateway can be connected to NATS and yet
+//	be stuck, or be gone without anybody noticing: nothing tells the
+//	difference between "no traffic" and "nobody listening". Each
+//	long-running component therefore publishes, every interval, a small
+//	CloudEvent describing itself (name, mode, host, uptime, counters) on
+//	its own subject:
+//
+//	  _sys.app.heartbeat.<name>
+//
+//	and answers the pings published on _sys.app.ping with the same event,
+//	so a tool can list the fleet at once instead of waiting a full
+//	interval ("natsctl fleet"). A component is considered alive while its
+//	last heartbeat is younger than MissedIntervals intervals.
+//
+// EVENT:
+//
+//	The events are structured-mode CloudEvents of type
+//	io.nats.app.heartbeat, the Status being the data:
+//
+//	  {"specversion":"1.0","type":"io.nats.app.heartbeat","source":"natsPubSub/sub-host-42",
+//	   "id":"…","time":"…","datacontenttype":"application/json",
+//	   "data":{"name":"sub-host-42","mode":"sub","subject":"orders.>","received":1250,…}}
+package heartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// SubjectPrefix is the prefix of the heartbeat subjects, followed by the
+	// component name; subscribe to SubjectPrefix + ".>" to see them all.
+	SubjectPrefix = "_sys.app.heartbeat"
+	// PingSubject receives the requests the components answer with a heartbeat.
+	PingSubject = "_sys.app.ping"
+	// EventType is the CloudEvents type of the heartbeats.
+	EventType = "io.nats.app.heartbeat"
+	// MissedIntervals is the number of intervals without heartbeat after
+	// which a component is considered dead.
+	MissedIntervals = 3
+)
+
+// Status values of a heartbeat.
+const (
+	StatusRunning  = "running"
+	StatusStopping = "stopping" // last heartbeat, sent on a graceful shutdown
+)
+
+// Status describes a component, it is the data of a heartbeat event.
+type Status struct {
+	Name       string    `json:"name"`
+	App        string    `json:"app"`
+	Version    string    `json:"version"`
+	Mode       string    `json:"mode"`
+	Subject    string    `json:"subject,omitempty"`
+	Status     string    `json:"status"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	StartedAt  time.Time `json:"started_at"`
+	IntervalMS int64     `json:"interval_ms"`
+	Received   int64     `json:"received"`
+	Published  int64     `json:"published"`
+	Goroutines int       `json:"goroutines"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+}
+
+// Interval returns the heartbeat interval announced by the component.
+func (s Status) Interval() time.Duration {
+	return time.Duration(s.IntervalMS) * time.Millisecond
+}
+
+// Alive reports whether a component whose last heartbeat was seen at seen
+// is still alive at now.
+func (s Status) Alive(seen, now time.Time) bool {
+	return s.Status != StatusStopping && now.Sub(seen) < MissedIntervals*s.Interval()
+}
+
+// event is the structured-mode CloudEvent carrying a Status.
+type event struct {
+	SpecVersion     string    `json:"specversion"`
+	Type            string    `json:"type"`
+	Source          string    `json:"source"`
+	ID              string    `json:"id"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Status    `json:"data"`
+}
+
+// Subject returns the subject of the heartbeats of the component name.
+func Subject(name string) string {
+	return SubjectPrefix + "." + Token(name)
+}
+
+// Token turns name into a single subject token, replacing the characters
+// a token cannot hold (".", wildcards, white space) by "_".
+func Token(name string) string {
+	token := strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+	if token == "" {
+		return "_"
+	}
+	return token
+}
+
+// Encode returns the heartbeat event of s, with the given event id.
+func Encode(s Status, id string) ([]byte, error) {
+	return json.Marshal(event{
+		SpecVersion:     "1.0",
+		Type:            EventType,
+		Source:          s.App + "/" + s.Name,
+		ID:              id,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            s,
+	})
+}
+
+// Decode returns the Status carried by a heartbeat event.
+func Decode(data []byte) (Status, error) {
+	var ev event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return Status{}, err
+	}
+	if ev.Type != EventType {
+		return Status{}, fmt.Errorf("not a heartbeat: type %q", ev.Type)
+	}
+	return ev.Data, nil
+}
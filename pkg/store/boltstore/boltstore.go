@@ -0,0 +1,150 @@
+// Package boltstore is the backend of the store interface on a BoltDB file
+// (go.etcd.io/bbolt): one file on the local disk, each write synced before
+// it returns, available while the network is not.
+//
+//	s, err := boltstore.Open("/var/lib/natsPubSub/state.db")
+//
+// A file is opened by one process at a time: Open waits up to OpenTimeout
+// for another one to close it. The values are kept in the "store" bucket,
+// with their deadline (see store.Wrap); the expired ones are deleted when
+// read, and all of them every store.SweepInterval, by the transaction of a
+// Put.
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+// OpenTimeout bounds the wait for the file lock held by another process.
+const OpenTimeout = 10 * time.Second
+
+// bucket is the BoltDB bucket of the values.
+var bucket = []byte("store")
+
+var _ store.Store = (*Store)(nil)
+
+// Store implements store.Store on a BoltDB file. It is safe for concurrent
+// use.
+type Store struct {
+	db    *bolt.DB
+	swept time.Time // last sweep, by the write transactions, one at a time
+}
+
+// Open opens the BoltDB file path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// sweep deletes the expired values of b, at most every
+// store.SweepInterval.
+func (s *Store) sweep(b *bolt.Bucket) error {
+	if time.Since(s.swept) < store.SweepInterval {
+		return nil
+	}
+	s.swept = time.Now()
+	var expired [][]byte
+	if err := b.ForEach(func(k, v []byte) error {
+		if _, ok := store.Unwrap(v); !ok {
+			expired = append(expired, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get implements store.Store.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	var value []byte
+	expired := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucket).Get([]byte(key))
+		if raw == nil {
+			return store.ErrNotFound
+		}
+		v, ok := store.Unwrap(raw)
+		if !ok {
+			expired = true
+			return store.ErrNotFound
+		}
+		value = slices.Clone(v) // raw is only valid during the transaction
+		return nil
+	})
+	if expired {
+		_ = s.Delete(context.Background(), key)
+	}
+	return value, s.wrap("get", err)
+}
+
+// Put implements store.Store.
+func (s *Store) Put(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.wrap("put", s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if err := s.sweep(b); err != nil {
+			return err
+		}
+		return b.Put([]byte(key), store.Wrap(value, ttl))
+	}))
+}
+
+// Delete implements store.Store.
+func (s *Store) Delete(_ context.Context, key string) error {
+	return s.wrap("delete", s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	}))
+}
+
+// List implements store.Store, the keys being sorted in the file.
+func (s *Store) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if _, ok := store.Unwrap(v); ok {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return keys, s.wrap("list", err)
+}
+
+// Close implements store.Store, releasing the file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// wrap returns the store.Closed error for the operation op on a closed
+// file.
+func (s *Store) wrap(op string, err error) error {
+	if errors.Is(err, berrors.ErrDatabaseNotOpen) {
+		return store.Closed(op)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+// count returns the number of values in the file, expired or not.
+func count(t *testing.T, s *Store) int {
+	t.Helper()
+	var n int
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, key := range []string{"dedup/1", "dedup/2", "dedup/3"} {
+		_ = s.Put(ctx, key, nil, 10*time.Millisecond)
+	}
+	_ = s.Put(ctx, "positions/orders-view", []byte("42"), 0)
+	time.Sleep(20 * time.Millisecond)
+
+	// Within store.SweepInterval of the last sweep, the values never read
+	// again stay in the file.
+	_ = s.Put(ctx, "dedup/4", nil, time.Hour)
+	if n := count(t, s); n != 5 {
+		t.Fatalf("%d values before the sweep, want 5", n)
+	}
+	// Past it, the transaction of the next Put deletes them.
+	s.swept = time.Now().Add(-store.SweepInterval)
+	_ = s.Put(ctx, "dedup/5", nil, time.Hour)
+	if n := count(t, s); n != 3 {
+		t.Errorf("%d values after the sweep, want 3", n)
+	}
+	if value, err := s.Get(ctx, "positions/orders-view"); err != nil || string(value) != "42" {
+		t.Errorf("Get of the value without expiry = %q, %v", value, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Put(ctx, "positions/orders-view", []byte("42"), 0)
+	_ = s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, err := s.Get(ctx, "positions/orders-view"); err != nil || string(value) != "42" {
+		t.Errorf("Get after reopening = %q, %v, want 42", value, err)
+	}
+}
@@ -0,0 +1,121 @@
+// Package memory is the in-process backend of the store interface, for the
+// unit tests and the runs whose state may be lost with the process.
+//
+//	s := memory.New()
+//	dedup := store.NewDedup(s, "dedup/", time.Minute)
+//
+// The expired values are dropped when read or listed, and all of them
+// every store.SweepInterval, when a value is put.
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+var _ store.Store = (*Store)(nil)
+
+// entry is a value and its deadline, zero for none.
+type entry struct {
+	value    []byte
+	deadline time.Time
+}
+
+// expired reports whether the entry expired at now.
+func (e entry) expired(now time.Time) bool {
+	return !e.deadline.IsZero() && !now.Before(e.deadline)
+}
+
+// Store implements store.Store in memory. It is safe for concurrent use.
+type Store struct {
+	mu      sync.Mutex
+	closed  bool
+	entries map[string]entry
+	swept   time.Time // last deletion of the expired entries
+}
+
+// New returns an empty in-memory store.
+func New() *Store {
+	return &Store{entries: make(map[string]entry)}
+}
+
+// Get implements store.Store.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, store.Closed("get")
+	}
+	e, ok := s.entries[key]
+	if !ok || e.expired(time.Now()) {
+		delete(s.entries, key)
+		return nil, store.ErrNotFound
+	}
+	return slices.Clone(e.value), nil
+}
+
+// Put implements store.Store.
+func (s *Store) Put(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return store.Closed("put")
+	}
+	now := time.Now()
+	if now.Sub(s.swept) >= store.SweepInterval {
+		maps.DeleteFunc(s.entries, func(_ string, e entry) bool { return e.expired(now) })
+		s.swept = now
+	}
+	e := entry{value: slices.Clone(value)}
+	if ttl > 0 {
+		e.deadline = now.Add(ttl)
+	}
+	s.entries[key] = e
+	return nil
+}
+
+// Delete implements store.Store.
+func (s *Store) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return store.Closed("delete")
+	}
+	delete(s.entries, key)
+	return nil
+}
+
+// List implements store.Store.
+func (s *Store) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, store.Closed("list")
+	}
+	now := time.Now()
+	var keys []string
+	for key, e := range s.entries {
+		switch {
+		case e.expired(now):
+			delete(s.entries, key)
+		case strings.HasPrefix(key, prefix):
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// Close implements store.Store, dropping the values.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed, s.entries = true, nil
+	return nil
+}
@@ -0,0 +1,37 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	for _, key := range []string{"dedup/1", "dedup/2", "dedup/3"} {
+		_ = s.Put(ctx, key, nil, 10*time.Millisecond)
+	}
+	_ = s.Put(ctx, "positions/orders-view", []byte("42"), 0)
+	time.Sleep(20 * time.Millisecond)
+
+	// Within store.SweepInterval of the last sweep, the values never read
+	// again stay.
+	_ = s.Put(ctx, "dedup/4", nil, time.Hour)
+	if n := len(s.entries); n != 5 {
+		t.Fatalf("%d entries before the sweep, want 5", n)
+	}
+	// Past it, the next Put deletes them.
+	s.swept = time.Now().Add(-store.SweepInterval)
+	_ = s.Put(ctx, "dedup/5", nil, time.Hour)
+	for _, key := range []string{"dedup/1", "dedup/2", "dedup/3"} {
+		if _, ok := s.entries[key]; ok {
+			t.Errorf("%s expired, not swept", key)
+		}
+	}
+	if n := len(s.entries); n != 3 {
+		t.Errorf("%d entries after the sweep, want 3", n)
+	}
+}
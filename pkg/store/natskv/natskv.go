@@ -0,0 +1,113 @@
+// Package natskv is the backend of the store interface on a JetStream
+// key-value bucket: shared by the instances of a service, replicated by
+// the cluster, nothing more to run.
+//
+//	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "state", History: 1, TTL: time.Hour})
+//	s := natskv.New(kv)
+//
+// The values are stored with their deadline (see store.Wrap), so it works
+// with the servers before the per-key TTL of NATS 2.11; the expired ones
+// are deleted when read. The others are only purged by the TTL of the
+// bucket, which must be at least the longest TTL put: without it, the
+// keys never read again (the ids of a deduplication) stay forever.
+// Closing the store leaves the bucket and the connection open.
+package natskv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker/natsbroker"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+var _ store.Store = (*Store)(nil)
+
+// Store implements store.Store on a key-value bucket. It is safe for
+// concurrent use.
+type Store struct {
+	kv     jetstream.KeyValue
+	closed atomic.Bool
+}
+
+// New returns the store of the bucket kv.
+func New(kv jetstream.KeyValue) *Store {
+	return &Store{kv: kv}
+}
+
+// Get implements store.Store.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.closed.Load() {
+		return nil, store.Closed("get")
+	}
+	entry, err := s.kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, natsbroker.Classify("get", "", err)
+	}
+	value, ok := store.Unwrap(entry.Value())
+	if !ok {
+		_ = s.kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision()))
+		return nil, store.ErrNotFound
+	}
+	return value, nil
+}
+
+// Put implements store.Store.
+func (s *Store) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if s.closed.Load() {
+		return store.Closed("put")
+	}
+	_, err := s.kv.Put(ctx, key, store.Wrap(value, ttl))
+	return natsbroker.Classify("put", "", err)
+}
+
+// Delete implements store.Store.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if s.closed.Load() {
+		return store.Closed("delete")
+	}
+	return natsbroker.Classify("delete", "", s.kv.Delete(ctx, key))
+}
+
+// List implements store.Store, reading the last value of every key of the
+// bucket to skip the expired ones.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	if s.closed.Load() {
+		return nil, store.Closed("list")
+	}
+	w, err := s.kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, natsbroker.Classify("list", "", err)
+	}
+	defer w.Stop()
+	var keys []string
+	for {
+		select {
+		case entry := <-w.Updates():
+			if entry == nil { // the current values are all delivered
+				slices.Sort(keys)
+				return keys, nil
+			}
+			if _, ok := store.Unwrap(entry.Value()); ok && strings.HasPrefix(entry.Key(), prefix) {
+				keys = append(keys, entry.Key())
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close implements store.Store.
+func (s *Store) Close() error {
+	s.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,108 @@
+// Package redisstore is the backend of the store interface on a Redis
+// server (github.com/redis/go-redis), for the services already keeping
+// their state there.
+//
+//	opts, err := redis.ParseURL("redis://localhost:6379/0")
+//	s := redisstore.New(redis.NewClient(opts), "natsPubSub:")
+//
+// The keys are prefixed by a namespace, so several programs share a
+// database, and expire with the TTL of Redis itself. List scans the keys
+// of the namespace (SCAN, which does not block the server).
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+)
+
+// scanCount is the number of keys a SCAN call looks at.
+const scanCount = 1000
+
+// globEscaper escapes the special characters of the SCAN patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+var _ store.Store = (*Store)(nil)
+
+// Store implements store.Store on a Redis client. It is safe for
+// concurrent use.
+type Store struct {
+	client    *redis.Client
+	namespace string
+}
+
+// New returns the store of the keys of client prefixed by namespace. Close
+// closes the client.
+func New(client *redis.Client, namespace string) *Store {
+	return &Store{client: client, namespace: namespace}
+}
+
+// Get implements store.Store.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, s.namespace+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, store.ErrNotFound
+	}
+	return value, s.wrap("get", err)
+}
+
+// Put implements store.Store.
+func (s *Store) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.wrap("put", s.client.Set(ctx, s.namespace+key, value, ttl).Err())
+}
+
+// Delete implements store.Store.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	return s.wrap("delete", s.client.Del(ctx, s.namespace+key).Err())
+}
+
+// List implements store.Store.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := s.client.Scan(ctx, 0, globEscaper.Replace(s.namespace+prefix)+"*", scanCount).Iterator()
+	for it.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(it.Val(), s.namespace))
+	}
+	if err := it.Err(); err != nil {
+		return nil, s.wrap("list", err)
+	}
+	// SCAN may return a key twice, when the keys change meanwhile.
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// Close implements store.Store, closing the client.
+func (s *Store) Close() error {
+	return s.client.Close()
+}
+
+// wrap returns err, an error of Redis on op, as a *broker.Error of the
+// kind matching it: store.Closed on a closed client, broker.ErrConnect
+// when the server cannot be reached, broker.ErrPermission when it refuses
+// the credentials or the command.
+func (s *Store) wrap(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, redis.ErrClosed) {
+		return store.Closed(op)
+	}
+	be := &broker.Error{Op: op, Err: err}
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr), errors.Is(err, io.EOF):
+		be.Kind = broker.ErrConnect
+	case redis.HasErrorPrefix(err, "NOAUTH"), redis.HasErrorPrefix(err, "WRONGPASS"), redis.HasErrorPrefix(err, "NOPERM"):
+		be.Kind = broker.ErrPermission
+	}
+	return be
+}
@@ -0,0 +1,190 @@
+// Package store defines the small key-value Store interface the programs
+// keep their state in, implemented by the backends in the sub-packages.
+//
+// WHERE THE STATE LIVES:
+//
+//	The ids of the events already handled, the messages waiting in a
+//	spool, the last stream sequence a projection applied: a little state
+//	that must outlive the process, but whose right home depends on the
+//	deployment. The code using it is written against Store, and the
+//	operator chooses:
+//
+//	  memory.New()                  in process: unit tests, single runs
+//	  boltstore.Open(path)          one file on the local disk (BoltDB),
+//	                                available while NATS is not
+//	  natskv.New(kv)                a JetStream key-value bucket, shared
+//	                                by the instances, replicated
+//	  redisstore.New(client, ns)    a Redis server the services already use
+//
+// KEYS AND EXPIRY:
+//
+//	Keys are made of letters, digits and "-_/=.", without leading or
+//	trailing ".", so that every backend accepts them (NATS KV is the
+//	strictest); List returns them sorted. A value put with a TTL is gone
+//	once it expires; the backends without expiry of their own store its
+//	deadline with the value (see Wrap), drop it when read, and delete all
+//	the expired ones every SweepInterval, when a value is put: the ids of
+//	a deduplication are never read again once their window is over.
+//
+// HELPERS:
+//
+//	dedup := store.NewDedup(s, "dedup/", 2*time.Minute)
+//	if seen, _ := dedup.Seen(ctx, id); !seen {
+//	    handle(ev)
+//	    _ = dedup.Mark(ctx, id)
+//	}
+//
+//	positions := store.NewPositions(s, "positions/", 30*24*time.Hour)
+//	last, _ := positions.Load(ctx, "orders-view")   // resume after it
+//	_ = positions.Save(ctx, "orders-view", seq)
+//
+// ERRORS:
+//
+//	Beside ErrNotFound, a plain result, the backends return *broker.Error
+//	of the kinds of the brokers: broker.ErrClosed once closed (see
+//	Closed), broker.ErrConnect when their server cannot be reached,
+//	broker.ErrPermission when it refuses the operation:
+//
+//	  if errors.Is(err, broker.ErrConnect) { … }  // whatever the backend
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+)
+
+// Errors of the stores.
+var (
+	// ErrNotFound is returned by Get for a key absent or expired.
+	ErrNotFound = errors.New("key not found")
+	// ErrClosed is returned by the operations on a closed store.
+	ErrClosed = errors.New("store closed")
+)
+
+// Closed returns the error of the operation op on a closed store, of kind
+// broker.ErrClosed and matching ErrClosed, for the backends.
+func Closed(op string) error {
+	return &broker.Error{Op: op, Kind: broker.ErrClosed, Err: ErrClosed}
+}
+
+// SweepInterval is the least delay between two deletions of the expired
+// values by the backends without expiry of their own.
+const SweepInterval = time.Minute
+
+// Store is a key-value store whose values may expire.
+type Store interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value of key, expiring after ttl, never when 0.
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key, absent or not.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// ─── Expiry ────────────────────────────────────────────────────────────
+
+// Wrap returns value prefixed by its deadline, now plus ttl (none when 0),
+// for the backends without expiry of their own; Unwrap reads it back.
+func Wrap(value []byte, ttl time.Duration) []byte {
+	var deadline int64
+	if ttl > 0 {
+		deadline = time.Now().Add(ttl).UnixNano()
+	}
+	raw := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(raw, uint64(deadline))
+	return append(raw, value...)
+}
+
+// Unwrap returns the value of raw, made by Wrap, and false when it expired
+// or raw is not a wrapped value.
+func Unwrap(raw []byte) ([]byte, bool) {
+	if len(raw) < 8 {
+		return nil, false
+	}
+	deadline := int64(binary.BigEndian.Uint64(raw))
+	if deadline != 0 && time.Now().UnixNano() >= deadline {
+		return nil, false
+	}
+	return raw[8:], true
+}
+
+// ─── Deduplication ─────────────────────────────────────────────────────
+
+// Dedup remembers the ids of the events handled during a window, to skip
+// the ones delivered again: retries of the producers, redeliveries.
+type Dedup struct {
+	s      Store
+	prefix string
+	window time.Duration
+}
+
+// NewDedup returns the deduplication of the ids kept in s under prefix
+// during window.
+func NewDedup(s Store, prefix string, window time.Duration) *Dedup {
+	return &Dedup{s: s, prefix: prefix, window: window}
+}
+
+// Seen reports whether id was marked during the window.
+func (d *Dedup) Seen(ctx context.Context, id string) (bool, error) {
+	_, err := d.s.Get(ctx, d.key(id))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Mark records id as handled, once its handling succeeded.
+func (d *Dedup) Mark(ctx context.Context, id string) error {
+	return d.s.Put(ctx, d.key(id), nil, d.window)
+}
+
+// key returns the key of id: its SHA-256, ids being free text.
+func (d *Dedup) key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return d.prefix + hex.EncodeToString(sum[:])
+}
+
+// ─── Positions ─────────────────────────────────────────────────────────
+
+// Positions records how far the readers of a stream went: the sequence of
+// the last message a projection applied, to resume after it.
+type Positions struct {
+	s         Store
+	prefix    string
+	retention time.Duration
+}
+
+// NewPositions returns the positions kept in s under prefix, each during
+// retention after it was last saved, forever when 0.
+func NewPositions(s Store, prefix string, retention time.Duration) *Positions {
+	return &Positions{s: s, prefix: prefix, retention: retention}
+}
+
+// Load returns the position of the reader name, 0 when it has none.
+func (p *Positions) Load(ctx context.Context, name string) (uint64, error) {
+	value, err := p.s.Get(ctx, p.prefix+name)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+// Save records seq as the position of the reader name, for the retention
+// of p.
+func (p *Positions) Save(ctx context.Context, name string, seq uint64) error {
+	return p.s.Put(ctx, p.prefix+name, strconv.AppendUint(nil, seq, 10), p.retention)
+}
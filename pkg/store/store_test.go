@@ -0,0 +1,194 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/broker"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/boltstore"
+	"github.com/lao-tseu-is-alive/go-cloud-events-pubsub-nats/pkg/store/memory"
+)
+
+// ttl is the lifetime of the values expiring in the tests, short but long
+// enough to read them before.
+const ttl = 50 * time.Millisecond
+
+// backends runs test on a new store of every local backend.
+func backends(t *testing.T, test func(t *testing.T, s store.Store)) {
+	open := map[string]func(t *testing.T) store.Store{
+		"memory": func(*testing.T) store.Store { return memory.New() },
+		"bolt": func(t *testing.T) store.Store {
+			s, err := boltstore.Open(filepath.Join(t.TempDir(), "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for _, name := range []string{"memory", "bolt"} {
+		t.Run(name, func(t *testing.T) {
+			s := open[name](t)
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		after time.Duration // wait before Unwrap
+		want  bool
+	}{
+		{"no expiry", 0, 2 * ttl, true},
+		{"within the ttl", time.Hour, 0, true},
+		{"past the ttl", ttl, 2 * ttl, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			raw := store.Wrap([]byte("value"), tt.ttl)
+			time.Sleep(tt.after)
+			value, ok := store.Unwrap(raw)
+			if ok != tt.want {
+				t.Fatalf("Unwrap after %v of a ttl %v = %v, want %v", tt.after, tt.ttl, ok, tt.want)
+			}
+			if ok && string(value) != "value" {
+				t.Errorf("Unwrap = %q, want %q", value, "value")
+			}
+		})
+	}
+
+	t.Run("not wrapped", func(t *testing.T) {
+		if _, ok := store.Unwrap([]byte("short")); ok {
+			t.Error("Unwrap of 5 bytes succeeded")
+		}
+	})
+	t.Run("empty value", func(t *testing.T) {
+		if value, ok := store.Unwrap(store.Wrap(nil, 0)); !ok || len(value) != 0 {
+			t.Errorf("Unwrap(Wrap(nil)) = %q, %v, want an empty value", value, ok)
+		}
+	})
+}
+
+func TestStore(t *testing.T) {
+	backends(t, func(t *testing.T, s store.Store) {
+		ctx := context.Background()
+		for _, key := range []string{"b/2", "a/1", "b/1", "c"} {
+			if err := s.Put(ctx, key, []byte(key), 0); err != nil {
+				t.Fatalf("Put(%q) = %v", key, err)
+			}
+		}
+		if err := s.Put(ctx, "b/expiring", nil, ttl); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := s.Get(ctx, "b/2"); err != nil || !bytes.Equal(value, []byte("b/2")) {
+			t.Errorf("Get(b/2) = %q, %v", value, err)
+		}
+		if keys, err := s.List(ctx, "b/"); err != nil || !slices.Equal(keys, []string{"b/1", "b/2", "b/expiring"}) {
+			t.Errorf("List(b/) = %q, %v", keys, err)
+		}
+
+		time.Sleep(2 * ttl)
+		if _, err := s.Get(ctx, "b/expiring"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("Get(expired) = %v, want ErrNotFound", err)
+		}
+		if err := s.Delete(ctx, "b/1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, "absent"); err != nil {
+			t.Errorf("Delete(absent) = %v, want nil", err)
+		}
+		if keys, err := s.List(ctx, "b/"); err != nil || !slices.Equal(keys, []string{"b/2"}) {
+			t.Errorf("List(b/) after expiry and Delete = %q, %v", keys, err)
+		}
+		if keys, _ := s.List(ctx, ""); !slices.Equal(keys, []string{"a/1", "b/2", "c"}) {
+			t.Errorf("List() = %q", keys)
+		}
+
+		_ = s.Close()
+		_, err := s.Get(ctx, "c")
+		if !errors.Is(err, store.ErrClosed) || !errors.Is(err, broker.ErrClosed) {
+			t.Errorf("Get after Close = %v, want store.ErrClosed of kind broker.ErrClosed", err)
+		}
+		if err := s.Put(ctx, "c", nil, 0); !errors.Is(err, broker.ErrClosed) {
+			t.Errorf("Put after Close = %v, want broker.ErrClosed", err)
+		}
+	})
+}
+
+func TestDedup(t *testing.T) {
+	backends(t, func(t *testing.T, s store.Store) {
+		ctx := context.Background()
+		dedup := store.NewDedup(s, "dedup/", ttl)
+		ids := []string{"order-1", "order 2 / free text ✓", ""}
+		for _, id := range ids {
+			if seen, err := dedup.Seen(ctx, id); err != nil || seen {
+				t.Errorf("Seen(%q) before Mark = %v, %v, want false", id, seen, err)
+			}
+			if err := dedup.Mark(ctx, id); err != nil {
+				t.Fatalf("Mark(%q) = %v", id, err)
+			}
+			if seen, err := dedup.Seen(ctx, id); err != nil || !seen {
+				t.Errorf("Seen(%q) after Mark = %v, %v, want true", id, seen, err)
+			}
+		}
+		if seen, _ := dedup.Seen(ctx, "order-3"); seen {
+			t.Error("Seen(order-3), never marked, = true")
+		}
+		// The ids are hashed: keys of the backends whatever their text.
+		keys, _ := s.List(ctx, "dedup/")
+		if len(keys) != len(ids) {
+			t.Errorf("%d keys under dedup/, want %d: %q", len(keys), len(ids), keys)
+		}
+
+		time.Sleep(2 * ttl)
+		for _, id := range ids {
+			if seen, err := dedup.Seen(ctx, id); err != nil || seen {
+				t.Errorf("Seen(%q) after the window = %v, %v, want false", id, seen, err)
+			}
+		}
+	})
+}
+
+func TestPositions(t *testing.T) {
+	backends(t, func(t *testing.T, s store.Store) {
+		ctx := context.Background()
+		positions := store.NewPositions(s, "positions/", 0)
+		if seq, err := positions.Load(ctx, "orders-view"); err != nil || seq != 0 {
+			t.Errorf("Load before Save = %d, %v, want 0", seq, err)
+		}
+		for _, seq := range []uint64{1, 42, 1<<64 - 1} {
+			if err := positions.Save(ctx, "orders-view", seq); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := positions.Load(ctx, "orders-view"); err != nil || got != seq {
+				t.Errorf("Load after Save(%d) = %d, %v", seq, got, err)
+			}
+		}
+		if seq, _ := positions.Load(ctx, "billing-view"); seq != 0 {
+			t.Errorf("Load of another reader = %d, want 0", seq)
+		}
+
+		// A reader gone for longer than the retention starts over.
+		retained := store.NewPositions(s, "retained/", ttl)
+		_ = retained.Save(ctx, "orders-view", 7)
+		if seq, _ := retained.Load(ctx, "orders-view"); seq != 7 {
+			t.Errorf("Load within the retention = %d, want 7", seq)
+		}
+		time.Sleep(2 * ttl)
+		if seq, err := retained.Load(ctx, "orders-view"); err != nil || seq != 0 {
+			t.Errorf("Load past the retention = %d, %v, want 0", seq, err)
+		}
+		if seq, _ := positions.Load(ctx, "orders-view"); seq != 1<<64-1 {
+			t.Errorf("Load without retention = %d, want it kept", seq)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+// Package upcast transforms old versions of an event into the version a
+// handler expects.
+//
+// WHY UPCASTING:
+//
+//	A JetStream stream keeps events for months, while their schema keeps
+//	evolving. A consumer replaying the stream finds events written by every
+//	past version of the producer. Instead of teaching each handler all the
+//	historical formats, the handler declares the ONE version it expects and
+//	small upcast functions, registered once, migrate older events on the
+//	fly, one version at a time:
+//
+//	  order.created v1 ──upcast 1→2──► v2 ──upcast 2→3──► v3 ──► handler (expects v3)
+//
+//	The stored events are never rewritten: upcasting happens on read.
+//
+// VERSION OF AN EVENT:
+//
+//	The version is carried by the "dataversion" CloudEvents extension
+//	attribute (the "ce-dataversion" header in binary content mode). An event
+//	without it is considered to be version 1, the version written before
+//	anybody thought of versioning.
+package upcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// VersionAttribute is the CloudEvents extension attribute holding the data version.
+const VersionAttribute = "dataversion"
+
+// ErrNoUpcaster is returned when a step of the migration is not registered.
+var ErrNoUpcaster = errors.New("no upcaster registered")
+
+// ErrNewerVersion is returned when the event is newer than the handler
+// expects: a downcast is not possible, the handler must be upgraded.
+var ErrNewerVersion = errors.New("event version newer than expected")
+
+// Func transforms the data of an event from version N to version N+1.
+type Func func(data json.RawMessage) (json.RawMessage, error)
+
+// Registry holds the upcast functions, by event type and source version.
+// It is safe for concurrent use.
+type Registry struct {
+	mu  sync.RWMutex
+	fns map[string]map[int]Func
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{fns: make(map[string]map[int]Func)}
+}
+
+// Register adds fn, migrating events of eventType from version from to from+1.
+func (r *Registry) Register(eventType string, from int, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fns[eventType] == nil {
+		r.fns[eventType] = make(map[int]Func)
+	}
+	r.fns[eventType][from] = fn
+}
+
+// Upcast migrates data of eventType from version to target, applying every
+// intermediate step in order.
+func (r *Registry) Upcast(eventType string, version, target int, data json.RawMessage) (json.RawMessage, error) {
+	if version > target {
+		return nil, fmt.Errorf("%s v%d, handler expects v%d: %w", eventType, version, target, ErrNewerVersion)
+	}
+	r.mu.RLock()
+	steps := r.fns[eventType]
+	r.mu.RUnlock()
+
+	for v := version; v < target; v++ {
+		fn, ok := steps[v]
+		if !ok {
+			return nil, fmt.Errorf("%s v%d → v%d: %w", eventType, v, v+1, ErrNoUpcaster)
+		}
+		var err error
+		if data, err = fn(data); err != nil {
+			return nil, fmt.Errorf("%s v%d → v%d: %w", eventType, v, v+1, err)
+		}
+	}
+	return data, nil
+}
+
+// Handler returns a function handling events of any version, calling h with
+// the data upcast to version want.
+func (r *Registry) Handler(eventType string, want int, h func(data json.RawMessage) error) func(version int, data json.RawMessage) error {
+	return func(version int, data json.RawMessage) error {
+		upcast, err := r.Upcast(eventType, version, want, data)
+		if err != nil {
+			return err
+		}
+		return h(upcast)
+	}
+}
@@ -0,0 +1,17 @@
+#!/bin/bash
+# Builds, vets and tests every Go module of the repository: the root one and
+# the nested ones (pkg/gocdk), which "go build ./..." at the root skips.
+cd "$(dirname "$0")/.." || exit 1
+status=0
+for mod in $(find . -name go.mod -not -path './nats_data/*' | sort); do
+  dir=$(dirname "$mod")
+  echo "🔭  checking the module in ${dir}"
+  if ! (cd "$dir" && go build ./... && go vet ./... && go test ./...); then
+    echo "💥   the module in ${dir} does not pass"
+    status=1
+  fi
+done
+if [ $status -eq 0 ]; then
+  echo "✓  all modules pass"
+fi
+exit $status
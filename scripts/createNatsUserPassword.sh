@@ -1,8 +1,9 @@
 #!/bin/bash
 echo "## will create a NATS password from your .env file"
 #checking if received arguments
-if [[ $# -ne 1 ]]; then
+if [[ $# -lt 1 || $# -gt 2 ]]; then
   echo "## 💥💥 expecting first argument to be an NATS user name"
+  echo "## optional second argument is the variable prefix (default NATS), e.g. ORDERS gives ORDERS_USER"
   exit 1
 fi
 #checking if nats-cli is present
@@ -12,6 +13,7 @@ if ! command -v nats &> /dev/null; then
   exit 1
 fi
 NATS_USER=${1}
+PREFIX=${2:-NATS}
 echo "generating a random password for NATS user: ${NATS_USER}"
 NATS_PASSWORD=$(openssl rand -base64 12)
 echo "## NATS USER: ${NATS_USER}"
@@ -20,11 +22,11 @@ echo "## will encrypt NATS password with nats server passwd command"
 ENCRYPTED_PASSWORD=$(nats server passwd --pass "${NATS_PASSWORD}")
 echo "## NATS PASSWORD: ${ENCRYPTED_PASSWORD}"
 echo "## adding those value now to your .env file"
-echo "NATS_USER=${NATS_USER}" >> .env
-echo "NATS_PASSWORD=${NATS_PASSWORD}" >> .env
-echo "NATS_ENCRYPTED_PASSWORD=${ENCRYPTED_PASSWORD}" >> .env  
+echo "${PREFIX}_USER=${NATS_USER}" >> .env
+echo "${PREFIX}_PASSWORD=${NATS_PASSWORD}" >> .env
+echo "${PREFIX}_ENCRYPTED_PASSWORD=${ENCRYPTED_PASSWORD}" >> .env  
 echo "## now you can use those value in your application, restart nats-server with the new .env file"
 echo "## Note: NATS_ENCRYPTED_PASSWORD is used by nats-server, NATS_PASSWORD is used by clients"
 echo "## example: nats-server --user your_user_name --pass your_password"
-echo "## or run scripts/runNatsStreamServerDev.sh"
+echo "## or run scripts/runNatsStreamServerDev.sh (or scripts/runNatsAccountsDemo.sh for the ORDERS/ANALYTICS accounts)"
 echo "## done"  
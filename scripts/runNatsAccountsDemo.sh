@@ -0,0 +1,41 @@
+#!/bin/bash
+CONFIG_FILE="configs/nats-accounts.conf"
+echo "🚀  starting nats-server with two isolated accounts (ORDERS and ANALYTICS) using ${CONFIG_FILE}"
+echo "ℹ️  will check if config file exists"
+if [ ! -f "${CONFIG_FILE}" ]; then
+    echo "💥   ${CONFIG_FILE} does not exist. Please run this script from the repository root."
+    exit 1
+fi
+echo "ℹ️  will check if nats-server is running"
+if [ "$(pgrep [n]ats-server | wc -l)" -gt 0 ]; then
+    echo "💥   NATS server is already running. Please stop it before running this script."
+    exit 1
+fi
+echo "ℹ️  will check if .env file exists"
+if [ ! -f ".env" ]; then
+    echo "💥   .env file does not exist. Please create it."
+    echo "     scripts/createNatsUserPassword.sh orders_app ORDERS"
+    echo "     scripts/createNatsUserPassword.sh analytics_app ANALYTICS"
+    exit 1
+fi
+# Source .env safely: the sed wraps values in single quotes to prevent
+# bash from interpreting $ characters in bcrypt hashes (e.g. $2a$11$...).
+source <(sed -e '/^#/d;/^\s*$/d' -e "s/'/'\\\\''/g" -e "s/=\(.*\)/='\1'/g" .env)
+echo "ℹ️  will check if ORDERS_* and ANALYTICS_* users are set in .env file"
+for VAR in ORDERS_USER ORDERS_ENCRYPTED_PASSWORD ANALYTICS_USER ANALYTICS_ENCRYPTED_PASSWORD; do
+    if [ -z "${!VAR}" ]; then
+        echo "💥   ${VAR} is not set in .env file. Please create the account users with :"
+        echo "     scripts/createNatsUserPassword.sh orders_app ORDERS"
+        echo "     scripts/createNatsUserPassword.sh analytics_app ANALYTICS"
+        exit 1
+    fi
+done
+# nats-server resolves $VARIABLES of the config file from the environment
+export ORDERS_USER ORDERS_ENCRYPTED_PASSWORD ANALYTICS_USER ANALYTICS_ENCRYPTED_PASSWORD
+echo "ℹ️  now in other terminals, consume in ANALYTICS and publish in ORDERS :"
+echo "scripts/execWithEnv.sh bin/natsPubSub -env-prefix ANALYTICS -mode sub -subject 'from_orders.orders.events.>'"
+echo "scripts/execWithEnv.sh bin/natsPubSub -env-prefix ORDERS -mode pub -subject 'orders.events.created' -msg '{\"order\":42}'"
+echo "ℹ️  Press Ctrl+C to stop the server"
+echo "about to run :"
+echo "nats-server -DV -c ${CONFIG_FILE}"
+nats-server -DV -c "${CONFIG_FILE}"